@@ -102,6 +102,10 @@ var ErrNoSuchCollection = errors.New("no-such-collection")
 // name is invalid, for example "".
 var ErrBadCollectionName = errors.New("bad-collection-name")
 
+// ErrCollectionExists is returned when a child collection is renamed
+// or cloned to the name of an existing child collection.
+var ErrCollectionExists = errors.New("collection-exists")
+
 // ErrIteratorDone is returned when the iterator has reached the end
 // range of the iterator or the end of the collection.
 var ErrIteratorDone = errors.New("iterator-done")
@@ -134,6 +138,10 @@ var ErrValueTooLarge = errors.New("value-too-large")
 // ErrAborted is returned when any operations are aborted.
 var ErrAborted = errors.New("operation-aborted")
 
+// ErrInvalidContinuationToken is returned when a continuation token
+// is malformed or of an unknown version.
+var ErrInvalidContinuationToken = errors.New("invalid-continuation-token")
+
 // A Collection represents an ordered mapping of key-val entries,
 // where a Collection is snapshot'able and atomically updatable.
 type Collection interface {
@@ -154,6 +162,12 @@ type Collection interface {
 	// and returns nil if the key is not found.
 	Get(key []byte, readOptions ReadOptions) ([]byte, error)
 
+	// GetMulti retrieves the vals for multiple keys from the
+	// collection, which is more efficient than separate Get()'s.  The
+	// returned vals are in the same order as the keys, with a nil val
+	// for each key that is not found.
+	GetMulti(keys [][]byte, readOptions ReadOptions) ([][]byte, error)
+
 	// NewBatch returns a new Batch instance with preallocated
 	// resources.  See the Batch.Alloc() method.
 	NewBatch(totalOps, totalKeyValBytes int) (Batch, error)
@@ -171,6 +185,19 @@ type Collection interface {
 	// collection.  Note that histograms might be updated
 	// asynchronously.
 	Histograms() ghistogram.Histograms
+
+	// ChildCollectionStats returns stats for a child collection of
+	// this collection, or ErrNoSuchCollection.  The counters like
+	// TotGet only count operations on the child collection, such as
+	// via a child collection Snapshot, and the gauges like
+	// CurDirtyOps only count the child collection's segments.
+	ChildCollectionStats(childCollectionName string) (*CollectionStats, error)
+
+	// ChildCollectionHistograms returns a snapshot of the histograms
+	// for a child collection of this collection, or
+	// ErrNoSuchCollection.
+	ChildCollectionHistograms(childCollectionName string) (
+		ghistogram.Histograms, error)
 }
 
 // CollectionOptions allows applications to specify config settings.
@@ -204,6 +231,12 @@ type CollectionOptions struct {
 	// canceled.
 	MergerCancelCheckEvery int
 
+	// MergerWorkers, when greater than 1, is the max number of
+	// goroutines that the merger uses to concurrently merge disjoint
+	// key ranges of the dirty segments, where each key range is
+	// merged into its own segment.  Small merges are not split.
+	MergerWorkers int
+
 	// MaxDirtyOps, when greater than zero, is the max number of dirty
 	// (unpersisted) ops allowed before ExecuteBatch() blocks to allow
 	// the persister to catch up.  It only has effect with a non-nil
@@ -216,10 +249,44 @@ type CollectionOptions struct {
 	// only has effect with a non-nil LowerLevelUpdate.
 	MaxDirtyKeyValBytes uint64
 
+	// CompactionFilter is an optional filter that's consulted when a
+	// Store compacts the collection's persisted data, to drop key-val
+	// entries that the application no longer needs.
+	CompactionFilter CompactionFilter `json:"-"`
+
 	// CachePersisted allows the collection to cache clean, persisted
 	// key-val's, and is considered when LowerLevelUpdate is used.
 	CachePersisted bool
 
+	// MemoryQuota, when greater than zero, is the max number of
+	// key-val bytes of the collection's in-memory segments, both dirty
+	// and clean, including those of its child collections.  When over
+	// the quota, clean segments are evicted, as chosen by the
+	// EvictionPolicy, and ExecuteBatch() blocks while the dirty
+	// segments alone are over the quota, to allow the persister to
+	// catch up.  It only has effect with a non-nil LowerLevelUpdate.
+	MemoryQuota uint64
+
+	// EvictionPolicy chooses the clean segments that are evicted when
+	// the collection is over its MemoryQuota.
+	EvictionPolicy EvictionPolicy
+
+	// ReadCacheBytes, when greater than zero, is the max number of
+	// bytes of a cache of the key-vals, including the keys that were
+	// not found, that the collection's Get() and GetMulti() read from
+	// the lower level snapshot, such as from a Store's mmap()'ed
+	// segments.  The cache is reset whenever the lower level snapshot
+	// is replaced, such as after persistence or compaction, while
+	// newer, unpersisted mutations take precedence over the cache.
+	ReadCacheBytes uint64
+
+	// ReadHistogramsSampleEvery is the number of Get()'s, and
+	// separately of iterators started on the collection's snapshots,
+	// per one that's recorded in the collection's read histograms,
+	// which keeps the cost of the read histograms low.  Defaults to
+	// DefaultCollectionOptions.ReadHistogramsSampleEvery when <= 0.
+	ReadHistogramsSampleEvery int
+
 	// LowerLevelInit is an optional Snapshot implementation that
 	// initializes the lower-level storage of a Collection.  This
 	// might be used, for example, for having a Collection be a
@@ -251,13 +318,71 @@ type CollectionOptions struct {
 	// ReadOnly means that persisted data and storage files if any,
 	// will remain unchanged.
 	ReadOnly bool
+
+	// childOptions are the ChildCollectionOptions that a child
+	// collection was created with, or nil when the options are
+	// inherited from the parent collection.
+	childOptions *ChildCollectionOptions
 }
 
+// ChildCollectionOptions allows a child collection to have options
+// that differ from its parent collection, and are provided via
+// Batch.NewChildCollectionBatchWithOptions() when the child collection
+// is created.  The fields that
+// are left unset (nil or 0), and the remaining CollectionOptions, are
+// inherited from the parent collection.
+//
+// When persisted by a Store, the options are recorded in the Store,
+// where the MergeOperator and CompactionFilter are recorded by their
+// Name() and are resolved on reopen from the MergeOperators and
+// CompactionFilters registries, so they must be registered.
+type ChildCollectionOptions struct {
+	MergeOperator MergeOperator `json:"-"`
+
+	CompactionFilter CompactionFilter `json:"-"`
+
+	// MaxDirtyOps and MaxDirtyKeyValBytes, when greater than zero,
+	// limit the dirty (unpersisted) ops and key-val bytes of the
+	// child collection, like the CollectionOptions of the same name.
+	MaxDirtyOps         uint64
+	MaxDirtyKeyValBytes uint64
+}
+
+// A CompactionFilter may be implemented by applications that wish to
+// drop key-val entries when a Store compacts a collection, such as to
+// garbage collect entries that are no longer needed.
+type CompactionFilter interface {
+	// Name returns an identifier for this compaction filter, which is
+	// recorded by a Store for child collections.
+	Name() string
+
+	// Filter returns true if the key-val entry should be dropped.
+	// The key and val must not be modified or retained.
+	Filter(key, val []byte) bool
+}
+
+// CompactionFilters is a registry of available compaction filters,
+// which should be immutable after process init()'ialization.  It is
+// keyed by CompactionFilter.Name().
+var CompactionFilters = map[string]CompactionFilter{}
+
 // Event represents the information provided in an OnEvent() callback.
+// Which of the detail fields are meaningful depends on the Kind.
 type Event struct {
 	Kind       EventKind
-	Collection Collection
+	Collection Collection // Nil for events from a Store.
+	Store      *Store     // Nil for events from a Collection.
 	Duration   time.Duration
+
+	// FileName is the name of the file that the event concerns.
+	FileName string
+
+	// Bytes is the number of bytes that the event concerns, such as
+	// the size of a written footer or of a removed file.
+	Bytes int64
+
+	// Segments is the number of segments that the event concerns.
+	Segments int
 }
 
 // EventKind represents an event code for OnEvent() callbacks.
@@ -287,6 +412,45 @@ var EventKindBatchExecuteStart = EventKind(5)
 // executing a batch.
 var EventKindBatchExecute = EventKind(6)
 
+// EventKindBatchExecuteWait is fired when a batch execution has
+// waited, or stalled, because the collection already had
+// MaxPreMergerBatches batches awaiting the merger.  The Duration is
+// the time spent waiting.
+var EventKindBatchExecuteWait = EventKind(7)
+
+// EventKindBatchExecuteQuotaWait is fired when a batch execution has
+// waited, or stalled, because the collection was over its
+// MaxDirtyOps, MaxDirtyKeyValBytes or MemoryQuota, until the
+// persister caught up.  The Duration is the time spent waiting.
+var EventKindBatchExecuteQuotaWait = EventKind(8)
+
+// EventKindCompactionStart is fired by a Store when a compaction has
+// begun compacting the given number of Segments of the top level
+// collection into the new FileName.  A compaction that fails or is
+// abandoned has no EventKindCompactionEnd.
+var EventKindCompactionStart = EventKind(9)
+
+// EventKindCompactionEnd is fired by a Store when a compaction has
+// switched the store over to the new FileName, whose size is Bytes
+// and whose top level collection has the given number of Segments.
+// The Duration is the time taken by the compaction.
+var EventKindCompactionEnd = EventKind(10)
+
+// EventKindFileCreate is fired by a Store when it has created the
+// data file FileName, whose initial size, that of its header, is
+// Bytes.
+var EventKindFileCreate = EventKind(11)
+
+// EventKindFileRemove is fired by a Store when it has removed the
+// obsoleted data file FileName, whose size was Bytes.
+var EventKindFileRemove = EventKind(12)
+
+// EventKindFooterWrite is fired by a Store when it has written, and
+// unless NoSync, synced, a footer of Bytes at the end of FileName.
+// The footer references the given number of Segments of the top
+// level collection, and the Duration includes the syncs.
+var EventKindFooterWrite = EventKind(13)
+
 // DefaultCollectionOptions are the default configuration options.
 var DefaultCollectionOptions = CollectionOptions{
 	MergeOperator:          nil,
@@ -295,6 +459,8 @@ var DefaultCollectionOptions = CollectionOptions{
 	MergerCancelCheckEvery: 10000,
 	Debug: 0,
 	Log:   nil,
+
+	ReadHistogramsSampleEvery: 16,
 }
 
 // BatchOptions are provided to NewChildCollectionBatch().
@@ -320,6 +486,14 @@ type Batch interface {
 	// bytes of the key and val may be reused by the caller.
 	Set(key, val []byte) error
 
+	// SetWithTTL is like Set(), but the key-val entry expires after
+	// the given ttl, after which the entry is hidden from Get()'s and
+	// Iterators as if it had been deleted, and is eventually dropped
+	// by the merger and by Store compaction.  A ttl <= 0 means the
+	// entry does not expire.  A later Merge() on an entry with a ttl
+	// results in an entry that does not expire.
+	SetWithTTL(key, val []byte, ttl time.Duration) error
+
 	// Del deletes a key-val entry from the Collection.  The key must
 	// be unique (not repeated) within the Batch.  Del copies the key
 	// bytes into the Batch, so the memory bytes of the key may be
@@ -357,13 +531,45 @@ type Batch interface {
 	// The child Batch will be executed atomically along with any
 	// other child batches and with the top-level Batch
 	// when the top-level Batch is executed.
+	// A child Batch may itself have child batches, so child collections
+	// may be nested to any depth. Asking again for the same child
+	// collection name returns the previously created child Batch.
 	// The child collection name should not start with a '.' (period)
 	// as those are reserved for future moss usage.
 	NewChildCollectionBatch(collectionName string, options BatchOptions) (Batch, error)
 
+	// NewChildCollectionBatchWithOptions is like
+	// NewChildCollectionBatch, but a child collection that's created
+	// by the batch will have the given childOptions, when non-nil.
+	// The childOptions are ignored when the child collection already
+	// exists.
+	NewChildCollectionBatchWithOptions(collectionName string,
+		options BatchOptions, childOptions *ChildCollectionOptions) (Batch, error)
+
 	// DelChildCollection records a child collection deletion given the name.
 	// It only takes effect when the top-level batch is executed.
+	// Any nested child collections of the deleted child collection
+	// are deleted along with it.
 	DelChildCollection(collectionName string) error
+
+	// RenameChildCollection records a rename of a child collection,
+	// along with its nested child collections.  Like
+	// CloneChildCollection, it only takes effect when the top-level
+	// batch is executed, when ExecuteBatch() returns
+	// ErrNoSuchCollection if the child collection does not exist, or
+	// ErrCollectionExists if the new name is already taken.
+	RenameChildCollection(oldName, newName string) error
+
+	// CloneChildCollection records a copy of a child collection, along
+	// with its nested child collections, to a new child collection.
+	// The clone shares the immutable segments of its source, both in
+	// memory and in a Store, so it's cheap regardless of the amount of
+	// data.  Renames and clones are applied in the order they were
+	// recorded and before the other changes of the batch, such as its
+	// child batches and child collection deletions.
+	// A Collection whose lower level snapshot is not from a Store
+	// returns ErrUnimplemented from ExecuteBatch().
+	CloneChildCollection(srcName, dstName string) error
 }
 
 // A Snapshot is a stable view of a Collection for readers, isolated
@@ -376,6 +582,14 @@ type Snapshot interface {
 	// if the entry does not exist in the Snapshot.
 	Get(key []byte, readOptions ReadOptions) ([]byte, error)
 
+	// GetMulti retrieves the vals for multiple keys from the
+	// Snapshot, in the same order as the keys, and will return a nil
+	// val for each entry that does not exist in the Snapshot.  The
+	// keys do not need to be sorted, and the lookups are performed
+	// with a single pass through each segment, so GetMulti() is more
+	// efficient than separate Get()'s.
+	GetMulti(keys [][]byte, readOptions ReadOptions) ([][]byte, error)
+
 	// StartIterator returns a new Iterator instance on this Snapshot.
 	//
 	// On success, the returned Iterator will be positioned so that
@@ -388,6 +602,13 @@ type Snapshot interface {
 	StartIterator(startKeyInclusive, endKeyExclusive []byte,
 		iteratorOptions IteratorOptions) (Iterator, error)
 
+	// EstimateRange returns an approximate summary of the entries in
+	// a key range, such as the number of ops and key-val bytes,
+	// without iterating through the entries.  See RangeEstimate for
+	// the error bounds of the estimate.
+	EstimateRange(startKeyInclusive, endKeyExclusive []byte) (
+		*RangeEstimate, error)
+
 	// ChildCollectionNames returns an array of child collection name strings.
 	ChildCollectionNames() ([]string, error)
 
@@ -450,6 +671,19 @@ type ReadOptions struct {
 	// lower-level snapshot (disk based). See
 	// CollectionOptions.LowerLevelInit/LowerLevelUpdate.
 	SkipLowerLevel bool
+
+	// canceler, when non-nil, is used internally to give up on a
+	// lookup before it reads from the lower-level snapshot.
+	canceler canceler
+
+	// segmentsProbed, when non-nil, is used internally to count the
+	// segments that a lookup probes, including lower-level segments.
+	segmentsProbed *uint64
+
+	// expiries, when non-nil, is used internally to record the
+	// earliest expiry of the unexpired TTL entries that a lookup
+	// reads, keyed by key, so that the readCache can expire vals.
+	expiries map[string]int64
 }
 
 // IteratorOptions are provided to StartIterator().
@@ -477,10 +711,27 @@ type IteratorOptions struct {
 	// array length.
 	MaxSegmentHeight int
 
+	// Prefix, when non-nil, restricts the Iterator to only those
+	// entries whose keys start with the Prefix.  The Prefix is
+	// intersected with any startKeyInclusive/endKeyExclusive bounds
+	// provided to StartIterator(), so an application does not have
+	// to compute the exclusive end key of a prefix range itself.
+	// See also PrefixEndKeyExclusive().
+	Prefix []byte
+
 	// base is used internally to provide the iterator with a
 	// segmentStack to use instead of a lower-level snapshot.  It's
 	// used so that segment merging consults the stackDirtyBase.
 	base *segmentStack
+
+	// rawExpiry is used internally by merges to see operationSetTTL
+	// entries as-is, so that unexpired entries keep their expiry.
+	rawExpiry bool
+
+	// canceler, when non-nil, is used internally to give up on an
+	// iterator's Next() before it reads from the lower-level
+	// snapshot.
+	canceler canceler
 }
 
 // EntryEx provides extra, advanced information about an entry from
@@ -506,7 +757,9 @@ const OperationMerge = uint64(0x0300000000000000)
 // MergeOperator functionality.
 type MergeOperator interface {
 	// Name returns an identifier for this merge operator, which might
-	// be used for logging / debugging.
+	// be used for logging / debugging.  A Store also records the Name()
+	// so that reopening the Store with a different merge operator can
+	// be detected, so the Name() should be stable across processes.
 	Name() string
 
 	// FullMerge the full sequence of operands on top of an
@@ -521,6 +774,25 @@ type MergeOperator interface {
 	PartialMerge(key, leftOperand, rightOperand []byte) ([]byte, bool)
 }
 
+// An EvictionPolicy chooses the clean, persisted segments that a
+// collection evicts when it's over its MemoryQuota.  Only segments
+// that don't have overlapping key ranges with older clean segments
+// can be evicted, as the older segments would otherwise shadow the
+// persisted entries, so the oldest segments are always evictable.
+type EvictionPolicy int
+
+const (
+	// EvictOldestSegments evicts the oldest clean segments, largest
+	// first when there are several, such as of child collections.
+	EvictOldestSegments EvictionPolicy = iota
+
+	// EvictLRURange evicts the clean segments whose key ranges were
+	// least recently read through the collection's Get() or
+	// GetMulti(), where segments without recorded reads, such as those
+	// of child collections, are evicted first.
+	EvictLRURange
+)
+
 // LowerLevelUpdate is the func callback signature used when a
 // Collection wants to update its optional, lower-level storage.
 type LowerLevelUpdate func(higher Snapshot) (lower Snapshot, err error)
@@ -543,8 +815,24 @@ type CollectionStats struct {
 	TotSnapshotInternalEnd uint64
 	TotSnapshotEnd         uint64
 
-	TotGet    uint64
-	TotGetErr uint64
+	TotGet         uint64
+	TotGetErr      uint64
+	TotGetCanceled uint64
+
+	TotGetMulti     uint64
+	TotGetMultiKeys uint64
+	TotGetMultiErr  uint64
+
+	TotIteratorCanceled uint64
+	TotIteratorStart    uint64
+
+	TotReadCacheHit  uint64
+	TotReadCacheMiss uint64
+
+	TotExpiredHidden  uint64
+	TotExpiredDropped uint64
+
+	TotCompactionFilterDropped uint64
 
 	TotNewBatch                 uint64
 	TotNewBatchTotalOps         uint64
@@ -555,6 +843,9 @@ type CollectionStats struct {
 	TotExecuteBatchEmpty          uint64
 	TotExecuteBatchWaitBeg        uint64
 	TotExecuteBatchWaitEnd        uint64
+	TotExecuteBatchQuotaWaitBeg   uint64
+	TotExecuteBatchQuotaWaitEnd   uint64
+	TotExecuteBatchCanceled       uint64
 	TotExecuteBatchAwakeMergerBeg uint64
 	TotExecuteBatchAwakeMergerEnd uint64
 	TotExecuteBatchEnd            uint64
@@ -570,6 +861,7 @@ type CollectionStats struct {
 	TotMergerInternalErr          uint64
 	TotMergerInternalEnd          uint64
 	TotMergerInternalSkip         uint64
+	TotMergerInternalRanges       uint64
 	TotMergerLowerLevelNotify     uint64
 	TotMergerLowerLevelNotifySkip uint64
 
@@ -593,6 +885,9 @@ type CollectionStats struct {
 	TotPersisterLowerLevelUpdateErr uint64
 	TotPersisterLowerLevelUpdateEnd uint64
 
+	TotEvictSegments uint64
+	TotEvictBytes    uint64
+
 	CurDirtyOps      uint64
 	CurDirtyBytes    uint64
 	CurDirtySegments uint64
@@ -612,6 +907,20 @@ type CollectionStats struct {
 	CurCleanOps      uint64
 	CurCleanBytes    uint64
 	CurCleanSegments uint64
+
+	// CurMemoryBytes are the key-val bytes of the in-memory segments,
+	// both dirty and clean, that count towards the MemoryQuota.
+	CurMemoryBytes uint64
+
+	CurReadCacheEntries uint64
+	CurReadCacheBytes   uint64
+
+	// The CurPersistedXxxx stats are from the lower-level snapshot
+	// when it's from a Store, where the bytes are the file bytes used
+	// by the persisted segments, including metadata.
+	CurPersistedOps      uint64
+	CurPersistedBytes    uint64
+	CurPersistedSegments uint64
 }
 
 // ------------------------------------------------------------
@@ -632,6 +941,7 @@ func NewCollection(options CollectionOptions) (
 		ghistogram.NewNamedHistogram("MutationKeyBytes", 10, 4, 4)
 	histograms["MutationValBytes"] =
 		ghistogram.NewNamedHistogram("MutationValBytes", 10, 4, 4)
+	addReadHistograms(histograms)
 
 	c := &collection{
 		options:            &options,
@@ -644,6 +954,10 @@ func NewCollection(options CollectionOptions) (
 		histograms:         histograms,
 	}
 
+	if options.ReadCacheBytes > 0 {
+		c.readCache = newReadCache(options.ReadCacheBytes)
+	}
+
 	c.stackDirtyTopCond = sync.NewCond(&c.m)
 	c.stackDirtyBaseCond = sync.NewCond(&c.m)
 
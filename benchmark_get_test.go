@@ -61,13 +61,87 @@ func BenchmarkCollectionGets(b *testing.B) {
 	}
 }
 
+func BenchmarkCollectionGetsReadCache(b *testing.B) {
+	tmpDir, _ := ioutil.TempDir("", "benchStore")
+	defer os.RemoveAll(tmpDir)
+
+	so := StoreOptions{}
+	so.CollectionOptions.ReadCacheBytes = 10 * 1024 * 1024
+
+	store, coll, keys := createStoreAndWriteNItemsEx(tmpDir, 10000, 100, so)
+	defer store.Close()
+	defer coll.Close()
+
+	// A hot set of every 10th key.
+	hotKeys := make([][]byte, 0, len(keys)/10)
+	for i := 0; i < len(keys); i += 10 {
+		hotKeys = append(hotKeys, keys[i])
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := coll.Get(hotKeys[i%len(hotKeys)], ReadOptions{})
+		if err != nil {
+			panic("Collection-Get() failed!")
+		}
+	}
+}
+
+func BenchmarkCollectionGetMulti100(b *testing.B) {
+	benchmarkCollectionGetMulti(b, 100, true)
+}
+
+func BenchmarkCollectionGetMulti100AsSingleGets(b *testing.B) {
+	benchmarkCollectionGetMulti(b, 100, false)
+}
+
+func benchmarkCollectionGetMulti(b *testing.B, numKeys int, multi bool) {
+	tmpDir, _ := ioutil.TempDir("", "benchStore")
+	defer os.RemoveAll(tmpDir)
+
+	store, coll, keys := createStoreAndWriteNItems(tmpDir, 10000, 100)
+	defer store.Close()
+	defer coll.Close()
+
+	// Every 100th key, so the lookups are spread over the key space.
+	getKeys := make([][]byte, numKeys)
+	for i := range getKeys {
+		getKeys[i] = keys[(i*100)%len(keys)]
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if multi {
+			_, err := coll.GetMulti(getKeys, ReadOptions{})
+			if err != nil {
+				panic("Collection-GetMulti() failed!")
+			}
+		} else {
+			for _, key := range getKeys {
+				_, err := coll.Get(key, ReadOptions{})
+				if err != nil {
+					panic("Collection-Get() failed!")
+				}
+			}
+		}
+	}
+}
+
 // ---------------------------------------------------------------
 
 func createStoreAndWriteNItems(tmpDir string, items int,
 	batches int) (s *Store, c Collection, ks [][]byte) {
+	return createStoreAndWriteNItemsEx(tmpDir, items, batches,
+		StoreOptions{})
+}
+
+func createStoreAndWriteNItemsEx(tmpDir string, items int,
+	batches int, so StoreOptions) (s *Store, c Collection, ks [][]byte) {
 
 	store, coll, err := OpenStoreCollection(tmpDir,
-		StoreOptions{},
+		so,
 		StorePersistOptions{})
 
 	if err != nil || store == nil {
@@ -97,12 +171,12 @@ func createStoreAndWriteNItems(tmpDir string, items int,
 		}
 
 		for j := 0; j < itemsPerBatch; j++ {
-			k := []byte(fmt.Sprintf("key%d", i))
-			v := []byte(fmt.Sprintf("val%d", i))
+			k := []byte(fmt.Sprintf("key%d", itemCount))
+			v := []byte(fmt.Sprintf("val%d", itemCount))
+			keys[itemCount] = k
 			itemCount++
 
 			batch.Set(k, v)
-			keys[j] = k
 		}
 
 		err = coll.ExecuteBatch(batch, WriteOptions{})
@@ -569,3 +569,68 @@ func clearBuf(buf []byte) {
 		buf[i] = 0
 	}
 }
+
+func BenchmarkStorePersist_keys1K_segments20(b *testing.B) {
+	benchmarkStorePersist(b, StoreOptions{})
+}
+
+func BenchmarkStorePersist_keys1K_segments20_trackDeadBytes(b *testing.B) {
+	benchmarkStorePersist(b, StoreOptions{TrackDeadBytes: true})
+}
+
+// benchmarkStorePersist measures the persistence of batches of 1K
+// random-like keys from a domain of 100K keys onto a store of up to
+// 20 segments, such as to compare the cost of TrackDeadBytes.
+func benchmarkStorePersist(b *testing.B, options StoreOptions) {
+	tmpDir, _ := ioutil.TempDir("", "mossStoreBenchmark")
+	defer os.RemoveAll(tmpDir)
+
+	store, err := OpenStore(tmpDir, options)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+
+		if i%20 == 0 {
+			llss, err := store.Persist(nil,
+				StorePersistOptions{CompactionConcern: CompactionForce})
+			if err != nil {
+				b.Fatal(err)
+			}
+			llss.Close()
+		}
+
+		coll, _ := NewCollection(CollectionOptions{})
+		coll.Start()
+
+		batch, _ := coll.NewBatch(1000, 1000*30)
+		for j := 0; j < 1000; j++ {
+			k := (int64(i*1000+j) * LargePrime) % 100000
+			batch.Set([]byte(fmt.Sprintf("%020d", k)), []byte("val"))
+		}
+		coll.ExecuteBatch(batch, WriteOptions{})
+		batch.Close()
+
+		ss, _ := coll.Snapshot()
+
+		b.StartTimer()
+
+		llss, err := store.Persist(ss, StorePersistOptions{NoSync: true})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+
+		llss.Close()
+		ss.Close()
+		coll.Close()
+
+		b.StartTimer()
+	}
+}
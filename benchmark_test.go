@@ -118,6 +118,59 @@ func BenchmarkSetsParallelBatchSize100000Dsc(b *testing.B) {
 
 // ---------------------------------------------------------------
 
+func BenchmarkMergerWorkers1(b *testing.B) {
+	benchmarkMergerWorkers(b, 1)
+}
+
+func BenchmarkMergerWorkers4(b *testing.B) {
+	benchmarkMergerWorkers(b, 4)
+}
+
+func BenchmarkMergerWorkers16(b *testing.B) {
+	benchmarkMergerWorkers(b, 16)
+}
+
+// benchmarkMergerWorkers measures the throughput of executing batches
+// of random keys and fully merging them, in bytes of key-vals.
+func benchmarkMergerWorkers(b *testing.B, mergerWorkers int) {
+	numBatches := 10
+	batchSize := 100000
+
+	batches := make([][][]byte, numBatches)
+	totBytes := 0
+	for i := range batches {
+		for j := 0; j < batchSize; j++ {
+			buf := []byte(fmt.Sprintf("%d", (j*numBatches+i)*7919))
+			batches[i] = append(batches[i], buf)
+			totBytes += len(buf) + len(buf)
+		}
+	}
+
+	b.SetBytes(int64(totBytes))
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m, _ := NewCollection(CollectionOptions{MergerWorkers: mergerWorkers})
+		m.Start()
+
+		for _, arr := range batches {
+			batch, _ := m.NewBatch(len(arr), totBytes/numBatches)
+			for _, buf := range arr {
+				batch.Set(buf, buf)
+			}
+			m.ExecuteBatch(batch, WriteOptions{})
+			batch.Close()
+		}
+
+		m.(*collection).NotifyMerger("mergeAll", true)
+
+		m.Close()
+	}
+}
+
+// ---------------------------------------------------------------
+
 func makeArr(n int, kind string) (arr [][]byte, arrTotBytes int) {
 	arr = make([][]byte, 0, n)
 
@@ -0,0 +1,67 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package moss
+
+import (
+	"sync"
+)
+
+// A canceler is the subset of a context.Context that's used to give
+// up on operations that might block or read from the lower level,
+// which allows the rest of moss to not depend on the context package.
+type canceler interface {
+	// Done returns a channel that's closed when the operation should
+	// be given up.
+	Done() <-chan struct{}
+
+	// Err returns a non-nil error after Done is closed.
+	Err() error
+}
+
+// canceled returns the error of an optional canceler whose operation
+// should be given up, or nil.
+func canceled(c canceler) error {
+	if c == nil {
+		return nil
+	}
+
+	select {
+	case <-c.Done():
+		return c.Err()
+	default:
+		return nil
+	}
+}
+
+// awakeOnCancel starts a goroutine that awakes the waiters of a cond
+// when an optional canceler is done, so that the waiters can check
+// for cancellation.  The returned func stops the goroutine.
+func awakeOnCancel(c canceler, cond *sync.Cond) (stop func()) {
+	if c == nil {
+		return func() {}
+	}
+
+	stopCh := make(chan struct{})
+
+	go func() {
+		select {
+		case <-c.Done():
+			cond.L.Lock()
+			cond.Broadcast()
+			cond.L.Unlock()
+		case <-stopCh:
+			// NO-OP.
+		}
+	}()
+
+	return func() { close(stopCh) }
+}
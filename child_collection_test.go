@@ -16,7 +16,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 // ----------------------------------------------------
@@ -295,3 +298,869 @@ func Test2Collection1000items(t *testing.T) {
 	}
 	testChildCollections(t, args)
 }
+
+// prefixCompactionFilter drops the key-val entries whose keys have
+// the prefix.
+type prefixCompactionFilter struct {
+	prefix string
+}
+
+func (f *prefixCompactionFilter) Name() string {
+	return "prefixCompactionFilter(" + f.prefix + ")"
+}
+
+func (f *prefixCompactionFilter) Filter(key, val []byte) bool {
+	return bytes.HasPrefix(key, []byte(f.prefix))
+}
+
+func TestChildCollectionOptions(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	filter := &prefixCompactionFilter{prefix: "tmp"}
+	CompactionFilters[filter.Name()] = filter
+	defer delete(CompactionFilters, filter.Name())
+
+	co := CollectionOptions{
+		MergeOperator: &MergeOperatorStringAppend{Sep: ":"},
+	}
+
+	cco := &ChildCollectionOptions{
+		MergeOperator:    MergeOperators["MergeOperatorInt64Add"],
+		CompactionFilter: filter,
+		MaxDirtyOps:      1000,
+	}
+
+	store, err := OpenStore(tmpDir, StoreOptions{CollectionOptions: co})
+	if err != nil {
+		t.Fatalf("expected open empty store to work, err: %v", err)
+	}
+
+	coll, _ := NewCollection(co)
+	coll.Start()
+
+	b, _ := coll.NewBatch(0, 0)
+	b.Merge([]byte("a"), []byte("A"))
+	cb, _ := b.NewChildCollectionBatchWithOptions("counters",
+		BatchOptions{0, 0}, cco)
+	cb.Merge([]byte("hits"), i64(10))
+	cb.Set([]byte("tmp0"), i64(0))
+	pb, _ := b.NewChildCollectionBatch("plain", BatchOptions{})
+	pb.Merge([]byte("p"), []byte("P"))
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	b, _ = coll.NewBatch(0, 0)
+	cb, _ = b.NewChildCollectionBatch("counters", BatchOptions{})
+	cb.Merge([]byte("hits"), i64(5))
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	checkChild := func(msg string, c Collection, cName string,
+		key string, exp []byte) {
+		ss, _ := c.Snapshot()
+		childSS, err := ss.ChildCollectionSnapshot(cName)
+		if err != nil || childSS == nil {
+			t.Fatalf("%s, expected child snapshot: %s, err: %v", msg, cName, err)
+		}
+		v, err := childSS.Get([]byte(key), ReadOptions{})
+		if err != nil || !bytes.Equal(v, exp) {
+			t.Errorf("%s, expected child: %s, key: %s, val: %v, got: %v,"+
+				" err: %v", msg, cName, key, exp, v, err)
+		}
+		childSS.Close()
+		ss.Close()
+	}
+
+	checkChild("before persist", coll, "counters", "hits", i64(15))
+	checkChild("before persist", coll, "plain", "p", []byte(":P"))
+
+	ss, _ := coll.Snapshot()
+	llss, err := store.Persist(ss, StorePersistOptions{
+		CompactionConcern: CompactionForce,
+	})
+	ss.Close()
+	if err != nil {
+		t.Fatalf("expected persist to work, err: %v", err)
+	}
+	llss.Close()
+
+	s, _ := coll.ChildCollectionStats("counters")
+	if s.TotCompactionFilterDropped != 1 {
+		t.Errorf("expected 1 entry dropped by the compaction filter, got: %d",
+			s.TotCompactionFilterDropped)
+	}
+	coll.Close()
+
+	footer, _ := store.snapshot()
+	childFooter := footer.ChildFooters["counters"]
+	if childFooter.ChildOptions == nil ||
+		childFooter.ChildOptions.MaxDirtyOps != 1000 ||
+		childFooter.MergeOperatorName != "MergeOperatorInt64Add" ||
+		childFooter.CompactionFilterName != filter.Name() {
+		t.Errorf("expected child options recorded, got: %+v", childFooter)
+	}
+	if footer.ChildFooters["plain"].ChildOptions != nil {
+		t.Errorf("expected inherited child options to not be recorded")
+	}
+	footer.Close()
+	store.Close()
+
+	// Reopening resolves the child's options from the registries.
+	store, coll, err = OpenStoreCollection(tmpDir,
+		StoreOptions{CollectionOptions: co}, StorePersistOptions{})
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+	defer store.Close()
+	defer coll.Close()
+
+	b, _ = coll.NewBatch(0, 0)
+	cb, _ = b.NewChildCollectionBatch("counters", BatchOptions{})
+	cb.Merge([]byte("hits"), i64(1))
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	checkChild("after reopen", coll, "counters", "hits", i64(16))
+	checkChild("after reopen", coll, "counters", "tmp0", nil)
+	checkChild("after reopen", coll, "plain", "p", []byte(":P"))
+
+	mc := coll.(*collection)
+	if mc.childCollections["counters"].options.MaxDirtyOps != 1000 ||
+		mc.childCollections["plain"].options != mc.options {
+		t.Errorf("expected restored child options")
+	}
+}
+
+func TestChildCollectionOptionsInherited(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	filter := &prefixCompactionFilter{prefix: "tmp"}
+
+	co := CollectionOptions{
+		MergeOperator:       &MergeOperatorStringAppend{Sep: ":"},
+		CompactionFilter:    filter,
+		MaxDirtyKeyValBytes: 12345,
+	}
+
+	store, err := OpenStore(tmpDir, StoreOptions{CollectionOptions: co})
+	if err != nil {
+		t.Fatalf("expected open empty store to work, err: %v", err)
+	}
+
+	coll, _ := NewCollection(co)
+	coll.Start()
+
+	b, _ := coll.NewBatch(0, 0)
+	cb, _ := b.NewChildCollectionBatchWithOptions("limited",
+		BatchOptions{0, 0}, &ChildCollectionOptions{
+			MaxDirtyOps: 100,
+		})
+	cb.Merge([]byte("a"), []byte("A"))
+	err = coll.ExecuteBatch(b, WriteOptions{})
+	if err != nil {
+		t.Fatalf("expected merge into child to work, err: %v", err)
+	}
+	b.Close()
+
+	childOptions := coll.(*collection).childCollections["limited"].options
+	if childOptions.MaxDirtyOps != 100 ||
+		childOptions.MergeOperator != co.MergeOperator ||
+		childOptions.CompactionFilter != co.CompactionFilter ||
+		childOptions.MaxDirtyKeyValBytes != co.MaxDirtyKeyValBytes {
+		t.Errorf("expected unset child options to be inherited, got: %+v",
+			childOptions)
+	}
+
+	ss, _ := coll.Snapshot()
+	llss, err := store.Persist(ss, StorePersistOptions{})
+	ss.Close()
+	if err != nil {
+		t.Fatalf("expected persist to work, err: %v", err)
+	}
+	llss.Close()
+	coll.Close()
+	store.Close()
+
+	// The inherited, unregistered MergeOperator and CompactionFilter
+	// are taken from the parent on reopen.
+	store, coll, err = OpenStoreCollection(tmpDir,
+		StoreOptions{CollectionOptions: co}, StorePersistOptions{})
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+
+	b, _ = coll.NewBatch(0, 0)
+	cb, _ = b.NewChildCollectionBatch("limited", BatchOptions{})
+	cb.Merge([]byte("a"), []byte("B"))
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	ss, _ = coll.Snapshot()
+	childSS, _ := ss.ChildCollectionSnapshot("limited")
+	v, err := childSS.Get([]byte("a"), ReadOptions{})
+	if err != nil || string(v) != ":A:B" {
+		t.Errorf("expected merged val after reopen, got: %q, err: %v", v, err)
+	}
+	childSS.Close()
+	ss.Close()
+
+	childOptions = coll.(*collection).childCollections["limited"].options
+	if childOptions.MaxDirtyOps != 100 ||
+		childOptions.CompactionFilter != co.CompactionFilter {
+		t.Errorf("expected restored child options, got: %+v", childOptions)
+	}
+
+	coll.Close()
+	store.Close()
+}
+
+func TestChildCollectionUnregisteredMergeOperator(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	co := CollectionOptions{
+		MergeOperator: MergeOperators["MergeOperatorInt64Add"],
+	}
+
+	store, coll, err := OpenStoreCollection(tmpDir,
+		StoreOptions{CollectionOptions: co}, StorePersistOptions{})
+	if err != nil {
+		t.Fatalf("expected open store collection to work, err: %v", err)
+	}
+
+	b, _ := coll.NewBatch(0, 0)
+	cb, _ := b.NewChildCollectionBatchWithOptions("appends",
+		BatchOptions{0, 0}, &ChildCollectionOptions{
+			MergeOperator: &MergeOperatorStringAppend{Sep: ":"},
+		})
+	cb.Merge([]byte("a"), []byte("A"))
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	waitForChildPersistence(t, coll)
+
+	coll.Close()
+	store.Close()
+
+	store, coll, err = OpenStoreCollection(tmpDir,
+		StoreOptions{CollectionOptions: co}, StorePersistOptions{})
+	if err == nil || !strings.Contains(err.Error(), "unregistered merge operator") {
+		t.Errorf("expected unregistered merge operator error, err: %v", err)
+	}
+	if err == nil {
+		coll.Close()
+		store.Close()
+	}
+}
+
+func TestChildCollectionOptionsKeptByCompaction(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	filter := &prefixCompactionFilter{prefix: "tmp"}
+	CompactionFilters[filter.Name()] = filter
+	defer delete(CompactionFilters, filter.Name())
+
+	co := CollectionOptions{
+		MergeOperator: &MergeOperatorStringAppend{Sep: ":"},
+	}
+
+	store, err := OpenStore(tmpDir, StoreOptions{CollectionOptions: co})
+	if err != nil {
+		t.Fatalf("expected open empty store to work, err: %v", err)
+	}
+
+	coll, _ := NewCollection(co)
+	coll.Start()
+
+	b, _ := coll.NewBatch(0, 0)
+	cb, _ := b.NewChildCollectionBatchWithOptions("counters",
+		BatchOptions{0, 0}, &ChildCollectionOptions{
+			MergeOperator:    MergeOperators["MergeOperatorInt64Add"],
+			CompactionFilter: filter,
+			MaxDirtyOps:      1000,
+		})
+	cb.Merge([]byte("hits"), i64(10))
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	ss, _ := coll.Snapshot()
+	llss, err := store.Persist(ss, StorePersistOptions{})
+	ss.Close()
+	if err != nil {
+		t.Fatalf("expected persist to work, err: %v", err)
+	}
+	llss.Close()
+	coll.Close()
+	store.Close()
+
+	// Without the registered filter, the reopened child's segments are
+	// loaded with the inherited options of the parent collection.
+	delete(CompactionFilters, filter.Name())
+
+	store, err = OpenStore(tmpDir, StoreOptions{CollectionOptions: co})
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+	defer store.Close()
+
+	footer, _ := store.snapshot()
+	err = store.compact(footer, nil, StorePersistOptions{})
+	footer.DecRef()
+	if err != nil {
+		t.Fatalf("expected compact to work, err: %v", err)
+	}
+
+	footer, _ = store.snapshot()
+	defer footer.DecRef()
+
+	childFooter := footer.ChildFooters["counters"]
+	if childFooter.ChildOptions == nil ||
+		childFooter.ChildOptions.MaxDirtyOps != 1000 ||
+		childFooter.MergeOperatorName != "MergeOperatorInt64Add" ||
+		childFooter.CompactionFilterName != filter.Name() {
+		t.Errorf("expected child options kept by compaction, got: %+v",
+			childFooter)
+	}
+}
+
+func TestChildCollectionDirtyLimits(t *testing.T) {
+	m, _ := NewCollection(CollectionOptions{})
+	mc := m.(*collection)
+
+	b, _ := m.NewBatch(0, 0)
+	cb, _ := b.NewChildCollectionBatchWithOptions("limited",
+		BatchOptions{0, 0}, &ChildCollectionOptions{
+			MaxDirtyOps: 2,
+		})
+	cb.Set([]byte("a"), []byte("A"))
+	cb.Set([]byte("b"), []byte("B"))
+	ub, _ := b.NewChildCollectionBatch("unlimited", BatchOptions{})
+	for i := 0; i < 10; i++ {
+		ub.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+	}
+	m.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	mc.m.Lock()
+	over := mc.childrenOverDirtyLimitsLOCKED(mc.stackDirtyTop)
+	mc.m.Unlock()
+	if over {
+		t.Errorf("expected child collection to be within its dirty limits")
+	}
+
+	b, _ = m.NewBatch(0, 0)
+	cb, _ = b.NewChildCollectionBatch("limited", BatchOptions{})
+	cb.Set([]byte("c"), []byte("C"))
+	m.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	mc.m.Lock()
+	over = mc.childrenOverDirtyLimitsLOCKED(mc.stackDirtyTop)
+	mc.m.Unlock()
+	if !over {
+		t.Errorf("expected child collection to be over its dirty limits")
+	}
+}
+
+func TestChildCollectionStats(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	store, coll, err := OpenStoreCollection(tmpDir,
+		StoreOptions{}, StorePersistOptions{})
+	if err != nil {
+		t.Fatalf("expected OpenStoreCollection to work, err: %v", err)
+	}
+	defer store.Close()
+	defer coll.Close()
+
+	_, err = coll.ChildCollectionStats("nope")
+	if err != ErrNoSuchCollection {
+		t.Errorf("expected ErrNoSuchCollection, got: %v", err)
+	}
+
+	b, _ := coll.NewBatch(0, 0)
+	b.Set([]byte("r"), []byte("R"))
+	ab, _ := b.NewChildCollectionBatch("a", BatchOptions{})
+	loadItems(ab, 10, 0)
+	bb, _ := b.NewChildCollectionBatch("b", BatchOptions{})
+	loadItems(bb, 3, 0)
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	ss, _ := coll.Snapshot()
+	childSS, _ := ss.ChildCollectionSnapshot("a")
+	childSS.Get([]byte("0001"), ReadOptions{})
+	childSS.Get([]byte("0002"), ReadOptions{})
+	childSS.Close()
+	ss.Close()
+
+	sa, err := coll.ChildCollectionStats("a")
+	if err != nil {
+		t.Fatalf("expected ChildCollectionStats to work, err: %v", err)
+	}
+	if sa.TotGet != 2 || sa.TotExecuteBatchEnd != 1 {
+		t.Errorf("unexpected child stats counters: %+v", sa)
+	}
+	if sa.CurDirtyOps+sa.CurCleanOps+sa.CurPersistedOps < 10 {
+		t.Errorf("expected child a to have 10 ops, got: %+v", sa)
+	}
+
+	sb, _ := coll.ChildCollectionStats("b")
+	if sb.TotGet != 0 || sb.CurDirtyOps+sb.CurCleanOps+sb.CurPersistedOps < 3 {
+		t.Errorf("unexpected child b stats: %+v", sb)
+	}
+
+	hs, err := coll.ChildCollectionHistograms("a")
+	if err != nil || hs["ExecuteBatchOpsCount"].TotCount != 1 {
+		t.Errorf("expected child histograms, err: %v", err)
+	}
+
+	// Wait for the persister to persist the child collections.
+	for i := 0; i < 500; i++ {
+		sa, _ = coll.ChildCollectionStats("a")
+		if sa.CurDirtyOps == 0 && sa.CurPersistedOps > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sa.CurDirtyOps != 0 || sa.CurPersistedOps != 10 ||
+		sa.CurPersistedBytes == 0 || sa.CurPersistedSegments == 0 {
+		t.Errorf("expected child a to be persisted, got: %+v", sa)
+	}
+
+	s, _ := coll.Stats()
+	if s.TotGet != 0 || s.CurPersistedOps != 1 {
+		t.Errorf("unexpected root stats: %+v", s)
+	}
+}
+
+// childSnapshotPath returns the snapshot of a nested child collection,
+// or nil if the child collection does not exist.
+func childSnapshotPath(t *testing.T, ss Snapshot, path ...string) Snapshot {
+	ss, err := ss.ChildCollectionSnapshot(path[0])
+	if err != nil {
+		t.Fatalf("expected ChildCollectionSnapshot to work, err: %v", err)
+	}
+	if ss == nil || len(path) == 1 {
+		return ss
+	}
+	defer ss.Close()
+	return childSnapshotPath(t, ss, path[1:]...)
+}
+
+// nestedBatch returns the batch of a nested child collection.
+func nestedBatch(b Batch, path ...string) Batch {
+	for _, name := range path {
+		b, _ = b.NewChildCollectionBatch(name, BatchOptions{})
+	}
+	return b
+}
+
+func TestNestedChildCollections(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	store, err := OpenStore(tmpDir, StoreOptions{})
+	if err != nil {
+		t.Fatalf("expected open empty store to work, err: %v", err)
+	}
+
+	coll, _ := NewCollection(CollectionOptions{})
+	coll.Start()
+
+	persist := func(compactionConcern CompactionConcern) {
+		ss, _ := coll.Snapshot()
+		llss, err := store.Persist(ss, StorePersistOptions{
+			CompactionConcern: compactionConcern,
+		})
+		ss.Close()
+		if err != nil {
+			t.Fatalf("expected persist to work, err: %v", err)
+		}
+		llss.Close()
+	}
+
+	// Expected vals, keyed by the child collection path and key,
+	// where an empty val means not found.
+	exp := map[string]string{}
+
+	set := func(b Batch, key, val string, path ...string) {
+		nestedBatch(b, path...).Set([]byte(key), []byte(val))
+		exp[strings.Join(append(path, key), "/")] = val
+	}
+
+	check := func(msg string, c Collection) {
+		ss, _ := c.Snapshot()
+		defer ss.Close()
+
+		for pathKey, val := range exp {
+			parts := strings.Split(pathKey, "/")
+			path, key := parts[:len(parts)-1], parts[len(parts)-1]
+
+			childSS := ss
+			if len(path) > 0 {
+				childSS = childSnapshotPath(t, ss, path...)
+				if childSS == nil {
+					if val != "" {
+						t.Errorf("%s, expected child collection: %v", msg, path)
+					}
+					continue
+				}
+				defer childSS.Close()
+			}
+
+			v, err := childSS.Get([]byte(key), ReadOptions{})
+			if err != nil || string(v) != val {
+				t.Errorf("%s, expected %s = %q, got: %q, err: %v",
+					msg, pathKey, val, v, err)
+			}
+		}
+	}
+
+	b, _ := coll.NewBatch(0, 0)
+	set(b, "r", "r0")
+	set(b, "t", "t1-0", "tenant1")
+	set(b, "i", "i1-0", "tenant1", "idx1")
+	set(b, "p", "p1-0", "tenant1", "idx1", "part1")
+	set(b, "p", "p2-0", "tenant1", "idx1", "part2")
+	set(b, "p", "p1-0", "tenant2", "idx1", "part1")
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	check("first batch", coll)
+	persist(CompactionDisable)
+
+	b, _ = coll.NewBatch(0, 0)
+	set(b, "p", "p1-1", "tenant1", "idx1", "part1")
+	set(b, "p", "p9-1", "tenant1", "idx2", "part9")
+	b.DelChildCollection("tenant2")
+	exp["tenant2/idx1/part1/p"] = ""
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	check("second batch", coll)
+	persist(CompactionForce)
+	check("after compaction", coll)
+
+	b, _ = coll.NewBatch(0, 0)
+	set(b, "q", "q2-2", "tenant1", "idx1", "part2")
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	persist(CompactionDisable)
+	coll.Close()
+
+	// A compaction of only the persisted data.
+	llss, err := store.Persist(nil, StorePersistOptions{
+		CompactionConcern: CompactionForce,
+	})
+	if err != nil {
+		t.Fatalf("expected compaction to work, err: %v", err)
+	}
+	llss.Close()
+	store.Close()
+
+	store, coll, err = OpenStoreCollection(tmpDir,
+		StoreOptions{}, StorePersistOptions{})
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+
+	check("after reopen", coll)
+
+	ss, _ := coll.Snapshot()
+	tenantSS := childSnapshotPath(t, ss, "tenant1")
+	names, _ := tenantSS.ChildCollectionNames()
+	sort.Strings(names)
+	if strings.Join(names, ",") != "idx1,idx2" {
+		t.Errorf("expected tenant1 child collections, got: %v", names)
+	}
+	tenantSS.Close()
+	ss.Close()
+
+	// Deleting a nested subtree.
+	b, _ = coll.NewBatch(0, 0)
+	nestedBatch(b, "tenant1").DelChildCollection("idx1")
+	exp["tenant1/idx1/i"] = ""
+	exp["tenant1/idx1/part1/p"] = ""
+	exp["tenant1/idx1/part2/p"] = ""
+	exp["tenant1/idx1/part2/q"] = ""
+	set(b, "p", "p9-3", "tenant1", "idx2", "part9")
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	check("after subtree delete", coll)
+
+	waitForChildPersistence(t, coll)
+	coll.Close()
+	store.Close()
+
+	store, err = OpenStore(tmpDir, StoreOptions{})
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+	defer store.Close()
+
+	// Nested snapshots of the store may be opened repeatedly.
+	for i := 0; i < 3; i++ {
+		ss, _ = store.Snapshot()
+		partSS := childSnapshotPath(t, ss, "tenant1", "idx2", "part9")
+		v, err := partSS.Get([]byte("p"), ReadOptions{})
+		if err != nil || string(v) != "p9-3" {
+			t.Errorf("expected persisted nested val, got: %q, err: %v", v, err)
+		}
+		partSS.Close()
+
+		if childSnapshotPath(t, ss, "tenant1", "idx1") != nil {
+			t.Errorf("expected deleted nested child collection to stay deleted")
+		}
+		ss.Close()
+	}
+}
+
+// waitForChildPersistence waits until a collection's dirty segments,
+// which include those of any child collections, have been persisted.
+func waitForChildPersistence(t *testing.T, m Collection) {
+	for i := 0; i < 500; i++ {
+		coll := m.(*collection)
+		coll.m.Lock()
+		dirty := (coll.stackDirtyTop != nil && !coll.stackDirtyTop.isEmpty()) ||
+			(coll.stackDirtyMid != nil && !coll.stackDirtyMid.isEmpty()) ||
+			coll.stackDirtyBase != nil
+		coll.m.Unlock()
+		if !dirty {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected persistence")
+}
+
+func TestChildCollectionRenameClone(t *testing.T) {
+	for _, compactionConcern := range []CompactionConcern{
+		CompactionDisable, CompactionForce} {
+		testChildCollectionRenameClone(t, compactionConcern)
+	}
+}
+
+func testChildCollectionRenameClone(t *testing.T,
+	compactionConcern CompactionConcern) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	persistOptions := StorePersistOptions{CompactionConcern: compactionConcern}
+
+	store, coll, err := OpenStoreCollection(tmpDir, StoreOptions{},
+		persistOptions)
+	if err != nil {
+		t.Fatalf("expected open store to work, err: %v", err)
+	}
+
+	exp := map[string]string{}
+
+	set := func(b Batch, key, val string, path ...string) {
+		nestedBatch(b, path...).Set([]byte(key), []byte(val))
+		exp[strings.Join(append(path, key), "/")] = val
+	}
+
+	check := func(msg string, c Collection) {
+		ss, _ := c.Snapshot()
+		defer ss.Close()
+
+		for pathKey, val := range exp {
+			parts := strings.Split(pathKey, "/")
+			path, key := parts[:len(parts)-1], parts[len(parts)-1]
+
+			childSS := childSnapshotPath(t, ss, path...)
+			if childSS == nil {
+				if val != "" {
+					t.Errorf("%v, %s, expected child collection: %v",
+						compactionConcern, msg, path)
+				}
+				continue
+			}
+
+			v, err := childSS.Get([]byte(key), ReadOptions{})
+			if err != nil || string(v) != val {
+				t.Errorf("%v, %s, expected %s = %q, got: %q, err: %v",
+					compactionConcern, msg, pathKey, val, v, err)
+			}
+			childSS.Close()
+		}
+	}
+
+	b, _ := coll.NewBatch(0, 0)
+	set(b, "a", "a0", "src")
+	set(b, "b", "b0", "src")
+	set(b, "k", "k0", "src", "sub")
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	waitForChildPersistence(t, coll)
+
+	storeSS, _ := store.Snapshot()
+	srcSlocs := storeSS.(*Footer).ChildFooters["src"].SegmentLocs
+	srcSloc := srcSlocs[len(srcSlocs)-1]
+	storeSS.Close()
+
+	// Unpersisted changes to the source are cloned too.
+	b, _ = coll.NewBatch(0, 0)
+	set(b, "c", "c1", "src")
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	b, _ = coll.NewBatch(0, 0)
+	if err = b.CloneChildCollection("src", "copy"); err != nil {
+		t.Fatalf("expected clone to work, err: %v", err)
+	}
+	if err = b.RenameChildCollection("src", "moved"); err != nil {
+		t.Fatalf("expected rename to work, err: %v", err)
+	}
+	set(b, "d", "d2", "copy")
+	nestedBatch(b, "moved").Del([]byte("a"))
+	for _, key := range []string{"a", "b", "c", "sub/k"} {
+		exp["copy/"+key] = exp["src/"+key]
+		exp["moved/"+key] = exp["src/"+key]
+		exp["src/"+key] = ""
+	}
+	exp["moved/a"] = ""
+	err = coll.ExecuteBatch(b, WriteOptions{})
+	if err != nil {
+		t.Fatalf("expected execute of clone and rename to work, err: %v", err)
+	}
+	b.Close()
+
+	check("after clone and rename", coll)
+
+	// Changes to a clone are not seen by its source.
+	b, _ = coll.NewBatch(0, 0)
+	set(b, "k", "k3", "copy", "sub")
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	check("after changing the clone", coll)
+
+	// A failing rename or clone leaves the collection unchanged.
+	for _, test := range []struct {
+		ops func(b Batch)
+		err error
+	}{
+		{func(b Batch) { b.RenameChildCollection("src", "x") },
+			ErrNoSuchCollection},
+		{func(b Batch) { b.CloneChildCollection("moved", "copy") },
+			ErrCollectionExists},
+		{func(b Batch) {
+			b.RenameChildCollection("moved", "x")
+			nestedBatch(b, "copy").CloneChildCollection("nope", "y")
+		}, ErrNoSuchCollection},
+	} {
+		b, _ = coll.NewBatch(0, 0)
+		test.ops(b)
+		err = coll.ExecuteBatch(b, WriteOptions{})
+		if err != test.err {
+			t.Errorf("expected err: %v, got: %v", test.err, err)
+		}
+		b.Close()
+	}
+
+	b, _ = coll.NewBatch(0, 0)
+	if b.RenameChildCollection("", "x") != ErrBadCollectionName ||
+		b.CloneChildCollection("x", "x") != ErrBadCollectionName {
+		t.Errorf("expected bad collection names")
+	}
+	b.Close()
+
+	check("after failed renames and clones", coll)
+
+	waitForChildPersistence(t, coll)
+
+	if compactionConcern == CompactionDisable {
+		// The clone references the persisted segments of its source.
+		storeSS, _ = store.Snapshot()
+		found := false
+		for _, sloc := range storeSS.(*Footer).ChildFooters["copy"].SegmentLocs {
+			if sloc.KvsOffset == srcSloc.KvsOffset {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected clone to reference its source's segments")
+		}
+		storeSS.Close()
+	}
+
+	check("after persistence", coll)
+
+	coll.Close()
+	store.Close()
+
+	store, coll, err = OpenStoreCollection(tmpDir, StoreOptions{},
+		persistOptions)
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+
+	check("after reopen", coll)
+
+	// A clone of a clone that's then persisted along with a compaction.
+	b, _ = coll.NewBatch(0, 0)
+	b.CloneChildCollection("copy", "copy2")
+	for _, key := range []string{"a", "b", "c", "d", "sub/k"} {
+		exp["copy2/"+key] = exp["copy/"+key]
+	}
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	waitForChildPersistence(t, coll)
+
+	llss, err := store.Persist(nil, StorePersistOptions{
+		CompactionConcern: CompactionForce,
+	})
+	if err != nil {
+		t.Fatalf("expected compaction to work, err: %v", err)
+	}
+	llss.Close()
+
+	coll.Close()
+	store.Close()
+
+	store, coll, err = OpenStoreCollection(tmpDir, StoreOptions{},
+		persistOptions)
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+
+	check("after compaction and reopen", coll)
+
+	coll.Close()
+	store.Close()
+}
+
+func TestChildCollectionCloneUnimplemented(t *testing.T) {
+	lower, _ := NewCollection(CollectionOptions{})
+	lower.Start()
+	defer lower.Close()
+
+	lowerSS, _ := lower.Snapshot()
+
+	m, _ := NewCollection(CollectionOptions{LowerLevelInit: lowerSS})
+	m.Start()
+	defer m.Close()
+
+	b, _ := m.NewBatch(0, 0)
+	b.NewChildCollectionBatch("a", BatchOptions{})
+	m.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	b, _ = m.NewBatch(0, 0)
+	b.CloneChildCollection("a", "b")
+	err := m.ExecuteBatch(b, WriteOptions{})
+	if err != ErrUnimplemented {
+		t.Errorf("expected unimplemented clone, got: %v", err)
+	}
+	b.Close()
+}
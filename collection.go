@@ -22,6 +22,11 @@ import (
 
 // A collection implements the Collection interface.
 type collection struct {
+	// cleanReadTick is incremented atomically on each read that's
+	// recorded for the EvictLRURange policy, and is the first field
+	// for the 64-bit alignment of atomic operations.
+	cleanReadTick uint64
+
 	options *CollectionOptions
 
 	stopCh          chan struct{}
@@ -41,9 +46,8 @@ type collection struct {
 	// non-nil).
 	waitDirtyOutgoingCh chan struct{}
 
-	// stats leverage sync/atomic counters.
-	// All child collections simply point back to the same stats instance.
-	// TODO: Have child collection specific stats.
+	// stats leverage sync/atomic counters.  Each child collection
+	// has its own stats instance.
 	stats *CollectionStats
 
 	// latestSnapshot caches the most recent collection snapshot to avoid
@@ -93,6 +97,11 @@ type collection struct {
 	// implementation, when using the Collection as a cache.
 	lowerLevelSnapshot *SnapshotWrapper
 
+	// readCache, when non-nil, caches the key-vals that were read from
+	// the lowerLevelSnapshot, and is reset whenever the
+	// lowerLevelSnapshot is replaced.
+	readCache *readCache
+
 	// histograms from collection operations
 	histograms ghistogram.Histograms
 
@@ -101,6 +110,12 @@ type collection struct {
 	// collection recreations and is zero in the top-level collection.
 	incarNum uint64
 
+	// cloneBase, when non-nil, is the lower level snapshot of the
+	// source of a child collection that was cloned or renamed, and
+	// is the child collection's lower level snapshot until the
+	// clone is persisted.
+	cloneBase *SnapshotWrapper
+
 	// Map of child collection by name.
 	// TODO: Most of the fields of the child collections are nil, so
 	// it might be lighter to use a dedicated struct instead of
@@ -255,14 +270,32 @@ func (m *collection) Get(key []byte, readOptions ReadOptions) ([]byte, error) {
 		return nil, ErrClosed
 	}
 
-	atomic.AddUint64(&m.stats.TotGet, 1)
+	totGet := atomic.AddUint64(&m.stats.TotGet, 1)
+
+	if !readHistogramsSampled(m.options, totGet) {
+		val, _, err := m.get(key, readOptions)
+		if err != nil {
+			atomic.AddUint64(&m.stats.TotGetErr, 1)
+		}
+
+		return val, err
+	}
+
+	startTime := time.Now()
+
+	var segmentsProbed uint64
+	readOptions.segmentsProbed = &segmentsProbed
 
-	val, err := m.get(key, readOptions)
+	val, source, err := m.get(key, readOptions)
 
 	if err != nil {
 		atomic.AddUint64(&m.stats.TotGetErr, 1)
 	}
 
+	m.histograms[getSourceHistograms[source]].Add(
+		uint64(time.Since(startTime).Nanoseconds()/1000), 1)
+	m.histograms["GetSegments"].Add(segmentsProbed, 1)
+
 	return val, err
 }
 
@@ -278,7 +311,10 @@ func (m *collection) NewBatch(totalOps, totalKeyValBytes int) (
 	atomic.AddUint64(&m.stats.TotNewBatchTotalOps, uint64(totalOps))
 	atomic.AddUint64(&m.stats.TotNewBatchTotalKeyValBytes, uint64(totalKeyValBytes))
 
-	return newBatch(m, BatchOptions{totalOps, totalKeyValBytes})
+	return newBatch(m, BatchOptions{
+		TotalOps:         totalOps,
+		TotalKeyValBytes: totalKeyValBytes,
+	})
 }
 
 // ExecuteBatch atomically incorporates the provided Batch into the
@@ -286,8 +322,27 @@ func (m *collection) NewBatch(totalOps, totalKeyValBytes int) (
 // ExecuteBatch() returns.
 func (m *collection) ExecuteBatch(bIn Batch,
 	writeOptions WriteOptions) error {
+	return m.executeBatch(bIn, writeOptions, nil)
+}
+
+// executeBatch implements ExecuteBatch(), where waiting for the
+// merger or persister to catch up is given up when the optional
+// canceler is done.
+func (m *collection) executeBatch(bIn Batch,
+	writeOptions WriteOptions, c canceler) error {
 	startTime := time.Now()
+
+	// The stalls are recorded while holding the lock and fired after.
+	var waited, quotaWaited bool
+	var waitDur, quotaWaitDur time.Duration
+
 	defer func() {
+		if waited {
+			m.fireEvent(EventKindBatchExecuteWait, waitDur)
+		}
+		if quotaWaited {
+			m.fireEvent(EventKindBatchExecuteQuotaWait, quotaWaitDur)
+		}
 		m.fireEvent(EventKindBatchExecute, time.Now().Sub(startTime))
 	}()
 
@@ -324,6 +379,14 @@ func (m *collection) ExecuteBatch(bIn Batch,
 	// notify interested handlers that we are about to execute this batch
 	m.fireEvent(EventKindBatchExecuteStart, 0)
 
+	if err := canceled(c); err != nil {
+		atomic.AddUint64(&m.stats.TotExecuteBatchCanceled, 1)
+		return err
+	}
+
+	stopAwakeOnCancel := awakeOnCancel(c, m.stackDirtyTopCond)
+	defer stopAwakeOnCancel()
+
 	m.m.Lock()
 
 	for m.stackDirtyTop != nil &&
@@ -333,34 +396,83 @@ func (m *collection) ExecuteBatch(bIn Batch,
 			return ErrClosed
 		}
 
+		if err := canceled(c); err != nil {
+			m.m.Unlock()
+			atomic.AddUint64(&m.stats.TotExecuteBatchCanceled, 1)
+			return err
+		}
+
 		if m.options.DeferredSort {
 			go b.RequestSort() // While waiting, might as well sort.
 		}
 
 		atomic.AddUint64(&m.stats.TotExecuteBatchWaitBeg, 1)
+		waitStart := time.Now()
 		m.stackDirtyTopCond.Wait()
+		waited = true
+		waitDur += time.Since(waitStart)
 		atomic.AddUint64(&m.stats.TotExecuteBatchWaitEnd, 1)
 	}
 
+	// The persister awakes us when dirty segments have been persisted.
+	for m.overDirtyMemoryQuotaLOCKED() && !m.isClosed() {
+		if err := canceled(c); err != nil {
+			m.m.Unlock()
+			atomic.AddUint64(&m.stats.TotExecuteBatchCanceled, 1)
+			return err
+		}
+
+		atomic.AddUint64(&m.stats.TotExecuteBatchQuotaWaitBeg, 1)
+		quotaWaitStart := time.Now()
+		m.stackDirtyTopCond.Wait()
+		quotaWaited = true
+		quotaWaitDur += time.Since(quotaWaitStart)
+		atomic.AddUint64(&m.stats.TotExecuteBatchQuotaWaitEnd, 1)
+	}
+
 	// check again, could have been closed while waiting
 	if m.isClosed() {
 		m.m.Unlock()
 		return ErrClosed
 	}
 
+	// The ctx might have been done without any waits, or at the end of
+	// the last wait, when the batch must still not be incorporated.
+	if err := canceled(c); err != nil {
+		m.m.Unlock()
+		atomic.AddUint64(&m.stats.TotExecuteBatchCanceled, 1)
+		return err
+	}
+
+	curStackDirtyTop := m.stackDirtyTop
+	if b.hasChildCollectionOps() {
+		var err error
+		curStackDirtyTop, err = m.execChildCollectionOpsLOCKED(b)
+		if err != nil {
+			m.m.Unlock()
+
+			atomic.AddUint64(&m.stats.TotExecuteBatchErr, 1)
+
+			return err
+		}
+	}
+
 	m.invalidateLatestSnapshotLOCKED()
 
-	stackDirtyTop := m.buildStackDirtyTop(b, m.stackDirtyTop)
+	stackDirtyTop := m.buildStackDirtyTop(b, curStackDirtyTop)
 
 	prevStackDirtyTop := m.stackDirtyTop
 	m.stackDirtyTop = stackDirtyTop
 
+	stackCleanPrev := m.evictCleanLOCKED()
+
 	waitDirtyIncomingCh := m.waitDirtyIncomingCh
 	m.waitDirtyIncomingCh = nil
 
 	m.m.Unlock()
 
 	prevStackDirtyTop.Close()
+	stackCleanPrev.Close()
 
 	if waitDirtyIncomingCh != nil {
 		atomic.AddUint64(&m.stats.TotExecuteBatchAwakeMergerBeg, 1)
@@ -396,15 +508,20 @@ func (m *collection) buildStackDirtyTop(b *batch, curStackTop *segmentStack) (
 		numDirtyTop = len(curStackTop.a)
 	}
 
-	rv = &segmentStack{options: m.options, refs: 1}
+	rv = &segmentStack{options: m.options, refs: 1, stats: m.stats}
 	rv.a = make([]Segment, 0, numDirtyTop+1)
 	if curStackTop != nil {
 		rv.a = append(rv.a, curStackTop.a...)
+		rv.cloneBase = curStackTop.cloneBase
 	}
 
 	rv.incarNum = m.incarNum
 
 	if b != nil {
+		if m.incarNum != 0 {
+			m.updateChildStats(b)
+		}
+
 		if b.Len() > 0 {
 			rv.a = append(rv.a, b.segment)
 		}
@@ -421,8 +538,9 @@ func (m *collection) buildStackDirtyTop(b *batch, curStackTop *segmentStack) (
 			if !exists { // Child collection being created for first time.
 				m.highestIncarNum++
 				childCollection = &collection{ // child4 in diagram above.
-					options:         m.options,
-					stats:           m.stats,
+					options:         m.options.withChildOptions(cBatch.childOptions),
+					stats:           &CollectionStats{},
+					histograms:      newChildHistograms(),
 					highestIncarNum: m.highestIncarNum,
 					incarNum:        m.highestIncarNum,
 				}
@@ -501,6 +619,58 @@ func (m *collection) updateStats(a *segment) {
 	m.histograms["MutationValBytes"].CallSyncEx(recordValLens)
 }
 
+// newChildHistograms returns the histograms of a child collection,
+// which are the subset of the histograms that a child collection
+// tracks on its own.
+func newChildHistograms() ghistogram.Histograms {
+	histograms := make(ghistogram.Histograms)
+	histograms["ExecuteBatchBytes"] =
+		ghistogram.NewNamedHistogram("ExecuteBatchBytes", 10, 4, 4)
+	histograms["ExecuteBatchOpsCount"] =
+		ghistogram.NewNamedHistogram("ExecuteBatchOpsCount", 10, 4, 4)
+	addReadHistograms(histograms)
+	return histograms
+}
+
+// addReadHistograms adds the histograms of the sampled Get()'s and
+// iterators of a collection.
+func addReadHistograms(histograms ghistogram.Histograms) {
+	for _, name := range getSourceHistograms {
+		histograms[name] = ghistogram.NewNamedHistogram(name, 10, 4, 4)
+	}
+	histograms["GetSegments"] =
+		ghistogram.NewNamedHistogram("GetSegments", 10, 2, 2)
+	histograms["IteratorStartUsecs"] =
+		ghistogram.NewNamedHistogram("IteratorStartUsecs", 10, 4, 4)
+	histograms["IteratorEntries"] =
+		ghistogram.NewNamedHistogram("IteratorEntries", 10, 4, 4)
+}
+
+// readHistogramsSampled returns true when the nth Get() or iterator
+// is to be recorded in the read histograms.
+func readHistogramsSampled(options *CollectionOptions, n uint64) bool {
+	sampleEvery := DefaultCollectionOptions.ReadHistogramsSampleEvery
+	if options != nil && options.ReadHistogramsSampleEvery > 0 {
+		sampleEvery = options.ReadHistogramsSampleEvery
+	}
+	return n%uint64(sampleEvery) == 0
+}
+
+// updateChildStats updates the stats/histograms of a child collection
+// given its part of an executed batch.
+func (m *collection) updateChildStats(b *batch) {
+	atomic.AddUint64(&m.stats.TotExecuteBatchBeg, 1)
+
+	if b.isEmpty() {
+		atomic.AddUint64(&m.stats.TotExecuteBatchEmpty, 1)
+	} else if m.histograms != nil {
+		m.histograms["ExecuteBatchOpsCount"].Add(uint64(b.Len()), 1)
+		m.histograms["ExecuteBatchBytes"].Add(b.totKeyByte+b.totValByte, 1)
+	}
+
+	atomic.AddUint64(&m.stats.TotExecuteBatchEnd, 1)
+}
+
 // ------------------------------------------------------
 
 // Log invokes the user's configured Log callback, if any, if the
@@ -544,7 +714,8 @@ func (m *collection) snapshot(skip uint32, cb func(*segmentStack),
 	gotLock bool) (*segmentStack, int, int, int, int) {
 	atomic.AddUint64(&m.stats.TotSnapshotInternalBeg, 1)
 
-	rv := &segmentStack{options: m.options, refs: 1}
+	rv := &segmentStack{options: m.options, refs: 1, stats: m.stats,
+		histograms: m.histograms}
 
 	heightDirtyTop := 0
 	heightDirtyMid := 0
@@ -608,10 +779,28 @@ func (m *collection) snapshot(skip uint32, cb func(*segmentStack),
 	return rv, heightClean, heightDirtyBase, heightDirtyMid, heightDirtyTop
 }
 
+// The sources of a get(), which are the stacks that resolved the key,
+// or that were consulted last when the key wasn't found.
+const (
+	getSourceDirty = iota
+	getSourceClean
+	getSourceLowerLevel
+)
+
+// getSourceHistograms are the names of the histograms of the Get()
+// latencies, indexed by the source of the get().
+var getSourceHistograms = []string{
+	"GetDirtyUsecs",
+	"GetCleanUsecs",
+	"GetLowerLevelUsecs",
+}
+
 // get() retrieves a value by iterating over all the segment stacks,
 // and then the lower level snapshot of the collection in pursuit of
-// the key, if not found, a nil val is returned.
-func (m *collection) get(key []byte, readOptions ReadOptions) ([]byte, error) {
+// the key, if not found, a nil val is returned.  The source of the
+// val is also returned.
+func (m *collection) get(key []byte, readOptions ReadOptions) (
+	[]byte, int, error) {
 	// Create a pointer to the lower level snapshot by incrementing it's ref
 	// count and then pointers to stackClean, stackDirtyBase, stackDirtyMid
 	// and stackDirtyTop for the collection within lock.
@@ -624,11 +813,17 @@ func (m *collection) get(key []byte, readOptions ReadOptions) ([]byte, error) {
 	stackDirtyMid := m.stackDirtyMid
 	stackDirtyTop := m.stackDirtyTop
 
+	readCacheGen := m.readCache.generation()
+
 	m.m.Unlock()
 
+	m.touchClean(stackClean, key)
+
 	var val []byte
 	var err error
 
+	source := getSourceDirty
+
 	// Avoid going to the lower-level snapshot for the
 	// stackDirtyTop/Mid/Base/Clean Get()s since their lower level snapshots
 	// may be modified concurrently by collection_merger/persister.
@@ -653,18 +848,153 @@ func (m *collection) get(key []byte, readOptions ReadOptions) ([]byte, error) {
 	}
 
 	if val == nil && err == nil && stackClean != nil {
+		source = getSourceClean
 		val, err = stackClean.Get(key, readOptionsSLL)
 	}
 
 	if lowerLevelSnapshot != nil {
 		if val == nil && err == nil {
-			val, err = lowerLevelSnapshot.Get(key, readOptions)
+			source = getSourceLowerLevel
+			err = canceled(readOptions.canceler)
+			if err != nil {
+				atomic.AddUint64(&m.stats.TotGetCanceled, 1)
+			} else {
+				val, err = m.lowerLevelGet(lowerLevelSnapshot, readCacheGen,
+					key, readOptions)
+			}
 		}
 
 		lowerLevelSnapshot.decRef()
 	}
 
-	return val, err
+	return val, source, err
+}
+
+// GetMulti retrieves the vals for multiple keys from the collection.
+func (m *collection) GetMulti(keys [][]byte, readOptions ReadOptions) (
+	[][]byte, error) {
+	if m.isClosed() {
+		return nil, ErrClosed
+	}
+
+	atomic.AddUint64(&m.stats.TotGetMulti, 1)
+	atomic.AddUint64(&m.stats.TotGetMultiKeys, uint64(len(keys)))
+
+	vals, err := m.getMulti(keys, readOptions)
+
+	if err != nil {
+		atomic.AddUint64(&m.stats.TotGetMultiErr, 1)
+	}
+
+	return vals, err
+}
+
+// getMulti() is the multi-key form of get(), where only the keys that
+// are still not found are looked up in each successive stack.
+func (m *collection) getMulti(keys [][]byte, readOptions ReadOptions) (
+	[][]byte, error) {
+	m.m.Lock()
+
+	lowerLevelSnapshot := m.lowerLevelSnapshot.addRef()
+	stacks := []*segmentStack{
+		m.stackDirtyTop,
+		m.stackDirtyMid,
+		m.stackDirtyBase,
+		m.stackClean,
+	}
+
+	readCacheGen := m.readCache.generation()
+
+	m.m.Unlock()
+
+	m.touchClean(stacks[3], keys...)
+
+	if lowerLevelSnapshot != nil {
+		defer lowerLevelSnapshot.decRef()
+	}
+
+	vals := make([][]byte, len(keys))
+
+	readOptionsSLL := readOptions
+	readOptionsSLL.SkipLowerLevel = true
+
+	// Like get(), a key that's not found (or has a nil val) in a
+	// stack is looked for in the next stack and finally in the
+	// lowerLevelSnapshot.
+	keyIdxs := sortedKeyIdxs(keys)
+
+	for _, stack := range stacks {
+		if stack == nil || len(keyIdxs) <= 0 {
+			continue
+		}
+
+		err := stack.getMulti(keys, keyIdxs, vals, len(stack.a)-1,
+			nil, readOptionsSLL)
+		if err != nil {
+			return nil, err
+		}
+
+		keyIdxs = nilValKeyIdxs(keyIdxs, vals)
+	}
+
+	if lowerLevelSnapshot != nil && len(keyIdxs) > 0 {
+		lowerKeys := make([][]byte, len(keyIdxs))
+		for i, keyIdx := range keyIdxs {
+			lowerKeys[i] = keys[keyIdx]
+		}
+
+		lowerVals, err := m.lowerLevelGetMulti(lowerLevelSnapshot,
+			readCacheGen, lowerKeys, readOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, keyIdx := range keyIdxs {
+			vals[keyIdx] = lowerVals[i]
+		}
+	}
+
+	return vals, nil
+}
+
+// nilValKeyIdxs filters the keyIdxs in-place, retaining only those
+// whose vals are still nil.
+func nilValKeyIdxs(keyIdxs []int, vals [][]byte) []int {
+	rv := keyIdxs[:0]
+	for _, keyIdx := range keyIdxs {
+		if vals[keyIdx] == nil {
+			rv = append(rv, keyIdx)
+		}
+	}
+	return rv
+}
+
+// withChildOptions returns the options of a child collection, which
+// are the same as the parent's options, co, unless the child
+// collection has its own ChildCollectionOptions, whose set (non-nil
+// or > 0) fields then override the parent's options.
+func (co *CollectionOptions) withChildOptions(
+	cco *ChildCollectionOptions) *CollectionOptions {
+	if cco == nil {
+		return co
+	}
+
+	rv := *co
+	if cco.MergeOperator != nil {
+		rv.MergeOperator = cco.MergeOperator
+	}
+	if cco.CompactionFilter != nil {
+		rv.CompactionFilter = cco.CompactionFilter
+	}
+	if cco.MaxDirtyOps > 0 {
+		rv.MaxDirtyOps = cco.MaxDirtyOps
+	}
+	if cco.MaxDirtyKeyValBytes > 0 {
+		rv.MaxDirtyKeyValBytes = cco.MaxDirtyKeyValBytes
+	}
+	rv.childOptions = cco
+
+	return &rv
 }
 
 func (m *collection) getOrInitChildStack(ss *segmentStack,
@@ -675,9 +1005,11 @@ func (m *collection) getOrInitChildStack(ss *segmentStack,
 	dstChildStack, exists := ss.childSegStacks[childCollName]
 	if !exists {
 		dstChildStack = &segmentStack{
-			options:  m.options,
-			refs:     1,
-			incarNum: m.incarNum,
+			options:    m.options,
+			refs:       1,
+			incarNum:   m.incarNum,
+			stats:      m.stats,
+			histograms: m.histograms,
 		}
 	}
 	return dstChildStack
@@ -692,7 +1024,12 @@ func (m *collection) appendChildLLSnapshot(dst *segmentStack,
 	for cName, childCollection := range m.childCollections {
 		dstChildStack := childCollection.getOrInitChildStack(dst, cName)
 		var childSnap Snapshot
-		if src != nil {
+		if childCollection.cloneBase != nil {
+			// A clone that's not yet persisted has the persisted
+			// entries of its source.
+			dstChildStack.cloneBase = childCollection.cloneBase
+			childSnap = childCollection.cloneBase.addRef()
+		} else if src != nil {
 			childSnap, _ = src.ChildCollectionSnapshot(cName)
 		}
 		dst.childSegStacks[cName] = childCollection.appendChildLLSnapshot(dstChildStack,
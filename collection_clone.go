@@ -0,0 +1,268 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package moss
+
+// execChildCollectionOpsLOCKED applies the renames and clones of
+// child collections that are recorded in a batch and its child
+// batches, and returns the stackDirtyTop that the rest of the batch
+// should be built upon.  The batch is checked beforehand, so either
+// all or none of the renames and clones are applied.
+func (m *collection) execChildCollectionOpsLOCKED(b *batch) (
+	*segmentStack, error) {
+	var lower Snapshot
+	if m.lowerLevelSnapshot != nil {
+		if _, ok := m.lowerLevelSnapshot.ss.(*Footer); !ok {
+			// Only a Store can reference the persisted segments of
+			// a source child collection from its clone.
+			return nil, ErrUnimplemented
+		}
+		lower = m.lowerLevelSnapshot
+	}
+
+	err := m.checkChildCollectionOps(b)
+	if err != nil {
+		return nil, err
+	}
+
+	// The stackClean is skipped, as its entries are already in the
+	// lower level snapshot.
+	stacks := []*segmentStack{m.stackDirtyBase, m.stackDirtyMid,
+		m.stackDirtyTop}
+
+	return m.applyChildCollectionOpsLOCKED(b, stacks, lower), nil
+}
+
+// checkChildCollectionOps returns an error if any of the renames or
+// clones of a batch, or of its child batches, would fail.
+func (m *collection) checkChildCollectionOps(b *batch) error {
+	// The child collections by name as the renames and clones are
+	// applied, where a clone has the same child collections as its
+	// source.
+	children := make(map[string]*collection, len(m.childCollections))
+	for cName, childCollection := range m.childCollections {
+		children[cName] = childCollection
+	}
+
+	for _, op := range b.childOps {
+		src, exists := children[op.srcName]
+		if !exists {
+			return ErrNoSuchCollection
+		}
+		if _, exists = children[op.dstName]; exists {
+			return ErrCollectionExists
+		}
+		children[op.dstName] = src
+		if op.rename {
+			delete(children, op.srcName)
+		}
+	}
+
+	for cName, cBatch := range b.childBatches {
+		if !cBatch.hasChildCollectionOps() {
+			continue
+		}
+		childCollection, exists := children[cName]
+		if !exists { // The child collection is created by the batch.
+			childCollection = &collection{}
+		}
+		err := childCollection.checkChildCollectionOps(cBatch)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyChildCollectionOpsLOCKED recursively applies the renames and
+// clones of a batch, given the base, mid and top segmentStacks and the
+// lower level snapshot of this collection.  The returned stack is a
+// copy of the top stack, which includes the segmentStacks of the
+// clones.
+func (m *collection) applyChildCollectionOpsLOCKED(b *batch,
+	stacks []*segmentStack, lower Snapshot) *segmentStack {
+	rv := &segmentStack{
+		options:  m.options,
+		refs:     1,
+		incarNum: m.incarNum,
+		stats:    m.stats,
+	}
+
+	top := stacks[len(stacks)-1]
+	if top != nil {
+		rv.a = top.a
+		rv.childSegStacks = make(map[string]*segmentStack,
+			len(top.childSegStacks)+len(b.childOps))
+		for cName, childStack := range top.childSegStacks {
+			rv.childSegStacks[cName] = childStack
+		}
+	} else {
+		rv.childSegStacks = make(map[string]*segmentStack, len(b.childOps))
+	}
+
+	stacks = append(append([]*segmentStack(nil),
+		stacks[:len(stacks)-1]...), rv)
+
+	for _, op := range b.childOps {
+		src := m.childCollections[op.srcName]
+
+		m.highestIncarNum++
+		dst, dstStack := src.clone(
+			childStacksOf(stacks, op.srcName, src.incarNum),
+			m.highestIncarNum)
+
+		dst.cloneBase = NewSnapshotWrapper(
+			src.lowerLevelChild(lower, op.srcName), nil)
+		dstStack.cloneBase = dst.cloneBase
+
+		if op.rename {
+			dst.stats = src.stats
+			dst.histograms = src.histograms
+			dstStack.stats = src.stats
+
+			delete(m.childCollections, op.srcName)
+		}
+
+		m.childCollections[op.dstName] = dst
+		rv.childSegStacks[op.dstName] = dstStack
+	}
+
+	for cName, cBatch := range b.childBatches {
+		if !cBatch.hasChildCollectionOps() {
+			continue
+		}
+		childCollection, exists := m.childCollections[cName]
+		if !exists {
+			continue
+		}
+
+		childLower := childCollection.lowerLevelChild(lower, cName)
+
+		rv.childSegStacks[cName] =
+			childCollection.applyChildCollectionOpsLOCKED(cBatch,
+				childStacksOf(stacks, cName, childCollection.incarNum),
+				childLower)
+
+		if childLower != nil {
+			childLower.Close()
+		}
+	}
+
+	return rv
+}
+
+// clone returns a copy of a child collection and its nested child
+// collections, along with a segmentStack that shares the given
+// stacks' segments of the child collection.  The nested child
+// collections keep their incarnation numbers, so that they match
+// those of the source's persisted child collections.
+func (m *collection) clone(stacks []*segmentStack, incarNum uint64) (
+	*collection, *segmentStack) {
+	rv := &collection{
+		options:         m.options,
+		stats:           &CollectionStats{},
+		histograms:      newChildHistograms(),
+		highestIncarNum: m.highestIncarNum,
+		incarNum:        incarNum,
+	}
+
+	rvStack := &segmentStack{
+		options:  m.options,
+		refs:     1,
+		incarNum: incarNum,
+		stats:    rv.stats,
+	}
+	for _, ss := range stacks {
+		if ss != nil {
+			rvStack.a = append(rvStack.a, ss.a...)
+		}
+	}
+
+	for cName, childCollection := range m.childCollections {
+		child, childStack := childCollection.clone(
+			childStacksOf(stacks, cName, childCollection.incarNum),
+			childCollection.incarNum)
+
+		child.cloneBase = childCollection.cloneBase.addRef()
+		childStack.cloneBase = child.cloneBase
+
+		if len(rv.childCollections) == 0 {
+			rv.childCollections = make(map[string]*collection)
+		}
+		rv.childCollections[cName] = child
+
+		if len(rvStack.childSegStacks) == 0 {
+			rvStack.childSegStacks = make(map[string]*segmentStack)
+		}
+		rvStack.childSegStacks[cName] = childStack
+	}
+
+	return rv, rvStack
+}
+
+// lowerLevelChild returns the lower level snapshot of a child
+// collection, given its parent's lower level snapshot, or nil.  The
+// caller must Close() the returned snapshot.
+func (m *collection) lowerLevelChild(lower Snapshot,
+	childCollectionName string) Snapshot {
+	if m.cloneBase != nil {
+		return m.cloneBase.addRef()
+	}
+	if lower == nil {
+		return nil
+	}
+
+	rv, _ := lower.ChildCollectionSnapshot(childCollectionName)
+	if f, ok := rv.(*Footer); ok && f.incarNum != m.incarNum {
+		// The persisted child collection is from a prior incarnation.
+		f.Close()
+		return nil
+	}
+	return rv
+}
+
+// childStacksOf returns the segmentStacks of a child collection from
+// each of the given segmentStacks, or nil where there's none.
+func childStacksOf(stacks []*segmentStack, childCollectionName string,
+	incarNum uint64) []*segmentStack {
+	rv := make([]*segmentStack, len(stacks))
+	for i, ss := range stacks {
+		if ss == nil {
+			continue
+		}
+		childStack, exists := ss.childSegStacks[childCollectionName]
+		if exists && childStack.incarNum == incarNum {
+			rv[i] = childStack
+		}
+	}
+	return rv
+}
+
+// releasePersistedCloneBasesLOCKED releases the cloneBase of each
+// child collection whose clone was persisted from the given stack, so
+// the child collection's own persisted data is then used.
+func (m *collection) releasePersistedCloneBasesLOCKED(ss *segmentStack) {
+	for cName, childStack := range ss.childSegStacks {
+		childCollection, exists := m.childCollections[cName]
+		if !exists || childCollection.incarNum != childStack.incarNum {
+			continue
+		}
+
+		if childStack.cloneBase != nil &&
+			childStack.cloneBase == childCollection.cloneBase {
+			childCollection.cloneBase.Close()
+			childCollection.cloneBase = nil
+		}
+
+		childCollection.releasePersistedCloneBasesLOCKED(childStack)
+	}
+}
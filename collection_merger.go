@@ -140,9 +140,6 @@ OUTER:
 		m.fireEvent(EventKindMergerProgress, time.Now().Sub(startTime))
 	}
 
-	// TODO: Concurrent merging of disjoint slices of stackDirtyMid
-	// instead of the current, single-threaded merger?
-	//
 	// TODO: A busy merger means no feeding of the persister?
 	//
 	// TODO: Delay merger until lots of deletion tombstones?
@@ -167,7 +164,8 @@ func (m *collection) mergerWaitForWork(pings []ping) (
 
 	m.m.Lock()
 
-	if m.stackDirtyTop == nil || len(m.stackDirtyTop.a) <= 0 {
+	// The stackDirtyTop might only have child collection segments.
+	if m.stackDirtyTop == nil || m.stackDirtyTop.isEmpty() {
 		m.waitDirtyIncomingCh = make(chan struct{})
 		waitDirtyIncomingCh = m.waitDirtyIncomingCh
 	}
@@ -307,6 +305,12 @@ func (m *collection) mergerNotifyPersister() {
 		}
 	}
 
+	if waitDirtyOutgoingCh == nil &&
+		m.childrenOverDirtyLimitsLOCKED(m.stackDirtyTop, m.stackDirtyMid,
+			m.stackDirtyBase) {
+		waitDirtyOutgoingCh = m.waitDirtyOutgoingCh
+	}
+
 	m.m.Unlock()
 
 	if waitDirtyOutgoingCh != nil {
@@ -326,3 +330,43 @@ func (m *collection) mergerNotifyPersister() {
 		atomic.AddUint64(&m.stats.TotMergerWaitOutgoingSkip, 1)
 	}
 }
+
+// childrenOverDirtyLimitsLOCKED returns true when any child collection
+// that has its own dirty limits, from its ChildCollectionOptions, has
+// more dirty ops or key-val bytes in the given dirty stacks than
+// allowed.
+func (m *collection) childrenOverDirtyLimitsLOCKED(
+	dirtyStacks ...*segmentStack) bool {
+	for cName, childCollection := range m.childCollections {
+		childStacks := make([]*segmentStack, 0, len(dirtyStacks))
+		for _, dirtyStack := range dirtyStacks {
+			if dirtyStack == nil {
+				continue
+			}
+			childStack, exists := dirtyStack.childSegStacks[cName]
+			if exists && childStack.incarNum == childCollection.incarNum {
+				childStacks = append(childStacks, childStack)
+			}
+		}
+
+		co := childCollection.options
+		if co != m.options && (co.MaxDirtyOps > 0 || co.MaxDirtyKeyValBytes > 0) {
+			sssDirty := &SegmentStackStats{}
+			for _, childStack := range childStacks {
+				childStack.Stats().AddTo(sssDirty)
+			}
+
+			if (co.MaxDirtyOps > 0 && sssDirty.CurOps > co.MaxDirtyOps) ||
+				(co.MaxDirtyKeyValBytes > 0 &&
+					sssDirty.CurBytes > co.MaxDirtyKeyValBytes) {
+				return true
+			}
+		}
+
+		if childCollection.childrenOverDirtyLimitsLOCKED(childStacks...) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,262 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package moss
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// memoryQuotaLOCKED returns the MemoryQuota of the collection, or 0
+// when there's no quota or when the quota has no effect.
+func (m *collection) memoryQuotaLOCKED() uint64 {
+	if m.options.LowerLevelUpdate == nil {
+		return 0
+	}
+	return m.options.MemoryQuota
+}
+
+// memoryBytesLOCKED returns the key-val bytes of the collection's
+// dirty segments, and also of its clean segments when withClean is
+// true, which count towards the MemoryQuota.
+func (m *collection) memoryBytesLOCKED(withClean bool) uint64 {
+	rv := m.stackDirtyTop.keyValBytes() +
+		m.stackDirtyMid.keyValBytes() +
+		m.stackDirtyBase.keyValBytes()
+	if withClean {
+		rv += m.stackClean.keyValBytes()
+	}
+	return rv
+}
+
+// keyValBytes returns the key-val bytes of a segmentStack, including
+// the segmentStacks of its child collections.
+func (ss *segmentStack) keyValBytes() (rv uint64) {
+	if ss == nil {
+		return 0
+	}
+	for _, seg := range ss.a {
+		nk, nv := seg.NumKeyValBytes()
+		rv += nk + nv
+	}
+	for _, childStack := range ss.childSegStacks {
+		rv += childStack.keyValBytes()
+	}
+	return rv
+}
+
+// overDirtyMemoryQuotaLOCKED returns true when the dirty segments
+// alone are over the MemoryQuota.
+func (m *collection) overDirtyMemoryQuotaLOCKED() bool {
+	quota := m.memoryQuotaLOCKED()
+	return quota > 0 && m.memoryBytesLOCKED(false) > quota
+}
+
+// ------------------------------------------------------
+
+// evictCleanLOCKED evicts segments from the stackClean, as chosen by
+// the EvictionPolicy, until the collection is within its MemoryQuota
+// or no more segments can be evicted.  The previous stackClean is
+// returned when it was replaced, which the caller should Close()
+// after unlocking.
+func (m *collection) evictCleanLOCKED() *segmentStack {
+	quota := m.memoryQuotaLOCKED()
+	if quota <= 0 || m.stackClean == nil {
+		return nil
+	}
+
+	used := m.memoryBytesLOCKED(true)
+	if used <= quota {
+		return nil
+	}
+
+	stackClean := m.stackClean.copyTree()
+
+	for used > quota {
+		c := m.nextEvictionCandidate(stackClean)
+		if c == nil {
+			break
+		}
+
+		c.ss.a = append(c.ss.a[:c.pos:c.pos], c.ss.a[c.pos+1:]...)
+
+		used -= c.bytes
+
+		atomic.AddUint64(&m.stats.TotEvictSegments, 1)
+		atomic.AddUint64(&m.stats.TotEvictBytes, c.bytes)
+	}
+
+	m.invalidateLatestSnapshotLOCKED()
+
+	rv := m.stackClean
+	m.stackClean = stackClean
+	return rv
+}
+
+// An evictionCandidate is a clean segment that can be evicted.
+type evictionCandidate struct {
+	ss    *segmentStack
+	pos   int
+	seg   Segment
+	bytes uint64
+	tick  uint64 // The tick of the segment's most recent read.
+}
+
+// nextEvictionCandidate returns the segment that should be evicted
+// next from a stackClean, or nil when none can be evicted.  The
+// candidate with the oldest read is chosen, and then the largest.
+func (m *collection) nextEvictionCandidate(
+	stackClean *segmentStack) *evictionCandidate {
+	var rv *evictionCandidate
+
+	stackClean.visitTree(func(ss *segmentStack) {
+		n := 1
+		if m.options.EvictionPolicy == EvictLRURange {
+			n = len(ss.a)
+		}
+
+		for pos := 0; pos < n && pos < len(ss.a); pos++ {
+			if !ss.evictable(pos) {
+				continue
+			}
+
+			seg := ss.a[pos]
+			nk, nv := seg.NumKeyValBytes()
+			c := &evictionCandidate{
+				ss:    ss,
+				pos:   pos,
+				seg:   seg,
+				bytes: nk + nv,
+			}
+			if a, ok := seg.(*segment); ok {
+				c.tick = atomic.LoadUint64(&a.lastRead)
+			}
+
+			if rv == nil || c.tick < rv.tick ||
+				(c.tick == rv.tick && c.bytes > rv.bytes) {
+				rv = c
+			}
+		}
+	})
+
+	return rv
+}
+
+// evictable returns true when the segment at pos can be evicted from
+// a stack of clean segments, which is when no older segment in the
+// stack might have any of its keys, as the older segment would then
+// shadow the persisted entries of those keys.
+func (ss *segmentStack) evictable(pos int) bool {
+	if pos == 0 {
+		return true
+	}
+
+	ss.ensureSorted(0, pos)
+
+	kMin, kMax, ok := segmentKeyRange(ss.a[pos])
+	if !ok {
+		return false
+	}
+
+	for _, older := range ss.a[:pos] {
+		oMin, oMax, ok := segmentKeyRange(older)
+		if !ok ||
+			(bytes.Compare(oMin, kMax) <= 0 && bytes.Compare(kMin, oMax) <= 0) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// segmentKeyRange returns the smallest and largest keys of a sorted
+// segment, where ok is false if those aren't known.
+func segmentKeyRange(seg Segment) (kMin, kMax []byte, ok bool) {
+	a, ok := seg.(*segment)
+	if !ok || a.Len() <= 0 {
+		return nil, nil, false
+	}
+
+	_, kMin, _ = a.getOperationKeyVal(0)
+	_, kMax, _ = a.getOperationKeyVal(a.Len() - 1)
+
+	return kMin, kMax, true
+}
+
+// copyTree returns a copy of a segmentStack and of its child
+// collection segmentStacks, so that segments can be removed from the
+// copy without affecting any snapshots that share the original.
+func (ss *segmentStack) copyTree() *segmentStack {
+	rv := &segmentStack{
+		options:   ss.options,
+		a:         append([]Segment(nil), ss.a...),
+		refs:      1,
+		incarNum:  ss.incarNum,
+		cloneBase: ss.cloneBase,
+		stats:     ss.stats,
+	}
+
+	ss.m.Lock()
+	rv.lowerLevelSnapshot = ss.lowerLevelSnapshot.addRef()
+	ss.m.Unlock()
+
+	if len(ss.childSegStacks) > 0 {
+		rv.childSegStacks = make(map[string]*segmentStack,
+			len(ss.childSegStacks))
+		for cName, childStack := range ss.childSegStacks {
+			rv.childSegStacks[cName] = childStack.copyTree()
+		}
+	}
+
+	return rv
+}
+
+// visitTree invokes the visitor on a segmentStack and recursively on
+// its child collection segmentStacks.
+func (ss *segmentStack) visitTree(visitor func(*segmentStack)) {
+	visitor(ss)
+	for _, childStack := range ss.childSegStacks {
+		childStack.visitTree(visitor)
+	}
+}
+
+// ------------------------------------------------------
+
+// touchClean records a read of the given keys for the segments of a
+// stackClean whose key ranges include any of the keys, when the
+// EvictionPolicy needs them.  The reads are recorded as atomic stamps
+// on the segments, so the collection's lock isn't held, and the
+// stackClean should be one that the caller grabbed under the lock.
+func (m *collection) touchClean(stackClean *segmentStack, keys ...[]byte) {
+	if stackClean == nil || len(stackClean.a) <= 0 ||
+		m.options.EvictionPolicy != EvictLRURange ||
+		m.options.MemoryQuota <= 0 || m.options.LowerLevelUpdate == nil {
+		return
+	}
+
+	tick := atomic.AddUint64(&m.cleanReadTick, 1)
+
+	stackClean.ensureSorted(0, len(stackClean.a)-1)
+
+	for _, seg := range stackClean.a {
+		kMin, kMax, ok := segmentKeyRange(seg)
+		if !ok {
+			continue
+		}
+		for _, key := range keys {
+			if bytes.Compare(kMin, key) <= 0 && bytes.Compare(key, kMax) <= 0 {
+				atomic.StoreUint64(&seg.(*segment).lastRead, tick)
+				break
+			}
+		}
+	}
+}
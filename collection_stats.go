@@ -26,11 +26,65 @@ func (m *collection) Stats() (*CollectionStats, error) {
 
 	m.m.Lock()
 	m.statsSegmentsLOCKED(rv)
+	statsPersisted(rv, m.lowerLevelSnapshot, "")
 	m.m.Unlock()
 
 	return rv, nil
 }
 
+// ChildCollectionStats returns stats for a child collection.
+func (m *collection) ChildCollectionStats(childCollectionName string) (
+	*CollectionStats, error) {
+	rv := &CollectionStats{}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	childCollection, exists := m.childCollections[childCollectionName]
+	if !exists {
+		return nil, ErrNoSuchCollection
+	}
+
+	childCollection.stats.AtomicCopyTo(rv)
+
+	childStackStats := func(ss *segmentStack) *SegmentStackStats {
+		if ss == nil {
+			return nil
+		}
+		childStack, exists := ss.childSegStacks[childCollectionName]
+		if !exists || childStack.incarNum != childCollection.incarNum {
+			return nil
+		}
+		return childStack.Stats()
+	}
+
+	statsSegments(rv,
+		childStackStats(m.stackDirtyTop),
+		childStackStats(m.stackDirtyMid),
+		childStackStats(m.stackDirtyBase),
+		childStackStats(m.stackClean))
+
+	statsPersisted(rv, m.lowerLevelSnapshot, childCollectionName)
+
+	return rv, nil
+}
+
+// ChildCollectionHistograms returns a snapshot of the histograms for
+// a child collection.
+func (m *collection) ChildCollectionHistograms(childCollectionName string) (
+	ghistogram.Histograms, error) {
+	m.m.Lock()
+	childCollection, exists := m.childCollections[childCollectionName]
+	m.m.Unlock()
+	if !exists {
+		return nil, ErrNoSuchCollection
+	}
+
+	histogramsSnapshot := make(ghistogram.Histograms)
+	histogramsSnapshot.AddAll(childCollection.histograms)
+	return histogramsSnapshot, nil
+}
+
 func (m *collection) Histograms() ghistogram.Histograms {
 	histogramsSnapshot := make(ghistogram.Histograms)
 	histogramsSnapshot.AddAll(m.histograms)
@@ -60,6 +114,17 @@ func (m *collection) statsSegmentsLOCKED(rv *CollectionStats) {
 		sssClean = m.stackClean.Stats()
 	}
 
+	statsSegments(rv, sssDirtyTop, sssDirtyMid, sssDirtyBase, sssClean)
+
+	rv.CurMemoryBytes = m.memoryBytesLOCKED(true)
+
+	rv.CurReadCacheEntries, rv.CurReadCacheBytes = m.readCache.stats()
+}
+
+// statsSegments fills in the segment related stats from the stats of
+// the stacks, which may be nil.
+func statsSegments(rv *CollectionStats,
+	sssDirtyTop, sssDirtyMid, sssDirtyBase, sssClean *SegmentStackStats) {
 	sssDirty := &SegmentStackStats{}
 	sssDirtyTop.AddTo(sssDirty)
 	sssDirtyMid.AddTo(sssDirty)
@@ -94,6 +159,41 @@ func (m *collection) statsSegmentsLOCKED(rv *CollectionStats) {
 	}
 }
 
+// statsPersisted fills in the persisted segment stats when the
+// lower-level snapshot is from a Store, where a non-empty
+// childCollectionName selects a child collection's segments.
+func statsPersisted(rv *CollectionStats, w *SnapshotWrapper,
+	childCollectionName string) {
+	if w == nil {
+		return
+	}
+
+	w.m.Lock()
+	footer, ok := w.ss.(*Footer)
+	w.m.Unlock()
+	if !ok || footer == nil {
+		return
+	}
+
+	if childCollectionName != "" {
+		footer, ok = footer.ChildFooters[childCollectionName]
+		if !ok || footer == nil {
+			return
+		}
+	}
+
+	// The footer's SegmentLocs are released when its last ref is
+	// dropped, which might be concurrent with a persistence.
+	footer.m.Lock()
+	for i := range footer.SegmentLocs {
+		sloc := &footer.SegmentLocs[i]
+		rv.CurPersistedOps += uint64(sloc.TotOps())
+		rv.CurPersistedBytes += sloc.KvsBytes + sloc.BufBytes
+		rv.CurPersistedSegments++
+	}
+	footer.m.Unlock()
+}
+
 // AtomicCopyTo copies stats from s to r (from source to result).
 func (s *CollectionStats) AtomicCopyTo(r *CollectionStats) {
 	rve := reflect.ValueOf(r).Elem()
@@ -110,3 +210,14 @@ func (s *CollectionStats) AtomicCopyTo(r *CollectionStats) {
 		}
 	}
 }
+
+// AddTo adds the values from this CollectionStats to the dest
+// CollectionStats, such as to sum the stats of multiple collections.
+func (s *CollectionStats) AddTo(dest *CollectionStats) {
+	dve := reflect.ValueOf(dest).Elem()
+	sve := reflect.ValueOf(s).Elem()
+	for i := 0; i < sve.NumField(); i++ {
+		dvef := dve.Field(i)
+		dvef.SetUint(dvef.Uint() + sve.Field(i).Uint())
+	}
+}
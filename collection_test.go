@@ -16,6 +16,7 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -1408,3 +1409,478 @@ func TestCollectionGet(t *testing.T) {
 		t.Errorf("Unexpected number of Get errors!")
 	}
 }
+
+func TestCollectionGetMulti(t *testing.T) {
+	mo := &MergeOperatorStringAppend{Sep: ":"}
+
+	m, _ := NewCollection(CollectionOptions{MergeOperator: mo})
+	m.Start()
+	defer m.Close()
+
+	b, _ := m.NewBatch(0, 0)
+	for i := 0; i < 10; i++ {
+		b.Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i)))
+	}
+	err := m.ExecuteBatch(b, WriteOptions{})
+	if err != nil {
+		t.Errorf("Expected ExecuteBatch() to succeed!")
+	}
+	b.Close()
+
+	b, _ = m.NewBatch(0, 0)
+	b.Del([]byte("k3"))
+	b.Merge([]byte("k5"), []byte("m5"))
+	b.Set([]byte("k7"), []byte("n7"))
+	err = m.ExecuteBatch(b, WriteOptions{})
+	if err != nil {
+		t.Errorf("Expected ExecuteBatch() to succeed!")
+	}
+	b.Close()
+
+	keys := [][]byte{
+		[]byte("k9"), []byte("x"), []byte("k5"), []byte("k3"),
+		[]byte("k0"), []byte("k7"), []byte("k9"), []byte("a"),
+	}
+	exp := []string{"v9", "", "v5:m5", "", "v0", "n7", "v9", ""}
+
+	check := func(vals [][]byte) {
+		if len(vals) != len(keys) {
+			t.Fatalf("expected %d vals, got %d", len(keys), len(vals))
+		}
+		for i, val := range vals {
+			if exp[i] == "" && val != nil {
+				t.Errorf("expected nil val for key: %s, got: %s", keys[i], val)
+			}
+			if string(val) != exp[i] {
+				t.Errorf("expected val: %s for key: %s, got: %s",
+					exp[i], keys[i], val)
+			}
+		}
+	}
+
+	vals, err := m.GetMulti(keys, ReadOptions{})
+	if err != nil {
+		t.Errorf("expected GetMulti() to succeed, err: %v", err)
+	}
+	check(vals)
+
+	ss, _ := m.Snapshot()
+	vals, err = ss.GetMulti(keys, ReadOptions{})
+	if err != nil {
+		t.Errorf("expected Snapshot.GetMulti() to succeed, err: %v", err)
+	}
+	check(vals)
+	ss.Close()
+
+	vals, err = m.GetMulti(nil, ReadOptions{})
+	if err != nil || len(vals) != 0 {
+		t.Errorf("expected empty GetMulti() to succeed, err: %v", err)
+	}
+
+	s, _ := m.Stats()
+	if s.TotGetMulti != 2 || s.TotGetMultiKeys != uint64(len(keys)) ||
+		s.TotGetMultiErr != 0 {
+		t.Errorf("unexpected GetMulti stats: %+v", s)
+	}
+}
+
+func TestCollectionEstimateRange(t *testing.T) {
+	m, _ := NewCollection(CollectionOptions{})
+	m.Start()
+	defer m.Close()
+
+	b, _ := m.NewBatch(0, 0)
+	for i := 0; i < 100; i++ {
+		b.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("vv"))
+	}
+	m.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	ss, _ := m.Snapshot()
+	re, err := ss.EstimateRange([]byte("k010"), []byte("k030"))
+	if err != nil {
+		t.Fatalf("expected EstimateRange() to work, err: %v", err)
+	}
+	exp := RangeEstimate{Ops: 20, MaxSegmentOps: 20,
+		KeyBytes: 20 * 4, ValBytes: 20 * 2, Segments: 1}
+	if *re != exp {
+		t.Errorf("expected exact estimate for single segment, got: %+v", re)
+	}
+	re, _ = ss.EstimateRange([]byte("x"), nil)
+	if *re != (RangeEstimate{}) {
+		t.Errorf("expected empty estimate, got: %+v", re)
+	}
+	ss.Close()
+
+	// A second, overlapping batch means Ops is an upper bound and
+	// MaxSegmentOps is a lower bound.
+	b, _ = m.NewBatch(0, 0)
+	for i := 20; i < 40; i++ {
+		b.Del([]byte(fmt.Sprintf("k%03d", i)))
+	}
+	m.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	ss, _ = m.Snapshot()
+	defer ss.Close()
+
+	re, _ = ss.EstimateRange([]byte("k010"), []byte("k030"))
+	if re.Ops != 30 || re.MaxSegmentOps != 20 || re.Segments != 2 {
+		t.Errorf("unexpected estimate with overlapping segments: %+v", re)
+	}
+
+	re, _ = ss.EstimateRange(nil, nil)
+	if re.Ops != 120 || re.MaxSegmentOps != 100 ||
+		re.KeyBytes != 120*4 || re.ValBytes != 100*2 {
+		t.Errorf("unexpected estimate for full range: %+v", re)
+	}
+}
+
+func TestCollectionTTL(t *testing.T) {
+	m, _ := NewCollection(CollectionOptions{})
+	m.Start()
+	defer m.Close()
+
+	b, _ := m.NewBatch(0, 0)
+	b.Set([]byte("k0"), []byte("v0"))
+	b.SetWithTTL([]byte("k1"), []byte("v1"), time.Hour)
+	b.SetWithTTL([]byte("k2"), []byte("v2"), time.Nanosecond)
+	b.SetWithTTL([]byte("k3"), []byte("v3"), 0)
+	m.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	b, _ = m.NewBatch(0, 0)
+	b.SetWithTTL([]byte("k4"), []byte("v4"), time.Nanosecond)
+	b.SetWithTTL([]byte("k5"), []byte("v5"), time.Hour)
+	m.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	time.Sleep(time.Millisecond)
+
+	keys := [][]byte{
+		[]byte("k0"), []byte("k1"), []byte("k2"),
+		[]byte("k3"), []byte("k4"), []byte("k5"),
+	}
+	exp := []string{"v0", "v1", "", "v3", "", "v5"}
+
+	check := func(msg string) {
+		for i, key := range keys {
+			val, err := m.Get(key, ReadOptions{})
+			if err != nil || string(val) != exp[i] {
+				t.Errorf("%s, expected Get() val: %s for key: %s, got: %s, err: %v",
+					msg, exp[i], key, val, err)
+			}
+		}
+
+		vals, err := m.GetMulti(keys, ReadOptions{})
+		if err != nil || len(vals) != len(keys) {
+			t.Fatalf("%s, expected GetMulti() to succeed, err: %v", msg, err)
+		}
+		for i, val := range vals {
+			if string(val) != exp[i] {
+				t.Errorf("%s, expected GetMulti() val: %s for key: %s, got: %s",
+					msg, exp[i], keys[i], val)
+			}
+		}
+
+		ss, _ := m.Snapshot()
+		iter, err := ss.StartIterator(nil, nil, IteratorOptions{})
+		if err != nil {
+			t.Fatalf("%s, expected StartIterator() to succeed, err: %v", msg, err)
+		}
+		var got []string
+		for {
+			k, v, err := iter.Current()
+			if err != nil {
+				break
+			}
+			got = append(got, string(k)+"="+string(v))
+			if iter.Next() != nil {
+				break
+			}
+		}
+		iter.Close()
+		ss.Close()
+
+		gotStr := strings.Join(got, ",")
+		if gotStr != "k0=v0,k1=v1,k3=v3,k5=v5" {
+			t.Errorf("%s, unexpected iteration: %s", msg, gotStr)
+		}
+	}
+
+	check("before merge")
+
+	// The background merger might have already dropped the expired
+	// entries before they could be hidden.
+	s, _ := m.Stats()
+	if s.TotExpiredHidden == 0 && s.TotExpiredDropped == 0 {
+		t.Errorf("expected some expired entries to be hidden")
+	}
+
+	m.(*collection).NotifyMerger("mergeAll", true)
+
+	check("after merge")
+
+	s, _ = m.Stats()
+	if s.TotExpiredDropped != 2 {
+		t.Errorf("expected 2 expired entries to be dropped, got: %d",
+			s.TotExpiredDropped)
+	}
+
+	// The merged segment keeps the expiry of the unexpired entries,
+	// and turns the expired entries into deletions.
+	ss, _ := m.Snapshot()
+	seg, ok := ss.(*segmentStack).a[0].(*segment)
+	if !ok || len(ss.(*segmentStack).a) != 1 {
+		t.Fatalf("expected a single merged segment")
+	}
+	for pos := 0; pos < seg.Len(); pos++ {
+		op, k, _ := seg.getOperationKeyVal(pos)
+		switch string(k) {
+		case "k1", "k5":
+			if op != operationSetTTL {
+				t.Errorf("expected key: %s to keep its expiry", k)
+			}
+		case "k2", "k4":
+			if op != OperationDel {
+				t.Errorf("expected key: %s to be deleted", k)
+			}
+		}
+	}
+	ss.Close()
+}
+
+func TestMergerWorkers(t *testing.T) {
+	m, _ := NewCollection(CollectionOptions{MergerWorkers: 4})
+	m.Start()
+	defer m.Close()
+
+	mc := m.(*collection)
+
+	numKeys := 40000
+
+	exec := func(start, step int, val string) {
+		b, _ := m.NewBatch(0, 0)
+		for i := start; i < numKeys; i += step {
+			key := []byte(fmt.Sprintf("%08d", (i*7919)%numKeys))
+			if val == "" {
+				b.Del(key)
+			} else {
+				b.Set(key, []byte(val))
+			}
+		}
+		err := m.ExecuteBatch(b, WriteOptions{})
+		if err != nil {
+			t.Fatalf("expected batch, err: %v", err)
+		}
+		b.Close()
+	}
+
+	exec(0, 1, "a")
+	exec(0, 2, "b")
+	exec(0, 5, "")
+
+	mc.NotifyMerger("mergeAll", true)
+
+	stats, _ := m.Stats()
+	if stats.TotMergerInternalRanges < 2 {
+		t.Errorf("expected merged ranges, stats: %+v", stats)
+	}
+	if stats.CurDirtyMidSegments < 2 {
+		t.Errorf("expected segments for the ranges, stats: %+v", stats)
+	}
+
+	expVal := func(k int) string {
+		if k%5 == 0 {
+			return ""
+		}
+		if k%2 == 0 {
+			return "b"
+		}
+		return "a"
+	}
+
+	ss, _ := m.Snapshot()
+	defer ss.Close()
+
+	for i := 0; i < numKeys; i++ {
+		k := (i * 7919) % numKeys
+		v, err := ss.Get([]byte(fmt.Sprintf("%08d", k)), ReadOptions{})
+		if err != nil || string(v) != expVal(i) {
+			t.Fatalf("i: %d, expected: %q, got: %q, err: %v",
+				i, expVal(i), v, err)
+		}
+	}
+
+	iter, _ := ss.StartIterator(nil, nil, IteratorOptions{})
+	defer iter.Close()
+
+	var prevKey []byte
+	numIterated := 0
+	for {
+		k, _, err := iter.Current()
+		if err == ErrIteratorDone {
+			break
+		}
+		if prevKey != nil && strings.Compare(string(prevKey), string(k)) >= 0 {
+			t.Fatalf("expected ascending keys, prevKey: %s, k: %s", prevKey, k)
+		}
+		prevKey = append(prevKey[:0], k...)
+		numIterated++
+		iter.Next()
+	}
+	if numIterated != numKeys-numKeys/5 {
+		t.Errorf("expected %d iterated, got: %d",
+			numKeys-numKeys/5, numIterated)
+	}
+}
+
+func TestCollectionReadHistograms(t *testing.T) {
+	m, _ := NewCollection(CollectionOptions{ReadHistogramsSampleEvery: 1})
+	m.Start()
+
+	b, _ := m.NewBatch(0, 0)
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("%04d", i))
+		b.Set(k, k)
+	}
+	m.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	for i := 0; i < 10; i++ {
+		m.Get([]byte(fmt.Sprintf("%04d", i*20)), ReadOptions{})
+	}
+
+	h := m.Histograms()
+
+	totGets := h["GetDirtyUsecs"].TotCount + h["GetCleanUsecs"].TotCount +
+		h["GetLowerLevelUsecs"].TotCount
+	if totGets != 10 || h["GetLowerLevelUsecs"].TotCount != 0 {
+		t.Errorf("expected 10 sampled gets, got: %s", h)
+	}
+	if h["GetSegments"].TotCount != 10 || h["GetSegments"].TotDataPoint < 5 {
+		t.Errorf("expected segments probed, got: %+v", h["GetSegments"])
+	}
+
+	ss, _ := m.Snapshot()
+	iter, _ := ss.StartIterator(nil, nil, IteratorOptions{})
+	for {
+		_, _, err := iter.Current()
+		if err != nil {
+			break
+		}
+		iter.Next()
+	}
+	iter.Close()
+	ss.Close()
+
+	h = m.Histograms()
+	if h["IteratorStartUsecs"].TotCount != 1 ||
+		h["IteratorEntries"].TotCount != 1 ||
+		h["IteratorEntries"].TotDataPoint != 100 {
+		t.Errorf("expected a sampled iterator, got: %s", h)
+	}
+
+	m.Close()
+
+	// By default, only some reads are sampled.
+	m, _ = NewCollection(CollectionOptions{})
+	m.Start()
+
+	for i := 0; i < 32; i++ {
+		m.Get([]byte("not-there"), ReadOptions{})
+	}
+
+	h = m.Histograms()
+	if h["GetDirtyUsecs"].TotCount != 32/
+		uint64(DefaultCollectionOptions.ReadHistogramsSampleEvery) {
+		t.Errorf("expected sampled gets, got: %+v", h["GetDirtyUsecs"])
+	}
+
+	m.Close()
+}
+
+func TestCollectionStallEvents(t *testing.T) {
+	var mu sync.Mutex
+	durations := map[EventKind][]time.Duration{}
+
+	onEvent := func(e Event) {
+		mu.Lock()
+		durations[e.Kind] = append(durations[e.Kind], e.Duration)
+		mu.Unlock()
+	}
+
+	exec := func(m Collection, key string) chan error {
+		errCh := make(chan error, 1)
+		go func() {
+			b, _ := m.NewBatch(0, 0)
+			b.Set([]byte(key), make([]byte, 100))
+			errCh <- m.ExecuteBatch(b, WriteOptions{})
+			b.Close()
+		}()
+		return errCh
+	}
+
+	// Without a started merger, the 2nd batch stalls.
+	m, _ := NewCollection(CollectionOptions{
+		MaxPreMergerBatches: 1,
+		OnEvent:             onEvent,
+	})
+
+	if err := <-exec(m, "a"); err != nil {
+		t.Fatalf("expected 1st batch, err: %v", err)
+	}
+
+	errCh := exec(m, "b")
+	time.Sleep(50 * time.Millisecond)
+	m.Start()
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("expected 2nd batch, err: %v", err)
+	}
+
+	m.Close()
+
+	mu.Lock()
+	if len(durations[EventKindBatchExecuteWait]) != 1 ||
+		durations[EventKindBatchExecuteWait][0] < 40*time.Millisecond ||
+		len(durations[EventKindBatchExecuteQuotaWait]) != 0 {
+		t.Errorf("expected a batch execute wait, got: %v", durations)
+	}
+	durations = map[EventKind][]time.Duration{}
+	mu.Unlock()
+
+	// While the persister is held up, the 2nd batch is over the quota.
+	unblockCh := make(chan struct{})
+
+	m, _ = NewCollection(CollectionOptions{
+		MemoryQuota: 100,
+		LowerLevelUpdate: func(higher Snapshot) (Snapshot, error) {
+			<-unblockCh
+			return nil, nil
+		},
+		OnEvent: onEvent,
+	})
+	m.Start()
+
+	if err := <-exec(m, "a"); err != nil {
+		t.Fatalf("expected 1st batch, err: %v", err)
+	}
+
+	errCh = exec(m, "b")
+	time.Sleep(50 * time.Millisecond)
+	close(unblockCh)
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("expected 2nd batch, err: %v", err)
+	}
+
+	m.Close()
+
+	mu.Lock()
+	if len(durations[EventKindBatchExecuteQuotaWait]) != 1 ||
+		durations[EventKindBatchExecuteQuotaWait][0] < 40*time.Millisecond {
+		t.Errorf("expected a batch execute quota wait, got: %v", durations)
+	}
+	mu.Unlock()
+}
@@ -0,0 +1,136 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// +build go1.7
+
+package moss
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// A ContextCollection is a Collection whose operations can be given
+// up when a context.Context is canceled or reaches its deadline, in
+// which case the operations return the ctx.Err().  The Collection
+// returned by NewCollection() implements ContextCollection.
+type ContextCollection interface {
+	Collection
+
+	// ExecuteBatchContext is like ExecuteBatch(), but gives up
+	// waiting for the merger or persister to catch up when the ctx
+	// is done, in which case the batch is not incorporated.
+	ExecuteBatchContext(ctx context.Context, b Batch,
+		writeOptions WriteOptions) error
+
+	// GetContext is like Get(), but gives up before reading from the
+	// lower-level storage when the ctx is done.
+	GetContext(ctx context.Context, key []byte,
+		readOptions ReadOptions) ([]byte, error)
+}
+
+// A ContextSnapshot is a Snapshot whose reads can be given up when a
+// context.Context is canceled or reaches its deadline.  The
+// Snapshots of a Collection implement ContextSnapshot.
+type ContextSnapshot interface {
+	Snapshot
+
+	// GetContext is like Get(), but gives up before reading from the
+	// lower-level storage when the ctx is done.
+	GetContext(ctx context.Context, key []byte,
+		readOptions ReadOptions) ([]byte, error)
+
+	// StartIteratorContext is like StartIterator(), where the
+	// returned Iterator's Next() gives up before reading from the
+	// lower-level storage when the ctx is done.
+	StartIteratorContext(ctx context.Context,
+		startKeyInclusive, endKeyExclusive []byte,
+		iteratorOptions IteratorOptions) (Iterator, error)
+}
+
+// ExecuteBatchContext atomically incorporates the provided Batch into
+// the collection, unless the ctx is done first.
+func (m *collection) ExecuteBatchContext(ctx context.Context, bIn Batch,
+	writeOptions WriteOptions) error {
+	return m.executeBatch(bIn, writeOptions, ctx)
+}
+
+// GetContext retrieves a value from the collection, unless the ctx is
+// done before the lower-level storage is read.
+func (m *collection) GetContext(ctx context.Context, key []byte,
+	readOptions ReadOptions) ([]byte, error) {
+	readOptions.canceler = ctx
+	return m.Get(key, readOptions)
+}
+
+// GetContext retrieves a val from the segmentStack, unless the ctx is
+// done before the lower-level snapshot is read.
+func (ss *segmentStack) GetContext(ctx context.Context, key []byte,
+	readOptions ReadOptions) ([]byte, error) {
+	readOptions.canceler = ctx
+	return ss.Get(key, readOptions)
+}
+
+// StartIteratorContext returns a new Iterator instance on this
+// segmentStack, whose Next() gives up before reading from the
+// lower-level snapshot when the ctx is done.
+func (ss *segmentStack) StartIteratorContext(ctx context.Context,
+	startKeyInclusive, endKeyExclusive []byte,
+	iteratorOptions IteratorOptions) (Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		if ss.stats != nil {
+			atomic.AddUint64(&ss.stats.TotIteratorCanceled, 1)
+		}
+		return nil, err
+	}
+
+	iteratorOptions.canceler = ctx
+	return ss.StartIterator(startKeyInclusive, endKeyExclusive,
+		iteratorOptions)
+}
+
+// GetContext retrieves a val from the shard of the key, unless the ctx
+// is done before the shard's lower-level storage is read.
+func (ss *shardedSnapshot) GetContext(ctx context.Context, key []byte,
+	readOptions ReadOptions) ([]byte, error) {
+	s := ss.snapshots[shardOf(key, ss.splitKeys, len(ss.snapshots))]
+
+	if cs, ok := s.(ContextSnapshot); ok {
+		return cs.GetContext(ctx, key, readOptions)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return s.Get(key, readOptions)
+}
+
+// StartIteratorContext returns an Iterator that merges the Iterators
+// of the shards in key order, whose Next() gives up before reading
+// from the lower-level storage of a shard when the ctx is done.
+func (ss *shardedSnapshot) StartIteratorContext(ctx context.Context,
+	startKeyInclusive, endKeyExclusive []byte,
+	iteratorOptions IteratorOptions) (Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return ss.startIterator(startKeyInclusive, endKeyExclusive,
+		func(s Snapshot) (Iterator, error) {
+			if cs, ok := s.(ContextSnapshot); ok {
+				return cs.StartIteratorContext(ctx,
+					startKeyInclusive, endKeyExclusive, iteratorOptions)
+			}
+			return s.StartIterator(startKeyInclusive, endKeyExclusive,
+				iteratorOptions)
+		})
+}
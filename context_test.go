@@ -0,0 +1,296 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// +build go1.7
+
+package moss
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExecuteBatchContext(t *testing.T) {
+	// Without a started merger, the 2nd batch waits forever.
+	m, _ := NewCollection(CollectionOptions{MaxPreMergerBatches: 1})
+	mc := m.(ContextCollection)
+
+	exec := func(ctx context.Context) error {
+		b, _ := m.NewBatch(0, 0)
+		b.Set([]byte("a"), []byte("A"))
+		return mc.ExecuteBatchContext(ctx, b, WriteOptions{})
+	}
+
+	err := exec(context.Background())
+	if err != nil {
+		t.Fatalf("expected 1st batch, err: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+
+	err = exec(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, err: %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	err = exec(ctx)
+	if err != context.Canceled {
+		t.Errorf("expected canceled, err: %v", err)
+	}
+
+	stats, _ := m.Stats()
+	if stats.TotExecuteBatchCanceled != 2 ||
+		stats.TotExecuteBatchWaitBeg != 2 ||
+		stats.TotExecuteBatchEnd != 1 {
+		t.Errorf("expected canceled batches, stats: %+v", stats)
+	}
+}
+
+func TestExecuteBatchContextCanceled(t *testing.T) {
+	m, _ := NewCollection(CollectionOptions{})
+	m.Start()
+	defer m.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// No wait is needed by an idle collection, but the batch must
+	// still not be incorporated.
+	b, _ := m.NewBatch(0, 0)
+	b.Set([]byte("a"), []byte("A"))
+	err := m.(ContextCollection).ExecuteBatchContext(ctx, b, WriteOptions{})
+	b.Close()
+	if err != context.Canceled {
+		t.Errorf("expected canceled, err: %v", err)
+	}
+
+	ss, _ := m.Snapshot()
+	v, err := ss.Get([]byte("a"), ReadOptions{})
+	ss.Close()
+	if err != nil || v != nil {
+		t.Errorf("expected no incorporated batch, v: %s, err: %v", v, err)
+	}
+
+	stats, _ := m.Stats()
+	if stats.TotExecuteBatchCanceled != 1 ||
+		stats.TotExecuteBatchEnd != 0 {
+		t.Errorf("expected a canceled batch, stats: %+v", stats)
+	}
+}
+
+func TestGetIteratorContext(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	store, coll, err := OpenStoreCollection(tmpDir, DefaultStoreOptions,
+		StorePersistOptions{CompactionConcern: CompactionDisable})
+	if err != nil {
+		t.Fatalf("expected open, err: %v", err)
+	}
+	defer store.Close()
+	defer coll.Close()
+
+	b, _ := coll.NewBatch(0, 0)
+	for i := 0; i < 10; i++ {
+		b.Set([]byte(fmt.Sprintf("%d", i)), []byte("persisted"))
+	}
+	coll.ExecuteBatch(b, WriteOptions{})
+	waitForChildPersistence(t, coll)
+
+	b, _ = coll.NewBatch(0, 0)
+	b.Set([]byte("dirty"), []byte("dirty"))
+	coll.ExecuteBatch(b, WriteOptions{})
+
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	mc := coll.(ContextCollection)
+
+	v, err := mc.GetContext(canceledCtx, []byte("dirty"), ReadOptions{})
+	if err != nil || string(v) != "dirty" {
+		t.Errorf("expected dirty val without lower-level read,"+
+			" v: %q, err: %v", v, err)
+	}
+
+	v, err = mc.GetContext(canceledCtx, []byte("1"), ReadOptions{})
+	if err != context.Canceled || v != nil {
+		t.Errorf("expected canceled get, v: %q, err: %v", v, err)
+	}
+
+	v, err = mc.GetContext(context.Background(), []byte("1"), ReadOptions{})
+	if err != nil || string(v) != "persisted" {
+		t.Errorf("expected persisted val, v: %q, err: %v", v, err)
+	}
+
+	ssIn, _ := coll.Snapshot()
+	defer ssIn.Close()
+
+	ss := ssIn.(ContextSnapshot)
+
+	v, err = ss.GetContext(canceledCtx, []byte("2"), ReadOptions{})
+	if err != context.Canceled || v != nil {
+		t.Errorf("expected canceled snapshot get, v: %q, err: %v", v, err)
+	}
+
+	_, err = ss.StartIteratorContext(canceledCtx, nil, nil, IteratorOptions{})
+	if err != context.Canceled {
+		t.Errorf("expected canceled iterator start, err: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	iter, err := ss.StartIteratorContext(ctx, nil, nil, IteratorOptions{})
+	if err != nil {
+		t.Fatalf("expected iterator, err: %v", err)
+	}
+	defer iter.Close()
+
+	if err = iter.Next(); err != nil {
+		t.Errorf("expected next, err: %v", err)
+	}
+
+	cancel()
+
+	if err = iter.Next(); err != context.Canceled {
+		t.Errorf("expected canceled next, err: %v", err)
+	}
+
+	stats, _ := coll.Stats()
+	if stats.TotGetCanceled != 2 || stats.TotIteratorCanceled != 2 {
+		t.Errorf("expected canceled stats, stats: %+v", stats)
+	}
+}
+
+func TestIteratorContextLowerLevelOnly(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	store, coll, err := OpenStoreCollection(tmpDir, DefaultStoreOptions,
+		StorePersistOptions{CompactionConcern: CompactionDisable})
+	if err != nil {
+		t.Fatalf("expected open, err: %v", err)
+	}
+	defer store.Close()
+	defer coll.Close()
+
+	b, _ := coll.NewBatch(0, 0)
+	for i := 0; i < 10; i++ {
+		b.Set([]byte(fmt.Sprintf("%d", i)), []byte("persisted"))
+	}
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+	waitForChildPersistence(t, coll)
+
+	ssIn, _ := coll.Snapshot()
+	defer ssIn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The only entries are from the lower level snapshot.
+	iter, err := ssIn.(ContextSnapshot).StartIteratorContext(ctx,
+		nil, nil, IteratorOptions{})
+	if err != nil {
+		t.Fatalf("expected iterator, err: %v", err)
+	}
+	defer iter.Close()
+
+	k, _, err := iter.Current()
+	if err != nil || string(k) != "0" {
+		t.Errorf("expected first key, k: %q, err: %v", k, err)
+	}
+
+	cancel()
+
+	if err = iter.Next(); err != context.Canceled {
+		t.Errorf("expected canceled next, err: %v", err)
+	}
+}
+
+func TestShardedSnapshotContext(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossSharded")
+	defer os.RemoveAll(tmpDir)
+
+	sc, err := OpenShardedCollection(tmpDir, ShardedCollectionOptions{
+		NumShards:    2,
+		StoreOptions: DefaultStoreOptions,
+	})
+	if err != nil {
+		t.Fatalf("expected open, err: %v", err)
+	}
+	defer sc.Close()
+
+	b, _ := sc.NewBatch(0, 0)
+	for i := 0; i < 10; i++ {
+		b.Set([]byte(fmt.Sprintf("%d", i)), []byte("persisted"))
+	}
+	sc.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	for _, shardColl := range sc.colls {
+		waitForChildPersistence(t, shardColl)
+	}
+
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ssIn, _ := sc.Snapshot()
+	defer ssIn.Close()
+
+	ss := ssIn.(ContextSnapshot)
+
+	v, err := ss.GetContext(canceledCtx, []byte("2"), ReadOptions{})
+	if err != context.Canceled || v != nil {
+		t.Errorf("expected canceled snapshot get, v: %q, err: %v", v, err)
+	}
+
+	v, err = ss.GetContext(context.Background(), []byte("2"), ReadOptions{})
+	if err != nil || string(v) != "persisted" {
+		t.Errorf("expected persisted val, v: %q, err: %v", v, err)
+	}
+
+	_, err = ss.StartIteratorContext(canceledCtx, nil, nil, IteratorOptions{})
+	if err != context.Canceled {
+		t.Errorf("expected canceled iterator start, err: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	iter, err := ss.StartIteratorContext(ctx, nil, nil, IteratorOptions{})
+	if err != nil {
+		t.Fatalf("expected iterator, err: %v", err)
+	}
+	defer iter.Close()
+
+	if err = iter.Next(); err != nil {
+		t.Errorf("expected next, err: %v", err)
+	}
+
+	cancel()
+
+	if err = iter.Next(); err != context.Canceled {
+		t.Errorf("expected canceled next, err: %v", err)
+	}
+}
@@ -0,0 +1,9 @@
+module github.com/couchbase/moss
+
+go 1.13
+
+require (
+	github.com/couchbase/ghistogram v0.1.0
+	github.com/edsrzf/mmap-go v1.2.0
+	github.com/mschoch/smat v0.2.0
+)
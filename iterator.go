@@ -15,6 +15,10 @@ import (
 	"bytes"
 	"container/heap"
 	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/ghistogram"
 )
 
 // DefaultNaiveSeekToMaxTries is the max number of attempts a forward
@@ -40,6 +44,13 @@ type iterator struct {
 	closer io.Closer
 
 	iteratorOptions IteratorOptions
+
+	now int64 // Unix nanoseconds, used to check for expired entries.
+
+	// histograms, when non-nil, record the number of entries that a
+	// sampled iterator scanned.
+	histograms ghistogram.Histograms
+	entries    uint64
 }
 
 // A cursor rerpresents a logical entry position inside a segment in a
@@ -73,12 +84,32 @@ type cursor struct {
 func (ss *segmentStack) StartIterator(
 	startKeyInclusive, endKeyExclusive []byte,
 	iteratorOptions IteratorOptions) (Iterator, error) {
+	if ss.histograms == nil || ss.stats == nil ||
+		!readHistogramsSampled(ss.options,
+			atomic.AddUint64(&ss.stats.TotIteratorStart, 1)) {
+		iter, err := ss.startIterator(startKeyInclusive, endKeyExclusive, iteratorOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		return iter.optimize()
+	}
+
+	startTime := time.Now()
+
 	iter, err := ss.startIterator(startKeyInclusive, endKeyExclusive, iteratorOptions)
 	if err != nil {
 		return nil, err
 	}
 
-	return iter.optimize()
+	iter.histograms = ss.histograms
+
+	rv, err := iter.optimize()
+
+	ss.histograms["IteratorStartUsecs"].Add(
+		uint64(time.Since(startTime).Nanoseconds()/1000), 1)
+
+	return rv, err
 }
 
 // startIterator() returns a new iterator on the given segmentStack.
@@ -97,6 +128,9 @@ func (ss *segmentStack) StartIterator(
 // startIterator() can skip lower segments, via the
 // IteratorOptions.MinSegmentLevel parameter.  For example, to ignore
 // the lowest, 0th segment, use MinSegmentLevel of 1.
+//
+// startIterator() narrows the range to the IteratorOptions.Prefix, if
+// any, and skips segments whose keys are entirely outside the range.
 func (ss *segmentStack) startIterator(
 	startKeyInclusive, endKeyExclusive []byte,
 	iteratorOptions IteratorOptions) (*iterator, error) {
@@ -104,6 +138,11 @@ func (ss *segmentStack) startIterator(
 		iteratorOptions.MaxSegmentHeight = len(ss.a)
 	}
 
+	if iteratorOptions.Prefix != nil {
+		startKeyInclusive, endKeyExclusive = prefixRange(
+			iteratorOptions.Prefix, startKeyInclusive, endKeyExclusive)
+	}
+
 	prefixLen := 0
 	if len(startKeyInclusive) > 0 &&
 		len(endKeyExclusive) > 0 {
@@ -120,6 +159,8 @@ func (ss *segmentStack) startIterator(
 		prefixLen: prefixLen,
 
 		iteratorOptions: iteratorOptions,
+
+		now: time.Now().UnixNano(),
 	}
 
 	// ----------------------------------------------
@@ -133,6 +174,11 @@ func (ss *segmentStack) startIterator(
 	for ssIndex := minSegmentLevel; ssIndex <= maxSegmentLevel; ssIndex++ {
 		b := ss.a[ssIndex]
 
+		if seg, ok := b.(*segment); ok &&
+			!seg.overlaps(startKeyInclusive, endKeyExclusive) {
+			continue
+		}
+
 		sc, err := b.Cursor(startKeyInclusive, endKeyExclusive)
 		if err != nil {
 			return nil, err
@@ -142,6 +188,8 @@ func (ss *segmentStack) startIterator(
 			continue
 		}
 
+		op, v = iter.resolveOp(op, v)
+
 		iter.cursors = append(iter.cursors, &cursor{
 			ssIndex: ssIndex,
 			sc:      sc,
@@ -206,6 +254,11 @@ func (ss *segmentStack) startIterator(
 
 // Close must be invoked to release resources.
 func (iter *iterator) Close() error {
+	if iter.histograms != nil {
+		iter.histograms["IteratorEntries"].Add(iter.entries, 1)
+		iter.histograms = nil
+	}
+
 	if iter.lowerLevelIter != nil {
 		iter.lowerLevelIter.Close()
 		iter.lowerLevelIter = nil
@@ -238,7 +291,16 @@ func (iter *iterator) Next() error {
 	for len(iter.cursors) > 0 {
 		next := iter.cursors[0]
 
+		iter.entries++
+
 		if next.ssIndex < 0 && next.sc == nil {
+			if err := canceled(iter.iteratorOptions.canceler); err != nil {
+				if iter.ss.stats != nil {
+					atomic.AddUint64(&iter.ss.stats.TotIteratorCanceled, 1)
+				}
+				return err
+			}
+
 			err := iter.lowerLevelIter.Next()
 			if err == nil {
 				next.k, next.v, err = iter.lowerLevelIter.Current()
@@ -262,6 +324,7 @@ func (iter *iterator) Next() error {
 				heap.Pop(iter)
 			} else {
 				next.op, next.k, next.v = next.sc.Current()
+				next.op, next.v = iter.resolveOp(next.op, next.v)
 				if next.op == 0 {
 					heap.Pop(iter)
 				} else if len(iter.cursors) > 1 {
@@ -287,6 +350,22 @@ func (iter *iterator) Next() error {
 	return ErrIteratorDone
 }
 
+// resolveOp converts an operationSetTTL entry read from a segment
+// into either an OperationSet or an OperationDel entry, unless the
+// iterator is meant to see the raw expiries, as in a merge.
+func (iter *iterator) resolveOp(op uint64, v []byte) (uint64, []byte) {
+	if op != operationSetTTL || iter.iteratorOptions.rawExpiry {
+		return op, v
+	}
+
+	op, v, expired := resolveExpiry(op, v, iter.now)
+	if expired {
+		countExpiredHidden(iter.ss.stats)
+	}
+
+	return op, v
+}
+
 func iteratorBytesEqual(a, b []byte) bool {
 	i := len(a)
 	if i != len(b) {
@@ -460,9 +539,16 @@ func (iter *iterator) optimize() (Iterator, error) {
 
 	cur := iter.cursors[0]
 
-	if cur.ssIndex == -1 && cur.sc == nil {
-		// Optimization to return lowerLevelIter directly.
-		return iter.lowerLevelIter, nil
+	if cur.ssIndex == -1 {
+		_, tokener := iter.lowerLevelIter.(ContinuationTokener)
+		if cur.sc == nil && tokener &&
+			iter.iteratorOptions.canceler == nil && iter.histograms == nil {
+			// Optimization to return lowerLevelIter directly, unless its
+			// Next()'s might need to be given up or counted, or it
+			// can't produce continuation tokens.
+			return iter.lowerLevelIter, nil
+		}
+		return iter, nil
 	}
 
 	seg, ok := iter.ss.a[cur.ssIndex].(*segment)
@@ -478,8 +564,15 @@ func (iter *iterator) optimize() (Iterator, error) {
 		v:       cur.v,
 		closer:  iter.closer,
 		options: iter.ss.options,
+		stats:   iter.ss.stats,
+		now:     iter.now,
+
+		endKeyExclusive: iter.endKeyExclusive,
 
 		iteratorOptions: iter.iteratorOptions,
+
+		histograms: iter.histograms,
+		entries:    iter.entries,
 	}, nil
 }
 
@@ -497,3 +590,38 @@ func sharedPrefixLen(a, b []byte) int {
 	}
 	return i
 }
+
+// PrefixEndKeyExclusive returns the smallest key that's greater than
+// every key that starts with the given prefix, which is useful as the
+// endKeyExclusive for a range iteration over the prefix.  A nil is
+// returned when there's no such key, such as for an empty prefix or a
+// prefix of only 0xFF bytes, where nil means the logical "top-most"
+// key to StartIterator().
+func PrefixEndKeyExclusive(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xFF {
+			rv := append([]byte(nil), prefix[:i+1]...)
+			rv[i]++
+			return rv
+		}
+	}
+	return nil
+}
+
+// prefixRange returns the intersection of the key range of a prefix
+// with the given startKeyInclusive and endKeyExclusive bounds.
+func prefixRange(prefix, startKeyInclusive, endKeyExclusive []byte) (
+	[]byte, []byte) {
+	if bytes.Compare(startKeyInclusive, prefix) < 0 {
+		startKeyInclusive = prefix
+	}
+
+	prefixEnd := PrefixEndKeyExclusive(prefix)
+	if prefixEnd != nil &&
+		(endKeyExclusive == nil ||
+			bytes.Compare(prefixEnd, endKeyExclusive) < 0) {
+		endKeyExclusive = prefixEnd
+	}
+
+	return startKeyInclusive, endKeyExclusive
+}
@@ -14,6 +14,8 @@ package moss
 import (
 	"bytes"
 	"io"
+
+	"github.com/couchbase/ghistogram"
 )
 
 // An iteratorSingle implements the Iterator interface, and is an edge
@@ -31,12 +33,27 @@ type iteratorSingle struct {
 	closer io.Closer
 
 	options *CollectionOptions
+	stats   *CollectionStats
+
+	now int64 // Unix nanoseconds, used to check for expired entries.
+
+	endKeyExclusive []byte
 
 	iteratorOptions IteratorOptions
+
+	// histograms, when non-nil, record the number of entries that a
+	// sampled iterator scanned.
+	histograms ghistogram.Histograms
+	entries    uint64
 }
 
 // Close must be invoked to release resources.
 func (iter *iteratorSingle) Close() error {
+	if iter.histograms != nil {
+		iter.histograms["IteratorEntries"].Add(iter.entries, 1)
+		iter.histograms = nil
+	}
+
 	if iter.closer != nil {
 		iter.closer.Close()
 		iter.closer = nil
@@ -55,6 +72,8 @@ func (iter *iteratorSingle) InitCloser(closer io.Closer) error {
 
 // Next returns ErrIteratorDone if the iterator is done.
 func (iter *iteratorSingle) Next() error {
+	iter.entries++
+
 	err := iter.sc.Next()
 	if err != nil {
 		iter.op = 0
@@ -66,6 +85,7 @@ func (iter *iteratorSingle) Next() error {
 	}
 
 	iter.op, iter.k, iter.v = iter.sc.Current()
+	iter.resolveOp()
 	if iter.op != OperationDel ||
 		iter.iteratorOptions.IncludeDeletions {
 		return nil
@@ -74,6 +94,20 @@ func (iter *iteratorSingle) Next() error {
 	return iter.Next()
 }
 
+// resolveOp converts the current operationSetTTL entry, if any, into
+// either an OperationSet or an OperationDel entry.
+func (iter *iteratorSingle) resolveOp() {
+	if iter.op != operationSetTTL || iter.iteratorOptions.rawExpiry {
+		return
+	}
+
+	var expired bool
+	iter.op, iter.v, expired = resolveExpiry(iter.op, iter.v, iter.now)
+	if expired {
+		countExpiredHidden(iter.stats)
+	}
+}
+
 func (iter *iteratorSingle) SeekTo(seekToKey []byte) error {
 	key, _, err := iter.Current()
 	if err != nil && err != ErrIteratorDone {
@@ -106,6 +140,7 @@ func (iter *iteratorSingle) SeekTo(seekToKey []byte) error {
 	}
 
 	iter.op, iter.k, iter.v = iter.sc.Current()
+	iter.resolveOp()
 	if !iter.iteratorOptions.IncludeDeletions &&
 		iter.op == OperationDel {
 		return iter.Next()
@@ -583,3 +583,287 @@ func TestIteratorSingleDone(t *testing.T) {
 		}
 	}
 }
+
+func TestPrefixEndKeyExclusive(t *testing.T) {
+	tests := []struct {
+		prefix, exp []byte
+	}{
+		{nil, nil},
+		{[]byte{}, nil},
+		{[]byte("a"), []byte("b")},
+		{[]byte("ab"), []byte("ac")},
+		{[]byte{'a', 0xFF}, []byte("b")},
+		{[]byte{'a', 0xFF, 0xFF}, []byte("b")},
+		{[]byte{0xFF}, nil},
+		{[]byte{0xFF, 0xFF}, nil},
+		{[]byte{0xFE, 0xFF}, []byte{0xFF}},
+	}
+
+	for _, test := range tests {
+		prefix := append([]byte(nil), test.prefix...)
+		got := PrefixEndKeyExclusive(test.prefix)
+		if string(got) != string(test.exp) || (got == nil) != (test.exp == nil) {
+			t.Errorf("test: %#v, got: %#v", test, got)
+		}
+		if string(prefix) != string(test.prefix) {
+			t.Errorf("expected prefix to be unmodified, test: %#v", test)
+		}
+	}
+}
+
+func TestIteratorPrefix(t *testing.T) {
+	m, _ := NewCollection(CollectionOptions{})
+	m.Start()
+	defer m.Close()
+
+	keySets := [][]string{
+		{"a", "ab", "abc", "b", "ba"},
+		{"ab\xff", "ab\xff\xff", "ac", "\xff", "\xff\x00", "\xff\xff"},
+		{"zz"}, // A segment that's entirely outside most prefixes.
+	}
+	for _, keys := range keySets {
+		b, _ := m.NewBatch(0, 0)
+		for _, k := range keys {
+			b.Set([]byte(k), []byte(k))
+		}
+		if err := m.ExecuteBatch(b, WriteOptions{}); err != nil {
+			t.Fatalf("expected ExecuteBatch() to work, err: %v", err)
+		}
+		b.Close()
+	}
+
+	ss, _ := m.Snapshot()
+	defer ss.Close()
+
+	tests := []struct {
+		prefix     string
+		start, end []byte
+		exp        []string
+	}{
+		{"ab", nil, nil, []string{"ab", "abc", "ab\xff", "ab\xff\xff"}},
+		{"ab\xff", nil, nil, []string{"ab\xff", "ab\xff\xff"}},
+		{"b", nil, nil, []string{"b", "ba"}},
+		{"\xff", nil, nil, []string{"\xff", "\xff\x00", "\xff\xff"}},
+		{"\xff\xff", nil, nil, []string{"\xff\xff"}},
+		{"", nil, nil, []string{"a", "ab", "abc", "ab\xff", "ab\xff\xff",
+			"ac", "b", "ba", "zz", "\xff", "\xff\x00", "\xff\xff"}},
+		{"ab", []byte("abd"), nil, []string{"ab\xff", "ab\xff\xff"}},
+		{"ab", nil, []byte("abd"), []string{"ab", "abc"}},
+		{"ab", []byte("b"), nil, nil},
+		{"c", nil, nil, nil},
+	}
+
+	for _, test := range tests {
+		iter, err := ss.StartIterator(test.start, test.end,
+			IteratorOptions{Prefix: []byte(test.prefix)})
+		if err != nil {
+			t.Fatalf("expected StartIterator() to work, err: %v", err)
+		}
+
+		var got []string
+		for {
+			k, _, err := iter.Current()
+			if err == ErrIteratorDone {
+				break
+			}
+			got = append(got, string(k))
+			if iter.Next() == ErrIteratorDone {
+				break
+			}
+		}
+
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", test.exp) {
+			t.Errorf("prefix: %q, expected: %q, got: %q",
+				test.prefix, test.exp, got)
+		}
+
+		// SeekTo() outside of the prefix respects the prefix range.
+		if len(test.exp) > 0 {
+			if err = iter.SeekTo(nil); err != nil {
+				t.Errorf("expected SeekTo(nil) to work, err: %v", err)
+			}
+			k, _, _ := iter.Current()
+			if string(k) != test.exp[0] {
+				t.Errorf("prefix: %q, SeekTo(nil) got: %q", test.prefix, k)
+			}
+			if err = iter.SeekTo([]byte("\xff\xff\xff")); err != ErrIteratorDone &&
+				test.prefix != "" && test.prefix[0] != '\xff' {
+				t.Errorf("prefix: %q, expected SeekTo() past prefix to be done",
+					test.prefix)
+			}
+		}
+
+		iter.Close()
+	}
+}
+
+func TestIteratorContinuationToken(t *testing.T) {
+	m, _ := NewCollection(CollectionOptions{})
+	m.Start()
+	defer m.Close()
+
+	update := func(cb func(b Batch)) {
+		b, _ := m.NewBatch(0, 0)
+		cb(b)
+		if err := m.ExecuteBatch(b, WriteOptions{}); err != nil {
+			t.Fatalf("expected ExecuteBatch() to work, err: %v", err)
+		}
+		b.Close()
+	}
+
+	update(func(b Batch) {
+		for i := 0; i < 10; i++ {
+			k := []byte(fmt.Sprintf("k%d", i))
+			b.Set(k, k)
+		}
+		cb, _ := b.NewChildCollectionBatch("child", BatchOptions{})
+		for i := 0; i < 5; i++ {
+			k := []byte(fmt.Sprintf("c%d", i))
+			cb.Set(k, k)
+		}
+	})
+
+	page := func(iter Iterator, n int) (keys []string, token []byte) {
+		for i := 0; i < n; i++ {
+			k, _, err := iter.Current()
+			if err == ErrIteratorDone {
+				break
+			}
+			keys = append(keys, string(k))
+			if i < n-1 {
+				iter.Next()
+			}
+		}
+		token, err := iter.(ContinuationTokener).ContinuationToken()
+		if err != nil {
+			t.Fatalf("expected ContinuationToken() to work, err: %v", err)
+		}
+		iter.Close()
+		return keys, token
+	}
+
+	ss, _ := m.Snapshot()
+	iter, _ := ss.StartIterator(nil, []byte("k8"), IteratorOptions{})
+	keys, token := page(iter, 3)
+	ss.Close()
+	if fmt.Sprintf("%v", keys) != "[k0 k1 k2]" {
+		t.Errorf("unexpected first page: %v", keys)
+	}
+
+	// Delete the last returned key, and add keys before and after
+	// the token's position.
+	update(func(b Batch) {
+		b.Del([]byte("k2"))
+		b.Del([]byte("k4"))
+		b.Set([]byte("k1a"), []byte("k1a"))
+		b.Set([]byte("k2a"), []byte("k2a"))
+	})
+
+	ss, _ = m.Snapshot()
+	iter, err := ResumeIterator(ss, token, IteratorOptions{})
+	if err != nil {
+		t.Fatalf("expected ResumeIterator() to work, err: %v", err)
+	}
+	keys, token = page(iter, 10)
+	if fmt.Sprintf("%v", keys) != "[k2a k3 k5 k6 k7]" {
+		t.Errorf("unexpected resumed page: %v", keys)
+	}
+	_, err = ResumeIterator(ss, token, IteratorOptions{})
+	if err != ErrIteratorDone {
+		t.Errorf("expected done token to give ErrIteratorDone, err: %v", err)
+	}
+
+	// Tokens from a child collection resume on the child collection.
+	childSS, _ := ss.ChildCollectionSnapshot("child")
+	iter, _ = childSS.StartIterator(nil, nil, IteratorOptions{})
+	keys, token = page(iter, 2)
+	if fmt.Sprintf("%v", keys) != "[c0 c1]" {
+		t.Errorf("unexpected child page: %v", keys)
+	}
+	childSS.Close()
+	ss.Close()
+
+	update(func(b Batch) {
+		cb, _ := b.NewChildCollectionBatch("child", BatchOptions{})
+		cb.Del([]byte("c2"))
+	})
+
+	ss, _ = m.Snapshot()
+	childSS, _ = ss.ChildCollectionSnapshot("child")
+	iter, _ = ResumeIterator(childSS, token, IteratorOptions{})
+	keys, _ = page(iter, 10)
+	if fmt.Sprintf("%v", keys) != "[c3 c4]" {
+		t.Errorf("unexpected resumed child page: %v", keys)
+	}
+	childSS.Close()
+	ss.Close()
+
+	update(func(b Batch) {
+		b.DelChildCollection("child")
+	})
+
+	ss, _ = m.Snapshot()
+	childSS, _ = ss.ChildCollectionSnapshot("child")
+	_, err = ResumeIterator(childSS, token, IteratorOptions{})
+	if err != ErrNoSuchCollection {
+		t.Errorf("expected ErrNoSuchCollection, err: %v", err)
+	}
+	ss.Close()
+
+	for _, badToken := range [][]byte{nil, {}, {2, 0}, {1, 0x80},
+		{1, 0, 5, 'a'}, {1, 0, 1, 'a', 'b'}} {
+		_, err = ResumeIterator(nil, badToken, IteratorOptions{})
+		if err != ErrInvalidContinuationToken {
+			t.Errorf("expected invalid token for %v, err: %v", badToken, err)
+		}
+	}
+}
+
+func TestIteratorContinuationTokenLowerLevel(t *testing.T) {
+	lower := newTestPersister()
+	for i := 0; i < 5; i++ {
+		k := fmt.Sprintf("k%d", i)
+		lower.kvpairs[k] = []byte(k)
+	}
+
+	m, _ := NewCollection(CollectionOptions{LowerLevelInit: lower})
+	m.Start()
+	defer m.Close()
+
+	ss, _ := m.Snapshot()
+	defer ss.Close()
+
+	// The entries are only from the lower level, whose own iterators
+	// don't produce continuation tokens.
+	iter, _ := ss.StartIterator(nil, []byte("k4"), IteratorOptions{})
+	tokener, ok := iter.(ContinuationTokener)
+	if !ok {
+		t.Fatalf("expected a ContinuationTokener, got: %T", iter)
+	}
+
+	iter.Next()
+	token, err := tokener.ContinuationToken()
+	if err != nil {
+		t.Fatalf("expected ContinuationToken() to work, err: %v", err)
+	}
+	iter.Close()
+
+	iter, err = ResumeIterator(ss, token, IteratorOptions{})
+	if err != nil {
+		t.Fatalf("expected ResumeIterator() to work, err: %v", err)
+	}
+	defer iter.Close()
+
+	var keys []string
+	for {
+		k, _, err := iter.Current()
+		if err == ErrIteratorDone {
+			break
+		}
+		keys = append(keys, string(k))
+		iter.Next()
+	}
+	if fmt.Sprintf("%v", keys) != "[k2 k3]" {
+		t.Errorf("expected resumed keys, got: %v", keys)
+	}
+}
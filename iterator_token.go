@@ -0,0 +1,193 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package moss
+
+import (
+	"encoding/binary"
+)
+
+// A ContinuationTokener is an Iterator that can produce a
+// continuation token, which is an opaque, serializable []byte that
+// records the iterator's position, such as for pagination of results
+// across requests.  The iterators returned by moss snapshots,
+// including those of a ShardedCollection, implement the
+// ContinuationTokener interface, even when the entries are only from
+// a lower-level snapshot whose own iterators don't.  The iterators of
+// other Snapshot implementations, such as an application provided
+// lower-level snapshot that's used directly, might not.
+//
+// A continuation token records the key of the iterator's current
+// entry and the endKeyExclusive bound of the iterator, so it
+// represents the position strictly after the current entry, where
+// the current entry is considered to have been consumed by the
+// application.  See ResumeIterator().
+type ContinuationTokener interface {
+	ContinuationToken() ([]byte, error)
+}
+
+// The encoding of a continuation token is...
+//
+//	version byte | flags byte |
+//	uvarint len(key) | key bytes |
+//	(if flag has end) uvarint len(endKeyExclusive) | endKeyExclusive bytes
+const continuationTokenVersion = byte(1)
+
+const (
+	continuationTokenFlagDone   = byte(0x01)
+	continuationTokenFlagHasEnd = byte(0x02)
+)
+
+// ContinuationToken returns an opaque token for the position after
+// the iterator's current entry.
+func (iter *iterator) ContinuationToken() ([]byte, error) {
+	_, key, _, err := iter.CurrentEx()
+	if err != nil && err != ErrIteratorDone {
+		return nil, err
+	}
+
+	return encodeContinuationToken(key, iter.endKeyExclusive,
+		err == ErrIteratorDone), nil
+}
+
+// ContinuationToken returns an opaque token for the position after
+// the iterator's current entry.
+func (iter *iteratorSingle) ContinuationToken() ([]byte, error) {
+	_, key, _, err := iter.CurrentEx()
+	if err != nil && err != ErrIteratorDone {
+		return nil, err
+	}
+
+	return encodeContinuationToken(key, iter.endKeyExclusive,
+		err == ErrIteratorDone), nil
+}
+
+// ContinuationToken returns an opaque token for the position after
+// the iterator's current entry.
+func (si *shardedIterator) ContinuationToken() ([]byte, error) {
+	_, key, _, err := si.CurrentEx()
+	if err != nil && err != ErrIteratorDone {
+		return nil, err
+	}
+
+	return encodeContinuationToken(key, si.endKeyExclusive,
+		err == ErrIteratorDone), nil
+}
+
+func encodeContinuationToken(key, endKeyExclusive []byte, done bool) []byte {
+	rv := make([]byte, 2, 2+2*binary.MaxVarintLen64+
+		len(key)+len(endKeyExclusive))
+
+	rv[0] = continuationTokenVersion
+	if done {
+		rv[1] |= continuationTokenFlagDone
+	}
+	if endKeyExclusive != nil {
+		rv[1] |= continuationTokenFlagHasEnd
+	}
+
+	rv = appendUvarintBytes(rv, key)
+	if endKeyExclusive != nil {
+		rv = appendUvarintBytes(rv, endKeyExclusive)
+	}
+
+	return rv
+}
+
+func appendUvarintBytes(dst, b []byte) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(b)))
+	dst = append(dst, lenBuf[:n]...)
+	return append(dst, b...)
+}
+
+func decodeContinuationToken(token []byte) (
+	key, endKeyExclusive []byte, done bool, err error) {
+	if len(token) < 2 || token[0] != continuationTokenVersion {
+		return nil, nil, false, ErrInvalidContinuationToken
+	}
+
+	flags := token[1]
+	if flags&^(continuationTokenFlagDone|continuationTokenFlagHasEnd) != 0 {
+		return nil, nil, false, ErrInvalidContinuationToken
+	}
+
+	rest := token[2:]
+
+	key, rest, err = readUvarintBytes(rest)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	if flags&continuationTokenFlagHasEnd != 0 {
+		endKeyExclusive, rest, err = readUvarintBytes(rest)
+		if err != nil {
+			return nil, nil, false, err
+		}
+	}
+
+	if len(rest) != 0 {
+		return nil, nil, false, ErrInvalidContinuationToken
+	}
+
+	return key, endKeyExclusive, flags&continuationTokenFlagDone != 0, nil
+}
+
+func readUvarintBytes(buf []byte) (b, rest []byte, err error) {
+	n, nlen := binary.Uvarint(buf)
+	if nlen <= 0 || n > uint64(len(buf)-nlen) {
+		return nil, nil, ErrInvalidContinuationToken
+	}
+
+	end := nlen + int(n)
+
+	return append([]byte{}, buf[nlen:end]...), buf[end:], nil
+}
+
+// ResumeIterator returns a new Iterator on the given Snapshot that's
+// positioned strictly after the entry recorded by a continuation
+// token, and bounded by the endKeyExclusive of the iterator that
+// produced the token.  The Snapshot may be more recent than the one
+// that produced the token, where positioning is by key, so entries
+// that were added, updated or deleted since then are seen or skipped
+// just as in a fresh iteration.  In particular, the key recorded by
+// the token does not need to exist anymore.
+//
+// A token from an iterator on a child collection should be resumed
+// on a Snapshot of the same child collection.  A nil Snapshot, such
+// as when the child collection no longer exists, results in
+// ErrNoSuchCollection.
+//
+// ErrIteratorDone is returned if the token was produced by an
+// iterator that was already done, and ErrInvalidContinuationToken is
+// returned for a malformed token.  Tokens are only produced by
+// iterators that implement ContinuationTokener.
+func ResumeIterator(ss Snapshot, token []byte,
+	iteratorOptions IteratorOptions) (Iterator, error) {
+	key, endKeyExclusive, done, err := decodeContinuationToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if done {
+		return nil, ErrIteratorDone
+	}
+
+	if ss == nil {
+		return nil, ErrNoSuchCollection
+	}
+
+	// The smallest key that's strictly greater than the key.
+	startKeyInclusive := append(key, 0)
+
+	return ss.StartIterator(startKeyInclusive, endKeyExclusive,
+		iteratorOptions)
+}
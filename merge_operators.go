@@ -0,0 +1,420 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package moss
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// MergeOperators is a registry of available merge operators, which
+// should be immutable after process init()'ialization.  It is keyed
+// by MergeOperator.Name(), so that the name of a merge operator can
+// be recorded and later resolved or verified, such as when a store
+// is reopened.  The merge operators that have parameters, like a
+// separator, include their parameters in their Name(), so
+// applications should register their configured instances.
+var MergeOperators = map[string]MergeOperator{}
+
+func init() {
+	for _, mo := range []MergeOperator{
+		&MergeOperatorInt64Add{},
+		&MergeOperatorUint64Add{},
+		&MergeOperatorInt64Max{},
+		&MergeOperatorInt64Min{},
+		&MergeOperatorJSONPatch{},
+	} {
+		MergeOperators[mo.Name()] = mo
+	}
+}
+
+// ------------------------------------------------------
+
+// MergeOperatorInt64Add implements a counter, where the existing
+// value and the operands are 8-byte, little-endian encoded int64's,
+// which are summed, with wraparound on overflow.  A nil existing
+// value is treated as 0.  As two's-complement addition is the same
+// for int64's and uint64's, the merging is that of the embedded
+// MergeOperatorUint64Add.
+type MergeOperatorInt64Add struct {
+	MergeOperatorUint64Add
+}
+
+// Name returns the name of this merge operator implementation.
+func (mo *MergeOperatorInt64Add) Name() string {
+	return "MergeOperatorInt64Add"
+}
+
+// MergeOperatorUint64Add implements a counter, where the existing
+// value and the operands are 8-byte, little-endian encoded uint64's,
+// which are summed, with wraparound on overflow.  A nil existing
+// value is treated as 0.
+type MergeOperatorUint64Add struct{}
+
+// Name returns the name of this merge operator implementation.
+func (mo *MergeOperatorUint64Add) Name() string {
+	return "MergeOperatorUint64Add"
+}
+
+// FullMerge adds the operands to the existing value.
+func (mo *MergeOperatorUint64Add) FullMerge(key, existingValue []byte,
+	operands [][]byte) ([]byte, bool) {
+	return mergeUint64s(existingValue, operands, addUint64)
+}
+
+// PartialMerge adds the two operands.
+func (mo *MergeOperatorUint64Add) PartialMerge(key,
+	leftOperand, rightOperand []byte) ([]byte, bool) {
+	return mergeUint64s(leftOperand, [][]byte{rightOperand}, addUint64)
+}
+
+// MergeOperatorInt64Max keeps the maximum, where the existing value
+// and the operands are 8-byte, little-endian encoded int64's.  A nil
+// existing value is ignored.
+type MergeOperatorInt64Max struct{}
+
+// Name returns the name of this merge operator implementation.
+func (mo *MergeOperatorInt64Max) Name() string {
+	return "MergeOperatorInt64Max"
+}
+
+// FullMerge returns the max of the existing value and the operands.
+func (mo *MergeOperatorInt64Max) FullMerge(key, existingValue []byte,
+	operands [][]byte) ([]byte, bool) {
+	return mergeUint64s(existingValue, operands, maxInt64)
+}
+
+// PartialMerge returns the max of the two operands.
+func (mo *MergeOperatorInt64Max) PartialMerge(key,
+	leftOperand, rightOperand []byte) ([]byte, bool) {
+	return mergeUint64s(leftOperand, [][]byte{rightOperand}, maxInt64)
+}
+
+// MergeOperatorInt64Min keeps the minimum, where the existing value
+// and the operands are 8-byte, little-endian encoded int64's.  A nil
+// existing value is ignored.
+type MergeOperatorInt64Min struct{}
+
+// Name returns the name of this merge operator implementation.
+func (mo *MergeOperatorInt64Min) Name() string {
+	return "MergeOperatorInt64Min"
+}
+
+// FullMerge returns the min of the existing value and the operands.
+func (mo *MergeOperatorInt64Min) FullMerge(key, existingValue []byte,
+	operands [][]byte) ([]byte, bool) {
+	return mergeUint64s(existingValue, operands, minInt64)
+}
+
+// PartialMerge returns the min of the two operands.
+func (mo *MergeOperatorInt64Min) PartialMerge(key,
+	leftOperand, rightOperand []byte) ([]byte, bool) {
+	return mergeUint64s(leftOperand, [][]byte{rightOperand}, minInt64)
+}
+
+func addUint64(a, b uint64) uint64 { return a + b }
+
+func maxInt64(a, b uint64) uint64 {
+	if int64(a) > int64(b) {
+		return a
+	}
+	return b
+}
+
+func minInt64(a, b uint64) uint64 {
+	if int64(a) < int64(b) {
+		return a
+	}
+	return b
+}
+
+// mergeUint64s folds the 8-byte, little-endian encoded operands into
+// the existing value, which may be nil, and returns (nil, false) if
+// any of them are malformed.  For the add f, starting the fold from
+// the first value is the same as starting from a nil existing value
+// of 0.
+func mergeUint64s(existingValue []byte, operands [][]byte,
+	f func(a, b uint64) uint64) ([]byte, bool) {
+	var rv uint64
+	var found bool
+
+	for i, v := range append([][]byte{existingValue}, operands...) {
+		if i == 0 && v == nil {
+			continue
+		}
+		if len(v) != 8 {
+			return nil, false
+		}
+
+		x := binary.LittleEndian.Uint64(v)
+		if found {
+			rv = f(rv, x)
+		} else {
+			rv, found = x, true
+		}
+	}
+
+	if !found {
+		return nil, true
+	}
+
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, rv)
+	return buf, true
+}
+
+// ------------------------------------------------------
+
+// MergeOperatorSetUnion maintains a set of members, where the
+// existing value and the operands are each zero or more members
+// delimited by the Sep.  The merged value holds the distinct
+// members in order of their first appearance.
+type MergeOperatorSetUnion struct {
+	Sep string // The non-empty separator between members.
+}
+
+// Name returns the name of this merge operator implementation, which
+// includes its configured Sep.
+func (mo *MergeOperatorSetUnion) Name() string {
+	return fmt.Sprintf("MergeOperatorSetUnion(%q)", mo.Sep)
+}
+
+// FullMerge returns the union of the existing value and operands.
+func (mo *MergeOperatorSetUnion) FullMerge(key, existingValue []byte,
+	operands [][]byte) ([]byte, bool) {
+	if mo.Sep == "" {
+		return nil, false
+	}
+
+	sep := []byte(mo.Sep)
+
+	var members [][]byte
+	seen := map[string]bool{}
+
+	for _, v := range append([][]byte{existingValue}, operands...) {
+		if len(v) <= 0 {
+			continue
+		}
+		for _, member := range bytes.Split(v, sep) {
+			if !seen[string(member)] {
+				seen[string(member)] = true
+				members = append(members, member)
+			}
+		}
+	}
+
+	return joinMembers(members, sep), true
+}
+
+// PartialMerge returns the union of the two operands.
+func (mo *MergeOperatorSetUnion) PartialMerge(key,
+	leftOperand, rightOperand []byte) ([]byte, bool) {
+	return mo.FullMerge(key, leftOperand, [][]byte{rightOperand})
+}
+
+// MergeOperatorListAppend maintains a list of items, where the
+// existing value and the operands are each zero or more items
+// delimited by the Sep.  Items are appended, and when MaxItems is
+// positive, only the last MaxItems items are kept.
+type MergeOperatorListAppend struct {
+	Sep      string // The non-empty separator between items.
+	MaxItems int    // When > 0, the max number of most recent items kept.
+}
+
+// Name returns the name of this merge operator implementation, which
+// includes its configured Sep and MaxItems.
+func (mo *MergeOperatorListAppend) Name() string {
+	return fmt.Sprintf("MergeOperatorListAppend(%q,%d)", mo.Sep, mo.MaxItems)
+}
+
+// FullMerge appends the operands to the existing value.
+func (mo *MergeOperatorListAppend) FullMerge(key, existingValue []byte,
+	operands [][]byte) ([]byte, bool) {
+	if mo.Sep == "" {
+		return nil, false
+	}
+
+	sep := []byte(mo.Sep)
+
+	var items [][]byte
+	for _, v := range append([][]byte{existingValue}, operands...) {
+		if len(v) > 0 {
+			items = append(items, bytes.Split(v, sep)...)
+		}
+	}
+
+	// Since only the most recent items are kept, a truncated partial
+	// merge of operands results in the same list as a full merge.
+	if mo.MaxItems > 0 && len(items) > mo.MaxItems {
+		items = items[len(items)-mo.MaxItems:]
+	}
+
+	return joinMembers(items, sep), true
+}
+
+// PartialMerge appends the right operand to the left operand.
+func (mo *MergeOperatorListAppend) PartialMerge(key,
+	leftOperand, rightOperand []byte) ([]byte, bool) {
+	return mo.FullMerge(key, leftOperand, [][]byte{rightOperand})
+}
+
+func joinMembers(members [][]byte, sep []byte) []byte {
+	rv := bytes.Join(members, sep)
+	if rv == nil {
+		rv = []byte{}
+	}
+	return rv
+}
+
+// ------------------------------------------------------
+
+// MergeOperatorJSONPatch applies JSON merge patches (RFC 7386) to a
+// JSON document, where the existing value is the document and each
+// operand is a patch.  A patch that's an object updates the fields of
+// the document, where a null field removes that field; any other
+// patch replaces the document.  The merged value is re-encoded, so
+// object fields are sorted.
+type MergeOperatorJSONPatch struct{}
+
+// Name returns the name of this merge operator implementation.
+func (mo *MergeOperatorJSONPatch) Name() string {
+	return "MergeOperatorJSONPatch"
+}
+
+// FullMerge applies the operands as patches to the existing value.
+func (mo *MergeOperatorJSONPatch) FullMerge(key, existingValue []byte,
+	operands [][]byte) ([]byte, bool) {
+	var doc interface{}
+	if existingValue != nil {
+		var err error
+		doc, err = decodeJSON(existingValue)
+		if err != nil {
+			return nil, false
+		}
+	}
+
+	for _, operand := range operands {
+		patch, err := decodeJSON(operand)
+		if err != nil {
+			return nil, false
+		}
+		doc = jsonMergePatch(doc, patch)
+	}
+
+	rv, err := json.Marshal(doc)
+	if err != nil {
+		return nil, false
+	}
+	return rv, true
+}
+
+// PartialMerge combines two patches into a single, equivalent patch.
+// It returns (nil, false) when no single patch is equivalent, which
+// is when the left patch replaces a non-object and the right patch
+// then updates its fields, as the combination depends on the document.
+func (mo *MergeOperatorJSONPatch) PartialMerge(key,
+	leftOperand, rightOperand []byte) ([]byte, bool) {
+	left, err := decodeJSON(leftOperand)
+	if err != nil {
+		return nil, false
+	}
+	right, err := decodeJSON(rightOperand)
+	if err != nil {
+		return nil, false
+	}
+
+	combined, ok := jsonCombinePatches(left, right)
+	if !ok {
+		return nil, false
+	}
+
+	rv, err := json.Marshal(combined)
+	if err != nil {
+		return nil, false
+	}
+	return rv, true
+}
+
+func decodeJSON(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber() // Preserves the precision of numbers.
+
+	var rv interface{}
+	err := dec.Decode(&rv)
+	if err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("merge_operators: trailing data after JSON")
+	}
+	return rv, nil
+}
+
+// jsonMergePatch applies a patch to a target, following RFC 7386.
+func jsonMergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+		} else {
+			targetObj[k] = jsonMergePatch(targetObj[k], v)
+		}
+	}
+
+	return targetObj
+}
+
+// jsonCombinePatches returns a patch that's equivalent to applying the
+// left patch and then the right patch, if there is one.
+func jsonCombinePatches(left, right interface{}) (interface{}, bool) {
+	rightObj, ok := right.(map[string]interface{})
+	if !ok {
+		return right, true // The right patch replaces the document.
+	}
+
+	leftObj, ok := left.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	for k, rv := range rightObj {
+		lv, exists := leftObj[k]
+		if !exists {
+			leftObj[k] = rv
+			continue
+		}
+
+		if _, rvIsObj := rv.(map[string]interface{}); !rvIsObj {
+			leftObj[k] = rv // Includes a null, which removes the field.
+			continue
+		}
+
+		combined, ok := jsonCombinePatches(lv, rv)
+		if !ok {
+			return nil, false
+		}
+		leftObj[k] = combined
+	}
+
+	return leftObj, true
+}
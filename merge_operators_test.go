@@ -0,0 +1,168 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package moss
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func i64(x int64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(x))
+	return buf
+}
+
+func TestMergeOperatorsRegistry(t *testing.T) {
+	for _, name := range []string{
+		"MergeOperatorInt64Add",
+		"MergeOperatorUint64Add",
+		"MergeOperatorInt64Max",
+		"MergeOperatorInt64Min",
+		"MergeOperatorJSONPatch",
+	} {
+		mo, exists := MergeOperators[name]
+		if !exists || mo.Name() != name {
+			t.Errorf("expected registered merge operator: %s", name)
+		}
+	}
+
+	a := &MergeOperatorListAppend{Sep: ",", MaxItems: 3}
+	b := &MergeOperatorListAppend{Sep: ",", MaxItems: 4}
+	if a.Name() == b.Name() {
+		t.Errorf("expected names to include parameters")
+	}
+}
+
+func TestMergeOperators(t *testing.T) {
+	tests := []struct {
+		mo       MergeOperator
+		existing []byte
+		operands [][]byte
+		exp      []byte
+	}{
+		{&MergeOperatorInt64Add{}, nil,
+			[][]byte{i64(1), i64(2), i64(-10)}, i64(-7)},
+		{&MergeOperatorInt64Add{}, i64(100),
+			[][]byte{i64(1), i64(2), i64(3)}, i64(106)},
+		{&MergeOperatorUint64Add{}, i64(-1),
+			[][]byte{i64(1), i64(2), i64(3)}, i64(5)},
+		{&MergeOperatorInt64Max{}, nil,
+			[][]byte{i64(-5), i64(-2), i64(-3)}, i64(-2)},
+		{&MergeOperatorInt64Max{}, i64(10),
+			[][]byte{i64(-5), i64(20), i64(3)}, i64(20)},
+		{&MergeOperatorInt64Min{}, i64(10),
+			[][]byte{i64(-5), i64(20), i64(3)}, i64(-5)},
+		{&MergeOperatorSetUnion{Sep: ","}, []byte("a,b"),
+			[][]byte{[]byte("b,c"), []byte(""), []byte("a,d")},
+			[]byte("a,b,c,d")},
+		{&MergeOperatorListAppend{Sep: ","}, []byte("a,b"),
+			[][]byte{[]byte("b,c"), []byte("d")},
+			[]byte("a,b,b,c,d")},
+		{&MergeOperatorListAppend{Sep: ",", MaxItems: 3}, []byte("a,b"),
+			[][]byte{[]byte("c"), []byte("d,e"), []byte("f")},
+			[]byte("d,e,f")},
+		{&MergeOperatorJSONPatch{}, []byte(`{"a":1,"b":{"c":2,"d":3}}`),
+			[][]byte{
+				[]byte(`{"b":{"c":null}}`),
+				[]byte(`{"e":[1,2]}`),
+				[]byte(`{"a":12345678901234567890}`),
+			},
+			[]byte(`{"a":12345678901234567890,"b":{"d":3},"e":[1,2]}`)},
+		{&MergeOperatorJSONPatch{}, []byte(`{"a":1}`),
+			[][]byte{[]byte(`"x"`), []byte(`{"b":2}`)},
+			[]byte(`{"b":2}`)},
+		{&MergeOperatorJSONPatch{}, nil,
+			[][]byte{[]byte(`{"a":{"b":1}}`), []byte(`{"a":{"c":null}}`)},
+			[]byte(`{"a":{"b":1}}`)},
+	}
+
+	for i, test := range tests {
+		v, ok := test.mo.FullMerge([]byte("k"), test.existing, test.operands)
+		if !ok || !bytes.Equal(v, test.exp) {
+			t.Errorf("test: %d, %s, expected FullMerge: %s, got: %s, ok: %v",
+				i, test.mo.Name(), test.exp, v, ok)
+		}
+
+		// Partially merging any adjacent operands must give the same
+		// result, unless the partial merge is declined.
+		for j := 0; j+1 < len(test.operands); j++ {
+			p, ok := test.mo.PartialMerge([]byte("k"),
+				test.operands[j], test.operands[j+1])
+			if !ok {
+				continue
+			}
+
+			var operands [][]byte
+			operands = append(operands, test.operands[:j]...)
+			operands = append(operands, p)
+			operands = append(operands, test.operands[j+2:]...)
+
+			v, ok = test.mo.FullMerge([]byte("k"), test.existing, operands)
+			if !ok || !bytes.Equal(v, test.exp) {
+				t.Errorf("test: %d, %s, j: %d, expected partial then"+
+					" FullMerge: %s, got: %s, ok: %v",
+					i, test.mo.Name(), j, test.exp, v, ok)
+			}
+		}
+	}
+}
+
+func TestMergeOperatorsMalformed(t *testing.T) {
+	_, ok := (&MergeOperatorInt64Add{}).FullMerge(nil, []byte("x"),
+		[][]byte{i64(1)})
+	if ok {
+		t.Errorf("expected malformed existing value to fail")
+	}
+	_, ok = (&MergeOperatorInt64Max{}).PartialMerge(nil, i64(1), []byte("y"))
+	if ok {
+		t.Errorf("expected malformed operand to fail")
+	}
+	_, ok = (&MergeOperatorSetUnion{}).FullMerge(nil, nil, [][]byte{[]byte("a")})
+	if ok {
+		t.Errorf("expected empty Sep to fail")
+	}
+	_, ok = (&MergeOperatorJSONPatch{}).FullMerge(nil, []byte("{"),
+		[][]byte{[]byte("{}")})
+	if ok {
+		t.Errorf("expected malformed JSON to fail")
+	}
+
+	// A patch that replaces a field with a non-object, followed by a
+	// patch that updates the field, has no single equivalent patch.
+	_, ok = (&MergeOperatorJSONPatch{}).PartialMerge(nil,
+		[]byte(`{"a":1}`), []byte(`{"a":{"b":2}}`))
+	if ok {
+		t.Errorf("expected JSON partial merge to be declined")
+	}
+}
+
+func TestMergeOperatorInt64AddCollection(t *testing.T) {
+	m, _ := NewCollection(CollectionOptions{
+		MergeOperator: MergeOperators["MergeOperatorInt64Add"],
+	})
+	m.Start()
+	defer m.Close()
+
+	for i := 0; i < 10; i++ {
+		b, _ := m.NewBatch(0, 0)
+		b.Merge([]byte("counter"), i64(int64(i)))
+		m.ExecuteBatch(b, WriteOptions{})
+		b.Close()
+	}
+
+	v, err := m.Get([]byte("counter"), ReadOptions{})
+	if err != nil || !bytes.Equal(v, i64(45)) {
+		t.Errorf("expected counter of 45, got: %v, err: %v", v, err)
+	}
+}
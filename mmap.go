@@ -24,6 +24,8 @@ type mmapRef struct {
 	buf  []byte
 	m    sync.Mutex // Protects the fields that follow.
 	refs int
+
+	verified bool // True once the segment's checksums were verified.
 }
 
 func (r *mmapRef) AddRef() *mmapRef {
@@ -0,0 +1,377 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// Package mossprom exports the stats and histograms of moss
+// collections and stores as prometheus metrics.
+//
+// The TotXxxx fields of the stats become counters with a _total
+// suffix, and the other fields become gauges, where the CurXxxx and
+// NumXxxx prefixes are dropped.  Names are converted to snake case,
+// and durations in microseconds (Usecs) are exported in seconds.  For
+// example, with the "moss" namespace, CollectionStats.TotGet becomes
+// moss_collection_get_total, and the PersistUsecs histogram of a store
+// becomes moss_store_persist_seconds.  The histograms are exported as
+// prometheus native histograms.
+//
+// Example usage:
+//
+//	reg := prometheus.NewRegistry()
+//	reg.MustRegister(mossprom.NewCollectionCollector(coll, "moss",
+//	    prometheus.Labels{"collection": "default"}))
+//	reg.MustRegister(mossprom.NewStoreCollector(store, "moss",
+//	    prometheus.Labels{"collection": "default"}))
+//	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+//
+// The package is its own module, github.com/couchbase/moss/mossprom,
+// so that moss itself doesn't depend on the prometheus client.
+package mossprom
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/couchbase/ghistogram"
+	"github.com/couchbase/moss"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NewCollectionCollector returns a prometheus.Collector of the
+// CollectionStats and histograms of a collection.  The constLabels,
+// which may be nil, are added to all the metrics, such as to tell
+// multiple collections apart.
+func NewCollectionCollector(coll moss.Collection, namespace string,
+	constLabels prometheus.Labels) prometheus.Collector {
+	return &collector{
+		fields: newFieldMetrics(reflect.TypeOf(moss.CollectionStats{}),
+			namespace, "collection", constLabels),
+		histograms: newHistogramMetrics(coll.Histograms(),
+			namespace, "collection", constLabels),
+		errDesc: newErrDesc(namespace, "collection", constLabels),
+		stats: func() (interface{}, ghistogram.Histograms, error) {
+			stats, err := coll.Stats()
+			if err != nil {
+				return nil, nil, err
+			}
+			return stats, coll.Histograms(), nil
+		},
+	}
+}
+
+// NewStoreCollector returns a prometheus.Collector of the StoreStats
+// and histograms of a store, including the sizes and the live and
+// dead bytes of the store's files, labeled by file name.  The
+// constLabels, which may be nil, are added to all the metrics.
+func NewStoreCollector(store *moss.Store, namespace string,
+	constLabels prometheus.Labels) prometheus.Collector {
+	fileDesc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "store", name),
+			help, []string{"file"}, constLabels)
+	}
+
+	sizeDesc := fileDesc("file_size_bytes",
+		"Size of a file of a moss store.")
+	liveDesc := fileDesc("file_live_bytes",
+		"Live bytes of a data file of a moss store.")
+	deadDesc := fileDesc("file_dead_bytes",
+		"Dead bytes of a data file of a moss store.")
+
+	return &collector{
+		fields: newFieldMetrics(reflect.TypeOf(moss.StoreStats{}),
+			namespace, "store", constLabels),
+		histograms: newHistogramMetrics(store.Histograms(),
+			namespace, "store", constLabels),
+		errDesc:   newErrDesc(namespace, "store", constLabels),
+		extraDesc: []*prometheus.Desc{sizeDesc, liveDesc, deadDesc},
+		stats: func() (interface{}, ghistogram.Histograms, error) {
+			stats, err := store.StatsEx()
+			if err != nil {
+				return nil, nil, err
+			}
+			return stats, store.Histograms(), nil
+		},
+		extra: func(stats interface{}, ch chan<- prometheus.Metric) {
+			for _, fs := range stats.(*moss.StoreStats).Files {
+				if fs.Exists && !fs.IsDir {
+					ch <- prometheus.MustNewConstMetric(sizeDesc,
+						prometheus.GaugeValue, float64(fs.Size), fs.Name)
+				}
+				if fs.Data {
+					ch <- prometheus.MustNewConstMetric(liveDesc,
+						prometheus.GaugeValue, float64(fs.LiveBytes), fs.Name)
+					ch <- prometheus.MustNewConstMetric(deadDesc,
+						prometheus.GaugeValue, float64(fs.DeadBytes), fs.Name)
+				}
+			}
+		},
+	}
+}
+
+// ------------------------------------------------------
+
+// collector implements prometheus.Collector for the stats struct and
+// histograms that are returned by the stats func.
+type collector struct {
+	fields     []*fieldMetric
+	histograms map[string]*histogramMetric
+	errDesc    *prometheus.Desc
+
+	extraDesc []*prometheus.Desc
+
+	stats func() (interface{}, ghistogram.Histograms, error)
+	extra func(stats interface{}, ch chan<- prometheus.Metric)
+}
+
+// Describe implements prometheus.Collector.
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, fm := range c.fields {
+		ch <- fm.desc
+	}
+
+	for _, hm := range c.histograms {
+		ch <- hm.desc
+	}
+
+	for _, desc := range c.extraDesc {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	stats, histograms, err := c.stats()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.errDesc, err)
+		return
+	}
+
+	sv := reflect.ValueOf(stats).Elem()
+	for _, fm := range c.fields {
+		fv := sv.Field(fm.index)
+
+		var v float64
+		switch fv.Kind() {
+		case reflect.Uint, reflect.Uint32, reflect.Uint64:
+			v = float64(fv.Uint())
+		default:
+			v = float64(fv.Int())
+		}
+
+		ch <- prometheus.MustNewConstMetric(fm.desc, fm.valueType, v/fm.divisor)
+	}
+
+	for name, hm := range c.histograms {
+		h := histograms[name]
+		if h != nil {
+			ch <- hm.metric(h)
+		}
+	}
+
+	if c.extra != nil {
+		c.extra(stats, ch)
+	}
+}
+
+func newErrDesc(namespace, subsystem string,
+	constLabels prometheus.Labels) *prometheus.Desc {
+	return prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "stats_error"),
+		"Error from retrieving the stats of moss.", nil, constLabels)
+}
+
+// ------------------------------------------------------
+
+// fieldMetric describes the metric of a numeric field of a stats
+// struct.
+type fieldMetric struct {
+	index     int
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	divisor   float64 // Converts values to base units.
+}
+
+// newFieldMetrics returns the fieldMetrics for the numeric fields of
+// a stats struct type.
+func newFieldMetrics(t reflect.Type, namespace, subsystem string,
+	constLabels prometheus.Labels) []*fieldMetric {
+	var rv []*fieldMetric
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		switch f.Type.Kind() {
+		case reflect.Uint, reflect.Uint32, reflect.Uint64,
+			reflect.Int, reflect.Int32, reflect.Int64:
+		default:
+			continue
+		}
+
+		name, valueType, divisor := metricName(f.Name)
+
+		rv = append(rv, &fieldMetric{
+			index: i,
+			desc: prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, subsystem, name),
+				fmt.Sprintf("%s.%s of moss.", t.Name(), f.Name),
+				nil, constLabels),
+			valueType: valueType,
+			divisor:   divisor,
+		})
+	}
+
+	return rv
+}
+
+// metricName converts the name of a stats field to a metric name, such
+// as TotPersistThrottledUsecs to persist_throttled_seconds_total,
+// along with the type of the metric and the divisor that converts its
+// values to base units.
+func metricName(fieldName string) (string, prometheus.ValueType, float64) {
+	valueType := prometheus.GaugeValue
+
+	name := fieldName
+	if strings.HasPrefix(name, "Tot") {
+		valueType = prometheus.CounterValue
+		name = name[len("Tot"):]
+	} else if strings.HasPrefix(name, "Cur") {
+		name = name[len("Cur"):]
+	} else if strings.HasPrefix(name, "Num") {
+		name = name[len("Num"):]
+	}
+
+	name, divisor := baseUnits(snakeCase(name))
+
+	if valueType == prometheus.CounterValue {
+		name += "_total"
+	}
+
+	return name, valueType, divisor
+}
+
+// baseUnits converts a snake case name whose values are in microseconds
+// to one whose values are in seconds, which is prometheus' base unit,
+// along with the divisor that converts the values.
+func baseUnits(name string) (string, float64) {
+	if strings.HasSuffix(name, "_usecs") {
+		return name[:len(name)-len("_usecs")] + "_seconds", 1e6
+	}
+	return name, 1.0
+}
+
+// snakeCase converts a CamelCase name to snake_case, keeping acronyms
+// together, such as GetOK to get_ok.
+func snakeCase(name string) string {
+	runes := []rune(name)
+
+	var rv []rune
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			if !unicode.IsUpper(prev) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				rv = append(rv, '_')
+			}
+		}
+		rv = append(rv, unicode.ToLower(r))
+	}
+
+	return string(rv)
+}
+
+// ------------------------------------------------------
+
+// histogramMetric describes the metric of a ghistogram.Histogram.
+type histogramMetric struct {
+	desc    *prometheus.Desc
+	divisor float64   // Converts data points to base units.
+	created time.Time // Approximates when the histogram was created.
+}
+
+// newHistogramMetrics returns the histogramMetrics for the given
+// histograms, keyed by histogram name.
+func newHistogramMetrics(histograms ghistogram.Histograms,
+	namespace, subsystem string,
+	constLabels prometheus.Labels) map[string]*histogramMetric {
+	rv := make(map[string]*histogramMetric, len(histograms))
+
+	now := time.Now()
+
+	for name := range histograms {
+		metricName, divisor := baseUnits(snakeCase(name))
+
+		rv[name] = &histogramMetric{
+			desc: prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, subsystem, metricName),
+				fmt.Sprintf("Histogram %s of moss.", name),
+				nil, constLabels),
+			divisor: divisor,
+			created: now,
+		}
+	}
+
+	return rv
+}
+
+// nativeHistogramSchema is the schema of the native histograms, where
+// the bucket boundaries grow by a factor of 2^(2^-3), or about 1.09,
+// which is the resolution of prometheus' default bucket factor of 1.1.
+const nativeHistogramSchema = 3
+
+// metric converts a ghistogram.Histogram to a prometheus native
+// histogram.  The bins of a ghistogram.Histogram hold the data points
+// from their range, up to but excluding the next bin's range, and as
+// the data points are integers, the inclusive upper bound of a bin is
+// the next bin's range minus 1, or the max data point for the last
+// bin.  The count of a bin is put into the native bucket of its
+// inclusive upper bound, as the data points of a bin can't be split
+// further, and a bin whose upper bound is 0 is put into the zero
+// bucket.
+func (hm *histogramMetric) metric(h *ghistogram.Histogram) prometheus.Metric {
+	buckets := make(map[int]int64, len(h.Ranges))
+
+	var count, sum, zero uint64
+
+	h.CallSync(func() {
+		for i, c := range h.Counts {
+			if c == 0 {
+				continue
+			}
+
+			upper := h.MaxDataPoint
+			if i+1 < len(h.Ranges) && h.Ranges[i+1]-1 < upper {
+				upper = h.Ranges[i+1] - 1
+			}
+			if upper == 0 {
+				zero += c
+				continue
+			}
+
+			buckets[nativeBucket(float64(upper)/hm.divisor)] += int64(c)
+		}
+
+		count, sum = h.TotCount, h.TotDataPoint
+	})
+
+	return prometheus.MustNewConstNativeHistogram(hm.desc,
+		count, float64(sum)/hm.divisor, buckets, nil, zero,
+		nativeHistogramSchema, 0, hm.created)
+}
+
+// nativeBucket returns the index of the native histogram bucket of a
+// positive value, where bucket i holds the values in the range of
+// (2^((i-1)*2^-schema), 2^(i*2^-schema)].
+func nativeBucket(v float64) int {
+	return int(math.Ceil(math.Log2(v) * (1 << nativeHistogramSchema)))
+}
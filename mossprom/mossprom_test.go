@@ -0,0 +1,203 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package mossprom
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/ghistogram"
+	"github.com/couchbase/moss"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMetricName(t *testing.T) {
+	tests := []struct {
+		fieldName    string
+		expName      string
+		expValueType prometheus.ValueType
+		expDivisor   float64
+	}{
+		{"TotGet", "get_total", prometheus.CounterValue, 1},
+		{"TotExecuteBatchBeg", "execute_batch_beg_total", prometheus.CounterValue, 1},
+		{"CurDirtyTopOps", "dirty_top_ops", prometheus.GaugeValue, 1},
+		{"NumBytesLive", "bytes_live", prometheus.GaugeValue, 1},
+		{"MaxCompactionUsecs", "max_compaction_seconds", prometheus.GaugeValue, 1e6},
+		{"TotCompactionThrottledUsecs", "compaction_throttled_seconds_total",
+			prometheus.CounterValue, 1e6},
+		{"TotGetOK", "get_ok_total", prometheus.CounterValue, 1},
+		{"NumFilesOpen", "files_open", prometheus.GaugeValue, 1},
+	}
+
+	for _, test := range tests {
+		name, valueType, divisor := metricName(test.fieldName)
+		if name != test.expName || valueType != test.expValueType ||
+			divisor != test.expDivisor {
+			t.Errorf("fieldName: %s, got: %s, %v, %v, expected: %+v",
+				test.fieldName, name, valueType, divisor, test)
+		}
+	}
+}
+
+func TestHistogramMetric(t *testing.T) {
+	h := ghistogram.NewNamedHistogram("ExecuteBatchUsecs", 10, 4, 4)
+	h.Add(3, 1)
+	h.Add(4, 1)
+	h.Add(4, 1)
+	h.Add(15, 1)
+	h.Add(100000000, 1)
+
+	hms := newHistogramMetrics(ghistogram.Histograms{"ExecuteBatchUsecs": h},
+		"moss", "collection", nil)
+
+	var m dto.Metric
+	err := hms["ExecuteBatchUsecs"].metric(h).Write(&m)
+	if err != nil {
+		t.Fatalf("expected write to work, err: %v", err)
+	}
+
+	if m.Histogram.GetSampleCount() != 5 ||
+		m.Histogram.GetSampleSum() != float64(3+4+4+15+100000000)/1e6 {
+		t.Errorf("unexpected histogram: %+v", m.Histogram)
+	}
+
+	if m.Histogram.GetSchema() != nativeHistogramSchema ||
+		m.Histogram.GetZeroCount() != 0 ||
+		len(m.Histogram.GetBucket()) != 0 {
+		t.Errorf("unexpected histogram: %+v", m.Histogram)
+	}
+
+	// The ranges are 0, 4, 16, 64, ..., so the inclusive upper bounds
+	// are 3, 15, 63, ... microseconds, except for the last bin, whose
+	// upper bound is the max data point of 100 seconds.
+	buckets := nativeBuckets(m.Histogram)
+	exp := map[int]int64{
+		-146: 1, // (2.94e-6, 3.21e-6]
+		-128: 3, // (1.43e-5, 1.56e-5]
+		54:   1, // (9.51e+1, 1.04e+2]
+	}
+	if !reflect.DeepEqual(buckets, exp) {
+		t.Errorf("unexpected buckets: %v, expected: %v", buckets, exp)
+	}
+}
+
+// nativeBuckets returns the counts of the positive buckets of a native
+// histogram, keyed by bucket index.
+func nativeBuckets(h *dto.Histogram) map[int]int64 {
+	rv := map[int]int64{}
+
+	var index int
+	var count int64
+	deltas := h.GetPositiveDelta()
+	for _, span := range h.GetPositiveSpan() {
+		index += int(span.GetOffset())
+		for i := uint32(0); i < span.GetLength(); i++ {
+			count += deltas[0]
+			deltas = deltas[1:]
+			if count != 0 {
+				rv[index] = count
+			}
+			index++
+		}
+	}
+
+	return rv
+}
+
+func TestCollectors(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossprom")
+	defer os.RemoveAll(tmpDir)
+
+	store, coll, err := moss.OpenStoreCollection(tmpDir,
+		moss.StoreOptions{}, moss.StorePersistOptions{})
+	if err != nil {
+		t.Fatalf("expected open store collection to work, err: %v", err)
+	}
+
+	b, _ := coll.NewBatch(0, 0)
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("%04d", i)
+		b.Set([]byte(k), []byte(k))
+	}
+	coll.ExecuteBatch(b, moss.WriteOptions{})
+	b.Close()
+
+	coll.Get([]byte("0001"), moss.ReadOptions{})
+
+	// Wait for the batch to be persisted.
+	for i := 0; ; i++ {
+		stats, _ := coll.Stats()
+		if stats.TotPersisterLowerLevelUpdateEnd > 0 && stats.CurDirtyOps == 0 {
+			break
+		}
+		if i > 1000 {
+			t.Fatalf("expected the batch to be persisted, stats: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	labels := prometheus.Labels{"collection": "test"}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewCollectionCollector(coll, "moss", labels))
+	reg.MustRegister(NewStoreCollector(store, "moss", labels))
+
+	server := httptest.NewServer(
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected get to work, err: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected metrics, status: %d, err: %v",
+			resp.StatusCode, err)
+	}
+
+	metrics := string(body)
+
+	for _, exp := range []string{
+		"# TYPE moss_collection_get_total counter",
+		`moss_collection_get_total{collection="test"} 1`,
+		`moss_collection_execute_batch_beg_total{collection="test"} 1`,
+		"# TYPE moss_collection_dirty_ops gauge",
+		"# TYPE moss_collection_execute_batch_seconds histogram",
+		`moss_collection_execute_batch_seconds_count{collection="test"} 1`,
+		"# TYPE moss_store_persists_total counter",
+		`moss_store_persists_total{collection="test"} 1`,
+		"# TYPE moss_store_bytes_live gauge",
+		"# TYPE moss_store_persist_seconds histogram",
+		`moss_store_persist_seconds_bucket{collection="test",le="+Inf"} 1`,
+		`moss_store_file_live_bytes{collection="test",file="data-0000000000000001.moss"}`,
+		`moss_store_file_size_bytes{collection="test",file="data-0000000000000001.moss"}`,
+	} {
+		if !strings.Contains(metrics, exp) {
+			t.Errorf("expected metrics to contain: %s, metrics: %s",
+				exp, metrics)
+		}
+	}
+
+	coll.Close()
+	store.Close()
+}
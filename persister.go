@@ -47,8 +47,8 @@ OUTER:
 			//
 			// So, we notify/awake the merger here so that it can feed
 			// stackDirtyMid down to the persister as stackDirtyBase.
-			if (m.stackDirtyMid != nil && len(m.stackDirtyMid.a) > 0) &&
-				(m.stackDirtyTop == nil || len(m.stackDirtyTop.a) <= 0) {
+			if (m.stackDirtyMid != nil && !m.stackDirtyMid.isEmpty()) &&
+				(m.stackDirtyTop == nil || m.stackDirtyTop.isEmpty()) {
 				m.NotifyMerger("from-persister", false)
 			}
 
@@ -89,6 +89,8 @@ OUTER:
 
 		m.invalidateLatestSnapshotLOCKED()
 
+		m.releasePersistedCloneBasesLOCKED(stackDirtyBase)
+
 		stackCleanPrev = m.stackClean
 		if m.options.CachePersisted {
 			m.stackClean = m.stackDirtyBase
@@ -104,9 +106,20 @@ OUTER:
 
 		llssPrev := m.lowerLevelSnapshot
 		m.lowerLevelSnapshot = NewSnapshotWrapper(llssNext, nil)
+		m.readCache.reset()
+
+		stackCleanEvicted := m.evictCleanLOCKED()
 
 		m.m.Unlock()
 
+		// Awake any ExecuteBatch()'ers that are waiting for the dirty
+		// segments to be under the MemoryQuota.
+		m.stackDirtyTopCond.Broadcast()
+
+		if stackCleanEvicted != nil {
+			stackCleanEvicted.Close()
+		}
+
 		if stackDirtyBasePrev != nil {
 			stackDirtyBasePrev.Close()
 		}
@@ -130,7 +143,6 @@ OUTER:
 		m.fireEvent(EventKindPersisterProgress, time.Now().Sub(startTime))
 	}
 
-	// TODO: More advanced eviction of stackClean.
 	// TODO: Timer based eviction of stackClean?
 	// TODO: Randomized eviction?
 	// TODO: Merging of stackClean to 1 level?
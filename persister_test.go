@@ -20,6 +20,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 // Implementation of mock lower-level iterator, using map that's
@@ -126,6 +127,37 @@ func (p *TestPersister) Get(key []byte,
 	return p.kvpairs[string(key)], nil
 }
 
+func (p *TestPersister) GetMulti(keys [][]byte,
+	readOptions ReadOptions) ([][]byte, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	rv := make([][]byte, len(keys))
+	for i, key := range keys {
+		rv[i] = p.kvpairs[string(key)]
+	}
+	return rv, nil
+}
+
+func (p *TestPersister) EstimateRange(startKeyInclusive,
+	endKeyExclusive []byte) (*RangeEstimate, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	rv := &RangeEstimate{}
+	for k, v := range p.kvpairs {
+		if k >= string(startKeyInclusive) &&
+			(endKeyExclusive == nil || k < string(endKeyExclusive)) {
+			rv.Ops++
+			rv.KeyBytes += uint64(len(k))
+			rv.ValBytes += uint64(len(v))
+		}
+	}
+	rv.MaxSegmentOps = rv.Ops
+	if rv.Ops > 0 {
+		rv.Segments = 1
+	}
+	return rv, nil
+}
+
 func (p *TestPersister) StartIterator(
 	startKeyInclusive, endKeyExclusive []byte,
 	iteratorOptions IteratorOptions) (Iterator, error) {
@@ -674,6 +706,37 @@ func (p *testPersister) Get(key []byte,
 	return p.kvpairs[string(key)], nil
 }
 
+func (p *testPersister) GetMulti(keys [][]byte,
+	readOptions ReadOptions) ([][]byte, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	rv := make([][]byte, len(keys))
+	for i, key := range keys {
+		rv[i] = p.kvpairs[string(key)]
+	}
+	return rv, nil
+}
+
+func (p *testPersister) EstimateRange(startKeyInclusive,
+	endKeyExclusive []byte) (*RangeEstimate, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	rv := &RangeEstimate{}
+	for k, v := range p.kvpairs {
+		if k >= string(startKeyInclusive) &&
+			(endKeyExclusive == nil || k < string(endKeyExclusive)) {
+			rv.Ops++
+			rv.KeyBytes += uint64(len(k))
+			rv.ValBytes += uint64(len(v))
+		}
+	}
+	rv.MaxSegmentOps = rv.Ops
+	if rv.Ops > 0 {
+		rv.Segments = 1
+	}
+	return rv, nil
+}
+
 func (p *testPersister) StartIterator(
 	startKeyInclusive, endKeyExclusive []byte,
 	iteratorOptions IteratorOptions) (Iterator, error) {
@@ -1212,3 +1275,314 @@ func Test_JustLoad1Mitems(b *testing.T) {
 		b.Fatalf("Error closing child collection")
 	}
 }
+
+func TestMemoryQuotaEviction(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	so := DefaultStoreOptions
+	so.CollectionOptions.CachePersisted = true
+	so.CollectionOptions.MemoryQuota = 1000
+
+	store, coll, err := OpenStoreCollection(tmpDir, so,
+		StorePersistOptions{CompactionConcern: CompactionDisable})
+	if err != nil {
+		t.Fatalf("expected open, err: %v", err)
+	}
+	defer store.Close()
+	defer coll.Close()
+
+	for i := 0; i < 10; i++ {
+		b, _ := coll.NewBatch(0, 0)
+		for j := 0; j < 100; j++ {
+			b.Set([]byte(fmt.Sprintf("%03d-%03d", i, j)), []byte("0123456789"))
+		}
+		err = coll.ExecuteBatch(b, WriteOptions{})
+		if err != nil {
+			t.Fatalf("expected batch, err: %v", err)
+		}
+		b.Close()
+	}
+
+	waitForChildPersistence(t, coll)
+
+	stats, _ := coll.Stats()
+	if stats.TotEvictSegments <= 0 || stats.TotEvictBytes <= 0 {
+		t.Errorf("expected evictions, stats: %+v", stats)
+	}
+	if stats.CurMemoryBytes > so.CollectionOptions.MemoryQuota ||
+		stats.CurCleanBytes > so.CollectionOptions.MemoryQuota {
+		t.Errorf("expected within quota, stats: %+v", stats)
+	}
+	if stats.TotExecuteBatchQuotaWaitBeg != stats.TotExecuteBatchQuotaWaitEnd {
+		t.Errorf("expected no quota waiters, stats: %+v", stats)
+	}
+
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 100; j++ {
+			v, err := coll.Get([]byte(fmt.Sprintf("%03d-%03d", i, j)),
+				ReadOptions{})
+			if err != nil || string(v) != "0123456789" {
+				t.Fatalf("expected val after eviction, i: %d, j: %d,"+
+					" v: %q, err: %v", i, j, v, err)
+			}
+		}
+	}
+}
+
+func TestMemoryQuotaEvictionPolicy(t *testing.T) {
+	newCleanSegment := func(keys ...string) Segment {
+		a, _ := newSegment(0, 0)
+		for _, key := range keys {
+			a.Set([]byte(key), []byte("val"))
+		}
+		return a
+	}
+
+	tests := []struct {
+		policy  EvictionPolicy
+		keys    [][]string
+		reads   []string
+		expKeys []string // The smallest key of each remaining segment.
+	}{
+		{EvictOldestSegments,
+			[][]string{{"a", "b"}, {"c", "d"}, {"e", "f"}},
+			[]string{"a"},
+			[]string{"c", "e"}},
+		{EvictLRURange,
+			[][]string{{"a", "b"}, {"c", "d"}, {"e", "f"}},
+			[]string{"a", "e"},
+			[]string{"a", "e"}},
+		{EvictLRURange,
+			[][]string{{"a", "b"}, {"c", "d"}, {"e", "f"}},
+			[]string{"c", "a", "e", "c"},
+			[]string{"c", "e"}},
+		{EvictLRURange, // The overlapping segment can't be evicted.
+			[][]string{{"a", "d"}, {"c", "e"}, {"f", "g"}},
+			[]string{"a", "g"},
+			[]string{"c", "f"}},
+	}
+
+	for testi, test := range tests {
+		mc, _ := NewCollection(CollectionOptions{
+			MemoryQuota:    16,
+			EvictionPolicy: test.policy,
+			LowerLevelUpdate: func(higher Snapshot) (Snapshot, error) {
+				return nil, nil
+			},
+		})
+		m := mc.(*collection)
+
+		m.stackClean = &segmentStack{options: m.options, refs: 1}
+		for _, keys := range test.keys {
+			m.stackClean.a = append(m.stackClean.a, newCleanSegment(keys...))
+		}
+
+		for _, key := range test.reads {
+			m.touchClean(m.stackClean, []byte(key))
+		}
+
+		m.m.Lock()
+		m.evictCleanLOCKED()
+		m.m.Unlock()
+
+		var gotKeys []string
+		for _, seg := range m.stackClean.a {
+			kMin, _, _ := segmentKeyRange(seg)
+			gotKeys = append(gotKeys, string(kMin))
+		}
+		if strings.Join(gotKeys, ",") != strings.Join(test.expKeys, ",") {
+			t.Errorf("testi: %d, expected segments: %v, got: %v",
+				testi, test.expKeys, gotKeys)
+		}
+		if m.stats.TotEvictSegments != 1 {
+			t.Errorf("testi: %d, expected 1 eviction, stats: %+v",
+				testi, m.stats)
+		}
+	}
+}
+
+func TestMemoryQuotaEvictionReads(t *testing.T) {
+	mc, _ := NewCollection(CollectionOptions{
+		MemoryQuota:    1000,
+		EvictionPolicy: EvictLRURange,
+		LowerLevelUpdate: func(higher Snapshot) (Snapshot, error) {
+			return nil, nil
+		},
+	})
+	m := mc.(*collection)
+
+	m.stackClean = &segmentStack{options: m.options, refs: 1}
+	for _, keys := range [][]string{{"a", "b"}, {"c", "d"}, {"e", "f"}} {
+		a, _ := newSegment(0, 0)
+		for _, key := range keys {
+			a.Set([]byte(key), []byte("val"))
+		}
+		m.stackClean.a = append(m.stackClean.a, a)
+	}
+
+	m.Get([]byte("c"), ReadOptions{})
+	m.GetMulti([][]byte{[]byte("e"), []byte("x")}, ReadOptions{})
+
+	var lastReads []uint64
+	for _, seg := range m.stackClean.a {
+		lastReads = append(lastReads, seg.(*segment).lastRead)
+	}
+	if fmt.Sprintf("%v", lastReads) != "[0 1 2]" {
+		t.Errorf("expected reads to be recorded, got: %v", lastReads)
+	}
+}
+
+func TestReadCache(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	so := DefaultStoreOptions
+	so.CollectionOptions.ReadCacheBytes = 1000
+
+	store, coll, err := OpenStoreCollection(tmpDir, so,
+		StorePersistOptions{CompactionConcern: CompactionDisable})
+	if err != nil {
+		t.Fatalf("expected open, err: %v", err)
+	}
+	defer store.Close()
+	defer coll.Close()
+
+	set := func(key, val string) {
+		b, _ := coll.NewBatch(0, 0)
+		if val != "" {
+			b.Set([]byte(key), []byte(val))
+		} else {
+			b.Del([]byte(key))
+		}
+		err := coll.ExecuteBatch(b, WriteOptions{})
+		if err != nil {
+			t.Fatalf("expected batch, err: %v", err)
+		}
+		b.Close()
+	}
+
+	get := func(key, expVal string, expHit, expMiss uint64) {
+		v, err := coll.Get([]byte(key), ReadOptions{})
+		if err != nil || string(v) != expVal || (expVal == "" && v != nil) {
+			t.Errorf("key: %s, expected val: %q, got: %q, err: %v",
+				key, expVal, v, err)
+		}
+		stats, _ := coll.Stats()
+		if stats.TotReadCacheHit != expHit ||
+			stats.TotReadCacheMiss != expMiss {
+			t.Errorf("key: %s, expected hit/miss: %d/%d, stats: %+v",
+				key, expHit, expMiss, stats)
+		}
+	}
+
+	set("a", "A")
+	set("b", "B")
+	waitForChildPersistence(t, coll)
+
+	get("a", "A", 0, 1)
+	get("a", "A", 1, 1)
+	get("x", "", 1, 2)
+	get("x", "", 2, 2) // A cached negative lookup.
+
+	vals, err := coll.GetMulti([][]byte{[]byte("a"), []byte("b")},
+		ReadOptions{})
+	if err != nil || string(vals[0]) != "A" || string(vals[1]) != "B" {
+		t.Errorf("expected GetMulti vals, got: %q, err: %v", vals, err)
+	}
+	get("b", "B", 4, 3)
+
+	// Unpersisted mutations take precedence over the cache.
+	set("a", "AA")
+	set("x", "X")
+	get("a", "AA", 4, 3)
+	get("x", "X", 4, 3)
+
+	// Persistence resets the cache.
+	waitForChildPersistence(t, coll)
+
+	stats, _ := coll.Stats()
+	if stats.CurReadCacheEntries != 0 || stats.CurReadCacheBytes != 0 {
+		t.Errorf("expected reset read cache, stats: %+v", stats)
+	}
+
+	get("a", "AA", 4, 4)
+	get("a", "AA", 5, 4)
+
+	set("a", "")
+	waitForChildPersistence(t, coll)
+	get("a", "", 5, 5)
+	get("a", "", 6, 5)
+
+	// The cache is bounded.
+	for i := 0; i < 100; i++ {
+		coll.Get([]byte(fmt.Sprintf("missing-%d", i)), ReadOptions{})
+	}
+
+	stats, _ = coll.Stats()
+	if stats.CurReadCacheBytes > so.CollectionOptions.ReadCacheBytes ||
+		stats.CurReadCacheEntries <= 0 {
+		t.Errorf("expected bounded read cache, stats: %+v", stats)
+	}
+}
+
+func TestReadCacheTTL(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	so := DefaultStoreOptions
+	so.CollectionOptions.ReadCacheBytes = 1000
+
+	store, coll, err := OpenStoreCollection(tmpDir, so,
+		StorePersistOptions{CompactionConcern: CompactionDisable})
+	if err != nil {
+		t.Fatalf("expected open, err: %v", err)
+	}
+	defer store.Close()
+	defer coll.Close()
+
+	ttl := 100 * time.Millisecond
+
+	b, _ := coll.NewBatch(0, 0)
+	b.SetWithTTL([]byte("a"), []byte("A"), ttl)
+	b.SetWithTTL([]byte("b"), []byte("B"), ttl)
+	b.Set([]byte("c"), []byte("C"))
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+	waitForChildPersistence(t, coll)
+
+	keys := [][]byte{[]byte("b"), []byte("c")}
+
+	// Fill the cache and then hit it.
+	for i := 0; i < 2; i++ {
+		v, err := coll.Get([]byte("a"), ReadOptions{})
+		if err != nil || string(v) != "A" {
+			t.Errorf("expected unexpired val, got: %q, err: %v", v, err)
+		}
+		vals, err := coll.GetMulti(keys, ReadOptions{})
+		if err != nil || string(vals[0]) != "B" || string(vals[1]) != "C" {
+			t.Errorf("expected unexpired vals, got: %q, err: %v", vals, err)
+		}
+	}
+
+	stats, _ := coll.Stats()
+	if stats.TotReadCacheHit != 3 || stats.TotReadCacheMiss != 3 {
+		t.Errorf("expected cached vals, stats: %+v", stats)
+	}
+
+	time.Sleep(ttl + 10*time.Millisecond)
+
+	v, err := coll.Get([]byte("a"), ReadOptions{})
+	if err != nil || v != nil {
+		t.Errorf("expected expired val, got: %q, err: %v", v, err)
+	}
+	vals, err := coll.GetMulti(keys, ReadOptions{})
+	if err != nil || vals[0] != nil || string(vals[1]) != "C" {
+		t.Errorf("expected expired val, got: %q, err: %v", vals, err)
+	}
+
+	stats, _ = coll.Stats()
+	if stats.TotReadCacheHit != 4 || stats.TotReadCacheMiss != 5 {
+		t.Errorf("expected expired vals as misses, stats: %+v", stats)
+	}
+}
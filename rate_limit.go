@@ -0,0 +1,125 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package moss
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimitChunkBytes is the max number of bytes of a single write
+// through a rateLimiter, so that large writes are spread out over time.
+var rateLimitChunkBytes = 64 * 1024
+
+// A rateLimiter limits writes to a number of bytes per second, which
+// is shared by all the writers that use the rateLimiter.
+type rateLimiter struct {
+	bytesPerSec int64
+
+	m sync.Mutex // Protects the fields that follow.
+
+	// The time when the bytes allowed so far will have been written
+	// at the rate of bytesPerSec.
+	next time.Time
+
+	totThrottled      uint64 // Number of writes that were delayed.
+	totThrottledNanos uint64 // Total time that writes were delayed.
+}
+
+// newRateLimiter returns a rateLimiter, or nil when bytesPerSec is
+// <= 0, meaning writes are not limited.
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{bytesPerSec: bytesPerSec}
+}
+
+// wait blocks until n more bytes may be written.
+func (r *rateLimiter) wait(n int) {
+	r.m.Lock()
+
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+
+	delay := r.next.Sub(now)
+
+	r.next = r.next.Add(
+		time.Duration(int64(n) * int64(time.Second) / r.bytesPerSec))
+
+	if delay > 0 {
+		r.totThrottled++
+		r.totThrottledNanos += uint64(delay)
+	}
+
+	r.m.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// stats returns the number of writes that were delayed and the total
+// time that they were delayed.
+func (r *rateLimiter) stats() (totThrottled, totThrottledNanos uint64) {
+	if r == nil {
+		return 0, 0
+	}
+
+	r.m.Lock()
+	totThrottled, totThrottledNanos = r.totThrottled, r.totThrottledNanos
+	r.m.Unlock()
+
+	return totThrottled, totThrottledNanos
+}
+
+// ------------------------------------------------------
+
+// rateLimitedFile is a File whose WriteAt()'s are limited by a
+// rateLimiter.
+type rateLimitedFile struct {
+	File
+	limiter *rateLimiter
+}
+
+// rateLimitFile returns a File whose writes are limited by the
+// rateLimiter, or the file itself when the rateLimiter is nil.
+func rateLimitFile(file File, limiter *rateLimiter) File {
+	if limiter == nil {
+		return file
+	}
+	return &rateLimitedFile{File: file, limiter: limiter}
+}
+
+func (f *rateLimitedFile) WriteAt(p []byte, off int64) (nn int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > rateLimitChunkBytes {
+			chunk = chunk[:rateLimitChunkBytes]
+		}
+
+		f.limiter.wait(len(chunk))
+
+		n, err := f.File.WriteAt(chunk, off)
+		nn += n
+		if err != nil {
+			return nn, err
+		}
+
+		p = p[n:]
+		off += int64(n)
+	}
+
+	return nn, nil
+}
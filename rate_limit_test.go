@@ -0,0 +1,133 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package moss
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedFile(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	if newRateLimiter(0) != nil {
+		t.Errorf("expected no rateLimiter for 0 bytesPerSec")
+	}
+
+	file, err := os.Create(path.Join(tmpDir, "test.file"))
+	if err != nil {
+		t.Fatalf("expected create to work, err: %v", err)
+	}
+	defer file.Close()
+
+	if rateLimitFile(file, nil) != file {
+		t.Errorf("expected no wrapping without a rateLimiter")
+	}
+
+	limiter := newRateLimiter(1024 * 1024)
+
+	buf := bytes.Repeat([]byte("0123456789abcdef"), 4*rateLimitChunkBytes/16)
+
+	startTime := time.Now()
+
+	n, err := rateLimitFile(file, limiter).WriteAt(buf, 100)
+	if err != nil || n != len(buf) {
+		t.Fatalf("expected WriteAt to work, n: %d, err: %v", n, err)
+	}
+
+	// The 4 chunks at 1MB/sec should take at least ~3/16th sec.
+	if time.Since(startTime) < 150*time.Millisecond {
+		t.Errorf("expected writes to be throttled, took: %v",
+			time.Since(startTime))
+	}
+
+	totThrottled, totThrottledNanos := limiter.stats()
+	if totThrottled != 3 || totThrottledNanos <= 0 {
+		t.Errorf("expected throttled stats, got: %d, %d",
+			totThrottled, totThrottledNanos)
+	}
+
+	readBuf := make([]byte, len(buf))
+	_, err = file.ReadAt(readBuf, 100)
+	if err != nil || !bytes.Equal(readBuf, buf) {
+		t.Errorf("expected written bytes, err: %v", err)
+	}
+}
+
+func TestStoreCompactionRateLimit(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	store, err := OpenStore(tmpDir, StoreOptions{
+		CompactionWriteBytesPerSec: 10 * 1024 * 1024,
+		PersistWriteBytesPerSec:    10 * 1024 * 1024,
+	})
+	if err != nil {
+		t.Fatalf("expected OpenStore to work, err: %v", err)
+	}
+
+	coll, _ := NewCollection(CollectionOptions{})
+	coll.Start()
+
+	val := bytes.Repeat([]byte("v"), 100)
+
+	b, _ := coll.NewBatch(0, 0)
+	for i := 0; i < 2000; i++ {
+		b.Set([]byte(fmt.Sprintf("%08d", i)), val)
+	}
+	err = coll.ExecuteBatch(b, WriteOptions{})
+	if err != nil {
+		t.Fatalf("expected ExecuteBatch to work, err: %v", err)
+	}
+	b.Close()
+
+	ss, _ := coll.Snapshot()
+	llss, err := store.Persist(ss, StorePersistOptions{})
+	if err != nil {
+		t.Fatalf("expected persist to work, err: %v", err)
+	}
+	llss.Close()
+
+	llss, err = store.Persist(ss,
+		StorePersistOptions{CompactionConcern: CompactionForce})
+	if err != nil {
+		t.Fatalf("expected compaction to work, err: %v", err)
+	}
+	llss.Close()
+	ss.Close()
+
+	stats, _ := store.Stats()
+	for _, name := range []string{
+		"total_compaction_throttled", "total_compaction_throttled_usecs",
+		"total_persist_throttled", "total_persist_throttled_usecs",
+	} {
+		if stats[name].(uint64) <= 0 {
+			t.Errorf("expected stat %s > 0, stats: %v", name, stats)
+		}
+	}
+
+	ss, _ = store.Snapshot()
+	v, err := ss.Get([]byte("00001999"), ReadOptions{})
+	if err != nil || !bytes.Equal(v, val) {
+		t.Errorf("expected compacted val, got: %s, err: %v", v, err)
+	}
+	ss.Close()
+
+	coll.Close()
+	store.Close()
+}
@@ -0,0 +1,255 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package moss
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readCacheEntryOverhead is the approximate number of bytes used by
+// a readCache entry in addition to its key and val.
+const readCacheEntryOverhead = 64
+
+// A readCache is a bounded, least recently used cache of the key-vals
+// read from the lower level snapshot of a collection, including the
+// keys that were not found.  The readCache is associated with a
+// generation of the lower level snapshot, and is reset when the
+// collection's lower level snapshot is replaced, such as after a
+// persistence or compaction.  Entries from a prior generation are
+// never cached, so concurrent readers of an older lower level
+// snapshot do not pollute the readCache.  As the lower level snapshot
+// is immutable, the vals of TTL entries are cached along with their
+// expiry, and are treated as cache misses once expired.
+type readCache struct {
+	m sync.Mutex // Protects the fields that follow.
+
+	maxBytes uint64
+	curBytes uint64
+
+	gen uint64
+
+	entries map[string]*list.Element // Values are *readCacheEntry.
+	lru     *list.List               // Most recently used at the front.
+}
+
+type readCacheEntry struct {
+	key    string
+	val    []byte // A nil val means the key was not found.
+	expiry int64  // Unix nanoseconds, where 0 means no expiry.
+}
+
+func newReadCache(maxBytes uint64) *readCache {
+	return &readCache{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// generation returns the current generation of the readCache.
+func (c *readCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.m.Lock()
+	gen := c.gen
+	c.m.Unlock()
+
+	return gen
+}
+
+// reset drops all the entries of the readCache and starts a new
+// generation.
+func (c *readCache) reset() {
+	if c == nil {
+		return
+	}
+
+	c.m.Lock()
+	c.gen++
+	c.curBytes = 0
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.m.Unlock()
+}
+
+// get returns the cached val of a key, where found is false on a
+// cache miss, including when the cached val has expired as of the
+// given now in unix nanoseconds.  The returned val must be treated as
+// immutable.
+func (c *readCache) get(gen uint64, key []byte, now int64) (
+	val []byte, found bool) {
+	c.m.Lock()
+	if c.gen == gen {
+		var e *list.Element
+		e, found = c.entries[string(key)]
+		if found {
+			entry := e.Value.(*readCacheEntry)
+			if entry.expiry != 0 && entry.expiry <= now {
+				c.removeLOCKED(e)
+				found = false
+			} else {
+				c.lru.MoveToFront(e)
+				val = entry.val
+			}
+		}
+	}
+	c.m.Unlock()
+
+	return val, found
+}
+
+// put caches a copy of the val of a key that was read from the lower
+// level snapshot of the given generation, where an expiry of 0 means
+// the val does not expire.
+func (c *readCache) put(gen uint64, key, val []byte, expiry int64) {
+	size := uint64(len(key)+len(val)) + readCacheEntryOverhead
+	if size > c.maxBytes {
+		return
+	}
+
+	if val != nil {
+		val = append(make([]byte, 0, len(val)), val...)
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.gen != gen {
+		return
+	}
+
+	if e, exists := c.entries[string(key)]; exists {
+		c.removeLOCKED(e)
+	}
+
+	for c.curBytes+size > c.maxBytes {
+		c.removeLOCKED(c.lru.Back())
+	}
+
+	c.entries[string(key)] =
+		c.lru.PushFront(&readCacheEntry{key: string(key), val: val,
+			expiry: expiry})
+	c.curBytes += size
+}
+
+func (c *readCache) removeLOCKED(e *list.Element) {
+	entry := c.lru.Remove(e).(*readCacheEntry)
+	delete(c.entries, entry.key)
+	c.curBytes -= uint64(len(entry.key)+len(entry.val)) +
+		readCacheEntryOverhead
+}
+
+// stats returns the number of entries and bytes of the readCache.
+func (c *readCache) stats() (entries, bytes uint64) {
+	if c == nil {
+		return 0, 0
+	}
+
+	c.m.Lock()
+	entries, bytes = uint64(len(c.entries)), c.curBytes
+	c.m.Unlock()
+
+	return entries, bytes
+}
+
+// ------------------------------------------------------
+
+// lowerLevelGet retrieves a val from the lower level snapshot, where
+// the readCache of the collection, if any, is consulted first, and is
+// of the generation that was current when the lower level snapshot
+// was retrieved.
+func (m *collection) lowerLevelGet(lower Snapshot, readCacheGen uint64,
+	key []byte, readOptions ReadOptions) ([]byte, error) {
+	if m.readCache == nil || readOptions.SkipLowerLevel {
+		return lower.Get(key, readOptions)
+	}
+
+	val, found := m.readCache.get(readCacheGen, key, time.Now().UnixNano())
+	if found {
+		atomic.AddUint64(&m.stats.TotReadCacheHit, 1)
+
+		return readCacheVal(val, readOptions), nil
+	}
+
+	atomic.AddUint64(&m.stats.TotReadCacheMiss, 1)
+
+	readOptions.expiries = map[string]int64{}
+
+	val, err := lower.Get(key, readOptions)
+	if err == nil {
+		m.readCache.put(readCacheGen, key, val,
+			readOptions.expiries[string(key)])
+	}
+
+	return val, err
+}
+
+// lowerLevelGetMulti is the multi-key form of lowerLevelGet(), where
+// only the keys that miss the readCache are retrieved from the lower
+// level snapshot.
+func (m *collection) lowerLevelGetMulti(lower Snapshot, readCacheGen uint64,
+	keys [][]byte, readOptions ReadOptions) ([][]byte, error) {
+	if m.readCache == nil || readOptions.SkipLowerLevel {
+		return lower.GetMulti(keys, readOptions)
+	}
+
+	vals := make([][]byte, len(keys))
+
+	var missIdxs []int
+	var missKeys [][]byte
+
+	now := time.Now().UnixNano()
+
+	for i, key := range keys {
+		val, found := m.readCache.get(readCacheGen, key, now)
+		if found {
+			vals[i] = readCacheVal(val, readOptions)
+		} else {
+			missIdxs = append(missIdxs, i)
+			missKeys = append(missKeys, key)
+		}
+	}
+
+	atomic.AddUint64(&m.stats.TotReadCacheHit, uint64(len(keys)-len(missKeys)))
+	atomic.AddUint64(&m.stats.TotReadCacheMiss, uint64(len(missKeys)))
+
+	if len(missKeys) > 0 {
+		readOptions.expiries = map[string]int64{}
+
+		missVals, err := lower.GetMulti(missKeys, readOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, missIdx := range missIdxs {
+			vals[missIdx] = missVals[i]
+
+			m.readCache.put(readCacheGen, missKeys[i], missVals[i],
+				readOptions.expiries[string(missKeys[i])])
+		}
+	}
+
+	return vals, nil
+}
+
+// readCacheVal returns a cached val as the readOptions ask for it.
+func readCacheVal(val []byte, readOptions ReadOptions) []byte {
+	if val == nil || readOptions.NoCopyValue {
+		return val
+	}
+	return append(make([]byte, 0, len(val)), val...)
+}
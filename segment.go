@@ -14,6 +14,7 @@ package moss
 import (
 	"bytes"
 	"fmt"
+	"hash/crc32"
 	"sort"
 )
 
@@ -101,6 +102,12 @@ type SegmentPersister interface {
 // is pushed into the collection.  A segment implements the Batch
 // interface.
 type segment struct {
+	// lastRead is the collection's cleanReadTick of the most recent
+	// read of this segment while it was clean, for the EvictLRURange
+	// policy, and is accessed atomically, so it's the first field for
+	// 64-bit alignment.
+	lastRead uint64
+
 	// Each key-val operation is encoded as 2 uint64's...
 	// - operation (see: maskOperation) |
 	//       key length (see: maskKeyLength) |
@@ -271,7 +278,7 @@ func (a *segment) mutateEx(operation uint64,
 	a.kvs = append(a.kvs, opKlVl, uint64(keyStart))
 
 	switch operation {
-	case OperationSet:
+	case OperationSet, operationSetTTL:
 		a.totOperationSet++
 	case OperationDel:
 		a.totOperationDel++
@@ -377,6 +384,27 @@ func (a *segment) Cursor(startKeyInclusive []byte, endKeyExclusive []byte) (Segm
 	return rv, nil
 }
 
+// overlaps returns true if the segment might have keys in the given
+// range, based on its smallest and largest keys.  A nil
+// endKeyExclusive means the logical "top-most" key.
+func (a *segment) overlaps(startKeyInclusive, endKeyExclusive []byte) bool {
+	n := a.Len()
+	if n <= 0 {
+		return false
+	}
+
+	if endKeyExclusive != nil {
+		_, kMin, _ := a.getOperationKeyVal(0)
+		if bytes.Compare(kMin, endKeyExclusive) >= 0 {
+			return false
+		}
+	}
+
+	_, kMax, _ := a.getOperationKeyVal(n - 1)
+
+	return bytes.Compare(kMax, startKeyInclusive) >= 0
+}
+
 func (a *segment) Get(key []byte) (operation uint64, val []byte, err error) {
 	pos := a.findKeyPos(key)
 	if pos >= 0 {
@@ -413,10 +441,19 @@ func (a *segment) findKeyPos(key []byte) int {
 // looking for 'c' will return 1.  Looking for 'd' will return 1.
 // Looking for 'g' will return 3.  Looking for 'a' will return 0.
 func (a *segment) findStartKeyInclusivePos(startKeyInclusive []byte) int {
+	return a.findStartKeyInclusivePosFrom(startKeyInclusive, 0)
+}
+
+// findStartKeyInclusivePosFrom is like findStartKeyInclusivePos(),
+// but only considers positions at or after the given lower bound pos,
+// which allows an ascending sequence of keys to be located with a
+// single, forwards-only pass through the segment.
+func (a *segment) findStartKeyInclusivePosFrom(startKeyInclusive []byte,
+	pos int) int {
 	kvs := a.kvs
 	buf := a.buf
 
-	i, j := 0, a.Len()
+	i, j := pos, a.Len()
 	for i < j {
 		h := i + (j-i)/2 // Keep i <= h < j.
 		x := h * 2
@@ -541,6 +578,10 @@ func (a *segment) Persist(file File, options *StoreOptions) (rv SegmentLoc, err
 
 // ------------------------------------------------------
 
+// segmentChecksumTable is the CRC-32C table for the KvsChecksum and
+// BufChecksum of persisted segments.
+var segmentChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
 // loadBasicSegment loads a basic segment.
 func loadBasicSegment(sloc *SegmentLoc) (Segment, error) {
 	var kvs []uint64
@@ -634,6 +675,9 @@ func persistBasicSegment(
 		TotOpsDel:  seg.totOperationDel,
 		TotKeyByte: seg.totKeyByte,
 		TotValByte: seg.totValByte,
+
+		KvsChecksum: crc32.Checksum(kvsBuf, segmentChecksumTable),
+		BufChecksum: crc32.Checksum(seg.buf, segmentChecksumTable),
 	}, nil
 }
 
@@ -681,6 +725,21 @@ type batch struct {
 	// childBatches track the segments of child collections indexed by their
 	// unique collection names.
 	childBatches map[string]*batch
+
+	// childOptions are used when this batch creates a child collection.
+	childOptions *ChildCollectionOptions
+
+	// childOps are the renames and clones of child collections, in
+	// the order they were recorded.
+	childOps []childCollectionOp
+}
+
+// A childCollectionOp is a recorded rename or clone of a child
+// collection.
+type childCollectionOp struct {
+	srcName string
+	dstName string
+	rename  bool
 }
 
 // deletedChildBatchMarker is used as a conduit to convey the delete
@@ -702,11 +761,25 @@ func newBatch(rootCollection *collection, options BatchOptions) (
 
 func (b *batch) NewChildCollectionBatch(collectionName string,
 	options BatchOptions) (Batch, error) {
+	return b.NewChildCollectionBatchWithOptions(collectionName, options, nil)
+}
+
+func (b *batch) NewChildCollectionBatchWithOptions(collectionName string,
+	options BatchOptions, childOptions *ChildCollectionOptions) (Batch, error) {
 	if len(collectionName) == 0 {
 		return nil, ErrBadCollectionName
 	}
 
+	if childBatch, exists := b.childBatches[collectionName]; exists &&
+		childBatch != deletedChildBatchMarker {
+		return childBatch, nil
+	}
+
 	childBatch, err := newBatch(b.rootCollection, options)
+	if err == nil && childOptions != nil {
+		cco := *childOptions
+		childBatch.childOptions = &cco
+	}
 
 	if b.childBatches == nil { // First creation of child batch.
 		b.childBatches = make(map[string]*batch)
@@ -730,6 +803,46 @@ func (b *batch) DelChildCollection(collectionName string) error {
 	return nil
 }
 
+func (b *batch) RenameChildCollection(oldName, newName string) error {
+	return b.addChildCollectionOp(oldName, newName, true)
+}
+
+func (b *batch) CloneChildCollection(srcName, dstName string) error {
+	return b.addChildCollectionOp(srcName, dstName, false)
+}
+
+func (b *batch) addChildCollectionOp(srcName, dstName string,
+	rename bool) error {
+	if len(srcName) == 0 || len(dstName) == 0 || srcName == dstName {
+		return ErrBadCollectionName
+	}
+
+	b.childOps = append(b.childOps, childCollectionOp{
+		srcName: srcName,
+		dstName: dstName,
+		rename:  rename,
+	})
+
+	return nil
+}
+
+// hasChildCollectionOps returns true if the batch or any of its child
+// batches have renames or clones of child collections.
+func (b *batch) hasChildCollectionOps() bool {
+	if b == deletedChildBatchMarker {
+		return false
+	}
+	if len(b.childOps) > 0 {
+		return true
+	}
+	for _, childBatch := range b.childBatches {
+		if childBatch.hasChildCollectionOps() {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *batch) readyDeferredSort() {
 	if b == deletedChildBatchMarker {
 		return
@@ -767,10 +880,11 @@ func (b *batch) doSort() {
 }
 
 func (b *batch) isEmpty() bool {
-	if len(b.childBatches) != 0 {
-		// Very presence of child batches indicates a non-empty batch
-		// even if the child batches themselves are empty. This is so that
-		// collection creation/deletions can still work.
+	if len(b.childBatches) != 0 || len(b.childOps) != 0 {
+		// Very presence of child batches, or of child collection renames
+		// and clones, indicates a non-empty batch even if the child
+		// batches themselves are empty. This is so that collection
+		// creation/deletions can still work.
 		return false
 	}
 	return b.Len() <= 0
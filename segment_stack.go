@@ -11,7 +11,15 @@
 
 package moss
 
-import "sync"
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/ghistogram"
+)
 
 // A segmentStack is a stack of segments, where higher (later) entries
 // in the stack have higher precedence, and should "shadow" any
@@ -32,8 +40,21 @@ type segmentStack struct {
 	// when the child collection was created. 0 for top-level collection.
 	incarNum uint64
 
+	// cloneBase, when non-nil, is the cloneBase of this segmentStack's
+	// child collection, which helps a Store to persist a clone by
+	// referencing the persisted segments of its source.
+	cloneBase *SnapshotWrapper
+
 	// childSegStacks recursively store child collection segmentStacks.
 	childSegStacks map[string]*segmentStack
+
+	// stats, when non-nil, are the stats of the owning collection,
+	// which are updated when expired entries are hidden or dropped.
+	stats *CollectionStats
+
+	// histograms, when non-nil, are the histograms of the collection
+	// whose snapshot this is, which record the sampled iterators.
+	histograms ghistogram.Histograms
 }
 
 func (ss *segmentStack) addRef() {
@@ -68,7 +89,16 @@ func (ss *segmentStack) Close() error {
 
 // Get retrieves a val from a segmentStack.
 func (ss *segmentStack) Get(key []byte, readOptions ReadOptions) ([]byte, error) {
-	return ss.get(key, len(ss.a)-1, nil, readOptions)
+	val, err := ss.get(key, len(ss.a)-1, nil, readOptions)
+
+	if ss.incarNum != 0 && ss.stats != nil { // A child collection's stats.
+		atomic.AddUint64(&ss.stats.TotGet, 1)
+		if err != nil {
+			atomic.AddUint64(&ss.stats.TotGetErr, 1)
+		}
+	}
+
+	return val, err
 }
 
 // get() retrieves a val from a segmentStack, but only considers
@@ -83,6 +113,10 @@ func (ss *segmentStack) get(key []byte, segStart int, base *segmentStack,
 		for seg := segStart; seg >= 0; seg-- {
 			b := ss.a[seg]
 
+			if readOptions.segmentsProbed != nil {
+				*readOptions.segmentsProbed++
+			}
+
 			op, val, err := b.Get(key)
 			if err != nil {
 				return nil, err
@@ -94,6 +128,14 @@ func (ss *segmentStack) get(key []byte, segStart int, base *segmentStack,
 				if op == OperationMerge {
 					return ss.getMerged(key, val, seg-1, base, readOptions)
 				}
+				if op == operationSetTTL {
+					if isExpired(val, time.Now().UnixNano()) {
+						countExpiredHidden(ss.stats)
+						return nil, nil
+					}
+					recordExpiry(readOptions, key, val)
+					return val[expiryLen:], nil
+				}
 				return val, nil
 			}
 		}
@@ -104,6 +146,12 @@ func (ss *segmentStack) get(key []byte, segStart int, base *segmentStack,
 	}
 
 	if !readOptions.SkipLowerLevel && ss.lowerLevelSnapshot != nil {
+		if err := canceled(readOptions.canceler); err != nil {
+			if ss.stats != nil {
+				atomic.AddUint64(&ss.stats.TotGetCanceled, 1)
+			}
+			return nil, err
+		}
 		return ss.lowerLevelSnapshot.Get(key, readOptions)
 	} // TODO: else add a special return error indicating cache-miss!
 
@@ -139,6 +187,184 @@ func (ss *segmentStack) getMerged(key, val []byte, segStart int,
 
 // ------------------------------------------------------
 
+// GetMulti retrieves the vals for multiple keys from a segmentStack.
+func (ss *segmentStack) GetMulti(keys [][]byte,
+	readOptions ReadOptions) ([][]byte, error) {
+	vals := make([][]byte, len(keys))
+
+	err := ss.getMulti(keys, sortedKeyIdxs(keys), vals,
+		len(ss.a)-1, nil, readOptions)
+
+	if ss.incarNum != 0 && ss.stats != nil { // A child collection's stats.
+		atomic.AddUint64(&ss.stats.TotGetMulti, 1)
+		atomic.AddUint64(&ss.stats.TotGetMultiKeys, uint64(len(keys)))
+		if err != nil {
+			atomic.AddUint64(&ss.stats.TotGetMultiErr, 1)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return vals, nil
+}
+
+// getMulti() is the multi-key form of get(), where the keyIdxs are
+// the indexes of the keys that still need lookups, ordered by
+// ascending key.  Each segment is visited only once, with the still
+// pending keys being located in a single, forwards-only pass through
+// the segment.  Results are stored into the vals, which has the same
+// ordering as the keys.  The provided keyIdxs are not modified.
+func (ss *segmentStack) getMulti(keys [][]byte, keyIdxs []int,
+	vals [][]byte, segStart int, base *segmentStack,
+	readOptions ReadOptions) (err error) {
+	keyIdxs = append([]int(nil), keyIdxs...) // Copy, as it's filtered.
+
+	if segStart >= 0 {
+		ss.ensureSorted(0, segStart)
+
+		for seg := segStart; seg >= 0 && len(keyIdxs) > 0; seg-- {
+			keyIdxs, err = ss.getMultiSegment(keys, keyIdxs, vals,
+				seg, base, readOptions)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(keyIdxs) <= 0 {
+		return nil
+	}
+
+	var lower Snapshot
+	if base != nil {
+		lower = base
+	} else if !readOptions.SkipLowerLevel && ss.lowerLevelSnapshot != nil {
+		lower = ss.lowerLevelSnapshot
+	}
+
+	if lower == nil {
+		return nil
+	}
+
+	lowerKeys := make([][]byte, len(keyIdxs))
+	for i, keyIdx := range keyIdxs {
+		lowerKeys[i] = keys[keyIdx]
+	}
+
+	lowerVals, err := lower.GetMulti(lowerKeys, readOptions)
+	if err != nil {
+		return err
+	}
+
+	for i, keyIdx := range keyIdxs {
+		vals[keyIdx] = lowerVals[i]
+	}
+
+	return nil
+}
+
+// getMultiSegment() looks up the keys of the ascending keyIdxs in a
+// single segment, and returns the keyIdxs that were not found.
+func (ss *segmentStack) getMultiSegment(keys [][]byte, keyIdxs []int,
+	vals [][]byte, seg int, base *segmentStack,
+	readOptions ReadOptions) ([]int, error) {
+	b := ss.a[seg]
+
+	a, aOk := b.(*segment)
+
+	pos := 0
+
+	now := time.Now().UnixNano()
+
+	// The not found keyIdxs are collected in-place, as the
+	// write position never passes the read position.
+	notFound := keyIdxs[:0]
+
+	for _, keyIdx := range keyIdxs {
+		key := keys[keyIdx]
+
+		var op uint64
+		var val []byte
+		var found bool
+
+		if aOk {
+			pos = a.findStartKeyInclusivePosFrom(key, pos)
+			if pos < a.Len() {
+				var k []byte
+				op, k, val = a.getOperationKeyVal(pos)
+				found = bytes.Equal(k, key)
+			}
+		} else {
+			var err error
+			op, val, err = b.Get(key)
+			if err != nil {
+				return nil, err
+			}
+			found = val != nil
+		}
+
+		if !found {
+			notFound = append(notFound, keyIdx)
+			continue
+		}
+
+		if op == OperationDel {
+			vals[keyIdx] = nil
+		} else if op == OperationMerge {
+			vMerged, err := ss.getMerged(key, val, seg-1, base, readOptions)
+			if err != nil {
+				return nil, err
+			}
+			vals[keyIdx] = vMerged
+		} else if op == operationSetTTL {
+			if isExpired(val, now) {
+				countExpiredHidden(ss.stats)
+				vals[keyIdx] = nil
+			} else {
+				recordExpiry(readOptions, key, val)
+				vals[keyIdx] = val[expiryLen:]
+			}
+		} else {
+			vals[keyIdx] = val
+		}
+	}
+
+	return notFound, nil
+}
+
+// sortedKeyIdxs returns the indexes of the keys, ordered by
+// ascending key.
+func sortedKeyIdxs(keys [][]byte) []int {
+	rv := &keyIdxSorter{keys: keys, idxs: make([]int, len(keys))}
+	for i := range rv.idxs {
+		rv.idxs[i] = i
+	}
+	if !sort.IsSorted(rv) { // Ex: keys from a higher level are sorted.
+		sort.Sort(rv)
+	}
+	return rv.idxs
+}
+
+// A keyIdxSorter sorts key indexes by their keys.
+type keyIdxSorter struct {
+	keys [][]byte
+	idxs []int
+}
+
+func (s *keyIdxSorter) Len() int { return len(s.idxs) }
+
+func (s *keyIdxSorter) Swap(i, j int) {
+	s.idxs[i], s.idxs[j] = s.idxs[j], s.idxs[i]
+}
+
+func (s *keyIdxSorter) Less(i, j int) bool {
+	return bytes.Compare(s.keys[s.idxs[i]], s.keys[s.idxs[j]]) < 0
+}
+
+// ------------------------------------------------------
+
 func (ss *segmentStack) ensureSorted(minSeg, maxSeg int) {
 	if ss.options == nil || !ss.options.DeferredSort {
 		return
@@ -188,6 +414,109 @@ func (ss *segmentStack) Stats() *SegmentStackStats {
 	return rv
 }
 
+// ------------------------------------------------------
+
+// A RangeEstimate is an approximate summary of the entries of a
+// Snapshot in a key range, which is computed without iterating
+// through the entries, such as for query planning or for splitting
+// work into similarly sized key ranges.
+//
+// The ops of each basic segment in the range are counted exactly via
+// binary search, but the ops are summed over all segments, including
+// any lower-level snapshot.  As the same key might appear in multiple
+// segments and deletions are counted as ops, the number of live keys
+// in the range is at most Ops.  And, the number of distinct keys,
+// including deleted keys, is at least MaxSegmentOps.  When there's
+// only a single segment, such as after a full merge or compaction,
+// both are exact.
+//
+// The KeyBytes and ValBytes are estimated by prorating each
+// segment's total key and val bytes by the fraction of the segment's
+// ops that are in the range, so they are exact for segments whose
+// entries are entirely in the range, and otherwise assume that the
+// keys and vals of a segment are uniformly sized.
+//
+// Segments whose implementation doesn't support positional lookups
+// are counted as entirely in the range.
+type RangeEstimate struct {
+	Ops           uint64
+	MaxSegmentOps uint64
+	KeyBytes      uint64
+	ValBytes      uint64
+	Segments      uint64 // Number of segments with ops in the range.
+}
+
+// AddTo adds the values from this RangeEstimate to the dest
+// RangeEstimate.
+func (re *RangeEstimate) AddTo(dest *RangeEstimate) {
+	if re == nil {
+		return
+	}
+
+	dest.Ops += re.Ops
+	if dest.MaxSegmentOps < re.MaxSegmentOps {
+		dest.MaxSegmentOps = re.MaxSegmentOps
+	}
+	dest.KeyBytes += re.KeyBytes
+	dest.ValBytes += re.ValBytes
+	dest.Segments += re.Segments
+}
+
+// EstimateRange returns an approximate summary of the entries in the
+// given key range.  A startKeyInclusive of nil means the logical
+// "bottom-most" possible key and an endKeyExclusive of nil means the
+// logical "top-most" possible key.
+func (ss *segmentStack) EstimateRange(startKeyInclusive,
+	endKeyExclusive []byte) (*RangeEstimate, error) {
+	rv := &RangeEstimate{}
+
+	ss.ensureSorted(0, len(ss.a)-1)
+
+	for _, b := range ss.a {
+		segLen := b.Len()
+		if segLen <= 0 {
+			continue
+		}
+
+		n := segLen
+		if a, ok := b.(*segment); ok {
+			beg := a.findStartKeyInclusivePos(startKeyInclusive)
+			end := segLen
+			if endKeyExclusive != nil {
+				end = a.findStartKeyInclusivePos(endKeyExclusive)
+			}
+			n = end - beg
+		}
+		if n <= 0 {
+			continue
+		}
+
+		nk, nv := b.NumKeyValBytes()
+
+		(&RangeEstimate{
+			Ops:           uint64(n),
+			MaxSegmentOps: uint64(n),
+			KeyBytes:      nk * uint64(n) / uint64(segLen),
+			ValBytes:      nv * uint64(n) / uint64(segLen),
+			Segments:      1,
+		}).AddTo(rv)
+	}
+
+	if ss.lowerLevelSnapshot != nil {
+		llre, err := ss.lowerLevelSnapshot.EstimateRange(
+			startKeyInclusive, endKeyExclusive)
+		if err != nil {
+			return nil, err
+		}
+
+		llre.AddTo(rv)
+	}
+
+	return rv, nil
+}
+
+// ------------------------------------------------------
+
 // ChildCollectionNames returns an array of child collection name strings.
 func (ss *segmentStack) ChildCollectionNames() ([]string, error) {
 	var childCollections = make([]string, len(ss.childSegStacks))
@@ -224,7 +553,7 @@ func (ss *segmentStack) ensureFullySorted() {
 }
 
 func (ss *segmentStack) isEmpty() bool {
-	if len(ss.a) > 0 {
+	if len(ss.a) > 0 || ss.cloneBase != nil {
 		return false
 	}
 	for _, childSegStack := range ss.childSegStacks {
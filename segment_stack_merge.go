@@ -11,6 +11,12 @@
 
 package moss
 
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
 // calcTargetTopLevel() heuristically computes a new top level that
 // the segmentStack should be merged to.
 func (ss *segmentStack) calcTargetTopLevel() int {
@@ -68,22 +74,37 @@ func (ss *segmentStack) merge(mergeAll bool, base *segmentStack) (
 	}
 
 	// ----------------------------------------------------
-	// Next, use an iterator for the actual merge.
+	// Next, use iterators for the actual merge, either of the whole
+	// key space or concurrently of disjoint key ranges.
 
-	mergedSegment, err := newSegment(totOps, int(totKeyBytes+totValBytes))
-	if err != nil {
-		return nil, 0, err
-	}
+	var mergedSegments []Segment
 
-	err = ss.mergeInto(newTopLevel, len(ss.a), mergedSegment, base, true,
-		true, nil)
-	if err != nil {
-		return nil, 0, err
+	splitKeys := ss.mergeSplitKeys(newTopLevel, totOps)
+	if len(splitKeys) > 0 {
+		var err error
+		mergedSegments, err = ss.mergeRanges(newTopLevel, base, splitKeys,
+			totOps, int(totKeyBytes+totValBytes))
+		if err != nil {
+			return nil, 0, err
+		}
+	} else {
+		mergedSegment, err := newSegment(totOps, int(totKeyBytes+totValBytes))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		err = ss.mergeInto(newTopLevel, len(ss.a), mergedSegment, base,
+			nil, nil, true, true, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		mergedSegments = []Segment{mergedSegment}
 	}
 
-	a := make([]Segment, 0, newTopLevel+1)
+	a := make([]Segment, 0, newTopLevel+len(mergedSegments))
 	a = append(a, ss.a[0:newTopLevel]...)
-	a = append(a, mergedSegment)
+	a = append(a, mergedSegments...)
 
 	rv := &segmentStack{
 		options:            ss.options,
@@ -91,6 +112,8 @@ func (ss *segmentStack) merge(mergeAll bool, base *segmentStack) (
 		refs:               1,
 		lowerLevelSnapshot: ss.lowerLevelSnapshot.addRef(),
 		incarNum:           ss.incarNum,
+		cloneBase:          ss.cloneBase,
+		stats:              ss.stats,
 	}
 
 	// ---------------------------------------------------
@@ -129,21 +152,123 @@ func (ss *segmentStack) merge(mergeAll bool, base *segmentStack) (
 	return rv, numFullMerges, nil
 }
 
+// mergerMinOpsPerWorker is the min number of ops for each of the
+// MergerWorkers, so that small merges aren't split into key ranges.
+const mergerMinOpsPerWorker = 10000
+
+// mergeSplitKeys() returns the keys that split the key space into
+// disjoint ranges for concurrent merging by the MergerWorkers, or nil
+// when the merge of the segments at the newTopLevel and higher should
+// not be split.  The split keys are taken at evenly spaced positions
+// of the largest segment.
+func (ss *segmentStack) mergeSplitKeys(newTopLevel, totOps int) [][]byte {
+	workers := ss.options.MergerWorkers
+	if workers > totOps/mergerMinOpsPerWorker {
+		workers = totOps / mergerMinOpsPerWorker
+	}
+	if workers <= 1 {
+		return nil
+	}
+
+	var largest *segment
+	for i := newTopLevel; i < len(ss.a); i++ {
+		seg, ok := ss.a[i].(*segment)
+		if !ok {
+			return nil // Unknown segment implementations aren't split.
+		}
+		if largest == nil || largest.Len() < seg.Len() {
+			largest = seg
+		}
+	}
+
+	ss.ensureSorted(newTopLevel, len(ss.a)-1)
+
+	var rv [][]byte
+	for i := 1; i < workers; i++ {
+		_, key, _ := largest.getOperationKeyVal(largest.Len() * i / workers)
+		if len(rv) <= 0 || bytes.Compare(rv[len(rv)-1], key) < 0 {
+			rv = append(rv, key)
+		}
+	}
+
+	return rv
+}
+
+// mergeRanges() concurrently merges the segments at the newTopLevel
+// and higher, with a goroutine for each of the disjoint key ranges
+// delimited by the splitKeys, and returns a merged segment for each
+// non-empty key range, in key order.
+func (ss *segmentStack) mergeRanges(newTopLevel int, base *segmentStack,
+	splitKeys [][]byte, totOps, totKeyValBytes int) ([]Segment, error) {
+	n := len(splitKeys) + 1
+
+	segs := make([]*segment, n)
+	errs := make([]error, n)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		var startKeyInclusive, endKeyExclusive []byte
+		if i > 0 {
+			startKeyInclusive = splitKeys[i-1]
+		}
+		if i < len(splitKeys) {
+			endKeyExclusive = splitKeys[i]
+		}
+
+		wg.Add(1)
+		go func(i int, startKeyInclusive, endKeyExclusive []byte) {
+			defer wg.Done()
+
+			segs[i], errs[i] = newSegment(totOps/n, totKeyValBytes/n)
+			if errs[i] == nil {
+				errs[i] = ss.mergeInto(newTopLevel, len(ss.a), segs[i], base,
+					startKeyInclusive, endKeyExclusive, true, true, nil)
+			}
+		}(i, startKeyInclusive, endKeyExclusive)
+	}
+
+	wg.Wait()
+
+	rv := make([]Segment, 0, n)
+	for i, seg := range segs {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if seg.Len() > 0 || (i == n-1 && len(rv) <= 0) {
+			rv = append(rv, seg)
+		}
+	}
+
+	if ss.stats != nil {
+		atomic.AddUint64(&ss.stats.TotMergerInternalRanges, uint64(n))
+	}
+
+	return rv, nil
+}
+
+// mergeInto() merges the entries of the segments from the
+// minSegmentLevel up to the maxSegmentHeight and in the given key
+// range into the dest.  A nil startKeyInclusive or endKeyExclusive
+// means the logical "bottom-most" or "top-most" key.
 func (ss *segmentStack) mergeInto(minSegmentLevel, maxSegmentHeight int,
-	dest SegmentMutator, base *segmentStack, includeDeletions, optimizeTail bool,
-	cancelCh chan struct{}) error {
+	dest SegmentMutator, base *segmentStack,
+	startKeyInclusive, endKeyExclusive []byte,
+	includeDeletions, optimizeTail bool, cancelCh chan struct{}) error {
 	cancelCheckEvery := ss.options.MergerCancelCheckEvery
 	if cancelCheckEvery <= 0 {
 		cancelCheckEvery = DefaultCollectionOptions.MergerCancelCheckEvery
 	}
 
-	iter, err := ss.startIterator(nil, nil, IteratorOptions{
-		IncludeDeletions: includeDeletions,
-		SkipLowerLevel:   true,
-		MinSegmentLevel:  minSegmentLevel,
-		MaxSegmentHeight: maxSegmentHeight,
-		base:             base,
-	})
+	iter, err := ss.startIterator(startKeyInclusive, endKeyExclusive,
+		IteratorOptions{
+			IncludeDeletions: includeDeletions,
+			SkipLowerLevel:   true,
+			MinSegmentLevel:  minSegmentLevel,
+			MaxSegmentHeight: maxSegmentHeight,
+			base:             base,
+			rawExpiry:        true,
+		})
 	if err != nil {
 		return err
 	}
@@ -181,7 +306,7 @@ OUTER:
 			var k, v []byte
 			op, k, v = cursor.sc.Current()
 			for op != 0 {
-				err = dest.Mutate(op, k, v)
+				err = ss.mergeMutate(dest, op, k, v, includeDeletions, iter.now)
 				if err != nil {
 					return err
 				}
@@ -214,7 +339,7 @@ OUTER:
 			}
 		}
 
-		err = dest.Mutate(op, key, val)
+		err = ss.mergeMutate(dest, op, key, val, includeDeletions, iter.now)
 		if err != nil {
 			return err
 		}
@@ -230,3 +355,24 @@ OUTER:
 
 	return nil
 }
+
+// mergeMutate() writes a merged entry to the dest, where an expired
+// operationSetTTL entry is dropped, leaving only a deletion tombstone
+// when includeDeletions is true so that it still shadows any older
+// entries of the same key that were not part of the merge.
+func (ss *segmentStack) mergeMutate(dest SegmentMutator,
+	op uint64, key, val []byte, includeDeletions bool, now int64) error {
+	if op == operationSetTTL && isExpired(val, now) {
+		if ss.stats != nil {
+			atomic.AddUint64(&ss.stats.TotExpiredDropped, 1)
+		}
+
+		if !includeDeletions {
+			return nil
+		}
+
+		op, val = OperationDel, nil
+	}
+
+	return dest.Mutate(op, key, val)
+}
@@ -0,0 +1,733 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package moss
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/couchbase/ghistogram"
+)
+
+// ShardedCollectionOptions are provided to OpenShardedCollection().
+type ShardedCollectionOptions struct {
+	// NumShards is the number of shards when the keys are hash
+	// partitioned, and is ignored when SplitKeys are provided.
+	NumShards int
+
+	// SplitKeys, when non-empty, range partitions the keys, where the
+	// ascending SplitKeys are the smallest keys of each shard after
+	// the first, so there are len(SplitKeys)+1 shards.
+	SplitKeys [][]byte
+
+	// StoreOptions and StorePersistOptions are used to open each
+	// shard's Store and Collection.
+	StoreOptions        StoreOptions
+	StorePersistOptions StorePersistOptions
+}
+
+// A ShardedCollection implements the Collection interface by
+// partitioning the keys across multiple Stores, each in its own
+// subdirectory, for more I/O concurrency.  The partitioning is
+// recorded in the directory, and must be the same when reopened.
+//
+// The mutations of a Batch are atomic per shard, and a Snapshot
+// doesn't see a Batch that's only partially executed across the
+// shards, as ExecuteBatch() and Snapshot() are mutually exclusive.
+// The Iterators of a Snapshot merge the shards in key order.
+//
+// Child collections are not supported, where their Batch methods
+// return ErrUnimplemented.
+//
+// The Snapshots of a ShardedCollection implement ContextSnapshot,
+// and their Iterators implement ContinuationTokener.  The
+// ShardedCollection itself is not a ContextCollection, as a batch
+// whose ctx is done while it's executed on some of the shards would
+// be left partially executed.
+type ShardedCollection struct {
+	dir       string
+	splitKeys [][]byte
+
+	stores []*Store
+	colls  []Collection
+
+	// m is held for reading by ExecuteBatch() and for writing by
+	// Snapshot(), so that snapshots of the shards are consistent.
+	m sync.RWMutex
+}
+
+// shardedMetaFileName is the name of the file that records the
+// partitioning of a ShardedCollection.
+const shardedMetaFileName = "sharded.json"
+
+type shardedMeta struct {
+	NumShards int
+	SplitKeys [][]byte
+}
+
+// OpenShardedCollection opens or creates a ShardedCollection in a
+// directory, where each shard's Store is in a "shard-N" subdirectory.
+func OpenShardedCollection(dir string, options ShardedCollectionOptions) (
+	*ShardedCollection, error) {
+	meta := shardedMeta{NumShards: options.NumShards}
+	if len(options.SplitKeys) > 0 {
+		for i := 1; i < len(options.SplitKeys); i++ {
+			if bytes.Compare(options.SplitKeys[i-1], options.SplitKeys[i]) >= 0 {
+				return nil, fmt.Errorf("sharded: SplitKeys not ascending")
+			}
+		}
+		meta = shardedMeta{
+			NumShards: len(options.SplitKeys) + 1,
+			SplitKeys: options.SplitKeys,
+		}
+	}
+	if meta.NumShards <= 0 {
+		return nil, fmt.Errorf("sharded: NumShards must be > 0")
+	}
+
+	err := readOrWriteShardedMeta(dir, &meta)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &ShardedCollection{
+		dir:       dir,
+		splitKeys: meta.SplitKeys,
+	}
+
+	for i := 0; i < meta.NumShards; i++ {
+		shardDir := path.Join(dir, fmt.Sprintf("shard-%d", i))
+
+		err = os.MkdirAll(shardDir, 0700)
+		if err != nil {
+			sc.Close()
+			return nil, err
+		}
+
+		store, coll, err := OpenStoreCollection(shardDir,
+			options.StoreOptions, options.StorePersistOptions)
+		if err != nil {
+			sc.Close()
+			return nil, err
+		}
+
+		sc.stores = append(sc.stores, store)
+		sc.colls = append(sc.colls, coll)
+	}
+
+	return sc, nil
+}
+
+// readOrWriteShardedMeta verifies that the partitioning recorded in a
+// directory matches the given partitioning, or records it when the
+// directory has none.
+func readOrWriteShardedMeta(dir string, meta *shardedMeta) error {
+	fileName := path.Join(dir, shardedMetaFileName)
+
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		buf, err = json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			return err
+		}
+
+		return ioutil.WriteFile(fileName, buf, 0600)
+	}
+
+	var prev shardedMeta
+	err = json.Unmarshal(buf, &prev)
+	if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(prev, *meta) {
+		return fmt.Errorf("sharded: partitioning differs from the"+
+			" partitioning recorded in: %s", fileName)
+	}
+
+	return nil
+}
+
+// Stores returns the Store of each shard, such as for applications
+// that wish to use the Store APIs on the shards.
+func (sc *ShardedCollection) Stores() []*Store {
+	return sc.stores
+}
+
+// shard returns the index of the shard of a key.
+func (sc *ShardedCollection) shard(key []byte) int {
+	return shardOf(key, sc.splitKeys, len(sc.colls))
+}
+
+func shardOf(key []byte, splitKeys [][]byte, numShards int) int {
+	if len(splitKeys) > 0 {
+		return sort.Search(len(splitKeys), func(i int) bool {
+			return bytes.Compare(key, splitKeys[i]) < 0
+		})
+	}
+
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(numShards))
+}
+
+// Start is a no-op, as the shards are started when opened.
+func (sc *ShardedCollection) Start() error {
+	return nil
+}
+
+// Close closes the Collection and Store of each shard.
+func (sc *ShardedCollection) Close() error {
+	var rv error
+	for i, coll := range sc.colls {
+		if err := coll.Close(); err != nil && rv == nil {
+			rv = err
+		}
+		if err := sc.stores[i].Close(); err != nil && rv == nil {
+			rv = err
+		}
+	}
+	return rv
+}
+
+// Options returns the options of the shards' collections.
+func (sc *ShardedCollection) Options() CollectionOptions {
+	return sc.colls[0].Options()
+}
+
+// Snapshot returns a stable Snapshot across all the shards.
+func (sc *ShardedCollection) Snapshot() (Snapshot, error) {
+	rv := &shardedSnapshot{splitKeys: sc.splitKeys}
+
+	sc.m.Lock()
+	defer sc.m.Unlock()
+
+	for _, coll := range sc.colls {
+		ss, err := coll.Snapshot()
+		if err != nil {
+			rv.Close()
+			return nil, err
+		}
+		rv.snapshots = append(rv.snapshots, ss)
+	}
+
+	return rv, nil
+}
+
+// Get retrieves a value from the shard of the key.
+func (sc *ShardedCollection) Get(key []byte,
+	readOptions ReadOptions) ([]byte, error) {
+	return sc.colls[sc.shard(key)].Get(key, readOptions)
+}
+
+// GetMulti retrieves the vals for multiple keys, with a GetMulti() on
+// each shard that has any of the keys.
+func (sc *ShardedCollection) GetMulti(keys [][]byte,
+	readOptions ReadOptions) ([][]byte, error) {
+	return getMultiShards(keys, sc.splitKeys, len(sc.colls),
+		func(shard int, shardKeys [][]byte) ([][]byte, error) {
+			return sc.colls[shard].GetMulti(shardKeys, readOptions)
+		})
+}
+
+// getMultiShards groups the keys by shard and invokes the getMulti
+// callback for each shard that has any of the keys.
+func getMultiShards(keys [][]byte, splitKeys [][]byte, numShards int,
+	getMulti func(shard int, shardKeys [][]byte) ([][]byte, error)) (
+	[][]byte, error) {
+	shardKeyIdxs := make([][]int, numShards)
+	for i, key := range keys {
+		shard := shardOf(key, splitKeys, numShards)
+		shardKeyIdxs[shard] = append(shardKeyIdxs[shard], i)
+	}
+
+	vals := make([][]byte, len(keys))
+
+	for shard, keyIdxs := range shardKeyIdxs {
+		if len(keyIdxs) <= 0 {
+			continue
+		}
+
+		shardKeys := make([][]byte, len(keyIdxs))
+		for i, keyIdx := range keyIdxs {
+			shardKeys[i] = keys[keyIdx]
+		}
+
+		shardVals, err := getMulti(shard, shardKeys)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, keyIdx := range keyIdxs {
+			vals[keyIdx] = shardVals[i]
+		}
+	}
+
+	return vals, nil
+}
+
+// NewBatch returns a new Batch whose mutations are routed to the
+// shards of their keys.
+func (sc *ShardedCollection) NewBatch(totalOps, totalKeyValBytes int) (
+	Batch, error) {
+	return &shardedBatch{
+		sc:               sc,
+		batches:          make([]Batch, len(sc.colls)),
+		totalOps:         totalOps/len(sc.colls) + 1,
+		totalKeyValBytes: totalKeyValBytes/len(sc.colls) + 1,
+	}, nil
+}
+
+// ExecuteBatch concurrently executes the mutations of a Batch on
+// their shards, where the mutations are atomic per shard.
+func (sc *ShardedCollection) ExecuteBatch(bIn Batch,
+	writeOptions WriteOptions) error {
+	b, ok := bIn.(*shardedBatch)
+	if !ok || b.sc != sc {
+		return fmt.Errorf("wrong Batch implementation type")
+	}
+
+	sc.m.RLock()
+	defer sc.m.RUnlock()
+
+	errs := make([]error, len(b.batches))
+
+	var wg sync.WaitGroup
+
+	for shard, shardBatch := range b.batches {
+		if shardBatch == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(shard int, shardBatch Batch) {
+			errs[shard] = sc.colls[shard].ExecuteBatch(shardBatch, writeOptions)
+			wg.Done()
+		}(shard, shardBatch)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stats returns the sum of the stats of the shards.
+func (sc *ShardedCollection) Stats() (*CollectionStats, error) {
+	rv := &CollectionStats{}
+	for _, coll := range sc.colls {
+		stats, err := coll.Stats()
+		if err != nil {
+			return nil, err
+		}
+		stats.AddTo(rv)
+	}
+	return rv, nil
+}
+
+// Histograms returns the combined histograms of the shards.
+func (sc *ShardedCollection) Histograms() ghistogram.Histograms {
+	rv := make(ghistogram.Histograms)
+	for _, coll := range sc.colls {
+		rv.AddAll(coll.Histograms())
+	}
+	return rv
+}
+
+// ChildCollectionStats returns ErrNoSuchCollection, as child
+// collections are not supported.
+func (sc *ShardedCollection) ChildCollectionStats(
+	childCollectionName string) (*CollectionStats, error) {
+	return nil, ErrNoSuchCollection
+}
+
+// ChildCollectionHistograms returns ErrNoSuchCollection, as child
+// collections are not supported.
+func (sc *ShardedCollection) ChildCollectionHistograms(
+	childCollectionName string) (ghistogram.Histograms, error) {
+	return nil, ErrNoSuchCollection
+}
+
+// ------------------------------------------------------
+
+// A shardedBatch holds a Batch for each shard with mutations, which
+// are created on demand.
+type shardedBatch struct {
+	sc      *ShardedCollection
+	batches []Batch
+
+	totalOps         int
+	totalKeyValBytes int
+}
+
+func (b *shardedBatch) shardBatch(key []byte) (Batch, error) {
+	shard := b.sc.shard(key)
+	if b.batches[shard] == nil {
+		shardBatch, err := b.sc.colls[shard].NewBatch(b.totalOps,
+			b.totalKeyValBytes)
+		if err != nil {
+			return nil, err
+		}
+		b.batches[shard] = shardBatch
+	}
+	return b.batches[shard], nil
+}
+
+func (b *shardedBatch) Close() error {
+	var rv error
+	for _, shardBatch := range b.batches {
+		if shardBatch != nil {
+			if err := shardBatch.Close(); err != nil && rv == nil {
+				rv = err
+			}
+		}
+	}
+	return rv
+}
+
+func (b *shardedBatch) Set(key, val []byte) error {
+	shardBatch, err := b.shardBatch(key)
+	if err != nil {
+		return err
+	}
+	return shardBatch.Set(key, val)
+}
+
+func (b *shardedBatch) SetWithTTL(key, val []byte, ttl time.Duration) error {
+	shardBatch, err := b.shardBatch(key)
+	if err != nil {
+		return err
+	}
+	return shardBatch.SetWithTTL(key, val, ttl)
+}
+
+func (b *shardedBatch) Del(key []byte) error {
+	shardBatch, err := b.shardBatch(key)
+	if err != nil {
+		return err
+	}
+	return shardBatch.Del(key)
+}
+
+func (b *shardedBatch) Merge(key, val []byte) error {
+	shardBatch, err := b.shardBatch(key)
+	if err != nil {
+		return err
+	}
+	return shardBatch.Merge(key, val)
+}
+
+// Alloc returns a slice that's not owned by any shard's Batch, as the
+// shard is only known once the slice is used as a key, so the
+// AllocXxx() methods copy the key and val into the shard's Batch.
+func (b *shardedBatch) Alloc(numBytes int) ([]byte, error) {
+	return make([]byte, numBytes), nil
+}
+
+func (b *shardedBatch) AllocSet(keyFromAlloc, valFromAlloc []byte) error {
+	return b.Set(keyFromAlloc, valFromAlloc)
+}
+
+func (b *shardedBatch) AllocDel(keyFromAlloc []byte) error {
+	return b.Del(keyFromAlloc)
+}
+
+func (b *shardedBatch) AllocMerge(keyFromAlloc, valFromAlloc []byte) error {
+	return b.Merge(keyFromAlloc, valFromAlloc)
+}
+
+func (b *shardedBatch) NewChildCollectionBatch(collectionName string,
+	options BatchOptions) (Batch, error) {
+	return nil, ErrUnimplemented
+}
+
+func (b *shardedBatch) NewChildCollectionBatchWithOptions(collectionName string,
+	options BatchOptions, childOptions *ChildCollectionOptions) (Batch, error) {
+	return nil, ErrUnimplemented
+}
+
+func (b *shardedBatch) DelChildCollection(collectionName string) error {
+	return ErrUnimplemented
+}
+
+func (b *shardedBatch) RenameChildCollection(oldName, newName string) error {
+	return ErrUnimplemented
+}
+
+func (b *shardedBatch) CloneChildCollection(srcName, dstName string) error {
+	return ErrUnimplemented
+}
+
+// ------------------------------------------------------
+
+// A shardedSnapshot holds a Snapshot of each shard.
+type shardedSnapshot struct {
+	splitKeys [][]byte
+	snapshots []Snapshot
+}
+
+func (ss *shardedSnapshot) Close() error {
+	for _, s := range ss.snapshots {
+		s.Close()
+	}
+	return nil
+}
+
+func (ss *shardedSnapshot) Get(key []byte,
+	readOptions ReadOptions) ([]byte, error) {
+	shard := shardOf(key, ss.splitKeys, len(ss.snapshots))
+	return ss.snapshots[shard].Get(key, readOptions)
+}
+
+func (ss *shardedSnapshot) GetMulti(keys [][]byte,
+	readOptions ReadOptions) ([][]byte, error) {
+	return getMultiShards(keys, ss.splitKeys, len(ss.snapshots),
+		func(shard int, shardKeys [][]byte) ([][]byte, error) {
+			return ss.snapshots[shard].GetMulti(shardKeys, readOptions)
+		})
+}
+
+// StartIterator returns an Iterator that merges the Iterators of the
+// shards in key order, where a key is in only one shard.  With range
+// partitioning, the shards outside of the key range are skipped.
+func (ss *shardedSnapshot) StartIterator(
+	startKeyInclusive, endKeyExclusive []byte,
+	iteratorOptions IteratorOptions) (Iterator, error) {
+	return ss.startIterator(startKeyInclusive, endKeyExclusive,
+		func(s Snapshot) (Iterator, error) {
+			return s.StartIterator(startKeyInclusive, endKeyExclusive,
+				iteratorOptions)
+		})
+}
+
+// startIterator returns a shardedIterator of the Iterators that are
+// started by the startShardIterator callback on the overlapping
+// shards.
+func (ss *shardedSnapshot) startIterator(
+	startKeyInclusive, endKeyExclusive []byte,
+	startShardIterator func(s Snapshot) (Iterator, error)) (Iterator, error) {
+	rv := &shardedIterator{endKeyExclusive: endKeyExclusive}
+
+	for shard, s := range ss.snapshots {
+		if !ss.shardOverlaps(shard, startKeyInclusive, endKeyExclusive) {
+			continue
+		}
+
+		iter, err := startShardIterator(s)
+		if err != nil {
+			rv.Close()
+			return nil, err
+		}
+
+		rv.iters = append(rv.iters, iter)
+	}
+
+	err := rv.init()
+	if err != nil {
+		rv.Close()
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+// shardOverlaps returns true if a shard might have keys in a key
+// range, where a nil endKeyExclusive means the logical "top-most" key.
+func (ss *shardedSnapshot) shardOverlaps(shard int,
+	startKeyInclusive, endKeyExclusive []byte) bool {
+	if len(ss.splitKeys) <= 0 {
+		return true
+	}
+	if shard > 0 && endKeyExclusive != nil &&
+		bytes.Compare(endKeyExclusive, ss.splitKeys[shard-1]) <= 0 {
+		return false
+	}
+	if shard < len(ss.splitKeys) && startKeyInclusive != nil &&
+		bytes.Compare(startKeyInclusive, ss.splitKeys[shard]) >= 0 {
+		return false
+	}
+	return true
+}
+
+func (ss *shardedSnapshot) EstimateRange(
+	startKeyInclusive, endKeyExclusive []byte) (*RangeEstimate, error) {
+	rv := &RangeEstimate{}
+	for shard, s := range ss.snapshots {
+		if !ss.shardOverlaps(shard, startKeyInclusive, endKeyExclusive) {
+			continue
+		}
+
+		re, err := s.EstimateRange(startKeyInclusive, endKeyExclusive)
+		if err != nil {
+			return nil, err
+		}
+		re.AddTo(rv)
+	}
+	return rv, nil
+}
+
+// ChildCollectionNames returns no names, as child collections are not
+// supported.
+func (ss *shardedSnapshot) ChildCollectionNames() ([]string, error) {
+	return []string{}, nil
+}
+
+func (ss *shardedSnapshot) ChildCollectionSnapshot(
+	childCollectionName string) (Snapshot, error) {
+	return nil, nil
+}
+
+// ------------------------------------------------------
+
+// A shardedIterator is a heap of the Iterators of the shards that are
+// not done, ordered by their current keys.  The keys are those of
+// CurrentEx(), as Current() returns no key for a deletion when
+// IteratorOptions.IncludeDeletions is true.
+type shardedIterator struct {
+	iters []Iterator // The iterators of the overlapping shards.
+	heap  []shardedCursor
+
+	endKeyExclusive []byte // For continuation tokens.
+}
+
+type shardedCursor struct {
+	iter Iterator
+	key  []byte
+}
+
+func (si *shardedIterator) Len() int { return len(si.heap) }
+
+func (si *shardedIterator) Less(i, j int) bool {
+	return bytes.Compare(si.heap[i].key, si.heap[j].key) < 0
+}
+
+func (si *shardedIterator) Swap(i, j int) {
+	si.heap[i], si.heap[j] = si.heap[j], si.heap[i]
+}
+
+func (si *shardedIterator) Push(x interface{}) {
+	si.heap = append(si.heap, x.(shardedCursor))
+}
+
+func (si *shardedIterator) Pop() interface{} {
+	n := len(si.heap)
+	x := si.heap[n-1]
+	si.heap = si.heap[0 : n-1]
+	return x
+}
+
+// init (re-)builds the heap from the current keys of the iterators.
+func (si *shardedIterator) init() error {
+	si.heap = si.heap[:0]
+	for _, iter := range si.iters {
+		_, key, _, err := iter.CurrentEx()
+		if err == ErrIteratorDone {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		si.heap = append(si.heap, shardedCursor{iter: iter, key: key})
+	}
+	heap.Init(si)
+	return nil
+}
+
+func (si *shardedIterator) Close() error {
+	for _, iter := range si.iters {
+		iter.Close()
+	}
+	si.iters = nil
+	si.heap = nil
+	return nil
+}
+
+func (si *shardedIterator) Next() error {
+	if len(si.heap) <= 0 {
+		return ErrIteratorDone
+	}
+
+	err := si.heap[0].iter.Next()
+	if err == nil {
+		_, si.heap[0].key, _, err = si.heap[0].iter.CurrentEx()
+	}
+	if err == ErrIteratorDone {
+		heap.Pop(si)
+	} else if err != nil {
+		return err
+	} else {
+		heap.Fix(si, 0)
+	}
+
+	if len(si.heap) <= 0 {
+		return ErrIteratorDone
+	}
+	return nil
+}
+
+func (si *shardedIterator) SeekTo(seekToKey []byte) error {
+	for _, iter := range si.iters {
+		err := iter.SeekTo(seekToKey)
+		if err != nil && err != ErrIteratorDone {
+			return err
+		}
+	}
+
+	err := si.init()
+	if err != nil {
+		return err
+	}
+
+	if len(si.heap) <= 0 {
+		return ErrIteratorDone
+	}
+	return nil
+}
+
+func (si *shardedIterator) Current() (key, val []byte, err error) {
+	if len(si.heap) <= 0 {
+		return nil, nil, ErrIteratorDone
+	}
+	return si.heap[0].iter.Current()
+}
+
+func (si *shardedIterator) CurrentEx() (
+	entryEx EntryEx, key, val []byte, err error) {
+	if len(si.heap) <= 0 {
+		return entryEx, nil, nil, ErrIteratorDone
+	}
+	return si.heap[0].iter.CurrentEx()
+}
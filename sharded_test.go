@@ -0,0 +1,326 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package moss
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestShardedCollection(t *testing.T) {
+	for _, options := range []ShardedCollectionOptions{
+		{NumShards: 4},
+		{SplitKeys: [][]byte{[]byte("030"), []byte("060")}},
+	} {
+		testShardedCollection(t, options)
+	}
+}
+
+func testShardedCollection(t *testing.T, options ShardedCollectionOptions) {
+	tmpDir, _ := ioutil.TempDir("", "mossSharded")
+	defer os.RemoveAll(tmpDir)
+
+	options.StoreOptions = DefaultStoreOptions
+
+	sc, err := OpenShardedCollection(tmpDir, options)
+	if err != nil {
+		t.Fatalf("expected open, err: %v", err)
+	}
+
+	var coll Collection = sc
+
+	b, _ := coll.NewBatch(0, 0)
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("%03d", i))
+		if i%10 == 9 {
+			b.Del(k)
+		} else {
+			b.Set(k, k)
+		}
+	}
+	err = coll.ExecuteBatch(b, WriteOptions{})
+	if err != nil {
+		t.Fatalf("expected batch, err: %v", err)
+	}
+	b.Close()
+
+	numUsedShards := 0
+	for _, shardColl := range sc.colls {
+		stats, _ := shardColl.Stats()
+		if stats.CurDirtyOps > 0 {
+			numUsedShards++
+		}
+	}
+	if numUsedShards != len(sc.colls) {
+		t.Errorf("expected all shards used, got: %d", numUsedShards)
+	}
+
+	check := func(coll Collection) {
+		v, err := coll.Get([]byte("042"), ReadOptions{})
+		if err != nil || string(v) != "042" {
+			t.Errorf("expected get, v: %q, err: %v", v, err)
+		}
+
+		vals, err := coll.GetMulti([][]byte{
+			[]byte("077"), []byte("009"), []byte("001")}, ReadOptions{})
+		if err != nil || string(vals[0]) != "077" || vals[1] != nil ||
+			string(vals[2]) != "001" {
+			t.Errorf("expected get multi, vals: %q, err: %v", vals, err)
+		}
+
+		ss, err := coll.Snapshot()
+		if err != nil {
+			t.Fatalf("expected snapshot, err: %v", err)
+		}
+		defer ss.Close()
+
+		iterate := func(start, end []byte, seekTo []byte) (rv []string) {
+			iter, err := ss.StartIterator(start, end, IteratorOptions{})
+			if err != nil {
+				t.Fatalf("expected iterator, err: %v", err)
+			}
+			defer iter.Close()
+
+			if seekTo != nil {
+				iter.SeekTo(seekTo)
+			}
+
+			for {
+				k, v, err := iter.Current()
+				if err == ErrIteratorDone {
+					return rv
+				}
+				if string(k) != string(v) {
+					t.Errorf("expected k == v, k: %s, v: %s", k, v)
+				}
+				rv = append(rv, string(k))
+				iter.Next()
+			}
+		}
+
+		keys := iterate(nil, nil, nil)
+		if len(keys) != 90 {
+			t.Errorf("expected 90 keys, got: %d", len(keys))
+		}
+		for i := 1; i < len(keys); i++ {
+			if keys[i-1] >= keys[i] {
+				t.Errorf("expected ascending keys, got: %v", keys)
+				break
+			}
+		}
+
+		keys = iterate([]byte("025"), []byte("035"), nil)
+		if fmt.Sprintf("%v", keys) !=
+			"[025 026 027 028 030 031 032 033 034]" {
+			t.Errorf("expected range keys, got: %v", keys)
+		}
+
+		keys = iterate(nil, []byte("005"), []byte("002"))
+		if fmt.Sprintf("%v", keys) != "[002 003 004]" {
+			t.Errorf("expected seek keys, got: %v", keys)
+		}
+
+		re, err := ss.EstimateRange(nil, nil)
+		if err != nil || re.Ops != 100 {
+			t.Errorf("expected range estimate, re: %+v, err: %v", re, err)
+		}
+	}
+
+	check(coll)
+
+	stats, err := coll.Stats()
+	if err != nil || stats.TotExecuteBatchEnd != uint64(len(sc.colls)) ||
+		stats.TotGet != 1 {
+		t.Errorf("expected summed stats, stats: %+v, err: %v", stats, err)
+	}
+
+	for _, shardColl := range sc.colls {
+		waitForChildPersistence(t, shardColl)
+	}
+
+	sc.Close()
+
+	badOptions := options
+	badOptions.NumShards = 3
+	badOptions.SplitKeys = nil
+	_, err = OpenShardedCollection(tmpDir, badOptions)
+	if err == nil {
+		t.Errorf("expected err on reopen with another partitioning")
+	}
+
+	sc, err = OpenShardedCollection(tmpDir, options)
+	if err != nil {
+		t.Fatalf("expected reopen, err: %v", err)
+	}
+	defer sc.Close()
+
+	check(sc)
+}
+
+func TestShardedCollectionSnapshotConsistency(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossSharded")
+	defer os.RemoveAll(tmpDir)
+
+	sc, err := OpenShardedCollection(tmpDir, ShardedCollectionOptions{
+		NumShards:    4,
+		StoreOptions: DefaultStoreOptions,
+	})
+	if err != nil {
+		t.Fatalf("expected open, err: %v", err)
+	}
+	defer sc.Close()
+
+	numKeys := 20
+
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for i := 0; i < 100; i++ {
+			b, _ := sc.NewBatch(0, 0)
+			for k := 0; k < numKeys; k++ {
+				b.Set([]byte(fmt.Sprintf("%d", k)), []byte(fmt.Sprintf("%d", i)))
+			}
+			sc.ExecuteBatch(b, WriteOptions{})
+			b.Close()
+		}
+	}()
+
+	for done := false; !done; {
+		select {
+		case <-doneCh:
+			done = true
+		default:
+		}
+
+		ss, _ := sc.Snapshot()
+		vals := map[string]bool{}
+		for k := 0; k < numKeys; k++ {
+			v, _ := ss.Get([]byte(fmt.Sprintf("%d", k)), ReadOptions{})
+			vals[string(v)] = true
+		}
+		ss.Close()
+
+		if len(vals) != 1 {
+			t.Fatalf("expected a consistent snapshot, vals: %v", vals)
+		}
+	}
+}
+
+func TestShardedIterator(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossSharded")
+	defer os.RemoveAll(tmpDir)
+
+	sc, err := OpenShardedCollection(tmpDir, ShardedCollectionOptions{
+		NumShards:    4,
+		StoreOptions: DefaultStoreOptions,
+		StorePersistOptions: StorePersistOptions{
+			CompactionConcern: CompactionDisable,
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected open, err: %v", err)
+	}
+	defer sc.Close()
+
+	b, _ := sc.NewBatch(0, 0)
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("%03d", i))
+		b.Set(k, k)
+	}
+	sc.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	for _, shardColl := range sc.colls {
+		waitForChildPersistence(t, shardColl)
+	}
+
+	// The deletions of persisted keys are kept as tombstones.
+	b, _ = sc.NewBatch(0, 0)
+	for i := 9; i < 100; i += 10 {
+		b.Del([]byte(fmt.Sprintf("%03d", i)))
+	}
+	sc.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	ss, _ := sc.Snapshot()
+	defer ss.Close()
+
+	// Deletions are ordered by their keys among the other entries.
+	iter, _ := ss.StartIterator(nil, nil, IteratorOptions{IncludeDeletions: true})
+	var keys []string
+	numDels := 0
+	for {
+		entryEx, k, _, err := iter.CurrentEx()
+		if err == ErrIteratorDone {
+			break
+		}
+		if entryEx.Operation == OperationDel {
+			numDels++
+		}
+		keys = append(keys, string(k))
+		iter.Next()
+	}
+	iter.Close()
+
+	if len(keys) != 100 || numDels != 10 {
+		t.Errorf("expected 100 entries with 10 deletions, got: %v, %d",
+			keys, numDels)
+	}
+	for i, k := range keys {
+		if k != fmt.Sprintf("%03d", i) {
+			t.Errorf("expected ascending keys, got: %v", keys)
+			break
+		}
+	}
+
+	// Resuming from continuation tokens visits all the keys in order.
+	keys = keys[:0]
+	iter, _ = ss.StartIterator(nil, []byte("050"), IteratorOptions{})
+	for {
+		for i := 0; i < 7; i++ {
+			k, _, err := iter.Current()
+			if err == ErrIteratorDone {
+				break
+			}
+			keys = append(keys, string(k))
+			if i < 6 {
+				iter.Next()
+			}
+		}
+
+		token, err := iter.(ContinuationTokener).ContinuationToken()
+		if err != nil {
+			t.Fatalf("expected token, err: %v", err)
+		}
+		iter.Close()
+
+		iter, err = ResumeIterator(ss, token, IteratorOptions{})
+		if err == ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			t.Fatalf("expected resume, err: %v", err)
+		}
+	}
+
+	if len(keys) != 45 || keys[0] != "000" || keys[44] != "048" {
+		t.Errorf("expected 45 keys below 050, got: %v", keys)
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] >= keys[i] {
+			t.Errorf("expected ascending keys, got: %v", keys)
+			break
+		}
+	}
+}
@@ -35,6 +35,10 @@ var StorePrefix = "data-"
 // StoreSuffix is the file name suffix
 var StoreSuffix = ".moss"
 
+// StoreAuxSuffix is the file name suffix of the auxiliary data files
+// that are written when StoreOptions.PersistFiles is > 1
+var StoreAuxSuffix = ".aux"
+
 // StoreEndian is the preferred endianness used by moss
 var StoreEndian = binary.LittleEndian
 
@@ -86,6 +90,16 @@ type Footer struct {
 	incarNum uint64 // Ephemeral; to detect fast collection recreations.
 
 	ChildFooters map[string]*Footer // Persisted; Child collections by name.
+
+	// Persisted; the Name() of the collection's MergeOperator, if any.
+	MergeOperatorName string `json:",omitempty"`
+
+	// Persisted; the Name() of the collection's CompactionFilter, if any.
+	CompactionFilterName string `json:",omitempty"`
+
+	// Persisted; the options of a child collection that was created
+	// with its own ChildCollectionOptions, otherwise nil.
+	ChildOptions *ChildCollectionOptions `json:",omitempty"`
 }
 
 // --------------------------------------------------------
@@ -94,7 +108,10 @@ type Footer struct {
 // higher snapshot may be nil.
 func (s *Store) persist(higher Snapshot, persistOptions StorePersistOptions) (
 	Snapshot, error) {
-	wasCompacted, err := s.compactMaybe(higher, persistOptions)
+	s.persistM.Lock()
+	defer s.persistM.Unlock()
+
+	wasCompacted, merge, err := s.compactMaybe(higher, persistOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -128,17 +145,56 @@ func (s *Store) persist(higher Snapshot, persistOptions StorePersistOptions) (
 
 	// Recursively build a new store footer combined with higher snapshot.
 	s.m.Lock()
-	footer := s.buildNewFooter(s.footer, ss)
+	storeFooter := s.footer
+	if storeFooter != nil {
+		storeFooter.AddRef()
+	}
+	footer := s.buildNewFooter(storeFooter, ss)
 	s.m.Unlock()
 
+	// Track the entries that the incoming segments shadow, before the
+	// newest segments might be merged away.
+	var shadowed map[Segment]uint64
+	if s.trackDeadBytes() {
+		shadowed = map[Segment]uint64{}
+		addShadowedBytes(storeFooter, footer, ss, shadowed)
+	}
+
+	// Merge the newest segments as planned by the CompactionPolicy.
+	ss, err = s.mergeTails(storeFooter, footer, ss, merge)
+	if storeFooter != nil {
+		storeFooter.DecRef()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	auxFrefs, err := s.startOrReuseAuxFiles(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, auxFref := range auxFrefs {
+			auxFref.DecRef()
+		}
+	}()
+
 	// Recursively write out all the segments of the snapshot.
-	err = s.persistSegments(ss, footer, file, fref)
+	err = s.persistSegments(ss, footer, file, auxFrefs, shadowed)
 	if err != nil {
 		return nil, err
 	}
 
+	if !persistOptions.NoSync {
+		for _, auxFref := range auxFrefs {
+			if err = auxFref.file.Sync(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	// Recursively load all segments of the newly persisted footer.
-	err = footer.loadSegments(s.options, fref)
+	err = footer.loadSegments(s.options, fref, auxFrefs)
 	if err != nil {
 		return nil, err
 	}
@@ -171,7 +227,11 @@ func (s *Store) persist(higher Snapshot, persistOptions StorePersistOptions) (
 // buildNewFooter will construct a new Footer for the store by combining
 // the given storeFooter's segmentLocs with that of the incoming snapshot.
 func (s *Store) buildNewFooter(storeFooter *Footer, ss *segmentStack) *Footer {
-	footer := &Footer{refs: 1, incarNum: ss.incarNum}
+	footer := &Footer{
+		refs:     1,
+		incarNum: ss.incarNum,
+	}
+	footer.initOptions(ss.options)
 
 	numSegmentLocs := len(ss.a)
 	var segmentLocs []SegmentLoc
@@ -187,20 +247,7 @@ func (s *Store) buildNewFooter(storeFooter *Footer, ss *segmentStack) *Footer {
 
 	// Now process the child collections recursively.
 	for cName, childStack := range ss.childSegStacks {
-		var storeChildFooter *Footer
-		if storeFooter != nil && storeFooter.ChildFooters != nil {
-			var exists bool
-			storeChildFooter, exists = storeFooter.ChildFooters[cName]
-			if exists {
-				if storeChildFooter.incarNum != childStack.incarNum {
-					// This is a special case of deletion & recreate where an
-					// existing child collection has been deleted and quickly
-					// recreated. Here we drop the existing store footer's
-					// segments that correspond to the prior incarnation.
-					storeChildFooter = nil
-				}
-			}
-		}
+		storeChildFooter := persistedChildFooter(storeFooter, cName, childStack)
 		childFooter := s.buildNewFooter(storeChildFooter, childStack)
 		if len(footer.ChildFooters) == 0 {
 			footer.ChildFooters = make(map[string]*Footer)
@@ -213,17 +260,138 @@ func (s *Store) buildNewFooter(storeFooter *Footer, ss *segmentStack) *Footer {
 	return footer
 }
 
-// persistSegments will recursively write out all the segments of the
-// current collection as well as any of its child collections.
+// persistedChildFooter returns the Footer of a child collection whose
+// persisted segments the incoming childStack builds upon, or nil.
+func persistedChildFooter(storeFooter *Footer, cName string,
+	childStack *segmentStack) *Footer {
+	var storeChildFooter *Footer
+	if storeFooter != nil && storeFooter.ChildFooters != nil {
+		var exists bool
+		storeChildFooter, exists = storeFooter.ChildFooters[cName]
+		if exists {
+			if storeChildFooter.incarNum != childStack.incarNum {
+				// This is a special case of deletion & recreate where an
+				// existing child collection has been deleted and quickly
+				// recreated. Here we drop the existing store footer's
+				// segments that correspond to the prior incarnation.
+				storeChildFooter = nil
+			}
+		}
+	}
+	if storeChildFooter == nil {
+		// A clone that's not yet persisted references the
+		// SegmentLocs of its source.
+		storeChildFooter = childStack.cloneBaseFooter()
+	}
+	return storeChildFooter
+}
+
+// cloneBaseFooter returns the Footer of the source of a clone of a
+// child collection that's not yet persisted, or nil.
+func (ss *segmentStack) cloneBaseFooter() *Footer {
+	if ss.cloneBase == nil {
+		return nil
+	}
+	f, _ := ss.cloneBase.ss.(*Footer)
+	return f
+}
+
+// persistSegments will write out all the segments of the current
+// collection as well as any of its child collections, in parallel
+// across the footer's file and the auxiliary data files.  When the
+// shadowed map is non-nil, the DeadBytes of each persisted segment are
+// its tombstones and its shadowed bytes, as tracked by
+// addShadowedBytes().
 func (s *Store) persistSegments(ss *segmentStack, footer *Footer,
-	file File, fref *FileRef) error {
+	file File, auxFrefs map[string]*FileRef,
+	shadowed map[Segment]uint64) error {
+	jobs := collectPersistJobs(ss, footer, nil)
+
+	// Assign each segment to the data file with the fewest bytes so
+	// far, where the footer's file has the auxFileName of "".
+	auxFileNames := make([]string, 0, len(auxFrefs)+1)
+	auxFileNames = append(auxFileNames, "")
+	for auxFileName := range auxFrefs {
+		auxFileNames = append(auxFileNames, auxFileName)
+	}
+	sort.Strings(auxFileNames)
+
+	assigned := make([]uint64, len(auxFileNames))
+	fileJobs := make([][]*persistJob, len(auxFileNames))
+
+	for _, job := range jobs {
+		x := 0
+		for i := range assigned {
+			if assigned[i] < assigned[x] {
+				x = i
+			}
+		}
+		nk, nv := job.segment.NumKeyValBytes()
+		assigned[x] += nk + nv + 1
+		fileJobs[x] = append(fileJobs[x], job)
+	}
+
+	errCh := make(chan error, len(auxFileNames))
+
+	for i, auxFileName := range auxFileNames {
+		f := file
+		if auxFileName != "" {
+			f = auxFrefs[auxFileName].file
+		}
+		f = rateLimitFile(f, s.persistLimiter)
+
+		go func(f File, auxFileName string, jobs []*persistJob) {
+			for _, job := range jobs {
+				segmentLoc, err := s.persistSegment(f, job.segment, s.options)
+				if err != nil {
+					errCh <- err
+					return
+				}
+				segmentLoc.FileName = auxFileName
+				if shadowed != nil {
+					segmentLoc.DeadBytes = shadowed[job.segment] +
+						tombstoneBytes(job.segment)
+				}
+				job.segmentLoc = segmentLoc
+			}
+			errCh <- nil
+		}(f, auxFileName, fileJobs[i])
+	}
+
+	var err error
+	for range auxFileNames {
+		if errJob := <-errCh; errJob != nil && err == nil {
+			err = errJob
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		job.footer.SegmentLocs = append(job.footer.SegmentLocs, job.segmentLoc)
+	}
+
+	return nil
+}
+
+// A persistJob is a segment to be persisted along with the footer
+// whose SegmentLocs the persisted segment is appended to.
+type persistJob struct {
+	footer     *Footer
+	segment    Segment
+	segmentLoc SegmentLoc
+}
+
+// collectPersistJobs recursively appends persistJobs for the segments
+// of a segmentStack and of its child collections, in the order that
+// their SegmentLocs are to be appended to their footers.
+func collectPersistJobs(ss *segmentStack, footer *Footer,
+	jobs []*persistJob) []*persistJob {
 	// First persist the child segments recursively.
 	for cName, childSegStack := range ss.childSegStacks {
-		err := s.persistSegments(childSegStack, footer.ChildFooters[cName],
-			file, fref)
-		if err != nil {
-			return err
-		}
+		jobs = collectPersistJobs(childSegStack, footer.ChildFooters[cName],
+			jobs)
 	}
 
 	for _, segment := range ss.a {
@@ -232,15 +400,10 @@ func (s *Store) persistSegments(ss *segmentStack, footer *Footer,
 			// collections segments are empty. Ok to skip these empty segments.
 			continue
 		}
-		segmentLoc, err := s.persistSegment(file, segment, s.options)
-		if err != nil {
-			return err
-		}
-
-		footer.SegmentLocs = append(footer.SegmentLocs, segmentLoc)
+		jobs = append(jobs, &persistJob{footer: footer, segment: segment})
 	}
 
-	return nil
+	return jobs
 }
 
 // --------------------------------------------------------
@@ -249,21 +412,36 @@ func (s *Store) persistSegments(ss *segmentStack, footer *Footer,
 // the last/current footer.
 func (s *Store) startOrReuseFile() (fref *FileRef, file File, err error) {
 	s.m.Lock()
-	defer s.m.Unlock()
 
 	if s.footer != nil {
-		slocs, _ := s.footer.segmentLocs()
-		defer s.footer.DecRef()
-
-		if len(slocs) > 0 {
-			fref := slocs[0].mref.fref
+		// A child collection's segments may be the only ones.
+		fref := s.footer.fileRef()
+		if fref != nil {
 			file := fref.AddRef()
 
+			s.m.Unlock()
+
 			return fref, file, nil
 		}
 	}
 
-	return s.startFileLOCKED()
+	s.m.Unlock()
+
+	return s.startFile()
+}
+
+// startFile creates a new file, firing an EventKindFileCreate.
+func (s *Store) startFile() (*FileRef, File, error) {
+	s.m.Lock()
+	fref, file, err := s.startFileLOCKED()
+	s.m.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.fireFileEvent(EventKindFileCreate, file, 0, 0)
+
+	return fref, file, nil
 }
 
 func (s *Store) startFileLOCKED() (*FileRef, File, error) {
@@ -286,6 +464,88 @@ func (s *Store) startFileLOCKED() (*FileRef, File, error) {
 	return fref, file, nil
 }
 
+// startOrReuseAuxFiles returns the FileRefs, keyed by file name, of
+// the auxiliary data files of the given footer's file, creating or
+// reusing them as needed.  The caller must DecRef() the FileRefs.
+func (s *Store) startOrReuseAuxFiles(file File) (map[string]*FileRef, error) {
+	if s.options.PersistFiles <= 1 {
+		return nil, nil
+	}
+
+	finfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var created []File
+
+	s.m.Lock()
+	rv, err := s.startOrReuseAuxFilesLOCKED(finfo.Name(), &created)
+	s.m.Unlock()
+
+	for _, file := range created {
+		s.fireFileEvent(EventKindFileCreate, file, 0, 0)
+	}
+
+	return rv, err
+}
+
+// startOrReuseAuxFilesLOCKED appends the files that it creates to the
+// created slice.
+func (s *Store) startOrReuseAuxFilesLOCKED(fileName string,
+	created *[]File) (map[string]*FileRef, error) {
+	var existing map[string]*FileRef
+	if s.footer != nil {
+		existing = s.footer.auxFileRefs(nil)
+	}
+
+	rv := make(map[string]*FileRef, s.options.PersistFiles-1)
+
+	onError := func(err error) (map[string]*FileRef, error) {
+		for _, fref := range rv {
+			fref.DecRef()
+		}
+		return nil, err
+	}
+
+	for i := 1; i < s.options.PersistFiles; i++ {
+		fname := FormatAuxFName(fileName, i)
+
+		fref := existing[fname]
+		if fref == nil {
+			fref = s.fileRefMap[fname]
+		}
+		if fref != nil && fref.FetchRefCount() > 0 {
+			fref.AddRef()
+			rv[fname] = fref
+			continue
+		}
+
+		file, err := s.options.OpenFile(path.Join(s.dir, fname),
+			os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return onError(err)
+		}
+
+		if err = s.persistHeader(file); err != nil {
+			file.Close()
+
+			os.Remove(path.Join(s.dir, fname))
+
+			return onError(err)
+		}
+
+		fref = &FileRef{file: file, refs: 1}
+		s.fileRefMap[fname] = fref
+
+		rv[fname] = fref
+
+		*created = append(*created, file)
+	}
+
+	return rv, nil
+}
+
 func (s *Store) createNextFileLOCKED() (string, File, error) {
 	// File to be opened in RDWR mode here because this is either
 	// invoked by the persister or the compactor either of which
@@ -322,25 +582,55 @@ func (s *Store) removeFileOnClose(fref *FileRef) (os.FileInfo, error) {
 						s.options.CollectionOptions.Log("Error deleting file %s:%v",
 							fileName, err)
 					}
+					return
 				}
+
+				s.fireEvent(Event{Kind: EventKindFileRemove,
+					FileName: fileName, Bytes: finfo.Size()})
 			}()
 		})
 	}
 	return finfo, nil
 }
 
+// fireEvent invokes the optional StoreOptions.OnEvent callback, and
+// must not be invoked while holding the store's lock.
+func (s *Store) fireEvent(event Event) {
+	if s.options.OnEvent != nil {
+		event.Store = s
+		s.options.OnEvent(event)
+	}
+}
+
+// fireFileEvent fires an event about a file, along with the file's
+// current size.
+func (s *Store) fireFileEvent(kind EventKind, file File, segments int,
+	dur time.Duration) {
+	if s.options.OnEvent == nil {
+		return
+	}
+
+	finfo, err := file.Stat()
+	if err != nil {
+		return
+	}
+
+	s.fireEvent(Event{Kind: kind, FileName: finfo.Name(),
+		Bytes: finfo.Size(), Segments: segments, Duration: dur})
+}
+
 // --------------------------------------------------------
 
 // Fetch all the files within the store, and the number of those
 // files that are open/in-use.
-func (s *Store) allFiles() (map[string]interface{}, int) {
-	files := make(map[string]interface{})
+func (s *Store) allFiles() ([]StoreFileStats, int) {
+	files := make(map[string]*StoreFileStats)
 
 	s.m.Lock()
 	for filename, ref := range s.fileRefMap {
 		if ref != nil {
-			files[filename] =
-				map[string]interface{}{"ref_count": ref.FetchRefCount()}
+			files[filename] = &StoreFileStats{Name: filename,
+				Open: true, RefCount: ref.FetchRefCount()}
 		}
 	}
 	s.m.Unlock()
@@ -353,22 +643,32 @@ func (s *Store) allFiles() (map[string]interface{}, int) {
 		fd.Close()
 		if err == nil {
 			for _, finfo := range filelist {
-				fileEntry := map[string]interface{}{"ref_count": nil,
-					"file_size":     finfo.Size(),
-					"file_mode":     finfo.Mode(),
-					"file_modified": finfo.ModTime(),
-					"is_dir":        finfo.IsDir()}
-				referencedEntry, exists := files[finfo.Name()]
-				if exists {
-					refMap, _ := referencedEntry.(map[string]interface{})
-					fileEntry["ref_count"] = refMap["ref_count"]
+				fs, exists := files[finfo.Name()]
+				if !exists {
+					fs = &StoreFileStats{Name: finfo.Name()}
+					files[finfo.Name()] = fs
 				}
-				files[finfo.Name()] = fileEntry
+				fs.Exists = true
+				fs.Size = finfo.Size()
+				fs.Mode = finfo.Mode()
+				fs.Modified = finfo.ModTime()
+				fs.IsDir = finfo.IsDir()
 			}
 		}
 	}
 
-	return files, numFilesOpen
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rv := make([]StoreFileStats, 0, len(names))
+	for _, name := range names {
+		rv = append(rv, *files[name])
+	}
+
+	return rv, numFilesOpen
 }
 
 // --------------------------------------------------------
@@ -470,6 +770,13 @@ func FormatFName(seq int64) string {
 	return fmt.Sprintf("%s%016x%s", StorePrefix, seq, StoreSuffix)
 }
 
+// FormatAuxFName returns the name of an auxiliary data file like
+// "data-000123.moss-1.aux" given a file name of "data-000123.moss"
+// and an index of 1.
+func FormatAuxFName(fname string, i int) string {
+	return fmt.Sprintf("%s-%d%s", fname, i, StoreAuxSuffix)
+}
+
 // --------------------------------------------------------
 
 // pageAlignCeil returns the pos if it's at the start of a page.
@@ -513,13 +820,17 @@ func openStore(dir string, options StoreOptions) (*Store, error) {
 
 	var maxFNameSeq int64
 
-	var fnames []string
+	var fnames, auxFNames []string
 	for _, fileInfo := range fileInfos { // Find candidate file names.
 		fname := fileInfo.Name()
 		if strings.HasPrefix(fname, StorePrefix) &&
 			strings.HasSuffix(fname, StoreSuffix) {
 			fnames = append(fnames, fname)
 		}
+		if strings.HasPrefix(fname, StorePrefix) &&
+			strings.HasSuffix(fname, StoreAuxSuffix) {
+			auxFNames = append(auxFNames, fname)
+		}
 
 		fnameSeq, err := ParseFNameSeq(fname)
 		if err == nil && fnameSeq > maxFNameSeq {
@@ -558,6 +869,9 @@ func openStore(dir string, options StoreOptions) (*Store, error) {
 			histograms:   histograms,
 			fileRefMap:   make(map[string]*FileRef),
 			abortCh:      make(chan struct{}),
+
+			compactionLimiter: newRateLimiter(options.CompactionWriteBytesPerSec),
+			persistLimiter:    newRateLimiter(options.PersistWriteBytesPerSec),
 		}, nil
 	}
 
@@ -591,12 +905,36 @@ func openStore(dir string, options StoreOptions) (*Store, error) {
 			continue
 		}
 
+		var verified uint64
+		if options.VerifyChecksums {
+			verified, err = footer.verifyChecksums(&options)
+			if err != nil {
+				footer.Close()
+				return nil, err
+			}
+		}
+
 		if !options.KeepFiles {
 			err := removeFiles(dir, append(fnames[0:i], fnames[i+1:]...))
 			if err != nil {
 				footer.Close()
 				return nil, err
 			}
+
+			auxFrefs := footer.auxFileRefs(nil)
+
+			var auxFNamesUnused []string
+			for _, auxFName := range auxFNames {
+				if auxFrefs[auxFName] == nil {
+					auxFNamesUnused = append(auxFNamesUnused, auxFName)
+				}
+			}
+
+			err = removeFiles(dir, auxFNamesUnused)
+			if err != nil {
+				footer.Close()
+				return nil, err
+			}
 		}
 
 		return &Store{
@@ -608,6 +946,11 @@ func openStore(dir string, options StoreOptions) (*Store, error) {
 			histograms:   histograms,
 			fileRefMap:   make(map[string]*FileRef),
 			abortCh:      make(chan struct{}),
+
+			totChecksumsVerified: verified,
+
+			compactionLimiter: newRateLimiter(options.CompactionWriteBytesPerSec),
+			persistLimiter:    newRateLimiter(options.PersistWriteBytesPerSec),
 		}, nil
 	}
 
@@ -647,6 +990,14 @@ func (s *Store) openCollection(
 		return nil, fmt.Errorf("Wrong Snapshot type - need Footer")
 	}
 
+	if !options.AllowMergeOperatorChange {
+		err = checkMergeOperator(&co, storeFooter, "")
+		if err != nil {
+			storeSnapshotInit.Close()
+			return nil, err
+		}
+	}
+
 	coll, err := restoreCollection(&co, storeFooter)
 	if err != nil {
 		storeSnapshotInit.Close()
@@ -662,6 +1013,128 @@ func (s *Store) openCollection(
 	return coll, nil
 }
 
+// mergeOperatorName returns the Name() of the MergeOperator of the
+// collection options, or "" when there's no MergeOperator.
+func mergeOperatorName(co *CollectionOptions) string {
+	if co == nil || co.MergeOperator == nil {
+		return ""
+	}
+	return co.MergeOperator.Name()
+}
+
+// initOptions records the persisted options of a footer from the
+// options of its collection.
+func (f *Footer) initOptions(co *CollectionOptions) {
+	f.MergeOperatorName = mergeOperatorName(co)
+	f.CompactionFilterName = ""
+	f.ChildOptions = nil
+
+	if co != nil {
+		if co.CompactionFilter != nil {
+			f.CompactionFilterName = co.CompactionFilter.Name()
+		}
+		f.ChildOptions = co.childOptions
+	}
+}
+
+// copyOptions recursively records the persisted options of a footer
+// and its child footers from those recorded by the src footer that
+// the footer was compacted from, as the options of src's segmentStack
+// might be missing or only inherited, such as for a child collection
+// whose options can't be resolved.
+func (f *Footer) copyOptions(src *Footer) {
+	f.MergeOperatorName = src.MergeOperatorName
+	f.CompactionFilterName = src.CompactionFilterName
+	f.ChildOptions = src.ChildOptions
+
+	for cName, childFooter := range f.ChildFooters {
+		srcChildFooter, exists := src.ChildFooters[cName]
+		if exists {
+			childFooter.copyOptions(srcChildFooter)
+		}
+	}
+}
+
+// initIncarNums recursively records the ephemeral incarnation numbers
+// of a footer and its child footers from the segmentStack that the
+// footer was written from.
+func (f *Footer) initIncarNums(ss *segmentStack) {
+	f.incarNum = ss.incarNum
+	for cName, childFooter := range f.ChildFooters {
+		childStack, exists := ss.childSegStacks[cName]
+		if exists {
+			childFooter.initIncarNums(childStack)
+		}
+	}
+}
+
+// childFooterOptions returns the collection options of a child
+// footer, which are the parent's options, co, unless the child
+// collection was created with its own ChildCollectionOptions.  The
+// recorded MergeOperator and CompactionFilter names that differ from
+// the parent's are then resolved from the registries, where an
+// unregistered name is an error.
+func childFooterOptions(co *CollectionOptions, childFooter *Footer,
+	collName string) (*CollectionOptions, error) {
+	if childFooter.ChildOptions == nil {
+		return co, nil
+	}
+
+	cco := *childFooter.ChildOptions
+
+	name := childFooter.MergeOperatorName
+	if name != "" && name != mergeOperatorName(co) {
+		cco.MergeOperator = MergeOperators[name]
+		if cco.MergeOperator == nil {
+			return nil, fmt.Errorf("store: unregistered merge operator: %q,"+
+				" child collection: %q", name, collName)
+		}
+	}
+
+	name = childFooter.CompactionFilterName
+	if name != "" &&
+		(co.CompactionFilter == nil || name != co.CompactionFilter.Name()) {
+		cco.CompactionFilter = CompactionFilters[name]
+		if cco.CompactionFilter == nil {
+			return nil, fmt.Errorf("store: unregistered compaction filter: %q,"+
+				" child collection: %q", name, collName)
+		}
+	}
+
+	return co.withChildOptions(&cco), nil
+}
+
+// checkMergeOperator returns ErrMergeOperatorMismatch if the footer,
+// or any of its child footers, records a MergeOperator that differs
+// from the configured MergeOperator.  A footer that has no recorded
+// MergeOperator, such as from an older store, is not checked.
+func checkMergeOperator(co *CollectionOptions, footer *Footer,
+	collName string) error {
+	name := mergeOperatorName(co)
+	if footer.MergeOperatorName != "" && footer.MergeOperatorName != name {
+		if co.Log != nil {
+			co.Log("store: merge operator mismatch, collection: %q,"+
+				" persisted: %q, configured: %q",
+				collName, footer.MergeOperatorName, name)
+		}
+		return ErrMergeOperatorMismatch
+	}
+
+	for cName, childFooter := range footer.ChildFooters {
+		childCo, err := childFooterOptions(co, childFooter, collName+"/"+cName)
+		if err != nil {
+			return err
+		}
+
+		err = checkMergeOperator(childCo, childFooter, collName+"/"+cName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func restoreCollection(co *CollectionOptions, storeFooter *Footer) (
 	rv *collection, err error) {
 	var coll *collection
@@ -678,9 +1151,10 @@ func restoreCollection(co *CollectionOptions, storeFooter *Footer) (
 		}
 	} else {
 		coll = &collection{
-			options:  co,
-			stats:    &CollectionStats{},
-			incarNum: storeFooter.incarNum,
+			options:    co,
+			stats:      &CollectionStats{},
+			histograms: newChildHistograms(),
+			incarNum:   storeFooter.incarNum,
 		}
 	}
 
@@ -696,8 +1170,14 @@ func restoreCollection(co *CollectionOptions, storeFooter *Footer) (
 		coll.highestIncarNum++
 		childFooter.incarNum = coll.highestIncarNum
 
+		var childCo *CollectionOptions
+		childCo, err = childFooterOptions(coll.options, childFooter, collName)
+		if err != nil {
+			break
+		}
+
 		var childCollection *collection
-		childCollection, err = restoreCollection(co, childFooter)
+		childCollection, err = restoreCollection(childCo, childFooter)
 		if err != nil {
 			break
 		}
@@ -708,10 +1188,13 @@ func restoreCollection(co *CollectionOptions, storeFooter *Footer) (
 
 // --------------------------------------------------------
 
+// removeFiles removes the given files of a dir, where files that no
+// longer exist are ignored, as the obsoleted files of a previously
+// opened store might concurrently be removed by removeFileOnClose().
 func removeFiles(dir string, fnames []string) error {
 	for _, fname := range fnames {
 		err := os.Remove(path.Join(dir, fname))
-		if err != nil {
+		if err != nil && !os.IsNotExist(err) {
 			return err
 		}
 	}
@@ -13,7 +13,9 @@ package moss
 
 import (
 	"errors"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/couchbase/ghistogram"
 )
@@ -22,6 +24,17 @@ import (
 // in a file.
 var ErrNoValidFooter = errors.New("no-valid-footer")
 
+// ErrMergeOperatorMismatch is returned when a store is opened with a
+// MergeOperator whose Name() differs from the one recorded in the
+// store, as the store's unresolved merge operations would otherwise
+// be merged with the wrong logic.
+var ErrMergeOperatorMismatch = errors.New("merge-operator-mismatch")
+
+// ErrChecksumMismatch is returned when StoreOptions.VerifyChecksums
+// is set and a persisted segment's data doesn't match the checksums
+// recorded in its SegmentLoc.
+var ErrChecksumMismatch = errors.New("checksum-mismatch")
+
 // --------------------------------------------------------
 
 // Store represents data persisted in a directory.
@@ -44,9 +57,31 @@ type Store struct {
 	maxCompactionDecreaseBytes   uint64 // Max file size decrease from any compaction
 	maxCompactionIncreaseBytes   uint64 // Max file size increase from any compaction
 
+	numLastCompactionUsecs uint64 // Duration of the last compaction
+	totCompactionUsecs     uint64 // Duration of all compactions
+	maxCompactionUsecs     uint64 // Duration of the longest compaction
+
 	histograms ghistogram.Histograms // Histograms from store operations
 	fileRefMap map[string]*FileRef   // Map to contain the FileRefs
 	abortCh    chan struct{}         // Forced close/abort channel
+
+	// Non-nil while a background compaction is running.
+	compactionBgStopCh chan struct{} // Closed to stop the compaction.
+	compactionBgDoneCh chan struct{} // Closed when the compaction exits.
+
+	totCompactionsBg          uint64 // Total number of background compactions
+	totCompactionMerges       uint64 // Total number of merges of newest segments
+	totCompactionsBgAbandoned uint64 // Background compactions that were abandoned
+
+	totChecksumsVerified  uint64 // Segments whose checksums were verified
+	totChecksumMismatches uint64 // Segments whose checksums didn't match
+
+	// persistM serializes persistence with the switch over to the
+	// file of a background compaction.
+	persistM sync.Mutex
+
+	compactionLimiter *rateLimiter // Nil when compaction writes are not limited.
+	persistLimiter    *rateLimiter // Nil when persistence writes are not limited.
 }
 
 // StoreCloseExOptions represents store CloseEx options.
@@ -80,6 +115,12 @@ type StoreOptions struct {
 	// compaction for additional safety.
 	CompactionSync bool
 
+	// CompactionPolicy decides whether and what to compact when the
+	// CompactionConcern is CompactionAllow or CompactionBackground.
+	// When nil, the DefaultCompactionPolicy is used, which is based on
+	// CompactionPercentage and CompactionMaxSegments.
+	CompactionPolicy CompactionPolicy `json:"-"`
+
 	// OpenFile allows apps to optionally provide their own file
 	// opening implementation.  When nil, os.OpenFile() is used.
 	OpenFile OpenFile `json:"-"`
@@ -96,6 +137,53 @@ type StoreOptions struct {
 	// Choose which Kind of segment to persist, if unspecified defaults
 	// to the value of DefaultPersistKind.
 	PersistKind string
+
+	// AllowMergeOperatorChange of true means OpenCollection() will
+	// not return ErrMergeOperatorMismatch when the configured
+	// MergeOperator differs from the one recorded in the store, which
+	// is meant for deliberate migrations.  The next persistence then
+	// records the configured MergeOperator.
+	AllowMergeOperatorChange bool
+
+	// PersistFiles is the number of data files that a persistence
+	// writes segments to in parallel, including the file that holds
+	// the footer.  The additional, auxiliary data files are named
+	// after the footer's file, using the StoreAuxSuffix.  Values <= 1
+	// mean segments are written only to the footer's file.
+	PersistFiles int
+
+	// CompactionWriteBytesPerSec, when > 0, limits the rate at which
+	// compactions write to files, so that compactions leave disk
+	// bandwidth for reads.
+	CompactionWriteBytesPerSec int64
+
+	// PersistWriteBytesPerSec, when > 0, limits the rate at which
+	// persistence writes segments to files.
+	PersistWriteBytesPerSec int64
+
+	// TrackDeadBytes of true means persistence also counts the
+	// deletion tombstones and the entries that are shadowed by newer
+	// segments as dead bytes, which costs a lookup of each persisted
+	// key in the older persisted segments.  Otherwise, only the file
+	// regions that are no longer referenced are dead.  The tracking is
+	// always on with a SpaceAmplificationCompactionPolicy.
+	TrackDeadBytes bool
+
+	// VerifyChecksums of true means the checksums of the persisted
+	// segments are verified when a store is opened and before the
+	// segments are rewritten by a compaction or merge, so that
+	// corrupted data is reported as ErrChecksumMismatch instead of
+	// being read or carried into new segments.  Each segment is
+	// verified once, which reads all of its data.
+	VerifyChecksums bool
+
+	// OnEvent is an optional callback invoked on Store related
+	// events, such as compactions and the creation and removal of
+	// files, which are not invoked on the CollectionOptions.OnEvent
+	// callback.  The callback must not Persist() to the Store, and if
+	// the application's callback implementation blocks, it may pause
+	// persistence and compaction.
+	OnEvent func(event Event) `json:"-"`
 }
 
 // DefaultPersistKind determines which persistence Kind to choose when
@@ -135,6 +223,14 @@ var CompactionAllow = CompactionConcern(1)
 // CompactionForce means compaction should be performed immediately.
 var CompactionForce = CompactionConcern(2)
 
+// CompactionBackground means compaction decision is automated as with
+// CompactionAllow, but a compaction runs on its own goroutine against
+// the current footer, while persistence continues to append to the
+// current file.  When the compaction is done, the segments persisted
+// in the meantime are copied to the compacted file, which then
+// becomes the current file.
+var CompactionBackground = CompactionConcern(3)
+
 // --------------------------------------------------------
 
 // SegmentLoc represents a persisted segment.
@@ -152,6 +248,21 @@ type SegmentLoc struct {
 	TotKeyByte uint64
 	TotValByte uint64
 
+	// DeadBytes is the number of bytes of the persisted segment's
+	// entries that are deletion tombstones or that are shadowed by the
+	// entries of newer segments, which a full compaction would drop.
+	DeadBytes uint64 `json:",omitempty"`
+
+	// FileName is the name of the auxiliary data file that holds the
+	// segment, or "" when the segment is in the footer's file.
+	FileName string `json:",omitempty"`
+
+	// KvsChecksum and BufChecksum are the CRC-32C checksums of the
+	// persisted segment.kvs and segment.buf, or 0 when the segment
+	// wasn't checksummed, such as by an older version of moss.
+	KvsChecksum uint32 `json:",omitempty"`
+	BufChecksum uint32 `json:",omitempty"`
+
 	mref *mmapRef // Immutable and ephemeral / non-persisted.
 }
 
@@ -254,16 +365,27 @@ func (s *Store) AddRef() {
 // to close the store.
 func (s *Store) Close() error {
 	s.m.Lock()
-	defer s.m.Unlock()
 
 	s.refs--
 	if s.refs > 0 || s.footer == nil {
+		s.m.Unlock()
 		return nil
 	}
 
 	footer := s.footer
 	s.footer = nil
 
+	compactionBgDoneCh := s.compactionBgDoneCh
+	if compactionBgDoneCh != nil {
+		close(s.compactionBgStopCh)
+	}
+
+	s.m.Unlock()
+
+	if compactionBgDoneCh != nil {
+		<-compactionBgDoneCh
+	}
+
 	return footer.Close()
 }
 
@@ -361,3 +483,71 @@ func (s *Store) SnapshotPrevious(ss Snapshot) (Snapshot, error) {
 func (s *Store) SnapshotRevert(revertTo Snapshot) error {
 	return s.snapshotRevert(revertTo)
 }
+
+// --------------------------------------------------------
+
+// StoreStats are the stats of a store, as returned by Store.StatsEx().
+// Fields that are prefixed like NumXxxx or MaxXxxx are gauges, and
+// fields that are prefixed like TotXxxx are monotonically increasing
+// counters.
+type StoreStats struct {
+	NumBytesUsedDisk uint64 // Bytes of all the files in the store's dir.
+	NumBytesLive     uint64 // Bytes of the data files that are referenced.
+	NumBytesDead     uint64 // Bytes of the data files that are obsolete.
+
+	NumSegments uint64 // Number of persisted top-level segments.
+
+	TotPersists               uint64
+	TotCompactions            uint64
+	TotCompactionsBackground  uint64
+	TotCompactionsBgAbandoned uint64
+	TotCompactionMerges       uint64
+
+	NumLastCompactionBeforeBytes uint64
+	NumLastCompactionAfterBytes  uint64
+	TotCompactionDecreaseBytes   uint64
+	TotCompactionIncreaseBytes   uint64
+	MaxCompactionDecreaseBytes   uint64
+	MaxCompactionIncreaseBytes   uint64
+
+	NumLastCompactionUsecs uint64 // Duration of the last compaction.
+	TotCompactionUsecs     uint64 // Duration of all compactions.
+	MaxCompactionUsecs     uint64 // Duration of the longest compaction.
+
+	TotCompactionThrottled      uint64
+	TotCompactionThrottledUsecs uint64
+	TotPersistThrottled         uint64
+	TotPersistThrottledUsecs    uint64
+
+	// TotChecksumsVerified and TotChecksumMismatches count the
+	// persisted segments whose checksums were verified, as asked for
+	// by StoreOptions.VerifyChecksums, and those that didn't match.
+	TotChecksumsVerified  uint64
+	TotChecksumMismatches uint64
+
+	NumFilesOpen int // Number of files with a FileRef.
+
+	// Files are the files in the store's dir and the files with a
+	// FileRef, sorted by name.
+	Files []StoreFileStats
+}
+
+// StoreFileStats are the stats of a file of a store.
+type StoreFileStats struct {
+	Name string
+
+	Open     bool // True when the file has a FileRef.
+	RefCount int  // Ref-count of the FileRef, when Open.
+
+	Exists   bool // True when the file is in the store's dir.
+	Size     int64
+	Mode     os.FileMode
+	Modified time.Time
+	IsDir    bool
+
+	// Data is true for the data files of the store's current footer,
+	// which have LiveBytes and DeadBytes.
+	Data      bool
+	LiveBytes int64
+	DeadBytes int64
+}
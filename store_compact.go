@@ -13,86 +13,80 @@ package moss
 
 import (
 	"fmt"
-	"os"
+	"hash/crc32"
+	"sync/atomic"
 	"time"
 )
 
 func (s *Store) compactMaybe(higher Snapshot, persistOptions StorePersistOptions) (
-	bool, error) {
+	bool, *CompactionMerge, error) {
 	if s.Options().CollectionOptions.ReadOnly {
 		// Do not compact in Read-Only mode
-		return false, nil
+		return false, nil, nil
 	}
 
 	compactionConcern := persistOptions.CompactionConcern
+	if compactionConcern != CompactionForce && s.hasStaleCloneBases(higher) {
+		// Compaction copies the segments of clones whose sources were
+		// compacted away, which a new footer can't reference.
+		compactionConcern = CompactionForce
+	}
 	if compactionConcern <= 0 {
-		return false, nil
+		return false, nil, nil
+	}
+
+	background := compactionConcern == CompactionBackground
+	if background {
+		compactionConcern = CompactionAllow
 	}
 
 	footer, err := s.snapshot()
 	if err != nil {
-		return false, err
+		return false, nil, err
 	}
 
 	defer footer.DecRef()
 
-	slocs, ss := footer.segmentLocs()
+	slocs, _ := footer.segmentLocs()
 
 	defer footer.DecRef()
 
-	if compactionConcern == CompactionAllow {
-		totUpperLen := 0
-		if ss != nil && len(ss.a) >= 2 {
-			for i := 1; i < len(ss.a); i++ {
-				totUpperLen += ss.a[i].Len()
-			}
-		}
-
-		if higher != nil {
-			higherSS, ok := higher.(*segmentStack)
-			if ok {
-				higherStats := higherSS.Stats()
-				if higherStats != nil {
-					totUpperLen += int(higherStats.CurOps)
-				}
-			}
-		}
+	var merge *CompactionMerge
 
-		if totUpperLen > 0 {
-			var pct float64
-			if ss != nil && len(ss.a) > 0 && ss.a[0].Len() > 0 {
-				pct = float64(totUpperLen) / float64(ss.a[0].Len())
-			}
+	if compactionConcern == CompactionAllow {
+		higherSS, _ := higher.(*segmentStack)
 
-			if pct >= s.options.CompactionPercentage ||
-				(s.options.CompactionMaxSegments > 0 &&
-					len(slocs) >= s.options.CompactionMaxSegments) {
+		plan := s.compactionPolicy().CompactionPlan(
+			s.compactionState(footer, higherSS))
+		if plan.Full {
+			if !background || !s.isCompactingBackground() {
 				compactionConcern = CompactionForce
 			}
+		} else if !s.isCompactingBackground() {
+			// Merging the newest segments would replace persisted
+			// segments that a running background compaction needs to
+			// find when it switches over, so it would be abandoned.
+			merge = plan.Merge
 		}
 	}
 
 	if compactionConcern != CompactionForce {
-		return false, nil
+		return false, merge, nil
+	}
+
+	if background {
+		s.startCompactionBackground(footer, persistOptions)
+		return false, nil, nil
 	}
 
 	err = s.compact(footer, higher, persistOptions)
 	if err != nil {
-		return false, err
+		return false, nil, err
 	}
 
-	var sizeBefore, sizeAfter int64
+	sizeBefore := s.removeFilesOnClose(footer, slocs)
 
-	if len(slocs) > 0 {
-		mref := slocs[0].mref
-		if mref != nil && mref.fref != nil {
-			finfo, err := s.removeFileOnClose(mref.fref)
-			if err == nil && len(finfo.Name()) > 0 {
-				// Fetch size of old file
-				sizeBefore = finfo.Size()
-			}
-		}
-	}
+	var sizeAfter int64
 
 	slocs, _ = footer.segmentLocs()
 	defer footer.DecRef()
@@ -108,6 +102,38 @@ func (s *Store) compactMaybe(higher Snapshot, persistOptions StorePersistOptions
 		}
 	}
 
+	s.updateCompactionStats(sizeBefore, sizeAfter)
+
+	return true, nil, nil
+}
+
+// removeFilesOnClose sets up the removal of the files of a footer
+// that was obsoleted by a compaction, returning their total size.
+func (s *Store) removeFilesOnClose(footer *Footer, slocs SegmentLocs) (
+	sizeBefore int64) {
+	if len(slocs) > 0 {
+		fref := footer.fileRef()
+		if fref != nil {
+			finfo, err := s.removeFileOnClose(fref)
+			if err == nil && len(finfo.Name()) > 0 {
+				// Fetch size of old file
+				sizeBefore = finfo.Size()
+			}
+		}
+	}
+
+	// The old auxiliary data files are also obsoleted by compaction.
+	for _, auxFref := range footer.auxFileRefs(nil) {
+		finfo, err := s.removeFileOnClose(auxFref)
+		if err == nil && len(finfo.Name()) > 0 {
+			sizeBefore += finfo.Size()
+		}
+	}
+
+	return sizeBefore
+}
+
+func (s *Store) updateCompactionStats(sizeBefore, sizeAfter int64) {
 	s.m.Lock()
 	s.numLastCompactionBeforeBytes = uint64(sizeBefore)
 	s.numLastCompactionAfterBytes = uint64(sizeAfter)
@@ -125,14 +151,35 @@ func (s *Store) compactMaybe(higher Snapshot, persistOptions StorePersistOptions
 		}
 	}
 	s.m.Unlock()
+}
+
+// updateCompactionUsecs records the duration of a compaction that
+// started at the given time.
+func (s *Store) updateCompactionUsecs(startTime time.Time) {
+	usecs := uint64(time.Since(startTime).Nanoseconds() / 1000)
+
+	s.histograms["CompactUsecs"].Add(usecs, 1)
 
-	return true, nil
+	s.m.Lock()
+	s.numLastCompactionUsecs = usecs
+	s.totCompactionUsecs += usecs
+	if s.maxCompactionUsecs < usecs {
+		s.maxCompactionUsecs = usecs
+	}
+	s.m.Unlock()
 }
 
 func (s *Store) compact(footer *Footer, higher Snapshot,
 	persistOptions StorePersistOptions) error {
 	startTime := time.Now()
 
+	// The persisted segments are verified before they're rewritten, so
+	// that corrupted data isn't carried into the compacted file.
+	err := s.verifyChecksums(footer)
+	if err != nil {
+		return err
+	}
+
 	var newSS *segmentStack
 	if higher != nil {
 		ssHigher, ok := higher.(*segmentStack)
@@ -142,23 +189,29 @@ func (s *Store) compact(footer *Footer, higher Snapshot,
 		ssHigher.ensureFullySorted()
 		newSS = s.mergeSegStacks(footer, ssHigher)
 	} else {
-		newSS = footer.ss // Safe as footer ref count is held positive.
+		newSS = footerSegStacks(footer) // Safe as footer ref count is held positive.
 	}
 
-	s.m.Lock()
-	frefCompact, fileCompact, err := s.startFileLOCKED()
-	s.m.Unlock()
+	frefCompact, fileCompact, err := s.startFile()
 	if err != nil {
 		return err
 	}
 
-	compactFooter, err := s.writeSegments(newSS, frefCompact, fileCompact)
+	s.fireFileEvent(EventKindCompactionStart, fileCompact,
+		len(newSS.a), 0)
+
+	compactFooter, err := s.writeSegments(newSS, frefCompact, fileCompact,
+		s.abortCh)
 	if err != nil {
 		s.removeFileOnClose(frefCompact)
 		frefCompact.DecRef()
 		return err
 	}
 
+	if higher == nil {
+		compactFooter.copyOptions(footer)
+	}
+
 	if s.options != nil && s.options.CompactionSync {
 		persistOptions.NoSync = false
 	}
@@ -177,14 +230,20 @@ func (s *Store) compact(footer *Footer, higher Snapshot,
 		return err
 	}
 
+	// The incarnation numbers of the child collections are ephemeral,
+	// so carry them over to the newly read footer.
+	footerReady.initIncarNums(newSS)
+
 	s.m.Lock()
 	footerPrev := s.footer
 	s.footer = footerReady // Owns the frefCompact ref-count.
 	s.totCompactions++
 	s.m.Unlock()
 
-	s.histograms["CompactUsecs"].Add(
-		uint64(time.Since(startTime).Nanoseconds()/1000), 1)
+	s.updateCompactionUsecs(startTime)
+
+	s.fireFileEvent(EventKindCompactionEnd, fileCompact,
+		len(footerReady.SegmentLocs), time.Since(startTime))
 
 	if footerPrev != nil {
 		footerPrev.DecRef()
@@ -204,6 +263,7 @@ func (s *Store) mergeSegStacks(footer *Footer, higher *segmentStack) *segmentSta
 		options:  higher.options,
 		a:        make([]Segment, 0, len(higher.a)+lenFooterSS),
 		incarNum: higher.incarNum,
+		stats:    higher.stats,
 	}
 	if footerSS != nil {
 		rv.a = append(rv.a, footerSS.a...)
@@ -213,36 +273,98 @@ func (s *Store) mergeSegStacks(footer *Footer, higher *segmentStack) *segmentSta
 		if len(rv.childSegStacks) == 0 {
 			rv.childSegStacks = make(map[string]*segmentStack)
 		}
-		if footer == nil {
-			rv.childSegStacks[cName] = s.mergeSegStacks(nil, newStack)
-			continue
+
+		var childFooter *Footer
+		if footer != nil {
+			var exists bool
+			childFooter, exists = footer.ChildFooters[cName]
+			if exists {
+				if childFooter.incarNum != newStack.incarNum {
+					// Fast child collection recreation, must not merge
+					// segments from prior incarnation.
+					childFooter = nil
+				}
+			}
 		}
+		if childFooter == nil {
+			childFooter = newStack.cloneBaseFooter()
+		}
+		rv.childSegStacks[cName] = s.mergeSegStacks(childFooter, newStack)
+	}
+	return rv
+}
+
+// hasStaleCloneBases returns true if the higher snapshot has a clone
+// of a child collection that's not yet persisted, and whose source's
+// segments are in a file other than the current file.
+func (s *Store) hasStaleCloneBases(higher Snapshot) bool {
+	ss, ok := higher.(*segmentStack)
+	if !ok || ss == nil {
+		return false
+	}
+
+	footer, err := s.snapshot()
+	if err != nil || footer == nil {
+		return false
+	}
+	defer footer.DecRef()
+
+	return staleCloneBases(footer, ss, footer.fileRef())
+}
 
-		childFooter, exists := footer.ChildFooters[cName]
-		if exists {
-			if childFooter.incarNum != higher.incarNum {
-				// Fast child collection recreation, must not merge
-				// segments from prior incarnation.
+func staleCloneBases(footer *Footer, ss *segmentStack, fref *FileRef) bool {
+	for cName, childStack := range ss.childSegStacks {
+		var childFooter *Footer
+		if footer != nil {
+			childFooter = footer.ChildFooters[cName]
+			if childFooter != nil && childFooter.incarNum != childStack.incarNum {
 				childFooter = nil
 			}
 		}
-		rv.childSegStacks[cName] = s.mergeSegStacks(childFooter, newStack)
+		if childFooter == nil {
+			childFooter = childStack.cloneBaseFooter()
+			if childFooter != nil {
+				cloneFref := childFooter.fileRef()
+				if cloneFref != nil && cloneFref != fref {
+					return true
+				}
+			}
+		}
+		if staleCloneBases(childFooter, childStack, fref) {
+			return true
+		}
+	}
+	return false
+}
+
+// footerSegStacks returns a segmentStack of the segments of a footer,
+// along with the segmentStacks of its nested child collections.
+func footerSegStacks(footer *Footer) *segmentStack {
+	rv := &segmentStack{incarNum: footer.incarNum}
+	if footer.ss != nil {
+		rv.options = footer.ss.options
+		rv.a = footer.ss.a
+	}
+	for cName, childFooter := range footer.ChildFooters {
+		if len(rv.childSegStacks) == 0 {
+			rv.childSegStacks = make(map[string]*segmentStack)
+		}
+		rv.childSegStacks[cName] = footerSegStacks(childFooter)
 	}
 	return rv
 }
 
 func (s *Store) writeSegments(newSS *segmentStack, frefCompact *FileRef,
-	fileCompact File) (compactFooter *Footer, err error) {
-	var pos int64
-	if newSS.incarNum == 0 {
+	fileCompact File, cancelCh chan struct{}) (compactFooter *Footer, err error) {
+	// The top-level collection's segments start at the first page after
+	// the header, and each child collection's segments follow on.
+	finfo, err := fileCompact.Stat()
+	if err != nil {
+		return nil, err
+	}
+	pos := finfo.Size()
+	if pos < int64(StorePageSize) {
 		pos = int64(StorePageSize)
-	} else {
-		var finfo os.FileInfo
-		finfo, err = fileCompact.Stat()
-		if err != nil {
-			return nil, err
-		}
-		pos = finfo.Size()
 	}
 
 	stats := newSS.Stats()
@@ -259,9 +381,11 @@ func (s *Store) writeSegments(newSS *segmentStack, frefCompact *FileRef,
 	}
 	compactionBufferSize := StorePageSize * compactionBufferPages
 
+	fileWriter := rateLimitFile(fileCompact, s.compactionLimiter)
+
 	compactWriter := &compactWriter{
-		kvsWriter: newBufferedSectionWriter(fileCompact, kvsBegPos, 0, compactionBufferSize),
-		bufWriter: newBufferedSectionWriter(fileCompact, bufBegPos, 0, compactionBufferSize),
+		kvsWriter: newBufferedSectionWriter(fileWriter, kvsBegPos, 0, compactionBufferSize),
+		bufWriter: newBufferedSectionWriter(fileWriter, bufBegPos, 0, compactionBufferSize),
 	}
 	onError := func(err error) error {
 		compactWriter.kvsWriter.Stop()
@@ -269,7 +393,17 @@ func (s *Store) writeSegments(newSS *segmentStack, frefCompact *FileRef,
 		return err
 	}
 
-	err = newSS.mergeInto(0, len(newSS.a), compactWriter, nil, false, false, s.abortCh)
+	var dest SegmentMutator = compactWriter
+	if newSS.options != nil && newSS.options.CompactionFilter != nil {
+		dest = &compactionFilterMutator{
+			dest:   compactWriter,
+			filter: newSS.options.CompactionFilter,
+			stats:  newSS.stats,
+		}
+	}
+
+	err = newSS.mergeInto(0, len(newSS.a), dest, nil, nil, nil,
+		false, false, cancelCh)
 	if err != nil {
 		return nil, onError(err)
 	}
@@ -301,16 +435,21 @@ func (s *Store) writeSegments(newSS *segmentStack, frefCompact *FileRef,
 				TotOpsDel:  compactWriter.totOperationDel,
 				TotKeyByte: compactWriter.totKeyByte,
 				TotValByte: compactWriter.totValByte,
+
+				KvsChecksum: compactWriter.kvsChecksum,
+				BufChecksum: compactWriter.bufChecksum,
 			},
 		},
 	}
 
+	compactFooter.initOptions(newSS.options)
+
 	for cName, childSegStack := range newSS.childSegStacks {
 		if compactFooter.ChildFooters == nil {
 			compactFooter.ChildFooters = make(map[string]*Footer)
 		}
 		childFooter, err := s.writeSegments(childSegStack,
-			frefCompact, fileCompact)
+			frefCompact, fileCompact, cancelCh)
 		if err != nil {
 			return nil, err
 		}
@@ -329,6 +468,9 @@ type compactWriter struct {
 	totOperationMerge uint64
 	totKeyByte        uint64
 	totValByte        uint64
+
+	kvsChecksum uint32
+	bufChecksum uint32
 }
 
 func (cw *compactWriter) Mutate(operation uint64, key, val []byte) error {
@@ -344,6 +486,9 @@ func (cw *compactWriter) Mutate(operation uint64, key, val []byte) error {
 		return err
 	}
 
+	cw.bufChecksum = crc32.Update(cw.bufChecksum, segmentChecksumTable, key)
+	cw.bufChecksum = crc32.Update(cw.bufChecksum, segmentChecksumTable, val)
+
 	keyLen := len(key)
 	valLen := len(val)
 
@@ -364,8 +509,10 @@ func (cw *compactWriter) Mutate(operation uint64, key, val []byte) error {
 		return err
 	}
 
+	cw.kvsChecksum = crc32.Update(cw.kvsChecksum, segmentChecksumTable, kvsBuf)
+
 	switch operation {
-	case OperationSet:
+	case OperationSet, operationSetTTL:
 		cw.totOperationSet++
 	case OperationDel:
 		cw.totOperationDel++
@@ -379,3 +526,34 @@ func (cw *compactWriter) Mutate(operation uint64, key, val []byte) error {
 
 	return nil
 }
+
+// --------------------------------------------------------
+
+// A compactionFilterMutator drops the key-val entries that are
+// filtered by a CompactionFilter, and passes the remaining entries
+// through to the dest.  As compaction writes all the entries of a
+// collection, dropped entries need no deletion tombstones.
+type compactionFilterMutator struct {
+	dest   SegmentMutator
+	filter CompactionFilter
+	stats  *CollectionStats
+}
+
+func (m *compactionFilterMutator) Mutate(operation uint64,
+	key, val []byte) error {
+	if operation == OperationSet || operation == operationSetTTL {
+		v := val
+		if operation == operationSetTTL && len(v) >= expiryLen {
+			v = v[expiryLen:]
+		}
+
+		if m.filter.Filter(key, v) {
+			if m.stats != nil {
+				atomic.AddUint64(&m.stats.TotCompactionFilterDropped, 1)
+			}
+			return nil
+		}
+	}
+
+	return m.dest.Mutate(operation, key, val)
+}
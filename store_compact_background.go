@@ -0,0 +1,303 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package moss
+
+import (
+	"fmt"
+	"time"
+)
+
+// isCompactingBackground returns true while a background compaction
+// is running.
+func (s *Store) isCompactingBackground() bool {
+	s.m.Lock()
+	rv := s.compactionBgDoneCh != nil
+	s.m.Unlock()
+
+	return rv
+}
+
+// startCompactionBackground starts a background compaction of the
+// given footer, unless one is already running or the store is closed.
+func (s *Store) startCompactionBackground(footer *Footer,
+	persistOptions StorePersistOptions) {
+	if footer.fileRef() == nil {
+		return // Nothing persisted yet, so nothing to compact.
+	}
+
+	s.m.Lock()
+	if s.compactionBgDoneCh != nil || s.footer == nil {
+		s.m.Unlock()
+		return
+	}
+
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+
+	s.compactionBgStopCh = stopCh
+	s.compactionBgDoneCh = doneCh
+	s.m.Unlock()
+
+	footer.AddRef() // The background compaction owns this ref-count.
+
+	go func() {
+		err := s.compactBackground(footer, persistOptions, stopCh)
+		if err != nil && err != ErrAborted &&
+			s.options.CollectionOptions.Log != nil {
+			s.options.CollectionOptions.Log("store: compactBackground, err: %v", err)
+		}
+
+		footer.DecRef()
+
+		s.m.Lock()
+		s.compactionBgStopCh = nil
+		s.compactionBgDoneCh = nil
+		s.m.Unlock()
+
+		close(doneCh)
+	}()
+}
+
+// compactBackground writes the segments of the pinned footer to a new
+// file, and then, while persistence is paused, copies the segments
+// persisted since the pinned footer to the new file and switches the
+// store over to the new file.  The compaction is abandoned if the
+// store's footer no longer derives from the pinned footer, such as
+// after a revert or another compaction.
+func (s *Store) compactBackground(footer *Footer,
+	persistOptions StorePersistOptions, stopCh chan struct{}) error {
+	startTime := time.Now()
+
+	err := s.verifyChecksums(footer)
+	if err != nil {
+		return err
+	}
+
+	newSS := footerSegStacks(footer) // Safe as footer ref count is held positive.
+
+	frefCompact, fileCompact, err := s.startFile()
+	if err != nil {
+		return err
+	}
+
+	s.fireFileEvent(EventKindCompactionStart, fileCompact,
+		len(newSS.a), 0)
+
+	abandon := func(err error) error {
+		s.m.Lock()
+		s.totCompactionsBgAbandoned++
+		s.m.Unlock()
+
+		s.removeFileOnClose(frefCompact)
+		frefCompact.DecRef()
+		return err
+	}
+
+	compactFooter, err := s.writeSegments(newSS, frefCompact, fileCompact,
+		stopCh)
+	if err != nil {
+		return abandon(err)
+	}
+
+	if s.trackDeadBytes() {
+		// The compacted segments are loaded, so that the entries that
+		// the replayed segments shadow within them can be tracked.
+		err = compactFooter.loadSegments(s.options, frefCompact, nil)
+		if err != nil {
+			return abandon(err)
+		}
+		defer compactFooter.DecRef()
+	}
+
+	// Pause persistence while catching up and switching over.
+	s.persistM.Lock()
+	defer s.persistM.Unlock()
+
+	select {
+	case <-stopCh:
+		return abandon(ErrAborted)
+	default:
+	}
+
+	cur, err := s.snapshot()
+	if err != nil {
+		return abandon(err)
+	}
+	if cur == nil {
+		return abandon(ErrAborted)
+	}
+	defer cur.DecRef()
+
+	if cur.fileRef() != footer.fileRef() ||
+		!segmentLocsHasPrefix(cur.SegmentLocs, footer.SegmentLocs) {
+		return abandon(nil)
+	}
+
+	err = s.verifyChecksums(cur)
+	if err != nil {
+		return abandon(err)
+	}
+
+	replayFooter, err := s.replaySegments(footer, cur, compactFooter,
+		fileCompact)
+	if err != nil {
+		return abandon(err)
+	}
+
+	if s.options.CompactionSync {
+		persistOptions.NoSync = false
+	}
+
+	err = s.persistFooter(fileCompact, replayFooter, persistOptions)
+	if err != nil {
+		return abandon(err)
+	}
+
+	footerReady, err := ReadFooter(s.options, fileCompact)
+	if err != nil {
+		return abandon(err)
+	}
+
+	// The incarnation numbers of the child collections are ephemeral,
+	// so carry them over to the newly read footer.
+	footerReady.initIncarNums(footerSegStacks(cur))
+
+	s.m.Lock()
+	footerPrev := s.footer
+	if footerPrev == nil { // The store was closed.
+		s.m.Unlock()
+		footerReady.DecRef()
+		return abandon(ErrAborted)
+	}
+	s.footer = footerReady // Owns the frefCompact ref-count.
+	s.totCompactions++
+	s.totCompactionsBg++
+	s.m.Unlock()
+
+	s.updateCompactionUsecs(startTime)
+
+	s.fireFileEvent(EventKindCompactionEnd, fileCompact,
+		len(footerReady.SegmentLocs), time.Since(startTime))
+
+	slocs, _ := cur.segmentLocs()
+	sizeBefore := s.removeFilesOnClose(cur, slocs)
+	cur.DecRef()
+
+	var sizeAfter int64
+	finfo, err := fileCompact.Stat()
+	if err == nil {
+		sizeAfter = finfo.Size()
+	}
+
+	s.updateCompactionStats(sizeBefore, sizeAfter)
+
+	footerPrev.DecRef()
+
+	return nil
+}
+
+// replaySegments returns a new footer whose SegmentLocs are those of
+// the compactFooter, which was written from the pinned footer, followed
+// by the SegmentLocs of copies of the segments that were persisted to
+// the cur footer after the pinned footer.  A child collection whose
+// SegmentLocs don't derive from the pinned footer, such as one that
+// was created or recreated during the compaction, has all its
+// segments copied.  The copies keep the DeadBytes of their originals,
+// and when dead bytes are tracked, the entries of the compacted
+// segments that the copies shadow are added to the DeadBytes of the
+// compacted segments.
+func (s *Store) replaySegments(footer, cur, compactFooter *Footer,
+	file File) (*Footer, error) {
+	slocs, ss := cur.segmentLocs()
+	defer cur.DecRef()
+
+	rv := &Footer{
+		refs:                 1,
+		incarNum:             cur.incarNum,
+		MergeOperatorName:    cur.MergeOperatorName,
+		CompactionFilterName: cur.CompactionFilterName,
+		ChildOptions:         cur.ChildOptions,
+	}
+
+	var replayFrom int
+	if footer != nil && compactFooter != nil &&
+		segmentLocsHasPrefix(slocs, footer.SegmentLocs) {
+		rv.SegmentLocs = append(rv.SegmentLocs, compactFooter.SegmentLocs...)
+		replayFrom = len(footer.SegmentLocs)
+	}
+
+	var segments []Segment
+	if ss != nil {
+		segments = ss.a
+	}
+	if len(segments) != len(slocs) {
+		return nil, fmt.Errorf("store: replaySegments segments mismatch,"+
+			" len(segments): %d, len(slocs): %d", len(segments), len(slocs))
+	}
+
+	if replayFrom > 0 && replayFrom < len(slocs) && s.trackDeadBytes() {
+		addShadowedBytes(compactFooter, rv,
+			&segmentStack{a: segments[replayFrom:]}, map[Segment]uint64{})
+	}
+
+	for i := replayFrom; i < len(slocs); i++ {
+		segmentLoc, err := s.persistSegment(file, segments[i], s.options)
+		if err != nil {
+			return nil, err
+		}
+
+		segmentLoc.DeadBytes = slocs[i].DeadBytes
+
+		rv.SegmentLocs = append(rv.SegmentLocs, segmentLoc)
+	}
+
+	for cName, curChild := range cur.ChildFooters {
+		var childFooter, compactChildFooter *Footer
+		if footer != nil {
+			childFooter = footer.ChildFooters[cName]
+		}
+		if compactFooter != nil {
+			compactChildFooter = compactFooter.ChildFooters[cName]
+		}
+
+		replayChildFooter, err := s.replaySegments(childFooter, curChild,
+			compactChildFooter, file)
+		if err != nil {
+			return nil, err
+		}
+
+		if rv.ChildFooters == nil {
+			rv.ChildFooters = make(map[string]*Footer)
+		}
+		rv.ChildFooters[cName] = replayChildFooter
+	}
+
+	return rv, nil
+}
+
+// segmentLocsHasPrefix returns true if the SegmentLocs start with the
+// same persisted segments as the prefix SegmentLocs.
+func segmentLocsHasPrefix(slocs, prefix SegmentLocs) bool {
+	if len(slocs) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		a, b := &slocs[i], &prefix[i]
+		if a.Kind != b.Kind ||
+			a.KvsOffset != b.KvsOffset || a.KvsBytes != b.KvsBytes ||
+			a.BufOffset != b.BufOffset || a.BufBytes != b.BufBytes ||
+			a.FileName != b.FileName {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,530 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package moss
+
+// A CompactionPolicy decides whether and what a store compacts as
+// part of persistence, when the CompactionConcern is CompactionAllow
+// or CompactionBackground.
+type CompactionPolicy interface {
+	CompactionPlan(state *CompactionState) CompactionPlan
+}
+
+// A CompactionState describes a store and the incoming higher
+// snapshot that's about to be persisted to a CompactionPolicy.
+type CompactionState struct {
+	Options *StoreOptions
+
+	// FileSizes are the byte sizes of the store's current data files,
+	// keyed by file name, including any auxiliary data files.
+	FileSizes map[string]int64
+
+	// LiveBytes are the number of bytes of the store's current data
+	// files that are still referenced, other than the bytes of
+	// tombstones and shadowed entries, keyed by file name.
+	LiveBytes map[string]int64
+
+	// Collection is the state of the top-level collection.
+	Collection *CompactionCollectionState
+}
+
+// DeadBytes returns the number of bytes of the store's current data
+// files that are no longer referenced or that hold tombstones and
+// shadowed entries, which a full compaction would reclaim.
+func (state *CompactionState) DeadBytes() int64 {
+	var rv int64
+	for fileName, size := range state.FileSizes {
+		if size > state.LiveBytes[fileName] {
+			rv += size - state.LiveBytes[fileName]
+		}
+	}
+	return rv
+}
+
+// SpaceAmplification returns the ratio of the byte size of the store's
+// current data files to the number of live bytes within them, or 1.0
+// when there are no live bytes.
+func (state *CompactionState) SpaceAmplification() float64 {
+	var totSize, totLive int64
+	for fileName, size := range state.FileSizes {
+		totSize += size
+		totLive += state.LiveBytes[fileName]
+	}
+	if totLive <= 0 {
+		return 1.0
+	}
+	return float64(totSize) / float64(totLive)
+}
+
+// A CompactionCollectionState describes a collection of a store, and
+// mirrors the collection's Footer.
+type CompactionCollectionState struct {
+	// SegmentLocs are the collection's persisted segments, where
+	// older segments come first.
+	SegmentLocs SegmentLocs
+
+	// Higher are the collection's segments in the incoming higher
+	// snapshot, where older segments come first.
+	Higher []CompactionSegment
+
+	// Children are the states of the child collections, by name.
+	Children map[string]*CompactionCollectionState
+}
+
+// A CompactionSegment describes a segment that's not yet persisted.
+type CompactionSegment struct {
+	Ops   int
+	Bytes uint64 // The key-val bytes of the segment.
+}
+
+// A CompactionPlan is the decision of a CompactionPolicy.
+type CompactionPlan struct {
+	// Full of true means all the segments of the store and of the
+	// incoming higher snapshot are compacted into a new file.
+	Full bool
+
+	// Merge, when Full is false, describes the collections whose
+	// newest segments are merged into a single segment that's
+	// persisted to the current file.  Nil means no merges.
+	Merge *CompactionMerge
+}
+
+// A CompactionMerge describes the merge of the newest segments of a
+// collection and of its child collections.  A merge doesn't reclaim
+// any file space, but reduces the number of segments that reads have
+// to consult.
+type CompactionMerge struct {
+	// From is the position in the collection's SegmentLocs of the
+	// oldest persisted segment to merge with the incoming higher
+	// segments, where From of len(SegmentLocs) means only the higher
+	// segments are merged.  From < 0 means no merge of the
+	// collection's own segments.
+	From int
+
+	// Children are the merges of the child collections, by name.
+	Children map[string]*CompactionMerge
+}
+
+// ------------------------------------------------------
+
+// DefaultCompactionPolicy is the CompactionPolicy that's used when
+// StoreOptions.CompactionPolicy is nil, which decides on a full
+// compaction based on the CompactionPercentage and
+// CompactionMaxSegments of the StoreOptions.
+type DefaultCompactionPolicy struct{}
+
+// CompactionPlan returns a full compaction when the ops of the upper
+// levels of the top-level collection are a CompactionPercentage or
+// more of the ops of the base level, or when there are
+// CompactionMaxSegments or more persisted segments.
+func (p DefaultCompactionPolicy) CompactionPlan(
+	state *CompactionState) CompactionPlan {
+	slocs := state.Collection.SegmentLocs
+
+	totUpperLen := 0
+	for i := 1; i < len(slocs); i++ {
+		totUpperLen += slocs[i].TotOps()
+	}
+	for _, seg := range state.Collection.Higher {
+		totUpperLen += seg.Ops
+	}
+
+	if totUpperLen > 0 {
+		var pct float64
+		if len(slocs) > 0 && slocs[0].TotOps() > 0 {
+			pct = float64(totUpperLen) / float64(slocs[0].TotOps())
+		}
+
+		if pct >= state.Options.CompactionPercentage ||
+			(state.Options.CompactionMaxSegments > 0 &&
+				len(slocs) >= state.Options.CompactionMaxSegments) {
+			return CompactionPlan{Full: true}
+		}
+	}
+
+	return CompactionPlan{}
+}
+
+// ------------------------------------------------------
+
+// SizeTieredCompactionPolicy is a CompactionPolicy that groups the
+// segments of a collection into tiers of similarly sized segments, and
+// merges a tier once it has enough segments, along with all the newer
+// segments, so that the segments of a collection form tiers of
+// increasing sizes.  A full compaction happens when a merge would
+// include the oldest segment of a collection.
+//
+// Unlike a full compaction, which streams entries to a new file, a
+// merge builds the merged segment in memory, allocating as many bytes
+// as the keys and vals of the merged segments plus 16 bytes per op,
+// and then appends it to the current file, where the bytes of the
+// merged segments become dead.  MaxMergeBytes bounds that cost.
+type SizeTieredCompactionPolicy struct {
+	// MinTierSegments is the number of similarly sized segments that
+	// are merged together, including the incoming higher segments,
+	// which count as one.  Defaults to 4 when <= 1.
+	MinTierSegments int
+
+	// TierRatio determines whether a segment is similarly sized to the
+	// newer segments of a tier, which is when its size is at most
+	// TierRatio times their average size.  Defaults to 2.0 when <= 0.
+	TierRatio float64
+
+	// MaxMergeBytes is the most key-val bytes of the segments of a
+	// merge, including the incoming higher segments.  A tier that would
+	// exceed it is not merged, so its segments remain until a full
+	// compaction.  Defaults to 64MB when <= 0.
+	MaxMergeBytes uint64
+}
+
+// CompactionPlan returns the merges of the newest full tier of each
+// collection.
+func (p SizeTieredCompactionPolicy) CompactionPlan(
+	state *CompactionState) CompactionPlan {
+	minTierSegments := p.MinTierSegments
+	if minTierSegments <= 1 {
+		minTierSegments = 4
+	}
+
+	tierRatio := p.TierRatio
+	if tierRatio <= 0 {
+		tierRatio = 2.0
+	}
+
+	maxMergeBytes := p.MaxMergeBytes
+	if maxMergeBytes <= 0 {
+		maxMergeBytes = 64 * 1024 * 1024
+	}
+
+	var full bool
+
+	var visit func(cs *CompactionCollectionState) *CompactionMerge
+	visit = func(cs *CompactionCollectionState) *CompactionMerge {
+		rv := &CompactionMerge{From: -1}
+
+		if len(cs.Higher) > 0 {
+			// The incoming higher segments start the newest tier.
+			var tierBytes uint64
+			for _, seg := range cs.Higher {
+				tierBytes += seg.Bytes
+			}
+
+			tierSegments := 1
+			from := len(cs.SegmentLocs)
+
+			mergeBytes := tierBytes
+
+			for from > 0 {
+				sloc := &cs.SegmentLocs[from-1]
+				slocBytes := sloc.TotKeyByte + sloc.TotValByte
+
+				if mergeBytes+slocBytes > maxMergeBytes {
+					break
+				}
+
+				if float64(slocBytes) >
+					tierRatio*float64(tierBytes)/float64(tierSegments) {
+					if tierSegments >= minTierSegments {
+						break
+					}
+
+					// The segment starts an older tier, which is merged
+					// along with all the newer segments when it fills up.
+					tierBytes, tierSegments = 0, 0
+				}
+
+				tierBytes += slocBytes
+				tierSegments++
+				mergeBytes += slocBytes
+				from--
+			}
+
+			if tierSegments >= minTierSegments &&
+				mergeBytes <= maxMergeBytes {
+				if from <= 0 {
+					full = true
+				}
+
+				rv.From = from
+			}
+		}
+
+		for cName, childState := range cs.Children {
+			childMerge := visit(childState)
+			if childMerge != nil {
+				if rv.Children == nil {
+					rv.Children = make(map[string]*CompactionMerge)
+				}
+				rv.Children[cName] = childMerge
+			}
+		}
+
+		if rv.From < 0 && len(rv.Children) <= 0 {
+			return nil
+		}
+
+		return rv
+	}
+
+	merge := visit(state.Collection)
+	if full {
+		return CompactionPlan{Full: true}
+	}
+
+	return CompactionPlan{Merge: merge}
+}
+
+// ------------------------------------------------------
+
+// SpaceAmplificationCompactionPolicy is a CompactionPolicy that decides
+// on a full compaction based on the space amplification of the store's
+// data files, meaning the ratio of their size to the bytes within them
+// that are still live, rather than on op counts.  The store tracks
+// tombstones and shadowed entries as dead bytes for the policy, as if
+// StoreOptions.TrackDeadBytes was true.
+type SpaceAmplificationCompactionPolicy struct {
+	// MaxSpaceAmplification is the space amplification at or above
+	// which a full compaction happens.  Defaults to 2.0 when <= 1.0.
+	MaxSpaceAmplification float64
+
+	// MinDeadBytes is the number of dead bytes below which no full
+	// compaction happens, so that small stores aren't compacted too
+	// often.
+	MinDeadBytes int64
+
+	// Policy, if non-nil, is consulted when no full compaction is
+	// needed due to space amplification, such as to merge segments.
+	Policy CompactionPolicy
+}
+
+// CompactionPlan returns a full compaction when the space amplification
+// of the store's data files is MaxSpaceAmplification or more, and
+// otherwise the plan of the Policy, if any.
+func (p SpaceAmplificationCompactionPolicy) CompactionPlan(
+	state *CompactionState) CompactionPlan {
+	maxSpaceAmplification := p.MaxSpaceAmplification
+	if maxSpaceAmplification <= 1.0 {
+		maxSpaceAmplification = 2.0
+	}
+
+	if state.SpaceAmplification() >= maxSpaceAmplification &&
+		state.DeadBytes() >= p.MinDeadBytes {
+		return CompactionPlan{Full: true}
+	}
+
+	if p.Policy != nil {
+		return p.Policy.CompactionPlan(state)
+	}
+
+	return CompactionPlan{}
+}
+
+// ------------------------------------------------------
+
+// compactionPolicy returns the CompactionPolicy of the store.
+func (s *Store) compactionPolicy() CompactionPolicy {
+	if s.options.CompactionPolicy != nil {
+		return s.options.CompactionPolicy
+	}
+	return DefaultCompactionPolicy{}
+}
+
+// compactionState returns the CompactionState for the given footer
+// of the store and the incoming higher snapshot, which may be nil.
+func (s *Store) compactionState(footer *Footer,
+	higher *segmentStack) *CompactionState {
+	fileSizes, liveBytes := footerFileBytes(footer)
+
+	return &CompactionState{
+		Options:    s.options,
+		FileSizes:  fileSizes,
+		LiveBytes:  liveBytes,
+		Collection: compactionCollectionState(footer, higher),
+	}
+}
+
+func compactionCollectionState(footer *Footer,
+	higher *segmentStack) *CompactionCollectionState {
+	rv := &CompactionCollectionState{}
+
+	if footer != nil {
+		slocs, _ := footer.segmentLocs()
+		footer.DecRef()
+
+		rv.SegmentLocs = slocs
+	}
+
+	if higher == nil {
+		return rv
+	}
+
+	for _, seg := range higher.a {
+		if seg.Len() > 0 {
+			nk, nv := seg.NumKeyValBytes()
+			rv.Higher = append(rv.Higher,
+				CompactionSegment{Ops: seg.Len(), Bytes: nk + nv})
+		}
+	}
+
+	for cName, childStack := range higher.childSegStacks {
+		if rv.Children == nil {
+			rv.Children = make(map[string]*CompactionCollectionState)
+		}
+		rv.Children[cName] = compactionCollectionState(
+			persistedChildFooter(footer, cName, childStack), childStack)
+	}
+
+	return rv
+}
+
+// ------------------------------------------------------
+
+// mergeTails returns the segmentStack to persist in place of the
+// incoming higher segmentStack, ss, where the newest segments of the
+// collections are merged as described by the CompactionMerge.  The
+// SegmentLocs of the new footer, which are those of the storeFooter,
+// are trimmed of the merged segments.
+func (s *Store) mergeTails(storeFooter, footer *Footer, ss *segmentStack,
+	merge *CompactionMerge) (*segmentStack, error) {
+	if merge == nil {
+		return ss, nil
+	}
+
+	// The merged persisted segments are verified before they're
+	// rewritten, like with a compaction.
+	err := s.verifyChecksums(storeFooter)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := ss
+
+	copyOnWrite := func() {
+		if rv == ss {
+			rv = &segmentStack{
+				options:        ss.options,
+				a:              ss.a,
+				incarNum:       ss.incarNum,
+				cloneBase:      ss.cloneBase,
+				stats:          ss.stats,
+				childSegStacks: ss.childSegStacks,
+			}
+		}
+	}
+
+	if merge.From >= 0 {
+		var persisted []Segment
+		if storeFooter != nil {
+			_, storeSS := storeFooter.segmentLocs()
+			if storeSS != nil {
+				persisted = storeSS.a
+			}
+			storeFooter.DecRef()
+		}
+
+		if len(persisted) == len(footer.SegmentLocs) &&
+			merge.From <= len(persisted) {
+			merged, err := s.mergeTail(persisted, ss, merge.From)
+			if err != nil {
+				return nil, err
+			}
+
+			copyOnWrite()
+			rv.a = merged
+
+			footer.SegmentLocs = footer.SegmentLocs[:merge.From]
+
+			s.m.Lock()
+			s.totCompactionMerges++
+			s.m.Unlock()
+		}
+	}
+
+	var childSegStacksCopied bool
+
+	for cName, childMerge := range merge.Children {
+		childStack := ss.childSegStacks[cName]
+		childFooter := footer.ChildFooters[cName]
+		if childStack == nil || childFooter == nil {
+			continue
+		}
+
+		childRV, err := s.mergeTails(
+			persistedChildFooter(storeFooter, cName, childStack),
+			childFooter, childStack, childMerge)
+		if err != nil {
+			return nil, err
+		}
+
+		if childRV != childStack {
+			copyOnWrite()
+			if !childSegStacksCopied {
+				rv.childSegStacks = make(map[string]*segmentStack,
+					len(ss.childSegStacks))
+				for k, v := range ss.childSegStacks {
+					rv.childSegStacks[k] = v
+				}
+				childSegStacksCopied = true
+			}
+			rv.childSegStacks[cName] = childRV
+		}
+	}
+
+	return rv, nil
+}
+
+// mergeTail returns the segments that result from merging the
+// persisted segments from the given position onwards along with the
+// higher segments into a single segment.
+func (s *Store) mergeTail(persisted []Segment, higher *segmentStack,
+	from int) ([]Segment, error) {
+	a := make([]Segment, 0, len(persisted)+len(higher.a))
+	a = append(a, persisted...)
+	a = append(a, higher.a...)
+
+	options := higher.options
+	if options == nil {
+		options = &s.options.CollectionOptions
+	}
+
+	ss := &segmentStack{options: options, a: a, stats: higher.stats}
+
+	var totOps int
+	var totKeyValBytes uint64
+	for _, seg := range a[from:] {
+		totOps += seg.Len()
+		nk, nv := seg.NumKeyValBytes()
+		totKeyValBytes += nk + nv
+	}
+
+	if totOps <= 0 {
+		return nil, nil
+	}
+
+	merged, err := newSegment(totOps, int(totKeyValBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	// Deletions are kept when there are older segments that they
+	// might shadow.
+	err = ss.mergeInto(from, len(a), merged, nil, nil, nil,
+		from > 0, true, s.abortCh)
+	if err != nil {
+		return nil, err
+	}
+
+	if merged.Len() <= 0 {
+		return nil, nil
+	}
+
+	return []Segment{merged}, nil
+}
@@ -16,6 +16,9 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
 	"time"
 
 	"github.com/edsrzf/mmap-go"
@@ -32,7 +35,7 @@ func (s *Store) persistFooter(file File, footer *Footer,
 		}
 	}
 
-	err := s.persistFooterUnsynced(file, footer)
+	footerLen, err := s.persistFooterUnsynced(file, footer)
 	if err != nil {
 		return err
 	}
@@ -42,22 +45,30 @@ func (s *Store) persistFooter(file File, footer *Footer,
 	}
 
 	if err == nil {
+		dur := time.Since(startTime)
+
 		s.histograms["PersistFooterUsecs"].Add(
-			uint64(time.Since(startTime).Nanoseconds()/1000), 1)
+			uint64(dur.Nanoseconds()/1000), 1)
+
+		s.fireEvent(Event{Kind: EventKindFooterWrite,
+			FileName: footer.fileName, Bytes: int64(footerLen),
+			Segments: len(footer.SegmentLocs), Duration: dur})
 	}
 
 	return err
 }
 
-func (s *Store) persistFooterUnsynced(file File, footer *Footer) error {
+// persistFooterUnsynced writes the footer at the end of the file,
+// returning the footer's length in bytes.
+func (s *Store) persistFooterUnsynced(file File, footer *Footer) (int, error) {
 	jBuf, err := json.Marshal(footer)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	finfo, err := file.Stat()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	footerPos := pageAlignCeil(finfo.Size())
@@ -76,16 +87,16 @@ func (s *Store) persistFooterUnsynced(file File, footer *Footer) error {
 
 	footerWritten, err := file.WriteAt(footerBuf.Bytes(), footerPos)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if footerWritten != len(footerBuf.Bytes()) {
-		return fmt.Errorf("store: persistFooter error writing all footerBuf")
+		return 0, fmt.Errorf("store: persistFooter error writing all footerBuf")
 	}
 
 	footer.fileName = finfo.Name()
 	footer.filePos = footerPos
 
-	return nil
+	return footerLen, nil
 }
 
 // --------------------------------------------------------
@@ -197,10 +208,12 @@ func ScanFooter(options *StoreOptions, fref *FileRef, fileName string,
 				return nil, err
 			}
 
+			f.initChildFooterRefs()
+
 			// json.Unmarshal would have just loaded the map.
 			// We now need to load each segment into the map.
 			// Also recursively load child footer segment stacks.
-			err = f.loadSegments(options, fref)
+			err = f.loadSegments(options, fref, nil)
 			if err != nil {
 				return nil, err
 			}
@@ -217,13 +230,25 @@ func ScanFooter(options *StoreOptions, fref *FileRef, fileName string,
 
 // --------------------------------------------------------
 
-// loadSegments() loads the segments of a footer.  Adds new ref-counts
-// to the fref on success.  The footer will be in an already closed
-// state on error.
-func (f *Footer) loadSegments(options *StoreOptions, fref *FileRef) (err error) {
+// loadSegments() loads the segments of a footer, where fref is the
+// footer's file and auxFrefs are any already opened auxiliary data
+// files, keyed by file name.  Other auxiliary data files are opened
+// as needed.  Adds new ref-counts to the frefs on success.  The footer
+// will be in an already closed state on error.
+func (f *Footer) loadSegments(options *StoreOptions, fref *FileRef,
+	auxFrefs map[string]*FileRef) (err error) {
+	frefs := &footerFileRefs{options: options, fref: fref, auxFrefs: auxFrefs}
+
 	// Track mrefs that we need to DecRef() if there's an error.
 	mrefs := make([]*mmapRef, 0, len(f.SegmentLocs))
-	mrefs, err = f.doLoadSegments(options, fref, mrefs)
+	mrefs, err = f.doLoadSegments(options, &options.CollectionOptions,
+		frefs, mrefs)
+
+	// The mrefs hold their own ref-counts on any opened files.
+	for _, openedFref := range frefs.opened {
+		openedFref.DecRef()
+	}
+
 	if err != nil {
 		for _, mref := range mrefs {
 			mref.DecRef()
@@ -234,11 +259,85 @@ func (f *Footer) loadSegments(options *StoreOptions, fref *FileRef) (err error)
 	return nil
 }
 
-func (f *Footer) doLoadSegments(options *StoreOptions, fref *FileRef,
-	mrefs []*mmapRef) (mrefsSoFar []*mmapRef, err error) {
+// footerFileRefs resolves the FileRefs of the SegmentLocs of a footer
+// that's being loaded.
+type footerFileRefs struct {
+	options  *StoreOptions
+	fref     *FileRef
+	auxFrefs map[string]*FileRef
+	opened   map[string]*FileRef // Auxiliary data files opened by us.
+}
+
+// fileRef returns the FileRef of the file holding a SegmentLoc,
+// opening an auxiliary data file if needed.
+func (frefs *footerFileRefs) fileRef(sloc *SegmentLoc) (*FileRef, error) {
+	if sloc.FileName == "" {
+		return frefs.fref, nil
+	}
+
+	if fref := frefs.auxFrefs[sloc.FileName]; fref != nil {
+		return fref, nil
+	}
+	if fref := frefs.opened[sloc.FileName]; fref != nil {
+		return fref, nil
+	}
+
+	osFile := ToOsFile(frefs.fref.file)
+	if osFile == nil {
+		return nil, fmt.Errorf("store: footerFileRefs convert to os.File error")
+	}
+
+	var flag int
+	var perm os.FileMode
+	if frefs.options.CollectionOptions.ReadOnly {
+		flag = os.O_RDONLY
+		perm = 0400
+	} else {
+		flag = os.O_RDWR
+		perm = 0600
+	}
+
+	openFile := frefs.options.OpenFile
+	if openFile == nil {
+		openFile = func(name string, flag int, perm os.FileMode) (File, error) {
+			return os.OpenFile(name, flag, perm)
+		}
+	}
+
+	file, err := openFile(path.Join(path.Dir(osFile.Name()), sloc.FileName),
+		flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	fref := &FileRef{file: file, refs: 1}
+
+	if frefs.opened == nil {
+		frefs.opened = make(map[string]*FileRef)
+	}
+	frefs.opened[sloc.FileName] = fref
+
+	return fref, nil
+}
+
+func (f *Footer) doLoadSegments(options *StoreOptions, co *CollectionOptions,
+	frefs *footerFileRefs, mrefs []*mmapRef) (mrefsSoFar []*mmapRef, err error) {
 	// Recursively load the childFooters first.
-	for _, childFooter := range f.ChildFooters {
-		mrefs, err = childFooter.doLoadSegments(options, fref, mrefs)
+	for cName, childFooter := range f.ChildFooters {
+		// An unresolvable child's options are reported when the child
+		// collection is restored, so its segments are still loaded.
+		childCo, errCo := childFooterOptions(co, childFooter, cName)
+		if errCo != nil {
+			childCo = co
+		}
+
+		mrefs, err = childFooter.doLoadSegments(options, childCo, frefs, mrefs)
 		if err != nil {
 			return mrefs, err
 		}
@@ -248,11 +347,6 @@ func (f *Footer) doLoadSegments(options *StoreOptions, fref *FileRef,
 		return mrefs, nil
 	}
 
-	osFile := ToOsFile(fref.file)
-	if osFile == nil {
-		return mrefs, fmt.Errorf("store: doLoadSegments convert to os.File error")
-	}
-
 	a := make([]Segment, len(f.SegmentLocs))
 
 	for i := range f.SegmentLocs {
@@ -260,12 +354,17 @@ func (f *Footer) doLoadSegments(options *StoreOptions, fref *FileRef,
 
 		mref := sloc.mref
 		if mref != nil {
-			if mref.fref != fref {
+			if sloc.FileName == "" && mref.fref != frefs.fref {
 				return mrefs, fmt.Errorf("store: doLoadSegments fref mismatch")
 			}
 
 			mref.AddRef()
 		} else {
+			fref, err := frefs.fileRef(sloc)
+			if err != nil {
+				return mrefs, err
+			}
+
 			// We persist kvs before buf, so KvsOffset < BufOffset.
 			begOffset := int64(sloc.KvsOffset)
 			endOffset := int64(sloc.BufOffset + sloc.BufBytes)
@@ -279,6 +378,11 @@ func (f *Footer) doLoadSegments(options *StoreOptions, fref *FileRef,
 			begOffsetDelta := int(begOffset - begOffsetActual)
 			nbytesActual := nbytes + begOffsetDelta
 
+			osFile := ToOsFile(fref.file)
+			if osFile == nil {
+				return mrefs, fmt.Errorf("store: doLoadSegments convert to os.File error")
+			}
+
 			mm, err := mmap.MapRegion(osFile, nbytesActual, mmap.RDONLY, 0, begOffsetActual)
 			if err != nil {
 				return mrefs, fmt.Errorf("store: doLoadSegments mmap.Map(), err: %v", err)
@@ -311,7 +415,7 @@ func (f *Footer) doLoadSegments(options *StoreOptions, fref *FileRef,
 	}
 
 	f.ss = &segmentStack{
-		options: &options.CollectionOptions,
+		options: co,
 		a:       a,
 		refs:    1,
 	}
@@ -365,10 +469,25 @@ func (f *Footer) DecRef() {
 		f.SegmentLocs.DecRef()
 		f.SegmentLocs = nil
 		f.ss = nil
+
+		// A footer owns a ref-count on each of its child footers.
+		for _, childFooter := range f.ChildFooters {
+			childFooter.DecRef()
+		}
 	}
 	f.m.Unlock()
 }
 
+// initChildFooterRefs recursively sets the ref-counts of the child
+// footers of a newly unmarshaled footer, which are owned by their
+// parent footer.
+func (f *Footer) initChildFooterRefs() {
+	for _, childFooter := range f.ChildFooters {
+		childFooter.refs = 1
+		childFooter.initChildFooterRefs()
+	}
+}
+
 // Length returns the length of this footer
 func (f *Footer) Length() uint64 {
 	jBuf, err := json.Marshal(f)
@@ -382,6 +501,153 @@ func (f *Footer) Length() uint64 {
 
 // --------------------------------------------------------
 
+// fileRef returns the FileRef of the footer's file from the loaded
+// segments of a footer or of its child footers, or nil if there are
+// none.
+func (f *Footer) fileRef() *FileRef {
+	f.m.Lock()
+	for _, sloc := range f.SegmentLocs {
+		if sloc.mref != nil && sloc.FileName == "" {
+			f.m.Unlock()
+			return sloc.mref.fref
+		}
+	}
+	f.m.Unlock()
+
+	for _, childFooter := range f.ChildFooters {
+		fref := childFooter.fileRef()
+		if fref != nil {
+			return fref
+		}
+	}
+	return nil
+}
+
+// auxFileRefs adds the FileRefs of the auxiliary data files of the
+// loaded segments of a footer and of its child footers to a map keyed
+// by file name, which is allocated if nil.
+func (f *Footer) auxFileRefs(rv map[string]*FileRef) map[string]*FileRef {
+	if rv == nil {
+		rv = make(map[string]*FileRef)
+	}
+
+	f.m.Lock()
+	for _, sloc := range f.SegmentLocs {
+		if sloc.mref != nil && sloc.FileName != "" {
+			rv[sloc.FileName] = sloc.mref.fref
+		}
+	}
+	f.m.Unlock()
+
+	for _, childFooter := range f.ChildFooters {
+		childFooter.auxFileRefs(rv)
+	}
+
+	return rv
+}
+
+// segmentBytes adds the number of bytes of the persisted segments of a
+// footer and of its child footers, less their DeadBytes, to a map
+// keyed by file name, where the segments in the footer's own file are
+// keyed by the fileName.
+func (f *Footer) segmentBytes(fileName string, rv map[string]int64) {
+	f.m.Lock()
+	for _, sloc := range f.SegmentLocs {
+		name := fileName
+		if sloc.FileName != "" {
+			name = sloc.FileName
+		}
+		if sloc.KvsBytes+sloc.BufBytes > sloc.DeadBytes {
+			rv[name] += int64(sloc.KvsBytes + sloc.BufBytes - sloc.DeadBytes)
+		}
+	}
+	f.m.Unlock()
+
+	for _, childFooter := range f.ChildFooters {
+		childFooter.segmentBytes(fileName, rv)
+	}
+}
+
+// verifyChecksums verifies the checksums of the loaded segments of a
+// footer and its child footers, skipping the segments that were
+// verified before or that weren't checksummed.  Returns the number of
+// segments that were verified, along with ErrChecksumMismatch for the
+// first segment that didn't match.
+func (f *Footer) verifyChecksums(options *StoreOptions) (uint64, error) {
+	var verified uint64
+
+	f.m.Lock()
+	slocs := f.SegmentLocs
+	f.m.Unlock()
+
+	for i := range slocs {
+		sloc := &slocs[i]
+		if sloc.mref == nil || (sloc.KvsChecksum == 0 && sloc.BufChecksum == 0) {
+			continue
+		}
+
+		sloc.mref.m.Lock()
+		if sloc.mref.verified || sloc.mref.buf == nil {
+			sloc.mref.m.Unlock()
+			continue
+		}
+
+		buf := sloc.mref.buf
+		bufStart := sloc.BufOffset - sloc.KvsOffset
+
+		ok := sloc.KvsBytes <= uint64(len(buf)) &&
+			bufStart+sloc.BufBytes <= uint64(len(buf)) &&
+			crc32.Checksum(buf[:sloc.KvsBytes],
+				segmentChecksumTable) == sloc.KvsChecksum &&
+			crc32.Checksum(buf[bufStart:bufStart+sloc.BufBytes],
+				segmentChecksumTable) == sloc.BufChecksum
+
+		sloc.mref.verified = ok
+		sloc.mref.m.Unlock()
+
+		if !ok {
+			if options.CollectionOptions.Log != nil {
+				options.CollectionOptions.Log("store: checksum mismatch,"+
+					" footer: %s, sloc: %+v", f.fileName, sloc)
+			}
+			return verified, ErrChecksumMismatch
+		}
+
+		verified++
+	}
+
+	for _, childFooter := range f.ChildFooters {
+		childVerified, err := childFooter.verifyChecksums(options)
+		verified += childVerified
+		if err != nil {
+			return verified, err
+		}
+	}
+
+	return verified, nil
+}
+
+// verifyChecksums verifies the checksums of the segments of a footer
+// when asked for by the StoreOptions, counting the results.
+func (s *Store) verifyChecksums(footer *Footer) error {
+	if footer == nil || !s.options.VerifyChecksums {
+		return nil
+	}
+
+	verified, err := footer.verifyChecksums(s.options)
+
+	s.m.Lock()
+	s.totChecksumsVerified += verified
+	if err != nil {
+		s.totChecksumMismatches++
+	}
+	s.m.Unlock()
+
+	return err
+}
+
+// --------------------------------------------------------
+
 // segmentLocs returns the current SegmentLocs and segmentStack for
 // a footer, while also incrementing the ref-count on the footer.  The
 // caller must DecRef() the footer when done.
@@ -418,6 +684,46 @@ func (f *Footer) Get(key []byte, readOptions ReadOptions) ([]byte, error) {
 	return rv, err
 }
 
+// GetMulti retrieves the vals for multiple keys from the Footer.
+func (f *Footer) GetMulti(keys [][]byte, readOptions ReadOptions) (
+	[][]byte, error) {
+	_, ss := f.segmentLocs()
+	if ss == nil {
+		f.DecRef()
+		return make([][]byte, len(keys)), nil
+	}
+
+	rv, err := ss.GetMulti(keys, readOptions)
+	if err == nil && !readOptions.NoCopyValue {
+		for i, val := range rv {
+			if val != nil {
+				rv[i] = append(make([]byte, 0, len(val)), val...) // Copy.
+			}
+		}
+	}
+
+	f.DecRef()
+
+	return rv, err
+}
+
+// EstimateRange returns an approximate summary of the entries in a
+// key range from the footer, based on the persisted segments.
+func (f *Footer) EstimateRange(startKeyInclusive, endKeyExclusive []byte) (
+	*RangeEstimate, error) {
+	_, ss := f.segmentLocs()
+	if ss == nil {
+		f.DecRef()
+		return &RangeEstimate{}, nil
+	}
+
+	rv, err := ss.EstimateRange(startKeyInclusive, endKeyExclusive)
+
+	f.DecRef()
+
+	return rv, err
+}
+
 // StartIterator returns a new Iterator instance on this footer.
 //
 // On success, the returned Iterator will be positioned so that
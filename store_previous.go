@@ -28,12 +28,7 @@ func (s *Store) snapshotPrevious(ss Snapshot) (Snapshot, error) {
 		return nil, nil
 	}
 
-	mref := slocs[0].mref
-	if mref == nil || mref.refs <= 0 {
-		return nil, fmt.Errorf("footer mref nil")
-	}
-
-	fref := mref.fref
+	fref := footer.fileRef()
 	if fref == nil || fref.refs <= 0 || fref.file == nil {
 		return nil, fmt.Errorf("footer fref nil")
 	}
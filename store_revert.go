@@ -30,14 +30,22 @@ func (s *Store) snapshotRevert(revertTo Snapshot) error {
 			" fileNameCurr: %s", revertToFooter.fileName, fileNameCurr)
 	}
 
+	if len(revertToFooter.SegmentLocs) <= 0 {
+		return fmt.Errorf("revert footer slocs <= 0")
+	}
+
+	fref := revertToFooter.fileRef()
+	if fref == nil || fref.file == nil {
+		return fmt.Errorf("revert footer parts nil")
+	}
+
 	persistOptions := StorePersistOptions{}
 	footer, err := s.revertToSnapshot(revertToFooter, persistOptions)
 	if err != nil {
 		return err
 	}
 
-	err = s.persistFooter(revertToFooter.SegmentLocs[0].mref.fref.file, footer,
-		persistOptions)
+	err = s.persistFooter(fref.file, footer, persistOptions)
 	if err != nil {
 		footer.DecRef()
 		return err
@@ -55,15 +63,8 @@ func (s *Store) snapshotRevert(revertTo Snapshot) error {
 
 func (s *Store) revertToSnapshot(revertToFooter *Footer, options StorePersistOptions) (
 	rv *Footer, err error) {
-	if len(revertToFooter.SegmentLocs) <= 0 {
-		return nil, fmt.Errorf("revert footer slocs <= 0")
-	}
-
-	mref := revertToFooter.SegmentLocs[0].mref
-	if mref == nil || mref.fref == nil || mref.fref.file == nil {
-		return nil, fmt.Errorf("revert footer parts nil")
-	}
-
+	// A child collection, such as one that only has nested child
+	// collections, may have no segments of its own.
 	slocs := append(SegmentLocs{}, revertToFooter.SegmentLocs...)
 	slocs.AddRef()
 
@@ -71,6 +72,10 @@ func (s *Store) revertToSnapshot(revertToFooter *Footer, options StorePersistOpt
 		refs:        1,
 		SegmentLocs: slocs,
 		ss:          revertToFooter.ss,
+
+		MergeOperatorName:    revertToFooter.MergeOperatorName,
+		CompactionFilterName: revertToFooter.CompactionFilterName,
+		ChildOptions:         revertToFooter.ChildOptions,
 	}
 
 	for cName, childFooter := range revertToFooter.ChildFooters {
@@ -12,69 +12,337 @@
 package moss
 
 import (
+	"bytes"
 	"io/ioutil"
 
 	"github.com/couchbase/ghistogram"
 )
 
-// Stats returns a map of stats.
+// Stats returns a map of stats, which are those of StatsEx() keyed
+// by their traditional names.
 func (s *Store) Stats() (map[string]interface{}, error) {
+	stats, err := s.StatsEx()
+	if err != nil {
+		return nil, err
+	}
+
+	return stats.toMap(), nil
+}
+
+// StatsEx returns the stats of the store.
+func (s *Store) StatsEx() (*StoreStats, error) {
 	finfos, err := ioutil.ReadDir(s.dir)
 	if err != nil {
 		return nil, err
 	}
 
-	var numBytesUsedDisk uint64
+	rv := &StoreStats{}
+
 	for _, finfo := range finfos {
 		if !finfo.IsDir() {
-			numBytesUsedDisk += uint64(finfo.Size())
+			rv.NumBytesUsedDisk += uint64(finfo.Size())
 		}
 	}
 
 	s.m.Lock()
-	totPersists := s.totPersists
-	totCompactions := s.totCompactions
-	numLastCompactionBeforeBytes := s.numLastCompactionBeforeBytes
-	numLastCompactionAfterBytes := s.numLastCompactionAfterBytes
-	totCompactionDecreaseBytes := s.totCompactionDecreaseBytes
-	totCompactionIncreaseBytes := s.totCompactionIncreaseBytes
-	maxCompactionDecreaseBytes := s.maxCompactionDecreaseBytes
-	maxCompactionIncreaseBytes := s.maxCompactionIncreaseBytes
+	rv.TotPersists = s.totPersists
+	rv.TotCompactions = s.totCompactions
+	rv.TotCompactionsBackground = s.totCompactionsBg
+	rv.TotCompactionsBgAbandoned = s.totCompactionsBgAbandoned
+	rv.TotCompactionMerges = s.totCompactionMerges
+	rv.NumLastCompactionBeforeBytes = s.numLastCompactionBeforeBytes
+	rv.NumLastCompactionAfterBytes = s.numLastCompactionAfterBytes
+	rv.TotCompactionDecreaseBytes = s.totCompactionDecreaseBytes
+	rv.TotCompactionIncreaseBytes = s.totCompactionIncreaseBytes
+	rv.MaxCompactionDecreaseBytes = s.maxCompactionDecreaseBytes
+	rv.MaxCompactionIncreaseBytes = s.maxCompactionIncreaseBytes
+	rv.NumLastCompactionUsecs = s.numLastCompactionUsecs
+	rv.TotCompactionUsecs = s.totCompactionUsecs
+	rv.MaxCompactionUsecs = s.maxCompactionUsecs
+	rv.TotChecksumsVerified = s.totChecksumsVerified
+	rv.TotChecksumMismatches = s.totChecksumMismatches
 	s.m.Unlock()
 
+	var totThrottledNanos uint64
+
+	rv.TotCompactionThrottled, totThrottledNanos = s.compactionLimiter.stats()
+	rv.TotCompactionThrottledUsecs = totThrottledNanos / 1000
+
+	rv.TotPersistThrottled, totThrottledNanos = s.persistLimiter.stats()
+	rv.TotPersistThrottledUsecs = totThrottledNanos / 1000
+
 	footer, err := s.snapshot()
 	if err != nil {
 		return nil, err
 	}
 
-	var numSegments uint64
 	if footer != nil {
 		footer.m.Lock()
 		if footer.ss != nil {
-			numSegments = uint64(len(footer.ss.a))
+			rv.NumSegments = uint64(len(footer.ss.a))
 		}
 		footer.m.Unlock()
 	}
 
+	fileSizes, liveBytes := footerFileBytes(footer)
+
 	footer.Close()
 
-	files, numFilesOpen := s.allFiles()
+	rv.Files, rv.NumFilesOpen = s.allFiles()
+
+	for i := range rv.Files {
+		fs := &rv.Files[i]
+
+		size, ok := fileSizes[fs.Name]
+		if ok {
+			fs.Data = true
+			fs.LiveBytes = liveBytes[fs.Name]
+			fs.DeadBytes = size - fs.LiveBytes
+
+			rv.NumBytesLive += uint64(fs.LiveBytes)
+			rv.NumBytesDead += uint64(fs.DeadBytes)
+		}
+	}
+
+	return rv, nil
+}
+
+// toMap returns the stats keyed by their traditional names, as used
+// by Store.Stats().
+func (stats *StoreStats) toMap() map[string]interface{} {
+	files := make(map[string]interface{}, len(stats.Files))
+	for _, fs := range stats.Files {
+		var refCount interface{}
+		if fs.Open {
+			refCount = fs.RefCount
+		}
+
+		fileEntry := map[string]interface{}{"ref_count": refCount}
+		if fs.Exists {
+			fileEntry["file_size"] = fs.Size
+			fileEntry["file_mode"] = fs.Mode
+			fileEntry["file_modified"] = fs.Modified
+			fileEntry["is_dir"] = fs.IsDir
+		}
+		if fs.Data {
+			fileEntry["live_bytes"] = fs.LiveBytes
+			fileEntry["dead_bytes"] = fs.DeadBytes
+		}
+
+		files[fs.Name] = fileEntry
+	}
 
 	return map[string]interface{}{
-		"num_bytes_used_disk":              numBytesUsedDisk,
-		"total_persists":                   totPersists,
-		"total_compactions":                totCompactions,
-		"num_segments":                     numSegments,
-		"num_last_compaction_before_bytes": numLastCompactionBeforeBytes,
-		"num_last_compaction_after_bytes":  numLastCompactionAfterBytes,
-		"total_compaction_decrease_bytes":  totCompactionDecreaseBytes,
-		"total_compaction_increase_bytes":  totCompactionIncreaseBytes,
-		"max_compaction_decrease_bytes":    maxCompactionDecreaseBytes,
-		"max_compaction_increase_bytes":    maxCompactionIncreaseBytes,
+		"num_bytes_used_disk":              stats.NumBytesUsedDisk,
+		"num_bytes_live":                   stats.NumBytesLive,
+		"num_bytes_dead":                   stats.NumBytesDead,
+		"total_persists":                   stats.TotPersists,
+		"total_compactions":                stats.TotCompactions,
+		"total_compactions_background":     stats.TotCompactionsBackground,
+		"total_compactions_bg_abandoned":   stats.TotCompactionsBgAbandoned,
+		"total_compaction_merges":          stats.TotCompactionMerges,
+		"num_segments":                     stats.NumSegments,
+		"num_last_compaction_before_bytes": stats.NumLastCompactionBeforeBytes,
+		"num_last_compaction_after_bytes":  stats.NumLastCompactionAfterBytes,
+		"total_compaction_decrease_bytes":  stats.TotCompactionDecreaseBytes,
+		"total_compaction_increase_bytes":  stats.TotCompactionIncreaseBytes,
+		"max_compaction_decrease_bytes":    stats.MaxCompactionDecreaseBytes,
+		"max_compaction_increase_bytes":    stats.MaxCompactionIncreaseBytes,
+		"num_last_compaction_usecs":        stats.NumLastCompactionUsecs,
+		"total_compaction_usecs":           stats.TotCompactionUsecs,
+		"max_compaction_usecs":             stats.MaxCompactionUsecs,
+		"total_compaction_throttled":       stats.TotCompactionThrottled,
+		"total_compaction_throttled_usecs": stats.TotCompactionThrottledUsecs,
+		"total_persist_throttled":          stats.TotPersistThrottled,
+		"total_persist_throttled_usecs":    stats.TotPersistThrottledUsecs,
+		"total_checksums_verified":         stats.TotChecksumsVerified,
+		"total_checksum_mismatches":        stats.TotChecksumMismatches,
 		"num_files":                        len(files),
-		"num_files_open":                   numFilesOpen,
+		"num_files_open":                   stats.NumFilesOpen,
 		"files":                            files,
-	}, nil
+	}
+}
+
+// footerFileBytes returns the byte sizes of the data files of a
+// footer and the number of live bytes within them, keyed by file name.
+// The live bytes of a file are its header, the segments that are
+// referenced by the footer and, for the footer's own file, the footer
+// itself.  The rest of a file is dead, such as previous footers, page
+// alignment padding, segments that were merged away, and the
+// tombstones and shadowed entries of the referenced segments, as
+// tracked by the DeadBytes of their SegmentLocs when TrackDeadBytes.
+func footerFileBytes(footer *Footer) (
+	fileSizes map[string]int64, liveBytes map[string]int64) {
+	fileSizes = map[string]int64{}
+	liveBytes = map[string]int64{}
+
+	if footer == nil {
+		return fileSizes, liveBytes
+	}
+
+	frefs := footer.auxFileRefs(nil)
+	if fref := footer.fileRef(); fref != nil {
+		frefs[""] = fref
+	}
+	for _, fref := range frefs {
+		file := fref.AddRef()
+		if file != nil {
+			finfo, err := file.Stat()
+			if err == nil {
+				fileSizes[finfo.Name()] = finfo.Size()
+			}
+		}
+		fref.DecRef()
+	}
+
+	footer.segmentBytes(footer.fileName, liveBytes)
+
+	for fileName, size := range fileSizes {
+		live := liveBytes[fileName] + int64(HeaderLength())
+		if fileName == footer.fileName && footer.filePos > 0 {
+			live += size - footer.filePos
+		}
+		if live > size {
+			live = size
+		}
+		liveBytes[fileName] = live
+	}
+
+	return fileSizes, liveBytes
+}
+
+// trackDeadBytes returns true when the persisted tombstones and
+// shadowed entries are to be tracked as dead bytes, which is when
+// they're asked for or needed by the CompactionPolicy.
+func (s *Store) trackDeadBytes() bool {
+	if s.options.TrackDeadBytes {
+		return true
+	}
+
+	switch s.options.CompactionPolicy.(type) {
+	case SpaceAmplificationCompactionPolicy, *SpaceAmplificationCompactionPolicy:
+		return true
+	}
+
+	return false
+}
+
+// addShadowedBytes tracks the bytes of the entries that are shadowed
+// by the Set and Del entries of the incoming segments of a
+// segmentStack, recursively for its child collections.  The shadowed
+// bytes of the storeFooter's persisted segments are added to the
+// DeadBytes of the new footer's SegmentLocs, and the shadowed bytes of
+// the incoming segments are added to the shadowed map.  Only the
+// newest older entry of a key is shadowed, along with the Merge
+// entries that it builds upon, as any older entries were accounted
+// for when that entry was persisted, and tombstones are accounted for
+// when their own segments are persisted.
+func addShadowedBytes(storeFooter, footer *Footer, ss *segmentStack,
+	shadowed map[Segment]uint64) {
+	var persisted []Segment
+	if storeFooter != nil {
+		_, storeSS := storeFooter.segmentLocs()
+		if storeSS != nil && len(storeSS.a) == len(footer.SegmentLocs) {
+			persisted = storeSS.a
+		}
+		storeFooter.DecRef()
+	}
+
+	a := make([]Segment, 0, len(persisted)+len(ss.a))
+	a = append(a, persisted...)
+	a = append(a, ss.a...)
+
+	for i := len(persisted); i < len(a); i++ {
+		cursor, err := a[i].Cursor(nil, nil)
+		if err != nil {
+			continue
+		}
+
+		var prevKey []byte
+		for {
+			operation, key, _ := cursor.Current()
+			if operation == 0 {
+				break
+			}
+
+			if operation != OperationMerge &&
+				(prevKey == nil || !bytes.Equal(prevKey, key)) {
+				shadowKey(a[:i], key, shadowed)
+			}
+			prevKey = key
+
+			if cursor.Next() != nil {
+				break
+			}
+		}
+	}
+
+	for j, seg := range persisted {
+		footer.SegmentLocs[j].DeadBytes += shadowed[seg]
+	}
+
+	for cName, childStack := range ss.childSegStacks {
+		childFooter := footer.ChildFooters[cName]
+		if childFooter != nil {
+			addShadowedBytes(
+				persistedChildFooter(storeFooter, cName, childStack),
+				childFooter, childStack, shadowed)
+		}
+	}
+}
+
+// shadowKey adds the bytes of the newest entry of a key within the
+// given older segments to the shadowed map, along with the bytes of
+// any Merge entries on the way.
+func shadowKey(older []Segment, key []byte, shadowed map[Segment]uint64) {
+	for j := len(older) - 1; j >= 0; j-- {
+		operation, val, err := older[j].Get(key)
+		if err != nil {
+			return
+		}
+
+		switch operation {
+		case 0:
+			continue
+		case OperationDel:
+			return // Already dead as a tombstone.
+		}
+
+		shadowed[older[j]] += entryBytes(key, val)
+
+		if operation != OperationMerge {
+			return
+		}
+	}
+}
+
+// tombstoneBytes returns the bytes of the Del entries of a segment.
+func tombstoneBytes(seg Segment) (rv uint64) {
+	cursor, err := seg.Cursor(nil, nil)
+	if err != nil {
+		return 0
+	}
+
+	for {
+		operation, key, val := cursor.Current()
+		if operation == 0 {
+			return rv
+		}
+
+		if operation == OperationDel {
+			rv += entryBytes(key, val)
+		}
+
+		if cursor.Next() != nil {
+			return rv
+		}
+	}
+}
+
+// entryBytes returns the persisted bytes of a key-val entry, which are
+// its key and val along with its two uint64's in the segment's kvs.
+func entryBytes(key, val []byte) uint64 {
+	return 16 + uint64(len(key)) + uint64(len(val))
 }
 
 // Histograms returns a snapshot of the histograms for this store.
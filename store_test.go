@@ -12,6 +12,7 @@
 package moss
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -2056,3 +2057,1623 @@ func TestStoreCompactMaxSegments(t *testing.T) {
 		t.Errorf("expected >0 total_compactions")
 	}
 }
+
+func TestStoreGetMulti(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	store, coll := openStoreAndWriteNItems(t, tmpDir, 1000, 10, false)
+	defer store.Close()
+	defer coll.Close()
+
+	// Some unpersisted changes that shadow persisted entries.
+	b, _ := coll.NewBatch(0, 0)
+	b.Del([]byte("key10"))
+	b.Set([]byte("key20"), []byte("updated"))
+	err := coll.ExecuteBatch(b, WriteOptions{})
+	if err != nil {
+		t.Errorf("expected ExecuteBatch() to succeed, err: %v", err)
+	}
+	b.Close()
+
+	var keys [][]byte
+	for i := 0; i < 120; i += 3 {
+		keys = append(keys, []byte(fmt.Sprintf("key%d", 119-i)))
+	}
+	keys = append(keys, []byte("key10"), []byte("key20"), []byte("nope"))
+
+	vals, err := coll.GetMulti(keys, ReadOptions{})
+	if err != nil || len(vals) != len(keys) {
+		t.Fatalf("expected GetMulti() to succeed, err: %v", err)
+	}
+
+	for i, key := range keys {
+		val, err := coll.Get(key, ReadOptions{})
+		if err != nil {
+			t.Errorf("expected Get() to succeed, err: %v", err)
+		}
+		if !bytes.Equal(val, vals[i]) {
+			t.Errorf("mismatched GetMulti() for key: %s, %s vs %s",
+				key, vals[i], val)
+		}
+	}
+
+	// The store's footer supports GetMulti() on persisted segments.
+	ssStore, _ := store.Snapshot()
+	vals, err = ssStore.GetMulti(keys, ReadOptions{})
+	if err != nil || len(vals) != len(keys) {
+		t.Fatalf("expected footer GetMulti() to succeed, err: %v", err)
+	}
+	for i, key := range keys {
+		val, _ := ssStore.Get(key, ReadOptions{})
+		if !bytes.Equal(val, vals[i]) {
+			t.Errorf("mismatched footer GetMulti() for key: %s, %s vs %s",
+				key, vals[i], val)
+		}
+	}
+	if string(vals[len(keys)-3]) != "val10" || vals[len(keys)-1] != nil {
+		t.Errorf("expected persisted vals from footer GetMulti()")
+	}
+	ssStore.Close()
+}
+
+func TestStoreEstimateRange(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	store, coll := openStoreAndWriteNItems(t, tmpDir, 100, 1, false)
+	defer store.Close()
+	defer coll.Close()
+
+	// The persisted key0..key99 are sorted as strings, so key1,
+	// key10..key19 are in the range of [key1, key2).
+	start, end := []byte("key1"), []byte("key2")
+
+	ssStore, _ := store.Snapshot()
+	re, err := ssStore.EstimateRange(start, end)
+	if err != nil {
+		t.Fatalf("expected footer EstimateRange() to work, err: %v", err)
+	}
+	if re.Ops != 11 || re.MaxSegmentOps != 11 || re.Segments != 1 {
+		t.Errorf("unexpected footer estimate: %+v", re)
+	}
+	ssStore.Close()
+
+	// The collection's snapshot includes the lower-level footer.
+	ss, _ := coll.Snapshot()
+	re2, err := ss.EstimateRange(start, end)
+	if err != nil {
+		t.Fatalf("expected EstimateRange() to work, err: %v", err)
+	}
+	if re2.Ops < re.Ops || re2.MaxSegmentOps != re.MaxSegmentOps {
+		t.Errorf("unexpected collection estimate: %+v vs %+v", re2, re)
+	}
+	ss.Close()
+}
+
+func TestStoreTTL(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	store, err := OpenStore(tmpDir, StoreOptions{})
+	if err != nil || store == nil {
+		t.Fatalf("expected open empty store to work, err: %v", err)
+	}
+
+	coll, _ := NewCollection(CollectionOptions{})
+	coll.Start()
+	defer coll.Close()
+
+	b, _ := coll.NewBatch(0, 0)
+	b.Set([]byte("k0"), []byte("v0"))
+	b.SetWithTTL([]byte("k1"), []byte("v1"), time.Hour)
+	b.SetWithTTL([]byte("k2"), []byte("v2"), 50*time.Millisecond)
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	ss, _ := coll.Snapshot()
+	llss, err := store.Persist(ss, StorePersistOptions{})
+	ss.Close()
+	if err != nil {
+		t.Fatalf("expected persist to work, err: %v", err)
+	}
+
+	v, _ := llss.Get([]byte("k2"), ReadOptions{})
+	if string(v) != "v2" {
+		t.Errorf("expected unexpired k2 from persisted snapshot, got: %s", v)
+	}
+	llss.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	ssStore, _ := store.Snapshot()
+	for key, exp := range map[string]string{"k0": "v0", "k1": "v1", "k2": ""} {
+		v, err = ssStore.Get([]byte(key), ReadOptions{})
+		if err != nil || string(v) != exp {
+			t.Errorf("expected persisted val: %s for key: %s, got: %s, err: %v",
+				exp, key, v, err)
+		}
+	}
+	ssStore.Close()
+
+	// Compaction physically drops the expired entries.
+	b, _ = coll.NewBatch(0, 0)
+	b.Set([]byte("k3"), []byte("v3"))
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	ss, _ = coll.Snapshot()
+	llss, err = store.Persist(ss, StorePersistOptions{
+		CompactionConcern: CompactionForce,
+	})
+	ss.Close()
+	if err != nil {
+		t.Fatalf("expected compaction to work, err: %v", err)
+	}
+	llss.Close()
+
+	// The collection's merger might also have dropped k2 from its
+	// own dirty segments.
+	s, _ := coll.Stats()
+	if s.TotExpiredDropped < 1 {
+		t.Errorf("expected an expired entry dropped, got: %d",
+			s.TotExpiredDropped)
+	}
+
+	store.Close()
+
+	store, err = OpenStore(tmpDir, StoreOptions{})
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+	defer store.Close()
+
+	footer, _ := store.snapshot()
+	if len(footer.ss.a) != 1 || footer.ss.a[0].Len() != 3 {
+		t.Errorf("expected a single compacted segment of 3 entries")
+	}
+	for key, exp := range map[string]string{"k0": "v0", "k1": "v1", "k3": "v3"} {
+		v, err = footer.Get([]byte(key), ReadOptions{})
+		if err != nil || string(v) != exp {
+			t.Errorf("expected compacted val: %s for key: %s, got: %s, err: %v",
+				exp, key, v, err)
+		}
+	}
+	footer.Close()
+}
+
+func TestStoreMergeOperatorMismatch(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	mo := &MergeOperatorStringAppend{Sep: ":"}
+
+	store, err := OpenStore(tmpDir, StoreOptions{})
+	if err != nil || store == nil {
+		t.Fatalf("expected open empty store to work, err: %v", err)
+	}
+
+	coll, _ := NewCollection(CollectionOptions{MergeOperator: mo})
+	coll.Start()
+
+	b, _ := coll.NewBatch(0, 0)
+	b.Merge([]byte("a"), []byte("A"))
+	cb, _ := b.NewChildCollectionBatch("child", BatchOptions{})
+	cb.Merge([]byte("c"), []byte("C"))
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	ss, _ := coll.Snapshot()
+	llss, err := store.Persist(ss, StorePersistOptions{})
+	ss.Close()
+	if err != nil {
+		t.Fatalf("expected persist to work, err: %v", err)
+	}
+	llss.Close()
+	coll.Close()
+
+	footer, _ := store.snapshot()
+	if footer.MergeOperatorName != mo.Name() ||
+		footer.ChildFooters["child"].MergeOperatorName != mo.Name() {
+		t.Errorf("expected merge operator name recorded in footers")
+	}
+	footer.Close()
+	store.Close()
+
+	for _, co := range []CollectionOptions{
+		{MergeOperator: &MergeOperatorInt64Add{}},
+		{},
+	} {
+		_, _, err = OpenStoreCollection(tmpDir,
+			StoreOptions{CollectionOptions: co}, StorePersistOptions{})
+		if err != ErrMergeOperatorMismatch {
+			t.Errorf("expected ErrMergeOperatorMismatch, got: %v", err)
+		}
+	}
+
+	store, coll, err = OpenStoreCollection(tmpDir,
+		StoreOptions{CollectionOptions: CollectionOptions{MergeOperator: mo}},
+		StorePersistOptions{})
+	if err != nil {
+		t.Fatalf("expected reopen with the same merge operator to work,"+
+			" err: %v", err)
+	}
+	v, err := coll.Get([]byte("a"), ReadOptions{})
+	if err != nil || string(v) != ":A" {
+		t.Errorf("expected merged val, got: %s, err: %v", v, err)
+	}
+	coll.Close()
+	store.Close()
+
+	// A deliberate migration to another merge operator.
+	store, coll, err = OpenStoreCollection(tmpDir,
+		StoreOptions{
+			CollectionOptions: CollectionOptions{
+				MergeOperator: &MergeOperatorInt64Add{},
+			},
+			AllowMergeOperatorChange: true,
+		}, StorePersistOptions{})
+	if err != nil {
+		t.Fatalf("expected AllowMergeOperatorChange to work, err: %v", err)
+	}
+	coll.Close()
+	store.Close()
+}
+
+func TestStorePersistFiles(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	auxFNames := func() (rv []string) {
+		fileInfos, _ := ioutil.ReadDir(tmpDir)
+		for _, fileInfo := range fileInfos {
+			if strings.HasSuffix(fileInfo.Name(), StoreAuxSuffix) {
+				rv = append(rv, fileInfo.Name())
+			}
+		}
+		return rv
+	}
+
+	so := StoreOptions{PersistFiles: 3}
+
+	store, err := OpenStore(tmpDir, so)
+	if err != nil {
+		t.Fatalf("expected open empty store to work, err: %v", err)
+	}
+
+	coll, _ := NewCollection(CollectionOptions{})
+	coll.Start()
+
+	numBatches := 6
+	itemsPerBatch := 100
+
+	for round := 0; round < 2; round++ {
+		for bi := 0; bi < numBatches; bi++ {
+			b, _ := coll.NewBatch(0, 0)
+			cb, _ := b.NewChildCollectionBatch("child", BatchOptions{})
+			for i := 0; i < itemsPerBatch; i++ {
+				k := fmt.Sprintf("%d-%d-%d", round, bi, i)
+				b.Set([]byte(k), []byte("v"+k))
+				cb.Set([]byte(k), []byte("c"+k))
+			}
+			err = coll.ExecuteBatch(b, WriteOptions{})
+			if err != nil {
+				t.Fatalf("expected ExecuteBatch to work, err: %v", err)
+			}
+			b.Close()
+		}
+
+		ss, _ := coll.Snapshot()
+		llss, err := store.Persist(ss, StorePersistOptions{})
+		ss.Close()
+		if err != nil {
+			t.Fatalf("expected persist to work, err: %v", err)
+		}
+		llss.Close()
+
+		if len(auxFNames()) != 2 {
+			t.Errorf("expected 2 aux files, got: %v", auxFNames())
+		}
+	}
+
+	coll.Close()
+
+	footer, _ := store.snapshot()
+	auxSlocs := 0
+	for _, slocs := range []SegmentLocs{
+		footer.SegmentLocs, footer.ChildFooters["child"].SegmentLocs,
+	} {
+		for _, sloc := range slocs {
+			if sloc.FileName != "" {
+				auxSlocs++
+			}
+		}
+	}
+	if auxSlocs <= 0 {
+		t.Errorf("expected segments in aux files")
+	}
+	footer.Close()
+	store.Close()
+
+	check := func(store *Store) {
+		ss, err := store.Snapshot()
+		if err != nil {
+			t.Fatalf("expected snapshot to work, err: %v", err)
+		}
+		childSS, _ := ss.ChildCollectionSnapshot("child")
+		for round := 0; round < 2; round++ {
+			for bi := 0; bi < numBatches; bi++ {
+				for i := 0; i < itemsPerBatch; i++ {
+					k := fmt.Sprintf("%d-%d-%d", round, bi, i)
+					v, err := ss.Get([]byte(k), ReadOptions{})
+					if err != nil || string(v) != "v"+k {
+						t.Fatalf("expected key: %s, got: %s, err: %v", k, v, err)
+					}
+					v, err = childSS.Get([]byte(k), ReadOptions{})
+					if err != nil || string(v) != "c"+k {
+						t.Fatalf("expected child key: %s, got: %s, err: %v", k, v, err)
+					}
+				}
+			}
+		}
+		childSS.Close()
+		ss.Close()
+	}
+
+	store, err = OpenStore(tmpDir, so)
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+	check(store)
+
+	llss, err := store.Persist(nil,
+		StorePersistOptions{CompactionConcern: CompactionForce})
+	if err != nil {
+		t.Fatalf("expected compaction to work, err: %v", err)
+	}
+	llss.Close()
+	check(store)
+	store.Close()
+
+	store, err = OpenStore(tmpDir, so)
+	if err != nil {
+		t.Fatalf("expected reopen after compaction to work, err: %v", err)
+	}
+	if len(auxFNames()) != 0 {
+		t.Errorf("expected obsolete aux files to be removed, got: %v",
+			auxFNames())
+	}
+	check(store)
+	store.Close()
+}
+
+func TestStoreReopenRemovedObsoleteFiles(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	so := StoreOptions{PersistFiles: 3}
+
+	store, coll, err := OpenStoreCollection(tmpDir, so,
+		StorePersistOptions{CompactionConcern: CompactionDisable})
+	if err != nil {
+		t.Fatalf("expected open store collection to work, err: %v", err)
+	}
+
+	b, _ := coll.NewBatch(0, 0)
+	b.Set([]byte("a"), []byte("A"))
+	coll.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	waitForChildPersistence(t, coll)
+
+	coll.Close()
+	store.Close()
+
+	// Obsoleted files, which the store being reopened lists, are
+	// removed concurrently, such as by a previously opened store.
+	fname := FormatFName(1)
+	obsoleteFNames := []string{
+		FormatFName(0), FormatAuxFName(FormatFName(0), 1),
+	}
+	for _, obsoleteFName := range obsoleteFNames {
+		ioutil.WriteFile(path.Join(tmpDir, obsoleteFName), nil, 0600)
+	}
+
+	so.OpenFile = func(name string, flag int, perm os.FileMode) (File, error) {
+		if path.Base(name) == fname {
+			for _, obsoleteFName := range obsoleteFNames {
+				os.Remove(path.Join(tmpDir, obsoleteFName))
+			}
+		}
+		return os.OpenFile(name, flag, perm)
+	}
+
+	store, err = OpenStore(tmpDir, so)
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+
+	ss, _ := store.Snapshot()
+	v, err := ss.Get([]byte("a"), ReadOptions{})
+	if err != nil || string(v) != "A" {
+		t.Errorf("expected persisted val, v: %q, err: %v", v, err)
+	}
+	ss.Close()
+
+	store.Close()
+}
+
+func TestStoreCompactionBackground(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	store, err := OpenStore(tmpDir, StoreOptions{TrackDeadBytes: true})
+	if err != nil {
+		t.Fatalf("expected open empty store to work, err: %v", err)
+	}
+
+	coll, _ := NewCollection(CollectionOptions{})
+	coll.Start()
+
+	numItems := 0
+
+	persist := func(n int, spo StorePersistOptions) {
+		for round := 0; round < n; round++ {
+			b, _ := coll.NewBatch(0, 0)
+			cb, _ := b.NewChildCollectionBatch("child", BatchOptions{})
+			for i := 0; i < 100; i++ {
+				k := fmt.Sprintf("%08d", numItems)
+				b.Set([]byte(k), []byte("v"+k))
+				cb.Set([]byte(k), []byte("c"+k))
+				numItems++
+			}
+			if numItems > 100 {
+				// Also overwrite and delete some older items.
+				k := fmt.Sprintf("%08d", numItems-150)
+				b.Set([]byte(k), []byte("x"+k))
+				cb.Del([]byte(k))
+			}
+			err = coll.ExecuteBatch(b, WriteOptions{})
+			if err != nil {
+				t.Fatalf("expected ExecuteBatch to work, err: %v", err)
+			}
+			b.Close()
+
+			ss, _ := coll.Snapshot()
+			llss, err := store.Persist(ss, spo)
+			ss.Close()
+			if err != nil {
+				t.Fatalf("expected persist to work, err: %v", err)
+			}
+			llss.Close()
+		}
+	}
+
+	check := func(store *Store) {
+		ss, err := store.Snapshot()
+		if err != nil {
+			t.Fatalf("expected snapshot to work, err: %v", err)
+		}
+		childSS, _ := ss.ChildCollectionSnapshot("child")
+		for i := 0; i < numItems; i++ {
+			k := fmt.Sprintf("%08d", i)
+			expVal, expChildVal := "v"+k, "c"+k
+			if i%100 == 50 && i+150 <= numItems {
+				expVal, expChildVal = "x"+k, ""
+			}
+			v, err := ss.Get([]byte(k), ReadOptions{})
+			if err != nil || string(v) != expVal {
+				t.Fatalf("expected key: %s, val: %s, got: %s, err: %v",
+					k, expVal, v, err)
+			}
+			v, err = childSS.Get([]byte(k), ReadOptions{})
+			if err != nil || string(v) != expChildVal {
+				t.Fatalf("expected child key: %s, val: %s, got: %s, err: %v",
+					k, expChildVal, v, err)
+			}
+		}
+		childSS.Close()
+		ss.Close()
+	}
+
+	// Segments persisted after the pinned footer are replayed into the
+	// compacted file.
+	persist(3, StorePersistOptions{})
+
+	pinned, _ := store.snapshot()
+
+	persist(3, StorePersistOptions{})
+
+	// The DeadBytes of the segments that are replayed.
+	deadBytes := func(f *Footer, from int) (rv []uint64) {
+		for _, sloc := range f.SegmentLocs[from:] {
+			rv = append(rv, sloc.DeadBytes)
+		}
+		return rv
+	}
+	numPinned := len(pinned.SegmentLocs)
+	numChildPinned := len(pinned.ChildFooters["child"].SegmentLocs)
+	replayDead := deadBytes(store.footer, numPinned)
+	replayChildDead := deadBytes(store.footer.ChildFooters["child"],
+		numChildPinned)
+
+	err = store.compactBackground(pinned, StorePersistOptions{},
+		make(chan struct{}))
+	if err != nil {
+		t.Fatalf("expected compactBackground to work, err: %v", err)
+	}
+	pinned.Close()
+
+	if store.totCompactionsBg != 1 || store.totCompactions != 1 {
+		t.Errorf("expected a background compaction")
+	}
+	check(store)
+
+	// The replayed segments keep their DeadBytes, and the replayed
+	// overwrites and deletions shadow entries of the compacted segment.
+	for _, f := range []*Footer{store.footer, store.footer.ChildFooters["child"]} {
+		if len(f.SegmentLocs) < 2 || f.SegmentLocs[0].DeadBytes <= 0 {
+			t.Errorf("expected shadowed entries in the compacted segment,"+
+				" slocs: %+v", f.SegmentLocs)
+		}
+	}
+	if fmt.Sprint(deadBytes(store.footer, 1)) != fmt.Sprint(replayDead) ||
+		fmt.Sprint(deadBytes(store.footer.ChildFooters["child"], 1)) !=
+			fmt.Sprint(replayChildDead) {
+		t.Errorf("expected the DeadBytes of the replayed segments to be kept")
+	}
+
+	// A compaction that happens in the meantime abandons the
+	// background compaction.
+	pinned, _ = store.snapshot()
+
+	persist(1, StorePersistOptions{CompactionConcern: CompactionForce})
+
+	err = store.compactBackground(pinned, StorePersistOptions{},
+		make(chan struct{}))
+	if err != nil {
+		t.Fatalf("expected abandoned compactBackground, err: %v", err)
+	}
+	pinned.Close()
+
+	if store.totCompactionsBg != 1 || store.totCompactionsBgAbandoned != 1 {
+		t.Errorf("expected an abandoned background compaction")
+	}
+	check(store)
+
+	// Compactions that run in the background of persistence.
+	store.options.CompactionPercentage = 0.5
+
+	persist(20, StorePersistOptions{CompactionConcern: CompactionBackground})
+
+	for store.isCompactingBackground() {
+		time.Sleep(time.Millisecond)
+	}
+
+	if store.totCompactionsBg < 2 {
+		t.Errorf("expected more background compactions")
+	}
+	check(store)
+
+	coll.Close()
+	store.Close()
+
+	store, err = OpenStore(tmpDir, StoreOptions{})
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+	check(store)
+	store.Close()
+}
+
+func TestStoreSizeTieredCompactionBackground(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	store, err := OpenStore(tmpDir, StoreOptions{
+		CompactionPolicy: SizeTieredCompactionPolicy{MinTierSegments: 2},
+	})
+	if err != nil {
+		t.Fatalf("expected open empty store to work, err: %v", err)
+	}
+
+	numItems := 0
+
+	persist := func(n int, concern CompactionConcern) {
+		coll, _ := NewCollection(CollectionOptions{})
+		coll.Start()
+
+		b, _ := coll.NewBatch(0, 0)
+		for i := 0; i < n; i++ {
+			k := fmt.Sprintf("%08d", numItems)
+			b.Set([]byte(k), []byte(k))
+			numItems++
+		}
+		coll.ExecuteBatch(b, WriteOptions{})
+		b.Close()
+
+		ss, _ := coll.Snapshot()
+		llss, err := store.Persist(ss,
+			StorePersistOptions{CompactionConcern: concern})
+		if err != nil {
+			t.Fatalf("expected persist to work, err: %v", err)
+		}
+		llss.Close()
+		ss.Close()
+		coll.Close()
+	}
+
+	// A large segment followed by a tier of small segments, so that
+	// the policy plans merges of the small segments and not a full
+	// compaction.
+	persist(1000, CompactionDisable)
+	persist(10, CompactionDisable)
+
+	pinned, _ := store.snapshot()
+
+	// Pretend that a background compaction of the pinned footer is
+	// running while more small segments are persisted.
+	store.m.Lock()
+	store.compactionBgDoneCh = make(chan struct{})
+	store.m.Unlock()
+
+	for i := 0; i < 3; i++ {
+		persist(10, CompactionBackground)
+	}
+
+	store.m.Lock()
+	store.compactionBgDoneCh = nil
+	store.m.Unlock()
+
+	if store.totCompactionMerges != 0 {
+		t.Errorf("expected no merges during a background compaction")
+	}
+
+	err = store.compactBackground(pinned, StorePersistOptions{},
+		make(chan struct{}))
+	if err != nil {
+		t.Fatalf("expected compactBackground to work, err: %v", err)
+	}
+	pinned.Close()
+
+	if store.totCompactionsBg != 1 || store.totCompactionsBgAbandoned != 0 {
+		t.Errorf("expected a background compaction that's not abandoned")
+	}
+
+	// The merges resume after the background compaction.
+	persist(10, CompactionBackground)
+
+	if store.totCompactionMerges <= 0 {
+		t.Errorf("expected merges after a background compaction")
+	}
+
+	ss, _ := store.Snapshot()
+	for i := 0; i < numItems; i++ {
+		k := fmt.Sprintf("%08d", i)
+		v, err := ss.Get([]byte(k), ReadOptions{})
+		if err != nil || string(v) != k {
+			t.Fatalf("expected key: %s, got: %s, err: %v", k, v, err)
+		}
+	}
+	ss.Close()
+
+	store.Close()
+}
+
+func TestSizeTieredCompactionPolicy(t *testing.T) {
+	slocs := func(sizes ...uint64) (rv SegmentLocs) {
+		for _, size := range sizes {
+			rv = append(rv, SegmentLoc{TotKeyByte: size / 2, TotValByte: size / 2})
+		}
+		return rv
+	}
+
+	p := SizeTieredCompactionPolicy{MinTierSegments: 3}
+
+	tests := []struct {
+		persisted []uint64
+		higher    uint64
+		expFull   bool
+		expFrom   int // -1 means no merge.
+	}{
+		{nil, 10, false, -1},
+		{[]uint64{10}, 10, false, -1},
+		{[]uint64{1000, 10}, 10, false, -1},
+		{[]uint64{1000, 10, 10}, 10, false, 1},
+		{[]uint64{1000, 100, 10, 10}, 10, false, 2},
+		{[]uint64{1000, 30, 10, 10}, 10, false, 2},
+		{[]uint64{1000, 15, 10, 10}, 10, false, 1},
+		{[]uint64{10, 10}, 10, true, 0},
+		{[]uint64{1000, 10, 10}, 0, false, -1},
+		{[]uint64{1000, 100, 100, 10}, 10, false, -1},
+		{[]uint64{1000, 100, 100, 100, 10}, 10, false, 1},
+		{[]uint64{100, 100, 100, 10}, 10, true, 0},
+	}
+
+	for testi, test := range tests {
+		cs := &CompactionCollectionState{SegmentLocs: slocs(test.persisted...)}
+		if test.higher > 0 {
+			cs.Higher = []CompactionSegment{{Ops: 1, Bytes: test.higher}}
+		}
+
+		plan := p.CompactionPlan(&CompactionState{
+			Options:    &StoreOptions{},
+			Collection: cs,
+		})
+
+		from := -1
+		if plan.Merge != nil {
+			from = plan.Merge.From
+		}
+		if plan.Full != test.expFull || (!test.expFull && from != test.expFrom) {
+			t.Errorf("testi: %d, test: %+v, got plan: %+v, from: %d",
+				testi, test, plan, from)
+		}
+	}
+
+	// Merges are capped by MaxMergeBytes.
+	pMax := SizeTieredCompactionPolicy{MinTierSegments: 3, MaxMergeBytes: 35}
+
+	testsMax := []struct {
+		persisted []uint64
+		higher    uint64
+		expFrom   int // -1 means no merge.
+	}{
+		{[]uint64{1000, 10, 10, 10}, 10, 2},
+		{[]uint64{10, 10}, 20, -1},
+		{[]uint64{10, 10}, 100, -1},
+	}
+
+	for testi, test := range testsMax {
+		plan := pMax.CompactionPlan(&CompactionState{
+			Options: &StoreOptions{},
+			Collection: &CompactionCollectionState{
+				SegmentLocs: slocs(test.persisted...),
+				Higher:      []CompactionSegment{{Ops: 1, Bytes: test.higher}},
+			},
+		})
+
+		from := -1
+		if plan.Merge != nil {
+			from = plan.Merge.From
+		}
+		if plan.Full || from != test.expFrom {
+			t.Errorf("testi: %d, test: %+v, got max plan: %+v, from: %d",
+				testi, test, plan, from)
+		}
+	}
+
+	// Child collections are planned independently.
+	plan := p.CompactionPlan(&CompactionState{
+		Options: &StoreOptions{},
+		Collection: &CompactionCollectionState{
+			SegmentLocs: slocs(1000),
+			Higher:      []CompactionSegment{{Ops: 1, Bytes: 10}},
+			Children: map[string]*CompactionCollectionState{
+				"child": {
+					SegmentLocs: slocs(1000, 10, 10),
+					Higher:      []CompactionSegment{{Ops: 1, Bytes: 10}},
+				},
+			},
+		},
+	})
+	if plan.Full || plan.Merge == nil || plan.Merge.From != -1 ||
+		plan.Merge.Children["child"] == nil ||
+		plan.Merge.Children["child"].From != 1 {
+		t.Errorf("expected a child merge, got: %+v", plan.Merge)
+	}
+}
+
+type testCompactionPolicy struct {
+	states []*CompactionState
+	plan   CompactionPlan
+}
+
+func (p *testCompactionPolicy) CompactionPlan(
+	state *CompactionState) CompactionPlan {
+	p.states = append(p.states, state)
+	return p.plan
+}
+
+func TestStoreCompactionPolicy(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	policy := &testCompactionPolicy{}
+
+	co := CollectionOptions{
+		MergeOperator: &MergeOperatorStringAppend{Sep: ":"},
+	}
+
+	store, err := OpenStore(tmpDir, StoreOptions{
+		CollectionOptions: co,
+		CompactionPolicy:  policy,
+	})
+	if err != nil {
+		t.Fatalf("expected open empty store to work, err: %v", err)
+	}
+
+	numItems := 0
+
+	persist := func(plan CompactionPlan) {
+		policy.plan = plan
+
+		coll, _ := NewCollection(co)
+		coll.Start()
+		defer coll.Close()
+
+		b, _ := coll.NewBatch(0, 0)
+		cb, _ := b.NewChildCollectionBatch("child", BatchOptions{})
+		for i := 0; i < 10; i++ {
+			k := fmt.Sprintf("%04d", numItems)
+			b.Set([]byte(k), []byte("v"+k))
+			cb.Set([]byte(k), []byte("c"+k))
+			numItems++
+		}
+		// Also delete, overwrite and merge some older items.
+		if numItems > 10 {
+			b.Del([]byte(fmt.Sprintf("%04d", numItems-15)))
+			cb.Set([]byte(fmt.Sprintf("%04d", numItems-15)), []byte("x"))
+		}
+		b.Merge([]byte("m"), []byte(fmt.Sprintf("%d", numItems)))
+		err = coll.ExecuteBatch(b, WriteOptions{})
+		if err != nil {
+			t.Fatalf("expected ExecuteBatch to work, err: %v", err)
+		}
+		b.Close()
+
+		ss, _ := coll.Snapshot()
+		llss, err := store.Persist(ss,
+			StorePersistOptions{CompactionConcern: CompactionAllow})
+		ss.Close()
+		if err != nil {
+			t.Fatalf("expected persist to work, err: %v", err)
+		}
+		llss.Close()
+	}
+
+	check := func(store *Store) {
+		ss, _ := store.Snapshot()
+		childSS, _ := ss.ChildCollectionSnapshot("child")
+		for i := 0; i < numItems; i++ {
+			k := fmt.Sprintf("%04d", i)
+			expVal, expChildVal := "v"+k, "c"+k
+			if i%10 == 5 && i+15 <= numItems {
+				expVal, expChildVal = "", "x"
+			}
+			v, err := ss.Get([]byte(k), ReadOptions{})
+			if err != nil || string(v) != expVal {
+				t.Fatalf("expected key: %s, val: %s, got: %s, err: %v",
+					k, expVal, v, err)
+			}
+			v, err = childSS.Get([]byte(k), ReadOptions{})
+			if err != nil || string(v) != expChildVal {
+				t.Fatalf("expected child key: %s, val: %s, got: %s, err: %v",
+					k, expChildVal, v, err)
+			}
+		}
+		var expMerged string
+		for n := 10; n <= numItems; n += 10 {
+			expMerged += fmt.Sprintf(":%d", n)
+		}
+		v, err := ss.Get([]byte("m"), ReadOptions{})
+		if err != nil || string(v) != expMerged {
+			t.Fatalf("expected merged val: %s, got: %s, err: %v",
+				expMerged, v, err)
+		}
+		childSS.Close()
+		ss.Close()
+	}
+
+	numSegments := func() (top, child int) {
+		footer, _ := store.snapshot()
+		defer footer.Close()
+		return len(footer.SegmentLocs),
+			len(footer.ChildFooters["child"].SegmentLocs)
+	}
+
+	for i := 0; i < 3; i++ {
+		persist(CompactionPlan{})
+	}
+	if top, child := numSegments(); top != 3 || child != 3 {
+		t.Errorf("expected 3 segments, got: %d, %d", top, child)
+	}
+
+	state := policy.states[len(policy.states)-1]
+	if len(state.Collection.SegmentLocs) != 2 ||
+		len(state.Collection.Higher) != 1 ||
+		len(state.Collection.Children["child"].SegmentLocs) != 2 ||
+		len(state.FileSizes) != 1 {
+		t.Errorf("unexpected CompactionState: %+v", state)
+	}
+
+	// Merge the newest 2 persisted segments of the top-level and the
+	// incoming segments, and only the incoming child segments.
+	persist(CompactionPlan{Merge: &CompactionMerge{
+		From: 1,
+		Children: map[string]*CompactionMerge{
+			"child": {From: 3},
+		},
+	}})
+	if top, child := numSegments(); top != 2 || child != 4 {
+		t.Errorf("expected merged segments, got: %d, %d", top, child)
+	}
+	check(store)
+
+	persist(CompactionPlan{Merge: &CompactionMerge{
+		From: -1,
+		Children: map[string]*CompactionMerge{
+			"child": {From: 0},
+		},
+	}})
+	if top, child := numSegments(); top != 3 || child != 1 {
+		t.Errorf("expected merged child segments, got: %d, %d", top, child)
+	}
+	check(store)
+
+	persist(CompactionPlan{Full: true})
+	if top, child := numSegments(); top != 1 || child != 1 {
+		t.Errorf("expected compacted segments, got: %d, %d", top, child)
+	}
+	check(store)
+
+	stats, _ := store.Stats()
+	if stats["total_compaction_merges"].(uint64) != 3 ||
+		stats["total_compactions"].(uint64) != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	store.Close()
+
+	store, err = OpenStore(tmpDir, StoreOptions{CollectionOptions: co})
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+	check(store)
+	store.Close()
+}
+
+func TestStoreSizeTieredCompaction(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	store, err := OpenStore(tmpDir, StoreOptions{
+		CompactionPolicy: SizeTieredCompactionPolicy{},
+	})
+	if err != nil {
+		t.Fatalf("expected open empty store to work, err: %v", err)
+	}
+
+	for bi := 0; bi < 100; bi++ {
+		coll, _ := NewCollection(CollectionOptions{})
+		coll.Start()
+
+		b, _ := coll.NewBatch(0, 0)
+		for i := 0; i < 10; i++ {
+			k := fmt.Sprintf("%04d-%04d", bi, i)
+			b.Set([]byte(k), []byte(k))
+		}
+		err = coll.ExecuteBatch(b, WriteOptions{})
+		if err != nil {
+			t.Fatalf("expected ExecuteBatch to work, err: %v", err)
+		}
+		b.Close()
+
+		ss, _ := coll.Snapshot()
+		llss, err := store.Persist(ss,
+			StorePersistOptions{CompactionConcern: CompactionAllow})
+		if err != nil {
+			t.Fatalf("expected persist to work, err: %v", err)
+		}
+		llss.Close()
+		ss.Close()
+		coll.Close()
+	}
+
+	stats, _ := store.Stats()
+	if stats["total_compaction_merges"].(uint64) <= 0 ||
+		stats["num_segments"].(uint64) > 10 {
+		t.Errorf("expected size tiered merges, stats: %+v", stats)
+	}
+
+	ss, _ := store.Snapshot()
+	for bi := 0; bi < 100; bi++ {
+		for i := 0; i < 10; i++ {
+			k := fmt.Sprintf("%04d-%04d", bi, i)
+			v, err := ss.Get([]byte(k), ReadOptions{})
+			if err != nil || string(v) != k {
+				t.Fatalf("expected key: %s, got: %s, err: %v", k, v, err)
+			}
+		}
+	}
+	ss.Close()
+
+	store.Close()
+}
+
+func TestStoreLiveDeadBytes(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	store, err := OpenStore(tmpDir, StoreOptions{TrackDeadBytes: true})
+	if err != nil {
+		t.Fatalf("expected open empty store to work, err: %v", err)
+	}
+
+	persist := func(bi int, del bool, concern CompactionConcern) {
+		coll, _ := NewCollection(CollectionOptions{})
+		coll.Start()
+
+		b, _ := coll.NewBatch(0, 0)
+		for i := 0; i < 100; i++ {
+			k := fmt.Sprintf("%04d", i) // Same keys each round.
+			if del {
+				b.Del([]byte(k))
+			} else {
+				b.Set([]byte(k), []byte(fmt.Sprintf("%04d-%04d", bi, i)))
+			}
+		}
+		coll.ExecuteBatch(b, WriteOptions{})
+		b.Close()
+
+		ss, _ := coll.Snapshot()
+		llss, err := store.Persist(ss,
+			StorePersistOptions{CompactionConcern: concern})
+		if err != nil {
+			t.Fatalf("expected persist to work, err: %v", err)
+		}
+		llss.Close()
+		ss.Close()
+		coll.Close()
+	}
+
+	checkStats := func() (live, dead uint64) {
+		stats, err := store.Stats()
+		if err != nil {
+			t.Fatalf("expected stats to work, err: %v", err)
+		}
+
+		live = stats["num_bytes_live"].(uint64)
+		dead = stats["num_bytes_dead"].(uint64)
+		// Files that were compacted away might still await removal.
+		if live+dead > stats["num_bytes_used_disk"].(uint64) {
+			t.Errorf("expected live + dead to be at most disk used,"+
+				" stats: %+v", stats)
+		}
+
+		var fileLive, fileDead int64
+		for _, v := range stats["files"].(map[string]interface{}) {
+			fileEntry := v.(map[string]interface{})
+			if fileEntry["live_bytes"] != nil {
+				fileLive += fileEntry["live_bytes"].(int64)
+				fileDead += fileEntry["dead_bytes"].(int64)
+			}
+		}
+		if uint64(fileLive) != live || uint64(fileDead) != dead {
+			t.Errorf("expected per file live and dead bytes to add up,"+
+				" stats: %+v", stats)
+		}
+
+		return live, dead
+	}
+
+	live0, dead0 := checkStats()
+	if live0 != 0 || dead0 != 0 {
+		t.Errorf("expected no bytes in an empty store")
+	}
+
+	// The bytes of the 100 entries of a round of sets and of dels,
+	// where each entry has 16 bytes in the segment's kvs.
+	setBytes := uint64(100 * (16 + 4 + 9))
+	delBytes := uint64(100 * (16 + 4))
+
+	persist(0, false, CompactionDisable)
+	live1, dead1 := checkStats()
+	if live1 <= setBytes {
+		t.Errorf("expected some live bytes")
+	}
+
+	for bi := 1; bi < 10; bi++ {
+		persist(bi, false, CompactionDisable)
+	}
+	live2, dead2 := checkStats()
+	if live2 >= live1+setBytes || dead2 < dead1+9*setBytes {
+		t.Errorf("expected shadowed entries to be dead, live: %d, %d,"+
+			" dead: %d, %d", live1, live2, dead1, dead2)
+	}
+
+	persist(10, true, CompactionDisable)
+	live3, dead3 := checkStats()
+	if live3 >= live2-setBytes/2 || dead3 < dead2+setBytes+delBytes {
+		t.Errorf("expected shadowed entries and tombstones to be dead,"+
+			" live: %d, %d, dead: %d, %d", live2, live3, dead2, dead3)
+	}
+
+	persist(11, false, CompactionForce)
+	live4, dead4 := checkStats()
+	if live4 >= live2 || dead4 >= dead3 {
+		t.Errorf("expected compaction to reduce live and dead bytes,"+
+			" live: %d, %d, dead: %d, %d", live2, live4, dead3, dead4)
+	}
+
+	store.Close()
+}
+
+func TestStoreDeadBytesUntracked(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	store, err := OpenStore(tmpDir, StoreOptions{})
+	if err != nil {
+		t.Fatalf("expected open empty store to work, err: %v", err)
+	}
+
+	for bi := 0; bi < 3; bi++ {
+		coll, _ := NewCollection(CollectionOptions{})
+		coll.Start()
+
+		b, _ := coll.NewBatch(0, 0)
+		b.Set([]byte("a"), []byte(fmt.Sprintf("%d", bi)))
+		b.Del([]byte("b"))
+		coll.ExecuteBatch(b, WriteOptions{})
+		b.Close()
+
+		ss, _ := coll.Snapshot()
+		llss, err := store.Persist(ss, StorePersistOptions{})
+		if err != nil {
+			t.Fatalf("expected persist to work, err: %v", err)
+		}
+		llss.Close()
+		ss.Close()
+		coll.Close()
+	}
+
+	footer, _ := store.snapshot()
+	if len(footer.SegmentLocs) != 3 {
+		t.Errorf("expected 3 segments, slocs: %+v", footer.SegmentLocs)
+	}
+	for _, sloc := range footer.SegmentLocs {
+		if sloc.DeadBytes != 0 {
+			t.Errorf("expected untracked dead bytes, slocs: %+v",
+				footer.SegmentLocs)
+		}
+	}
+	footer.DecRef()
+
+	store.Close()
+}
+
+func TestStoreVerifyChecksums(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	options := StoreOptions{VerifyChecksums: true}
+
+	store, err := OpenStore(tmpDir, options)
+	if err != nil {
+		t.Fatalf("expected open empty store to work, err: %v", err)
+	}
+
+	persist := func(bi int, compactionConcern CompactionConcern) error {
+		coll, _ := NewCollection(CollectionOptions{})
+		coll.Start()
+		defer coll.Close()
+
+		b, _ := coll.NewBatch(0, 0)
+		b.Set([]byte(fmt.Sprintf("a%d", bi)), []byte("A"))
+		b.Set([]byte("b"), []byte(fmt.Sprintf("%d", bi)))
+		coll.ExecuteBatch(b, WriteOptions{})
+		b.Close()
+
+		ss, _ := coll.Snapshot()
+		defer ss.Close()
+
+		llss, err := store.Persist(ss, StorePersistOptions{
+			CompactionConcern: compactionConcern,
+		})
+		if err != nil {
+			return err
+		}
+		llss.Close()
+		return nil
+	}
+
+	for bi := 0; bi < 3; bi++ {
+		if err = persist(bi, CompactionDisable); err != nil {
+			t.Fatalf("expected persist to work, err: %v", err)
+		}
+	}
+	if err = persist(3, CompactionForce); err != nil {
+		t.Fatalf("expected compaction to work, err: %v", err)
+	}
+
+	stats, _ := store.StatsEx()
+	if stats.TotChecksumsVerified != 3 || stats.TotChecksumMismatches != 0 {
+		t.Errorf("expected the 3 compacted segments verified, stats: %+v",
+			stats)
+	}
+
+	footer, _ := store.snapshot()
+	if len(footer.SegmentLocs) != 1 ||
+		footer.SegmentLocs[0].KvsChecksum == 0 ||
+		footer.SegmentLocs[0].BufChecksum == 0 {
+		t.Errorf("expected a checksummed compacted segment, slocs: %+v",
+			footer.SegmentLocs)
+	}
+	footer.DecRef()
+
+	// Persist a segment and then corrupt its data.
+	if err = persist(4, CompactionDisable); err != nil {
+		t.Fatalf("expected persist to work, err: %v", err)
+	}
+
+	footer, _ = store.snapshot()
+	sloc := footer.SegmentLocs[len(footer.SegmentLocs)-1]
+	fileName := footer.fileName
+	footer.DecRef()
+
+	if sloc.KvsChecksum == 0 || sloc.BufChecksum == 0 {
+		t.Errorf("expected a checksummed persisted segment, sloc: %+v", sloc)
+	}
+
+	f, err := os.OpenFile(path.Join(tmpDir, fileName), os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatalf("expected open file to work, err: %v", err)
+	}
+	f.WriteAt([]byte("x"), int64(sloc.BufOffset))
+	f.Close()
+
+	err = persist(5, CompactionForce)
+	if err != ErrChecksumMismatch {
+		t.Errorf("expected compaction checksum mismatch, err: %v", err)
+	}
+
+	stats, _ = store.StatsEx()
+	if stats.TotChecksumMismatches != 1 {
+		t.Errorf("expected a checksum mismatch, stats: %+v", stats)
+	}
+	sstats, _ := store.Stats()
+	if sstats["total_checksum_mismatches"] != uint64(1) {
+		t.Errorf("expected a checksum mismatch in the stats map")
+	}
+
+	store.Close()
+
+	_, err = OpenStore(tmpDir, options)
+	if err != ErrChecksumMismatch {
+		t.Errorf("expected reopen checksum mismatch, err: %v", err)
+	}
+
+	// Without verification, the corrupted data is not noticed.
+	store, err = OpenStore(tmpDir, StoreOptions{})
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+	stats, _ = store.StatsEx()
+	if stats.TotChecksumsVerified != 0 {
+		t.Errorf("expected no verified checksums, stats: %+v", stats)
+	}
+	store.Close()
+}
+
+func TestSpaceAmplificationCompactionPolicy(t *testing.T) {
+	tests := []struct {
+		policy  SpaceAmplificationCompactionPolicy
+		size    int64
+		live    int64
+		expFull bool
+	}{
+		{SpaceAmplificationCompactionPolicy{}, 0, 0, false},
+		{SpaceAmplificationCompactionPolicy{}, 1000, 600, false},
+		{SpaceAmplificationCompactionPolicy{}, 1000, 500, true},
+		{SpaceAmplificationCompactionPolicy{MaxSpaceAmplification: 1.5},
+			1000, 600, true},
+		{SpaceAmplificationCompactionPolicy{MinDeadBytes: 1000},
+			1000, 100, false},
+		{SpaceAmplificationCompactionPolicy{
+			Policy: DefaultCompactionPolicy{},
+		}, 1000, 900, true},
+	}
+
+	for testi, test := range tests {
+		state := &CompactionState{
+			Options:   &StoreOptions{CompactionPercentage: 0.5},
+			FileSizes: map[string]int64{"data": test.size},
+			LiveBytes: map[string]int64{"data": test.live},
+			Collection: &CompactionCollectionState{
+				SegmentLocs: SegmentLocs{{KvsBytes: 16}},
+				Higher:      []CompactionSegment{{Ops: 1}},
+			},
+		}
+
+		plan := test.policy.CompactionPlan(state)
+		if plan.Full != test.expFull {
+			t.Errorf("testi: %d, test: %+v, got plan: %+v",
+				testi, test, plan)
+		}
+	}
+}
+
+func TestStoreSpaceAmplificationCompaction(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	store, err := OpenStore(tmpDir, StoreOptions{
+		CompactionPolicy: SpaceAmplificationCompactionPolicy{
+			MaxSpaceAmplification: 1.5,
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected open empty store to work, err: %v", err)
+	}
+
+	for bi := 0; bi < 20; bi++ {
+		coll, _ := NewCollection(CollectionOptions{})
+		coll.Start()
+
+		b, _ := coll.NewBatch(0, 0)
+		for i := 0; i < 100; i++ {
+			b.Set([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("%d", bi)))
+		}
+		coll.ExecuteBatch(b, WriteOptions{})
+		b.Close()
+
+		ss, _ := coll.Snapshot()
+		llss, err := store.Persist(ss,
+			StorePersistOptions{CompactionConcern: CompactionAllow})
+		if err != nil {
+			t.Fatalf("expected persist to work, err: %v", err)
+		}
+		llss.Close()
+		ss.Close()
+		coll.Close()
+	}
+
+	stats, _ := store.Stats()
+	if stats["total_compactions"].(uint64) <= 0 {
+		t.Errorf("expected compactions due to space amplification,"+
+			" stats: %+v", stats)
+	}
+
+	store.Close()
+}
+
+func TestStoreStatsEx(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	store, err := OpenStore(tmpDir, StoreOptions{})
+	if err != nil {
+		t.Fatalf("expected open empty store to work, err: %v", err)
+	}
+
+	for bi := 0; bi < 3; bi++ {
+		coll, _ := NewCollection(CollectionOptions{})
+		coll.Start()
+
+		b, _ := coll.NewBatch(0, 0)
+		for i := 0; i < 100; i++ {
+			b.Set([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("%d", bi)))
+		}
+		coll.ExecuteBatch(b, WriteOptions{})
+		b.Close()
+
+		concern := CompactionDisable
+		if bi == 2 {
+			concern = CompactionForce
+		}
+
+		ss, _ := coll.Snapshot()
+		llss, err := store.Persist(ss,
+			StorePersistOptions{CompactionConcern: concern})
+		if err != nil {
+			t.Fatalf("expected persist to work, err: %v", err)
+		}
+		llss.Close()
+		ss.Close()
+		coll.Close()
+	}
+
+	stats, err := store.StatsEx()
+	if err != nil {
+		t.Fatalf("expected StatsEx to work, err: %v", err)
+	}
+
+	// The forced compaction takes the place of the last persist.
+	if stats.TotPersists != 2 || stats.TotCompactions != 1 ||
+		stats.NumSegments != 1 || stats.NumBytesLive <= 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if stats.TotCompactionUsecs < stats.NumLastCompactionUsecs ||
+		stats.MaxCompactionUsecs < stats.NumLastCompactionUsecs {
+		t.Errorf("unexpected compaction usecs, stats: %+v", stats)
+	}
+
+	var numData int
+	for i, fs := range stats.Files {
+		if i > 0 && stats.Files[i-1].Name >= fs.Name {
+			t.Errorf("expected files sorted by name, stats: %+v", stats)
+		}
+		if fs.Data {
+			numData++
+			if !fs.Open || !fs.Exists || fs.RefCount <= 0 ||
+				fs.LiveBytes+fs.DeadBytes != fs.Size {
+				t.Errorf("unexpected data file stats: %+v", fs)
+			}
+		}
+	}
+	if numData != 1 {
+		t.Errorf("expected 1 data file, stats: %+v", stats)
+	}
+
+	m, err := store.Stats()
+	if err != nil {
+		t.Fatalf("expected Stats to work, err: %v", err)
+	}
+	if m["total_persists"].(uint64) != stats.TotPersists ||
+		m["total_compactions"].(uint64) != stats.TotCompactions ||
+		m["num_bytes_live"].(uint64) != stats.NumBytesLive ||
+		m["num_files"].(int) != len(stats.Files) ||
+		m["num_files_open"].(int) != stats.NumFilesOpen {
+		t.Errorf("expected Stats to match StatsEx, m: %+v, stats: %+v",
+			m, stats)
+	}
+
+	store.Close()
+}
+
+func TestStoreCollReadHistograms(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	store, m, err := OpenStoreCollection(tmpDir, StoreOptions{
+		CollectionOptions: CollectionOptions{ReadHistogramsSampleEvery: 1},
+	}, StorePersistOptions{})
+	if err != nil {
+		t.Fatalf("expected OpenStoreCollection to work, err: %v", err)
+	}
+
+	b, _ := m.NewBatch(0, 0)
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("%04d", i))
+		b.Set(k, k)
+	}
+	m.ExecuteBatch(b, WriteOptions{})
+	b.Close()
+
+	for i := 0; ; i++ {
+		stats, _ := m.Stats()
+		if stats.TotPersisterLowerLevelUpdateEnd > 0 && stats.CurDirtyOps == 0 {
+			break
+		}
+		if i > 1000 {
+			t.Fatalf("expected the batch to be persisted, stats: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	v, err := m.Get([]byte("0042"), ReadOptions{})
+	if err != nil || string(v) != "0042" {
+		t.Errorf("expected get to work, v: %s, err: %v", v, err)
+	}
+
+	h := m.Histograms()
+	if h["GetLowerLevelUsecs"].TotCount != 1 ||
+		h["GetSegments"].TotDataPoint < 1 {
+		t.Errorf("expected a lower level get, got: %s", h)
+	}
+
+	m.Close()
+	store.Close()
+}
+
+func TestStoreEvents(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "mossStore")
+	defer os.RemoveAll(tmpDir)
+
+	var mu sync.Mutex
+	var events []Event
+
+	eventsOf := func(kind EventKind) (rv []Event) {
+		mu.Lock()
+		for _, e := range events {
+			if e.Kind == kind {
+				rv = append(rv, e)
+			}
+		}
+		mu.Unlock()
+		return rv
+	}
+
+	var store *Store
+
+	store, err := OpenStore(tmpDir, StoreOptions{
+		OnEvent: func(e Event) {
+			if e.Store != store || e.Collection != nil {
+				t.Errorf("expected a store event, got: %+v", e)
+			}
+			mu.Lock()
+			events = append(events, e)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected open empty store to work, err: %v", err)
+	}
+
+	for bi := 0; bi < 3; bi++ {
+		coll, _ := NewCollection(CollectionOptions{})
+		coll.Start()
+
+		b, _ := coll.NewBatch(0, 0)
+		for i := 0; i < 100; i++ {
+			b.Set([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("%d", bi)))
+		}
+		coll.ExecuteBatch(b, WriteOptions{})
+		b.Close()
+
+		concern := CompactionDisable
+		if bi == 2 {
+			concern = CompactionForce
+		}
+
+		ss, _ := coll.Snapshot()
+		llss, err := store.Persist(ss,
+			StorePersistOptions{CompactionConcern: concern})
+		if err != nil {
+			t.Fatalf("expected persist to work, err: %v", err)
+		}
+		llss.Close()
+		ss.Close()
+		coll.Close()
+	}
+
+	fname1, fname2 := FormatFName(1), FormatFName(2)
+
+	creates := eventsOf(EventKindFileCreate)
+	if len(creates) != 2 ||
+		creates[0].FileName != fname1 || creates[1].FileName != fname2 ||
+		creates[0].Bytes != int64(StorePageSize) {
+		t.Errorf("expected file creates, got: %+v", creates)
+	}
+
+	footers := eventsOf(EventKindFooterWrite)
+	if len(footers) != 3 ||
+		footers[0].FileName != fname1 || footers[0].Segments != 1 ||
+		footers[1].FileName != fname1 || footers[1].Segments != 2 ||
+		footers[2].FileName != fname2 || footers[2].Segments != 1 {
+		t.Errorf("expected footer writes, got: %+v", footers)
+	}
+	for _, e := range footers {
+		if e.Bytes <= 0 || e.Duration <= 0 {
+			t.Errorf("expected footer write details, got: %+v", e)
+		}
+	}
+
+	starts := eventsOf(EventKindCompactionStart)
+	ends := eventsOf(EventKindCompactionEnd)
+	// The forced compaction also merges the segment of the last batch.
+	if len(starts) != 1 || starts[0].FileName != fname2 ||
+		starts[0].Segments != 3 ||
+		len(ends) != 1 || ends[0].FileName != fname2 ||
+		ends[0].Segments != 1 || ends[0].Bytes <= 0 || ends[0].Duration <= 0 {
+		t.Errorf("expected compaction start and end, got: %+v, %+v",
+			starts, ends)
+	}
+
+	// The compacted away file is removed asynchronously.
+	for i := 0; len(eventsOf(EventKindFileRemove)) == 0; i++ {
+		if i > 100 {
+			t.Fatalf("expected a file remove")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	removes := eventsOf(EventKindFileRemove)
+	if len(removes) != 1 || removes[0].FileName != fname1 ||
+		removes[0].Bytes <= 0 {
+		t.Errorf("expected file remove, got: %+v", removes)
+	}
+
+	store.Close()
+}
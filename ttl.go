@@ -0,0 +1,102 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package moss
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// operationSetTTL is like OperationSet, but the val of the entry is
+// prefixed by an expiry, which is the absolute time in unix
+// nanoseconds after which the entry is treated as deleted.  It's an
+// internal encoding of segments and is never returned to
+// applications, as Get()'s and Iterators hide expired entries and
+// strip the expiry from unexpired entries, which are then seen as
+// OperationSet entries.
+const operationSetTTL = uint64(0x0400000000000000)
+
+// expiryLen is the number of bytes of the expiry prefix of the val
+// of an operationSetTTL entry.
+const expiryLen = 8
+
+// SetWithTTL is like Set(), but the key-val entry expires after the
+// given ttl, which is measured from when SetWithTTL() is invoked.  A
+// ttl <= 0 means the entry does not expire.
+func (a *segment) SetWithTTL(key, val []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return a.Set(key, val)
+	}
+
+	var expiry [expiryLen]byte
+	binary.LittleEndian.PutUint64(expiry[:],
+		uint64(time.Now().Add(ttl).UnixNano()))
+
+	keyStart := len(a.buf)
+	a.buf = append(a.buf, key...)
+	a.buf = append(a.buf, expiry[:]...)
+	a.buf = append(a.buf, val...)
+
+	return a.mutateEx(operationSetTTL, keyStart, len(key), expiryLen+len(val))
+}
+
+// resolveExpiry converts an operationSetTTL entry into either an
+// OperationSet entry whose val has the expiry stripped, or into an
+// OperationDel entry when the entry has expired as of the given now
+// in unix nanoseconds.  Other operations are returned unchanged.
+func resolveExpiry(op uint64, val []byte, now int64) (
+	opOut uint64, valOut []byte, expired bool) {
+	if op != operationSetTTL {
+		return op, val, false
+	}
+
+	if isExpired(val, now) {
+		return OperationDel, nil, true
+	}
+
+	return OperationSet, val[expiryLen:], false
+}
+
+// recordExpiry records the expiry of the val of an unexpired
+// operationSetTTL entry of a key into the expiries of the
+// readOptions, if any, keeping the earliest expiry of the key.
+func recordExpiry(readOptions ReadOptions, key, val []byte) {
+	if readOptions.expiries == nil || len(val) < expiryLen {
+		return
+	}
+
+	expiry := int64(binary.LittleEndian.Uint64(val[:expiryLen]))
+
+	prev, exists := readOptions.expiries[string(key)]
+	if !exists || expiry < prev {
+		readOptions.expiries[string(key)] = expiry
+	}
+}
+
+// isExpired returns true if the val of an operationSetTTL entry has
+// an expiry at or before the given now in unix nanoseconds.
+func isExpired(val []byte, now int64) bool {
+	if len(val) < expiryLen {
+		return true // Treat a malformed val as expired.
+	}
+
+	return int64(binary.LittleEndian.Uint64(val[:expiryLen])) <= now
+}
+
+// countExpiredHidden increments the stats, if any, for an expired
+// entry that was hidden from a reader.
+func countExpiredHidden(stats *CollectionStats) {
+	if stats != nil {
+		atomic.AddUint64(&stats.TotExpiredHidden, 1)
+	}
+}
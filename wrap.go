@@ -95,6 +95,20 @@ func (w *SnapshotWrapper) Get(key []byte, readOptions ReadOptions) (
 	return w.ss.Get(key, readOptions)
 }
 
+// GetMulti returns the vals for multiple keys from the underlying
+// snapshot.
+func (w *SnapshotWrapper) GetMulti(keys [][]byte, readOptions ReadOptions) (
+	[][]byte, error) {
+	return w.ss.GetMulti(keys, readOptions)
+}
+
+// EstimateRange returns an approximate summary of the entries in a
+// key range from the underlying snapshot.
+func (w *SnapshotWrapper) EstimateRange(startKeyInclusive,
+	endKeyExclusive []byte) (*RangeEstimate, error) {
+	return w.ss.EstimateRange(startKeyInclusive, endKeyExclusive)
+}
+
 // StartIterator initiates a start iterator over the underlying snapshot.
 func (w *SnapshotWrapper) StartIterator(
 	startKeyInclusive, endKeyExclusive []byte,